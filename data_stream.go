@@ -0,0 +1,276 @@
+package usbwallet
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+// TypedDataValues provides the values of an EIP-712 message on demand, allowing
+// messages too large to be decoded into memory upfront (e.g. long arrays of
+// structs) to be signed. Values are addressed by member path: the indices of the
+// struct fields (in type declaration order) and of the array items leading to
+// them from the primary struct, e.g. [2, 5, 0] is the first field of the sixth
+// item of the array in the third field of the message.
+//
+// The values are pulled in message order while streaming them to the device, but
+// each one may be requested more than once (the message hash is computed on the
+// host before streaming).
+type TypedDataValues interface {
+	// Len returns the number of items of the array at the given member path.
+	Len(path []uint32) (int, error)
+
+	// Value returns the primitive value at the given member path, in any of the
+	// forms accepted in an apitypes.TypedDataMessage, or nil if it's missing.
+	Value(path []uint32) (interface{}, error)
+}
+
+// typedDataMap serves the values of an EIP-712 struct held in memory.
+type typedDataMap struct {
+	data  apitypes.TypedData     // Typed data declaring the struct types
+	name  string                 // Name of the root struct type
+	value map[string]interface{} // Value of the root struct
+}
+
+// newTypedDataValues serves the values of an in-memory EIP-712 message.
+func newTypedDataValues(data apitypes.TypedData) TypedDataValues {
+	return &typedDataMap{data: data, name: data.PrimaryType, value: data.Message}
+}
+
+// newTypedDomainValues serves the values of the domain of EIP-712 typed data.
+func newTypedDomainValues(data apitypes.TypedData) TypedDataValues {
+	return &typedDataMap{data: data, name: "EIP712Domain", value: typedDomainMap(data)}
+}
+
+// typedDomainMap returns the values of the domain of EIP-712 typed data. As the
+// domain only has the fields set (and non-empty) in data.Domain, any other field
+// declared in EIP712Domain is given the zero value of its type, hashing the domain
+// as declared (the struct the verifier computes the domain separator of) instead
+// of failing on, or sending the devices, nil values.
+func typedDomainMap(data apitypes.TypedData) map[string]interface{} {
+	domain := data.Domain.Map()
+	for _, field := range data.Types["EIP712Domain"] {
+		if _, ok := domain[field.Name]; ok {
+			continue
+		}
+		dt, _, byteLength, arrays, err := parseType(data, field)
+		if err != nil || len(arrays) > 0 {
+			continue // Leave invalid types to fail hashing, domains have no arrays
+		}
+		switch dt {
+		case IntType, UintType, FixedPointType, UfixedPointType:
+			domain[field.Name] = "0"
+		case AddressType:
+			domain[field.Name] = common.Address{}.Hex()
+		case BoolType:
+			domain[field.Name] = false
+		case StringType:
+			domain[field.Name] = ""
+		case BytesType, FixedBytesType:
+			domain[field.Name] = make([]byte, byteLength)
+		}
+	}
+	return domain
+}
+
+// typedDataHashes computes the EIP-712 domain separator and message hash of typed
+// data held in memory, like apitypes.TypedDataAndHash but with the domain fields
+// missing from data.Domain set to zero (see typedDomainMap).
+func typedDataHashes(data apitypes.TypedData) ([]byte, []byte, error) {
+	domainHash, err := data.HashStruct("EIP712Domain", typedDomainMap(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("domain: %w", err)
+	}
+	messageHash, err := data.HashStruct(data.PrimaryType, data.Message)
+	if err != nil {
+		return nil, nil, err
+	}
+	return domainHash, messageHash, nil
+}
+
+// Len implements TypedDataValues, returning the length of the array at a path.
+func (m *typedDataMap) Len(path []uint32) (int, error) {
+	value, err := m.resolve(path)
+	if err != nil {
+		return 0, err
+	}
+	if value == nil {
+		return 0, fmt.Errorf("missing array at path %v", path)
+	}
+	a := reflect.ValueOf(value)
+	if k := a.Kind(); k != reflect.Array && k != reflect.Slice {
+		return 0, fmt.Errorf("expected array at path %v, got %T", path, value)
+	}
+	return a.Len(), nil
+}
+
+// Value implements TypedDataValues, returning the value at a path.
+func (m *typedDataMap) Value(path []uint32) (interface{}, error) {
+	return m.resolve(path)
+}
+
+// resolve descends from the root struct along the member path, following the
+// declared types, returning the value found (nil if missing).
+func (m *typedDataMap) resolve(path []uint32) (interface{}, error) {
+	var (
+		kind  = m.name
+		value = interface{}(m.value)
+	)
+	for i, index := range path {
+		if value == nil {
+			return nil, fmt.Errorf("missing value at path %v", path[:i])
+		}
+		if strings.HasSuffix(kind, "]") {
+			a := reflect.ValueOf(value)
+			if k := a.Kind(); k != reflect.Array && k != reflect.Slice {
+				return nil, fmt.Errorf("expected array at path %v, got %T", path[:i], value)
+			}
+			if int(index) >= a.Len() {
+				return nil, fmt.Errorf("invalid array index %d at path %v", index, path[:i])
+			}
+			kind, value = kind[:strings.LastIndex(kind, "[")], a.Index(int(index)).Interface()
+			continue
+		}
+		fields := m.data.Types[kind]
+		if fields == nil {
+			return nil, fmt.Errorf("path %v descends into %s", path[:i+1], kind)
+		}
+		s, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected struct at path %v, got %T", path[:i], value)
+		}
+		if int(index) >= len(fields) {
+			return nil, fmt.Errorf("invalid field index %d for struct %s", index, kind)
+		}
+		kind, value = strings.TrimSpace(fields[index].Type), s[fields[index].Name]
+	}
+	return value, nil
+}
+
+// hashTypedDataValues computes the EIP-712 hash of a message provided by values,
+// as the hash of the struct of the primary type, pulling the values one by one.
+func hashTypedDataValues(data apitypes.TypedData, values TypedDataValues) ([]byte, error) {
+	return hashStructValues(data, data.PrimaryType, values, nil)
+}
+
+// typedDataDigest computes the EIP-712 digest signed for typed data, with the
+// message values provided by values: keccak256(0x1901 || domain hash || hash).
+func typedDataDigest(data apitypes.TypedData, values TypedDataValues) ([]byte, error) {
+	domain, err := hashStructValues(data, "EIP712Domain", newTypedDomainValues(data), nil)
+	if err != nil {
+		return nil, fmt.Errorf("domain: %w", err)
+	}
+	hash, err := hashTypedDataValues(data, values)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Keccak256([]byte{0x19, 0x01}, domain, hash), nil
+}
+
+// hashStructValues computes the EIP-712 hashStruct of the struct of the named type
+// at the member path.
+func hashStructValues(data apitypes.TypedData, name string, values TypedDataValues, path []uint32) ([]byte, error) {
+	fields := data.Types[name]
+	if fields == nil {
+		return nil, fmt.Errorf("unknown type %s", name)
+	}
+	enc := append(make([]byte, 0, 32*(len(fields)+1)), data.TypeHash(name)...)
+	for i, field := range fields {
+		dt, typeName, byteLength, arrays, err := parseType(data, field)
+		if err != nil {
+			return nil, err
+		}
+		member, err := encodeValueAt(data, dt, typeName, byteLength, arrays, values, append(path[:len(path):len(path)], uint32(i)))
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", field.Name, err)
+		}
+		enc = append(enc, member...)
+	}
+	return crypto.Keccak256(enc), nil
+}
+
+// encodeValueAt computes the 32 byte EIP-712 encoding of the value at the member
+// path, hashing arrays and structs, descending through the given (outermost last)
+// array dimensions.
+func encodeValueAt(data apitypes.TypedData, dt dataType, name string, byteLength int, arrays []*int, values TypedDataValues, path []uint32) ([]byte, error) {
+	if n := len(arrays); n > 0 {
+		items, err := values.Len(path)
+		if err != nil {
+			return nil, err
+		}
+		if length := arrays[n-1]; length != nil && items != *length {
+			return nil, fmt.Errorf("array length mismatch at path %v: have %d, want %d", path, items, *length)
+		}
+		enc := make([]byte, 0, 32*items)
+		for i := 0; i < items; i++ {
+			item, err := encodeValueAt(data, dt, name, byteLength, arrays[:n-1], values, append(path[:len(path):len(path)], uint32(i)))
+			if err != nil {
+				return nil, err
+			}
+			enc = append(enc, item...)
+		}
+		return crypto.Keccak256(enc), nil
+	}
+	if dt == CustomType {
+		return hashStructValues(data, name, values, path)
+	}
+	value, err := values.Value(path)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, fmt.Errorf("missing value at path %v", path)
+	}
+	switch dt {
+	case IntType, UintType, FixedPointType, UfixedPointType:
+		// Range check against the declared width, but sign extend to 32 bytes
+		if _, err := encodeInteger(value, dt == IntType || dt == FixedPointType, byteLength); err != nil {
+			return nil, err
+		}
+		n, _ := parseInteger(value)
+		return math.U256Bytes(n), nil
+	case AddressType:
+		address, err := parseAddress(value)
+		if err != nil {
+			return nil, err
+		}
+		return common.LeftPadBytes(address.Bytes(), 32), nil
+	case BoolType:
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("expected bool, got %T", value)
+		}
+		if b {
+			return common.LeftPadBytes([]byte{1}, 32), nil
+		}
+		return make([]byte, 32), nil
+	case StringType:
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected string, got %T", value)
+		}
+		return crypto.Keccak256([]byte(s)), nil
+	case BytesType:
+		b, err := parseBytes(value)
+		if err != nil {
+			return nil, err
+		}
+		return crypto.Keccak256(b), nil
+	case FixedBytesType:
+		b, err := parseBytes(value)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) != byteLength {
+			return nil, fmt.Errorf("invalid length: have %d bytes, want %d", len(b), byteLength)
+		}
+		return common.RightPadBytes(b, 32), nil
+	}
+	return nil, errors.New("unsupported type")
+}
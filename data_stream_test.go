@@ -0,0 +1,206 @@
+package usbwallet
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+// testTypedDataStream generates the values of a batch of transfers on demand,
+// tracking how many values were pulled.
+type testTypedDataStream struct {
+	legs  int // Number of transfers in the batch
+	pulls int // Number of values and lengths requested
+}
+
+// newTestStreamTypedData returns the typed data declaring the types of the
+// messages generated by testTypedDataStream, without a message.
+func newTestStreamTypedData() apitypes.TypedData {
+	data := newTestTypedData([]apitypes.Type{{Name: "name", Type: "string"}, {Name: "legs", Type: "Leg[]"}}, nil)
+	data.Types["Leg"] = []apitypes.Type{{Name: "to", Type: "address"}, {Name: "amount", Type: "uint256"}, {Name: "tags", Type: "bytes4[2]"}}
+	return data
+}
+
+func (s *testTypedDataStream) Len(path []uint32) (int, error) {
+	s.pulls++
+	switch len(path) {
+	case 1:
+		return s.legs, nil
+	case 3:
+		return 2, nil
+	}
+	return 0, fmt.Errorf("no array at path %v", path)
+}
+
+func (s *testTypedDataStream) Value(path []uint32) (interface{}, error) {
+	s.pulls++
+	if len(path) == 1 {
+		return "batch", nil
+	}
+	leg := int(path[1])
+	switch path[2] {
+	case 0:
+		return common.BigToAddress(common.Big1).Hex(), nil
+	case 1:
+		return fmt.Sprintf("%d000000000000000000000000", leg+1), nil
+	default:
+		return fmt.Sprintf("0x%08x", leg<<8|int(path[3])), nil
+	}
+}
+
+// message returns the generated message decoded into memory.
+func (s *testTypedDataStream) message() apitypes.TypedDataMessage {
+	legs := make([]interface{}, s.legs)
+	for i := range legs {
+		to, _ := s.Value([]uint32{1, uint32(i), 0})
+		amount, _ := s.Value([]uint32{1, uint32(i), 1})
+		tag0, _ := s.Value([]uint32{1, uint32(i), 2, 0})
+		tag1, _ := s.Value([]uint32{1, uint32(i), 2, 1})
+		legs[i] = map[string]interface{}{"to": to, "amount": amount, "tags": []interface{}{tag0, tag1}}
+	}
+	s.pulls = 0
+	return apitypes.TypedDataMessage{"name": "batch", "legs": legs}
+}
+
+// Tests that messages hashed while pulling their values hash the same as when
+// decoded into memory.
+func TestHashTypedDataValues(t *testing.T) {
+	nested := newTestTypedData([]apitypes.Type{
+		{Name: "from", Type: "Person"},
+		{Name: "matrix", Type: "int8[2][]"},
+		{Name: "flag", Type: "bool"},
+		{Name: "blob", Type: "bytes"},
+		{Name: "people", Type: "Person[]"},
+	}, apitypes.TypedDataMessage{
+		"from":   map[string]interface{}{"name": "alice", "wallet": "0x0000000000000000000000000000000000000001"},
+		"matrix": []interface{}{[]interface{}{"-1", "2"}, []interface{}{"3", "-4"}, []interface{}{"5", "6"}},
+		"flag":   true,
+		"blob":   "0x010203",
+		"people": []interface{}{
+			map[string]interface{}{"name": "bob", "wallet": "0x0000000000000000000000000000000000000002"},
+		},
+	})
+	nested.Types["Person"] = []apitypes.Type{{Name: "name", Type: "string"}, {Name: "wallet", Type: "address"}}
+
+	stream := &testTypedDataStream{legs: 3}
+	batch := newTestStreamTypedData()
+	batch.Message = stream.message()
+
+	for i, data := range []apitypes.TypedData{nested, batch} {
+		_, hashes, err := apitypes.TypedDataAndHash(data)
+		if err != nil {
+			t.Fatalf("test %d: failed to hash typed data: %v", i, err)
+		}
+		hash, err := hashTypedDataValues(data, newTypedDataValues(data))
+		if err != nil {
+			t.Fatalf("test %d: failed to hash typed data values: %v", i, err)
+		}
+		if !bytes.Equal(hash, []byte(hashes[34:66])) {
+			t.Errorf("test %d: hash mismatch: have %x, want %x", i, hash, hashes[34:66])
+		}
+		digest, err := typedDataDigest(data, newTypedDataValues(data))
+		if err != nil {
+			t.Fatalf("test %d: failed to compute typed data digest: %v", i, err)
+		}
+		if want := crypto.Keccak256([]byte(hashes)); !bytes.Equal(digest, want) {
+			t.Errorf("test %d: digest mismatch: have %x, want %x", i, digest, want)
+		}
+	}
+	hash, err := hashTypedDataValues(batch, stream)
+	if err != nil {
+		t.Fatalf("failed to hash streamed values: %v", err)
+	}
+	if want, _ := hashTypedDataValues(batch, newTypedDataValues(batch)); !bytes.Equal(hash, want) {
+		t.Errorf("streamed hash mismatch: have %x, want %x", hash, want)
+	}
+	// Ensure fixed size arrays of the wrong length are rejected
+	batch.Types["Leg"][2].Type = "bytes4[3]"
+	if _, err := hashTypedDataValues(batch, stream); err == nil {
+		t.Errorf("array length mismatch accepted")
+	}
+}
+
+// newTestDomainTypedData creates typed data declaring every EIP712Domain field,
+// leaving out the values of the omitted ones.
+func newTestDomainTypedData(omitChainID, omitSalt bool) apitypes.TypedData {
+	data := newTestTypedData([]apitypes.Type{{Name: "value", Type: "uint256"}}, apitypes.TypedDataMessage{"value": "42"})
+	data.Types["EIP712Domain"] = []apitypes.Type{
+		{Name: "name", Type: "string"},
+		{Name: "version", Type: "string"},
+		{Name: "chainId", Type: "uint256"},
+		{Name: "verifyingContract", Type: "address"},
+		{Name: "salt", Type: "bytes32"},
+	}
+	data.Domain.Version = "1"
+	data.Domain.VerifyingContract = "0xCcCCccccCCCCcCCCCCCcCcCccCcCCCcCcccccccC"
+	data.Domain.Salt = "0x" + strings.Repeat("ab", 32)
+	if omitChainID {
+		data.Domain.ChainId = nil
+	}
+	if omitSalt {
+		data.Domain.Salt = ""
+	}
+	return data
+}
+
+// Tests that EIP712Domain fields declared but missing from the domain are hashed
+// and sent to the devices as zero values.
+func TestTypedDomainMissingFields(t *testing.T) {
+	tests := []struct {
+		omitChainID bool
+		omitSalt    bool
+	}{
+		{false, false},
+		{false, true},
+		{true, false},
+		{true, true},
+	}
+	for i, tt := range tests {
+		data := newTestDomainTypedData(tt.omitChainID, tt.omitSalt)
+
+		chainID, salt := common.LeftPadBytes([]byte{1}, 32), bytes.Repeat([]byte{0xab}, 32)
+		if tt.omitChainID {
+			chainID = make([]byte, 32)
+		}
+		if tt.omitSalt {
+			salt = make([]byte, 32)
+		}
+		want := crypto.Keccak256(
+			data.TypeHash("EIP712Domain"),
+			crypto.Keccak256([]byte("Test")),
+			crypto.Keccak256([]byte("1")),
+			chainID,
+			common.LeftPadBytes(common.HexToAddress(data.Domain.VerifyingContract).Bytes(), 32),
+			salt,
+		)
+		domainHash, messageHash, err := typedDataHashes(data)
+		if err != nil {
+			t.Fatalf("test %d: failed to hash typed data: %v", i, err)
+		}
+		if !bytes.Equal(domainHash, want) {
+			t.Errorf("test %d: domain hash mismatch: have %x, want %x", i, domainHash, want)
+		}
+		digest, err := typedDataDigest(data, newTypedDataValues(data))
+		if err != nil {
+			t.Fatalf("test %d: failed to compute typed data digest: %v", i, err)
+		}
+		if want := crypto.Keccak256([]byte{0x19, 0x01}, domainHash, messageHash); !bytes.Equal(digest, want) {
+			t.Errorf("test %d: digest mismatch: have %x, want %x", i, digest, want)
+		}
+		// Ensure the Trezor is sent the same values as hashed
+		for field, want := range map[uint32][]byte{2: chainID, 4: salt} {
+			value, _, err := trezorTypedValue(data, newTypedDataValues(data), []uint32{0, field})
+			if err != nil {
+				t.Fatalf("test %d: failed to encode domain field %d: %v", i, field, err)
+			}
+			if !bytes.Equal(common.LeftPadBytes(value, 32), want) {
+				t.Errorf("test %d: domain field %d mismatch: have %x, want %x", i, field, value, want)
+			}
+		}
+	}
+}
@@ -1,11 +1,23 @@
 package usbwallet
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	gomath "math"
+	"math/big"
+	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
 	"github.com/ethereum/go-ethereum/signer/core/apitypes"
 )
 
@@ -20,6 +32,8 @@ const (
 	StringType
 	FixedBytesType
 	BytesType
+	FixedPointType
+	UfixedPointType
 )
 
 var nameToType = map[string]dataType{
@@ -31,27 +45,81 @@ var nameToType = map[string]dataType{
 	"bytes":   BytesType,
 }
 
+// fixedPointRegexp matches the fixed point number families, optionally with
+// their bit and decimal sizes (e.g. fixed, ufixed128x18).
+var fixedPointRegexp = regexp.MustCompile(`^(u?fixed)(?:(\d+)x(\d+))?$`)
+
+// arraySuffixRegexp matches the array dimensions following the base type of an
+// array field (e.g. [2][] in Person[2][]).
+var arraySuffixRegexp = regexp.MustCompile(`^(?:\[\d*])+$`)
+
+// arrayLengthRegexp matches a single array dimension, capturing its length (empty
+// for dynamic arrays).
+var arrayLengthRegexp = regexp.MustCompile(`\[(\d*)]`)
+
+// sizedTypeRegexp splits an elementary type into its family and size suffix (e.g.
+// uint and 256 for uint256).
+var sizedTypeRegexp = regexp.MustCompile(`(?s)^(.+?)(\d*)$`)
+
+// parseType parses an EIP-712 field type into its base data type, name, byte
+// length and array dimensions. For fixed point numbers of the fixedMxN type,
+// byteLength holds the M/8 bytes of the underlying scaled integer; the decimals
+// N are only validated, as the values are encoded as the scaled integers.
 func parseType(data apitypes.TypedData, field apitypes.Type) (dt dataType, name string, byteLength int, arrayLevels []*int, err error) {
 	name = strings.TrimSpace(field.Type)
-	arrayLengths := regexp.MustCompile(`\[(\d*)]`).FindAllStringSubmatch(name, -1)
-	if len(arrayLengths) > 0 {
+	if index := strings.Index(name, "["); index >= 0 {
+		// Strip the dimensions before looking up custom types, rejecting anything
+		// but brackets after the base type (e.g. Person[2]x)
+		if !arraySuffixRegexp.MatchString(name[index:]) {
+			err = fmt.Errorf("invalid array type: %s", field.Type)
+			return
+		}
+		arrayLengths := arrayLengthRegexp.FindAllStringSubmatch(name[index:], -1)
 		arrayLevels = make([]*int, len(arrayLengths))
 		for i, arrayLength := range arrayLengths {
 			if len(arrayLength[1]) == 0 {
-				arrayLevels[i] = nil // nil means dynamic length
-			} else {
-				length, _ := strconv.Atoi(arrayLength[1]) // guaranteed to be a digit, ignore error
-				arrayLevels[i] = &length
+				continue // nil means dynamic length
+			}
+			// Reject lengths overflowing an int or not in canonical form
+			length := parseTypeSize(arrayLength[1])
+			if length < 0 {
+				err = fmt.Errorf("invalid array length in %s: %s", field.Type, arrayLength[1])
+				return
 			}
+			arrayLevels[i] = &length
 		}
-		name = name[0:strings.Index(name, "[")]
+		name = name[:index]
+	}
+	if name == "" {
+		err = fmt.Errorf("missing base type: %q", field.Type)
+		return
 	}
 	if data.Types[name] != nil {
 		dt = CustomType
 		return
 	}
+	if matches := fixedPointRegexp.FindStringSubmatch(name); matches != nil {
+		dt, name = FixedPointType, matches[1]
+		if name == "ufixed" {
+			dt = UfixedPointType
+		}
+		bits, dec := 128, 18 // fixed and ufixed are aliases for fixed128x18 and ufixed128x18
+		if matches[2] != "" {
+			bits, dec = parseTypeSize(matches[2]), parseTypeSize(matches[3])
+		}
+		if bits < 8 || bits > 256 || bits%8 != 0 {
+			err = fmt.Errorf("invalid length for %s: M must be a multiple of 8 between 8 and 256, got %s", field.Type, matches[2])
+			return
+		}
+		if dec < 1 || dec > 80 {
+			err = fmt.Errorf("invalid decimals for %s: N must be between 1 and 80, got %s", field.Type, matches[3])
+			return
+		}
+		byteLength = bits / 8
+		return
+	}
 
-	matches := regexp.MustCompile(`^(.+?)(\d*)$`).FindStringSubmatch(name)
+	matches := sizedTypeRegexp.FindStringSubmatch(name)
 	name = matches[1]
 	lengthStr := matches[2]
 
@@ -60,31 +128,430 @@ func parseType(data apitypes.TypedData, field apitypes.Type) (dt dataType, name
 		err = fmt.Errorf("unknown type: %s", field.Type)
 		return
 	}
-
-	byteLength, _ = strconv.Atoi(lengthStr)
-	if dt == UintType || dt == IntType {
-		if lengthStr == "" {
-			byteLength = 32
-		} else if byteLength%8 != 0 {
-			err = fmt.Errorf("invalid length for %s: %s", field.Type, lengthStr)
+	switch {
+	case lengthStr == "" && (dt == UintType || dt == IntType):
+		byteLength = 32 // int and uint are aliases for int256 and uint256
+	case lengthStr == "" && dt == AddressType:
+		byteLength = 20 // address is always 20 bytes
+	case lengthStr == "": // bool, string and bytes are unsized
+	case dt == UintType || dt == IntType:
+		bits := parseTypeSize(lengthStr)
+		if bits < 8 || bits > 256 || bits%8 != 0 {
+			err = fmt.Errorf("invalid length for %s: M must be a multiple of 8 between 8 and 256, got %s", field.Type, lengthStr)
 			return
-		} else {
-			byteLength /= 8
-		}
-	} else if lengthStr != "" {
-		if dt == BytesType {
-			dt = FixedBytesType
-		} else {
-			err = fmt.Errorf("invalid type: %s", field.Type)
+		}
+		byteLength = bits / 8
+	case dt == BytesType:
+		if byteLength = parseTypeSize(lengthStr); byteLength < 1 || byteLength > 32 {
+			err = fmt.Errorf("invalid length for %s: N must be between 1 and 32, got %s", field.Type, lengthStr)
 			return
 		}
-	} else if dt == AddressType {
-		byteLength = 20 // address is always 20 bytes
-	}
-	if lengthStr != "" && (byteLength < 1 || byteLength > 32) {
-		err = fmt.Errorf("invalid length for %s: %s", field.Type, lengthStr)
+		dt = FixedBytesType
+	default:
+		err = fmt.Errorf("invalid type: %s: %s has no sized variants", field.Type, name)
 		return
 	}
-
 	return
 }
+
+// parseTypeSize parses the size suffix of an elementary type (e.g. the 256 of
+// uint256), returning -1 if it's out of the int range or not in canonical form
+// (leading zeros), so it fails any range check.
+func parseTypeSize(size string) int {
+	n, err := strconv.Atoi(size)
+	if err != nil || (len(size) > 1 && size[0] == '0') {
+		return -1
+	}
+	return n
+}
+
+// parseInteger converts an EIP-712 integer value, as provided in typed data (JSON
+// number, either as a float64 or a json.Number if decoded with UseNumber, decimal
+// or hex string, optionally negative, or a big integer), into a big integer.
+func parseInteger(value interface{}) (*big.Int, error) {
+	switch v := value.(type) {
+	case float64:
+		if v != gomath.Trunc(v) || gomath.IsInf(v, 0) {
+			return nil, fmt.Errorf("non-integer number %v", v)
+		}
+		n, _ := big.NewFloat(v).Int(nil)
+		return n, nil
+	case json.Number:
+		// Parse the literal exactly, float64 would lose the precision of large
+		// amounts. Exponent notation is accepted if the value is integral.
+		if n, ok := new(big.Int).SetString(string(v), 10); ok {
+			return n, nil
+		}
+		f, _, err := big.ParseFloat(string(v), 10, 512, big.ToZero)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", v)
+		}
+		if f.IsInf() || f.MantExp(nil) > 256 {
+			return nil, fmt.Errorf("number %s out of range", v)
+		}
+		if !f.IsInt() || f.Acc() != big.Exact {
+			return nil, fmt.Errorf("non-integer number %s", v)
+		}
+		n, _ := f.Int(nil)
+		return n, nil
+	case string:
+		// ParseBig256 accepts empty strings as zero and signed ones too, so only a
+		// single leading minus followed by digits is let through
+		digits, neg := strings.CutPrefix(v, "-")
+		if digits == "" || digits[0] == '-' || digits[0] == '+' {
+			return nil, fmt.Errorf("invalid integer %q", v)
+		}
+		n, ok := math.ParseBig256(digits)
+		if !ok {
+			return nil, fmt.Errorf("invalid integer %q", v)
+		}
+		if neg {
+			n.Neg(n)
+		}
+		return n, nil
+	case *math.HexOrDecimal256:
+		if v == nil {
+			return nil, fmt.Errorf("nil integer")
+		}
+		return new(big.Int).Set((*big.Int)(v)), nil
+	case *big.Int:
+		if v == nil {
+			return nil, fmt.Errorf("nil integer")
+		}
+		return new(big.Int).Set(v), nil
+	}
+	return nil, fmt.Errorf("unsupported integer type %T", value)
+}
+
+// encodeInteger encodes an EIP-712 integer value as a big-endian number of the
+// field's byte length, using two's complement for negative signed integers. It
+// returns an error if the value overflows the declared bit width.
+func encodeInteger(value interface{}, signed bool, byteLength int) ([]byte, error) {
+	n, err := parseInteger(value)
+	if err != nil {
+		return nil, err
+	}
+	bits := uint(8 * byteLength)
+	if signed {
+		limit := new(big.Int).Lsh(big.NewInt(1), bits-1)
+		if n.Cmp(limit) >= 0 || n.Cmp(new(big.Int).Neg(limit)) < 0 {
+			return nil, fmt.Errorf("value %v overflows int%d", n, bits)
+		}
+		if n.Sign() < 0 {
+			n.Add(n, new(big.Int).Lsh(big.NewInt(1), bits))
+		}
+	} else if n.Sign() < 0 || n.BitLen() > int(bits) {
+		return nil, fmt.Errorf("value %v overflows uint%d", n, bits)
+	}
+	return math.PaddedBigBytes(n, byteLength), nil
+}
+
+// parseAddress converts an EIP-712 address value into an address. The value must
+// be a 0x prefixed hex string of exactly 20 bytes; mixed case strings must pass
+// the EIP-55 checksum, while all lowercase or all uppercase ones are accepted as
+// non-checksummed.
+func parseAddress(value interface{}) (common.Address, error) {
+	v, ok := value.(string)
+	if !ok {
+		return common.Address{}, fmt.Errorf("expected address string, got %T", value)
+	}
+	if !strings.HasPrefix(v, "0x") && !strings.HasPrefix(v, "0X") {
+		return common.Address{}, fmt.Errorf("address %q lacks 0x prefix", v)
+	}
+	digits := v[2:]
+	if len(digits) != 2*common.AddressLength {
+		return common.Address{}, fmt.Errorf("invalid address length: have %d hex digits, want %d", len(digits), 2*common.AddressLength)
+	}
+	if !common.IsHexAddress(v) {
+		return common.Address{}, fmt.Errorf("invalid hex address %q", v)
+	}
+	address := common.HexToAddress(v)
+	if digits != strings.ToLower(digits) && digits != strings.ToUpper(digits) && address.Hex()[2:] != digits {
+		return common.Address{}, fmt.Errorf("invalid address checksum %q, expected %s", v, address.Hex())
+	}
+	return address, nil
+}
+
+// parseBytes converts an EIP-712 bytes or bytesN value into its raw bytes. The
+// value may be a 0x prefixed hex string, a standard (padded) base64 string as some
+// API clients send, or raw bytes as set by callers building typed data in code:
+// a []byte (or named byte slice type, like hexutil.Bytes) or a byte array (like
+// common.Hash). Strings lacking the 0x prefix are always decoded as base64, never
+// as hex.
+func parseBytes(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case []byte:
+		return v, nil
+	case hexutil.Bytes:
+		return v, nil
+	case string:
+		if strings.HasPrefix(v, "0x") || strings.HasPrefix(v, "0X") {
+			enc, err := hex.DecodeString(v[2:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid hex bytes %q: %w", v, err)
+			}
+			return enc, nil
+		}
+		enc, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 bytes %q: %w", v, err)
+		}
+		return enc, nil
+	}
+	switch v := reflect.ValueOf(value); v.Kind() {
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Bytes(), nil
+		}
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			enc := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(enc), v)
+			return enc, nil
+		}
+	}
+	return nil, fmt.Errorf("expected bytes string, got %T", value)
+}
+
+// decodeTypedBytes returns a copy of the typed data with all the bytes and bytesN
+// values of the message decoded into raw bytes (see parseBytes), so base64 ones
+// are hashed the same way as they are streamed to the devices, and json.Number
+// integers converted into big integers. Values of invalid types are left to the
+// encoders to reject.
+func decodeTypedBytes(data apitypes.TypedData) (apitypes.TypedData, error) {
+	message, err := decodeStructBytes(data, data.PrimaryType, data.Message, "message")
+	if err != nil {
+		return apitypes.TypedData{}, err
+	}
+	data.Message = message
+	return data, nil
+}
+
+// decodeStructBytes decodes the bytes values of a struct value of the named type,
+// returning a copy of it.
+func decodeStructBytes(data apitypes.TypedData, name string, value map[string]interface{}, path string) (map[string]interface{}, error) {
+	decoded := maps.Clone(value)
+	for _, field := range data.Types[name] {
+		v, ok := value[field.Name]
+		if !ok {
+			continue
+		}
+		dt, typeName, _, arrayLevels, err := parseType(data, field)
+		if err != nil {
+			continue
+		}
+		if decoded[field.Name], err = decodeValueBytes(data, dt, typeName, len(arrayLevels), v, path+"."+field.Name); err != nil {
+			return nil, err
+		}
+	}
+	return decoded, nil
+}
+
+// decodeValueBytes decodes the bytes values within a field value, descending into
+// the given number of array dimensions and into custom structs.
+func decodeValueBytes(data apitypes.TypedData, dt dataType, name string, levels int, value interface{}, path string) (interface{}, error) {
+	if levels > 0 {
+		items, ok := value.([]interface{})
+		if !ok {
+			return value, nil
+		}
+		decoded := make([]interface{}, len(items))
+		for i, item := range items {
+			var err error
+			if decoded[i], err = decodeValueBytes(data, dt, name, levels-1, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return nil, err
+			}
+		}
+		return decoded, nil
+	}
+	switch dt {
+	case CustomType:
+		if v, ok := value.(map[string]interface{}); ok {
+			return decodeStructBytes(data, name, v, path)
+		}
+	case BytesType, FixedBytesType:
+		if _, ok := value.(float64); ok {
+			return value, nil // Numeric fixed bytes, left to the encoders
+		}
+		enc, err := parseBytes(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidTypedData, path, err)
+		}
+		return enc, nil
+	case IntType, UintType, FixedPointType, UfixedPointType:
+		// Numbers decoded with UseNumber aren't understood by the EIP-712 hasher,
+		// convert them exactly (invalid ones are left to the encoders to reject)
+		if v, ok := value.(json.Number); ok {
+			if n, err := parseInteger(v); err == nil {
+				return n, nil
+			}
+		}
+	}
+	return value, nil
+}
+
+// orderedTypes returns the names of the EIP-712 struct types ordered so that
+// every struct follows the custom types its fields reference, breaking ties (and
+// reference cycles) alphabetically to make the order deterministic.
+func orderedTypes(types apitypes.Types) []string {
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var (
+		ordered = make([]string, 0, len(types))
+		visited = make(map[string]bool, len(types))
+		visit   func(name string)
+	)
+	visit = func(name string) {
+		if visited[name] {
+			return
+		}
+		visited[name] = true
+		for _, field := range types[name] {
+			dep := field.Type
+			if i := strings.Index(dep, "["); i >= 0 {
+				dep = dep[:i]
+			}
+			if _, ok := types[dep]; ok {
+				visit(dep)
+			}
+		}
+		ordered = append(ordered, name)
+	}
+	for _, name := range names {
+		visit(name)
+	}
+	return ordered
+}
+
+// ErrInvalidTypedData is returned if an EIP-712 JSON payload is malformed. It is
+// wrapped into an error naming the offending JSON field (e.g. domain.chainId).
+var ErrInvalidTypedData = errors.New("invalid typed data")
+
+// typedDataDomainFields are the fields an EIP712Domain struct may declare.
+var typedDataDomainFields = map[string]bool{
+	"name":              true,
+	"version":           true,
+	"chainId":           true,
+	"verifyingContract": true,
+	"salt":              true,
+}
+
+// parseTypedDataJSON unmarshals an EIP-712 JSON payload (as sent to the
+// eth_signTypedData_v4 RPC call) and checks its structure: the sections are all
+// present, the primary type and the domain are declared, every field type is
+// known, and the domain values are all declared in EIP712Domain. Declared values
+// may be missing, they are hashed as zero values (see typedDomainMap).
+func parseTypedDataJSON(raw []byte) (apitypes.TypedData, error) {
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &sections); err != nil {
+		return apitypes.TypedData{}, typedDataError("", err)
+	}
+	var (
+		data   apitypes.TypedData
+		domain map[string]json.RawMessage
+	)
+	for _, section := range []struct {
+		field string
+		dests []interface{}
+	}{
+		{"types", []interface{}{&data.Types}},
+		{"primaryType", []interface{}{&data.PrimaryType}},
+		{"domain", []interface{}{&domain}},
+		{"message", []interface{}{&data.Message}},
+	} {
+		value, ok := sections[section.field]
+		if !ok || string(value) == "null" {
+			return apitypes.TypedData{}, fmt.Errorf("%w: %s: missing", ErrInvalidTypedData, section.field)
+		}
+		for _, dest := range section.dests {
+			if err := json.Unmarshal(value, dest); err != nil {
+				return apitypes.TypedData{}, typedDataError(section.field, err)
+			}
+		}
+	}
+	// Decode the domain field by field to pinpoint invalid values
+	fields := make([]string, 0, len(domain))
+	for field := range domain {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		value, _ := json.Marshal(map[string]json.RawMessage{field: domain[field]})
+		if err := json.Unmarshal(value, &data.Domain); err != nil {
+			var terr *json.UnmarshalTypeError
+			if errors.As(err, &terr) {
+				return apitypes.TypedData{}, typedDataError("domain", err) // field named by the error
+			}
+			return apitypes.TypedData{}, typedDataError("domain."+field, err)
+		}
+	}
+	// Ensure all the types are well-formed
+	if data.PrimaryType == "" {
+		return apitypes.TypedData{}, fmt.Errorf("%w: primaryType: empty", ErrInvalidTypedData)
+	}
+	if data.Types[data.PrimaryType] == nil {
+		return apitypes.TypedData{}, fmt.Errorf("%w: primaryType: type %s not found in types", ErrInvalidTypedData, data.PrimaryType)
+	}
+	if data.Types["EIP712Domain"] == nil {
+		return apitypes.TypedData{}, fmt.Errorf("%w: types.EIP712Domain: missing", ErrInvalidTypedData)
+	}
+	for _, name := range orderedTypes(data.Types) {
+		for i, field := range data.Types[name] {
+			if field.Name == "" {
+				return apitypes.TypedData{}, fmt.Errorf("%w: types.%s[%d].name: empty", ErrInvalidTypedData, name, i)
+			}
+			if _, _, _, _, err := parseType(data, field); err != nil {
+				return apitypes.TypedData{}, fmt.Errorf("%w: types.%s[%d].type: %v", ErrInvalidTypedData, name, i, err)
+			}
+		}
+	}
+	// Ensure the domain values are all declared
+	declared := make(map[string]bool)
+	for i, field := range data.Types["EIP712Domain"] {
+		if !typedDataDomainFields[field.Name] {
+			return apitypes.TypedData{}, fmt.Errorf("%w: types.EIP712Domain[%d].name: unknown domain field %s", ErrInvalidTypedData, i, field.Name)
+		}
+		declared[field.Name] = true
+	}
+	for _, field := range fields {
+		if value := string(domain[field]); value == "null" || value == `""` {
+			continue // Unset, as apitypes.TypedDataDomain encodes missing fields
+		}
+		if !declared[field] {
+			return apitypes.TypedData{}, fmt.Errorf("%w: domain.%s: not declared in types.EIP712Domain", ErrInvalidTypedData, field)
+		}
+	}
+	if contract := data.Domain.VerifyingContract; contract != "" {
+		if _, err := parseAddress(contract); err != nil {
+			return apitypes.TypedData{}, fmt.Errorf("%w: domain.verifyingContract: %v", ErrInvalidTypedData, err)
+		}
+	}
+	return data, nil
+}
+
+// typedDataError converts a JSON decoding error of an EIP-712 payload section into
+// an ErrInvalidTypedData naming the offending field.
+func typedDataError(field string, err error) error {
+	var terr *json.UnmarshalTypeError
+	if errors.As(err, &terr) {
+		if terr.Field != "" {
+			if field != "" {
+				field += "."
+			}
+			field += terr.Field
+		}
+		if field == "" {
+			return fmt.Errorf("%w: expected %s, got %s", ErrInvalidTypedData, terr.Type, terr.Value)
+		}
+		return fmt.Errorf("%w: %s: expected %s, got %s", ErrInvalidTypedData, field, terr.Type, terr.Value)
+	}
+	if field == "" {
+		return fmt.Errorf("%w: %v", ErrInvalidTypedData, err)
+	}
+	return fmt.Errorf("%w: %s: %v", ErrInvalidTypedData, field, err)
+}
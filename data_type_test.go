@@ -0,0 +1,423 @@
+package usbwallet
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+func TestParseType(t *testing.T) {
+	data := apitypes.TypedData{
+		Types: apitypes.Types{
+			"Person": {{Name: "name", Type: "string"}},
+		},
+	}
+	tests := []struct {
+		typ        string
+		dt         dataType
+		byteLength int
+		arrays     int
+		fail       bool
+	}{
+		{typ: "uint256", dt: UintType, byteLength: 32},
+		{typ: "int8", dt: IntType, byteLength: 1},
+		{typ: "address", dt: AddressType, byteLength: 20},
+		{typ: "bytes4", dt: FixedBytesType, byteLength: 4},
+		{typ: "bytes", dt: BytesType},
+		{typ: "Person[]", dt: CustomType, arrays: 1},
+		{typ: "Person[2]", dt: CustomType, arrays: 1},
+		{typ: "Person[2][]", dt: CustomType, arrays: 2},
+		{typ: "Person[][3][]", dt: CustomType, arrays: 3},
+		{typ: "uint8[2][]", dt: UintType, byteLength: 1, arrays: 2},
+		{typ: "Person[2]x", fail: true},
+		{typ: "Person[2]]", fail: true},
+		{typ: "Person[x]", fail: true},
+		{typ: "Persons[]", fail: true},
+		{typ: "Person[02]", fail: true},
+		{typ: "uint8[99999999999999999999]", fail: true},
+		{typ: "", fail: true},
+		{typ: "[]", fail: true},
+		{typ: "[2][]", fail: true},
+		{typ: "uint\n8", fail: true},
+		{typ: "\n", fail: true},
+		{typ: "fixed", dt: FixedPointType, byteLength: 16},
+		{typ: "ufixed128x18", dt: UfixedPointType, byteLength: 16},
+		{typ: "fixed8x1", dt: FixedPointType, byteLength: 1},
+		{typ: "ufixed256x80[2]", dt: UfixedPointType, byteLength: 32, arrays: 1},
+		{typ: "fixed0x0", fail: true},
+		{typ: "ufixed7x1", fail: true},
+		{typ: "fixed264x18", fail: true},
+		{typ: "ufixed128x0", fail: true},
+		{typ: "fixed128x81", fail: true},
+		{typ: "ufixed128", fail: true},
+		{typ: "Unknown", fail: true},
+
+		// Sizes of every elementary family
+		{typ: "uint", dt: UintType, byteLength: 32},
+		{typ: "uint8", dt: UintType, byteLength: 1},
+		{typ: "uint128", dt: UintType, byteLength: 16},
+		{typ: "uint0", fail: true},
+		{typ: "uint7", fail: true},
+		{typ: "uint264", fail: true},
+		{typ: "uint08", fail: true},
+		{typ: "uint99999999999999999999", fail: true},
+		{typ: "int", dt: IntType, byteLength: 32},
+		{typ: "int256", dt: IntType, byteLength: 32},
+		{typ: "int0", fail: true},
+		{typ: "int12", fail: true},
+		{typ: "int512", fail: true},
+		{typ: "bytes1", dt: FixedBytesType, byteLength: 1},
+		{typ: "bytes32", dt: FixedBytesType, byteLength: 32},
+		{typ: "bytes0", fail: true},
+		{typ: "bytes33", fail: true},
+		{typ: "bytes032", fail: true},
+		{typ: "fixed08x1", fail: true},
+		{typ: "ufixed8x01", fail: true},
+		{typ: "bool", dt: BoolType},
+		{typ: "bool8", fail: true},
+		{typ: "string", dt: StringType},
+		{typ: "string32", fail: true},
+		{typ: "address20", fail: true},
+	}
+	for _, tt := range tests {
+		dt, _, byteLength, arrays, err := parseType(data, apitypes.Type{Name: "field", Type: tt.typ})
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%s: expected failure, got none", tt.typ)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected failure: %v", tt.typ, err)
+			continue
+		}
+		if dt != tt.dt || byteLength != tt.byteLength || len(arrays) != tt.arrays {
+			t.Errorf("%s: parse mismatch: have (%d, %d, %d), want (%d, %d, %d)", tt.typ,
+				dt, byteLength, len(arrays), tt.dt, tt.byteLength, tt.arrays)
+		}
+	}
+}
+
+// Fuzzes the type parser with arbitrary type strings, as received in untrusted
+// typed data, checking that it never panics and that accepted types are within
+// the ranges the encoders rely on.
+func FuzzParseType(f *testing.F) {
+	for _, typ := range []string{
+		"uint256", "int8", "address", "bytes", "bytes32", "bool", "string", "fixed",
+		"ufixed128x18", "Person", "Person[]", "Person[2][]", "uint8[2][3]",
+		"", "[]", "[2]", "uint0", "bytes33", "Person[2]x", "Person[x]", "uint08",
+		"uint8[99999999999999999999]", "fixed128x81", "uint\n8", "Person[[]]",
+	} {
+		f.Add(typ)
+	}
+	data := apitypes.TypedData{
+		Types: apitypes.Types{
+			"Person": {{Name: "name", Type: "string"}},
+		},
+	}
+	f.Fuzz(func(t *testing.T, typ string) {
+		dt, name, byteLength, arrays, err := parseType(data, apitypes.Type{Name: "field", Type: typ})
+		if err != nil {
+			if err.Error() == "" {
+				t.Fatalf("empty error for %q", typ)
+			}
+			return
+		}
+		if name == "" {
+			t.Fatalf("empty base type accepted for %q", typ)
+		}
+		if dt > UfixedPointType || byteLength < 0 || byteLength > 32 {
+			t.Fatalf("out of range result for %q: (%d, %d)", typ, dt, byteLength)
+		}
+		for _, length := range arrays {
+			if length != nil && *length < 0 {
+				t.Fatalf("negative array length for %q", typ)
+			}
+		}
+		if dt == CustomType && data.Types[name] == nil {
+			t.Fatalf("unknown custom type %q accepted for %q", name, typ)
+		}
+	})
+}
+
+// Tests that out of range sizes of elementary types are rejected with errors
+// stating the valid range.
+func TestParseTypeSizeErrors(t *testing.T) {
+	tests := []struct {
+		typ string
+		err string
+	}{
+		{"uint0", "invalid length for uint0: M must be a multiple of 8 between 8 and 256, got 0"},
+		{"int0", "invalid length for int0: M must be a multiple of 8 between 8 and 256, got 0"},
+		{"uint264", "invalid length for uint264: M must be a multiple of 8 between 8 and 256, got 264"},
+		{"bytes0", "invalid length for bytes0: N must be between 1 and 32, got 0"},
+		{"bytes033[]", "invalid length for bytes033[]: N must be between 1 and 32, got 033"},
+		{"bool1", "invalid type: bool1: bool has no sized variants"},
+	}
+	for _, tt := range tests {
+		_, _, _, _, err := parseType(apitypes.TypedData{}, apitypes.Type{Name: "field", Type: tt.typ})
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%s: error mismatch: have %v, want %s", tt.typ, err, tt.err)
+		}
+	}
+}
+
+// Tests that the dimensions of custom struct arrays are parsed in declaration
+// order, nil denoting dynamic ones.
+func TestParseTypeArrayLevels(t *testing.T) {
+	data := apitypes.TypedData{
+		Types: apitypes.Types{
+			"Person": {{Name: "name", Type: "string"}},
+		},
+	}
+	tests := []struct {
+		typ    string
+		levels []int // Array lengths, -1 for dynamic
+	}{
+		{"Person[]", []int{-1}},
+		{"Person[2][]", []int{2, -1}},
+		{"Person[][3]", []int{-1, 3}},
+		{"Person[1][2][3]", []int{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		dt, name, _, arrays, err := parseType(data, apitypes.Type{Name: "field", Type: tt.typ})
+		if err != nil {
+			t.Errorf("%s: unexpected failure: %v", tt.typ, err)
+			continue
+		}
+		if dt != CustomType || name != "Person" {
+			t.Errorf("%s: type mismatch: have (%d, %s), want (%d, Person)", tt.typ, dt, name, CustomType)
+		}
+		levels := make([]int, len(arrays))
+		for i, length := range arrays {
+			levels[i] = -1
+			if length != nil {
+				levels[i] = *length
+			}
+		}
+		if !slices.Equal(levels, tt.levels) {
+			t.Errorf("%s: array levels mismatch: have %v, want %v", tt.typ, levels, tt.levels)
+		}
+	}
+}
+
+func TestEncodeInteger(t *testing.T) {
+	tests := []struct {
+		value      interface{}
+		signed     bool
+		byteLength int
+		want       string
+		fail       bool
+	}{
+		{value: float64(1), signed: true, byteLength: 1, want: "01"},
+		{value: float64(-1), signed: true, byteLength: 32, want: strings.Repeat("ff", 32)},
+		{value: float64(-128), signed: true, byteLength: 1, want: "80"},
+		{value: "-0x81", signed: true, byteLength: 2, want: "ff7f"},
+		{value: "-2", signed: true, byteLength: 4, want: "fffffffe"},
+		{value: "0xff", signed: false, byteLength: 1, want: "ff"},
+		{value: "255", signed: false, byteLength: 2, want: "00ff"},
+		{value: big.NewInt(-1), signed: true, byteLength: 2, want: "ffff"},
+		{value: json.Number("115792089237316195423570985008687907853269984665640564039457584007913129639935"), signed: false, byteLength: 32, want: strings.Repeat("ff", 32)},
+		{value: json.Number("-2"), signed: true, byteLength: 1, want: "fe"},
+		{value: json.Number("1e18"), signed: false, byteLength: 8, want: "0de0b6b3a7640000"},
+		{value: json.Number("2.5e1"), signed: false, byteLength: 1, want: "19"},
+		{value: json.Number("1.5"), signed: false, byteLength: 32, fail: true},
+		{value: json.Number("1e100"), signed: false, byteLength: 32, fail: true},
+		{value: json.Number("1e1000000000"), signed: false, byteLength: 32, fail: true},
+		{value: json.Number("0x10"), signed: false, byteLength: 32, fail: true},
+		{value: float64(128), signed: true, byteLength: 1, fail: true},
+		{value: float64(-129), signed: true, byteLength: 1, fail: true},
+		{value: "0x100", signed: false, byteLength: 1, fail: true},
+		{value: float64(-1), signed: false, byteLength: 32, fail: true},
+		{value: 1.5, signed: true, byteLength: 32, fail: true},
+		{value: "abc", signed: true, byteLength: 32, fail: true},
+		{value: "", signed: true, byteLength: 32, fail: true},
+		{value: "-", signed: true, byteLength: 32, fail: true},
+		{value: "--1", signed: true, byteLength: 32, fail: true},
+		{value: "+1", signed: true, byteLength: 32, fail: true},
+		{value: true, signed: true, byteLength: 32, fail: true},
+	}
+	for i, tt := range tests {
+		enc, err := encodeInteger(tt.value, tt.signed, tt.byteLength)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("test %d: expected failure, got %x", i, enc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: failed to encode %v: %v", i, tt.value, err)
+			continue
+		}
+		if hex.EncodeToString(enc) != tt.want {
+			t.Errorf("test %d: encoding mismatch: have %x, want %s", i, enc, tt.want)
+		}
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		fail  bool
+	}{
+		{value: "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"}, // EIP-55 checksummed
+		{value: "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed"}, // all lowercase
+		{value: "0x5AAEB6053F3E94C9B9A09F33669435E7EF1BEAED"}, // all uppercase
+		{value: "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAeD", fail: true},
+		{value: "0x5aaeb6053f3e94c9b9a09f33669435e7ef1bea", fail: true},
+		{value: "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed00", fail: true},
+		{value: "5aaeb6053f3e94c9b9a09f33669435e7ef1beaed", fail: true},
+		{value: "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaeg", fail: true},
+		{value: float64(1), fail: true},
+	}
+	want := common.HexToAddress("0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed")
+	for i, tt := range tests {
+		address, err := parseAddress(tt.value)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("test %d: expected failure, got %x", i, address)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: failed to parse %v: %v", i, tt.value, err)
+			continue
+		}
+		if address != want {
+			t.Errorf("test %d: address mismatch: have %x, want %x", i, address, want)
+		}
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+		fail  bool
+	}{
+		{value: "0x0102ff", want: "0102ff"},
+		{value: "0X0102FF", want: "0102ff"},
+		{value: "0x", want: ""},
+		{value: "AQL/", want: "0102ff"},
+		{value: "AQI=", want: "0102"},
+		{value: "", want: ""},
+		{value: []byte{1, 2, 0xff}, want: "0102ff"},
+		{value: hexutil.Bytes{1, 2, 0xff}, want: "0102ff"},
+		{value: [3]byte{1, 2, 0xff}, want: "0102ff"},
+		{value: common.Hash{31: 1}, want: strings.Repeat("00", 31) + "01"},
+		{value: []uint8{}, want: ""},
+		{value: []int{1}, fail: true},
+		{value: [1]int{1}, fail: true},
+		{value: nil, fail: true},
+		{value: "0x0102f", fail: true},
+		{value: "0x01zz", fail: true},
+		{value: "AQI", fail: true},                // missing base64 padding
+		{value: "01020304", want: "d35d36d37d38"}, // unprefixed hex is decoded as base64
+		{value: float64(1), fail: true},
+	}
+	for i, tt := range tests {
+		enc, err := parseBytes(tt.value)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("test %d: expected failure, got %x", i, enc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: failed to parse %v: %v", i, tt.value, err)
+			continue
+		}
+		if hex.EncodeToString(enc) != tt.want {
+			t.Errorf("test %d: bytes mismatch: have %x, want %s", i, enc, tt.want)
+		}
+	}
+}
+
+func TestOrderedTypes(t *testing.T) {
+	types := apitypes.Types{
+		"EIP712Domain": {{Name: "name", Type: "string"}},
+		"Mail":         {{Name: "from", Type: "Person"}, {Name: "to", Type: "Person[]"}},
+		"Person":       {{Name: "name", Type: "string"}, {Name: "wallet", Type: "Wallet"}},
+		"Wallet":       {{Name: "owner", Type: "Owner"}},
+		"Owner":        {{Name: "wallets", Type: "Wallet[2]"}}, // references Wallet back
+	}
+	want := []string{"EIP712Domain", "Owner", "Wallet", "Person", "Mail"}
+	for i := 0; i < 10; i++ {
+		if have := orderedTypes(types); strings.Join(have, ",") != strings.Join(want, ",") {
+			t.Fatalf("order mismatch: have %v, want %v", have, want)
+		}
+	}
+}
+
+// Tests that EIP-712 JSON payloads are parsed and that malformed ones are rejected
+// with errors naming the offending field.
+func TestParseTypedDataJSON(t *testing.T) {
+	const valid = `{
+		"types": {
+			"EIP712Domain": [{"name": "name", "type": "string"}, {"name": "chainId", "type": "uint256"}, {"name": "verifyingContract", "type": "address"}],
+			"Person": [{"name": "name", "type": "string"}, {"name": "wallet", "type": "address"}]
+		},
+		"primaryType": "Person",
+		"domain": {"name": "Ether Mail", "chainId": 1, "verifyingContract": "0xCcCCccccCCCCcCCCCCCcCcCccCcCCCcCcccccccC"},
+		"message": {"name": "Bob", "wallet": "0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB"}
+	}`
+	data, err := parseTypedDataJSON([]byte(valid))
+	if err != nil {
+		t.Fatalf("failed to parse valid payload: %v", err)
+	}
+	if data.PrimaryType != "Person" || data.Domain.Name != "Ether Mail" || data.Message["name"] != "Bob" {
+		t.Fatalf("parsed payload mismatch: %+v", data)
+	}
+	// Declared domain values may be missing, as in the typed data signed directly
+	if data, err = parseTypedDataJSON([]byte(strings.Replace(valid, `"chainId": 1,`, ``, 1))); err != nil {
+		t.Fatalf("failed to parse payload without chain ID: %v", err)
+	}
+	if data.Domain.ChainId != nil {
+		t.Fatalf("missing chain ID parsed as %v", data.Domain.ChainId)
+	}
+	// Undeclared domain values must be unset, as encoded by apitypes.TypedDataDomain
+	if _, err = parseTypedDataJSON([]byte(strings.Replace(valid, `"chainId": 1,`, `"chainId": 1, "version": "", "salt": null,`, 1))); err != nil {
+		t.Fatalf("failed to parse payload with unset domain values: %v", err)
+	}
+	tests := []struct {
+		old, new string // Replacement to apply to the valid payload
+		want     string // Field expected in the error
+	}{
+		{`"primaryType": "Person",`, ``, "primaryType: missing"},
+		{`"primaryType": "Person"`, `"primaryType": "Mail"`, "primaryType: type Mail not found"},
+		{`"primaryType": "Person"`, `"primaryType": 1`, "primaryType: expected string"},
+		{`"EIP712Domain"`, `"Domain"`, "types.EIP712Domain: missing"},
+		{`{"name": "wallet", "type": "address"}`, `{"name": "wallet", "type": "addr"}`, "types.Person[1].type"},
+		{`{"name": "name", "type": "string"}, {"name": "wallet"`, `{"name": "", "type": "string"}, {"name": "wallet"`, "types.Person[0].name: empty"},
+		{`"chainId": 1`, `"chainId": "one"`, "domain.chainId: invalid hex or decimal integer"},
+		{`"name": "Ether Mail"`, `"name": 1`, "domain.name: expected string"},
+		{`"name": "Ether Mail",`, `"name": "Ether Mail", "version": "1",`, "domain.version: not declared"},
+		{`"0xCcCCccccCCCCcCCCCCCcCcCccCcCCCcCcccccccC"`, `"0xCcCC"`, "domain.verifyingContract"},
+		{`{"name": "chainId", "type": "uint256"}`, `{"name": "chain", "type": "uint256"}`, "types.EIP712Domain[1].name: unknown domain field"},
+		{`"message": {"name": "Bob", "wallet": "0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB"}`, `"message": null`, "message: missing"},
+		{`"message": {"name": "Bob", "wallet": "0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB"}`, `"message": []`, "message: expected"},
+		{`"Person": [`, `"Person": {`, "invalid typed data: invalid character"},
+	}
+	for i, tt := range tests {
+		payload := strings.Replace(valid, tt.old, tt.new, 1)
+		if payload == valid {
+			t.Fatalf("test %d: replacement not applied", i)
+		}
+		_, err := parseTypedDataJSON([]byte(payload))
+		if !errors.Is(err, ErrInvalidTypedData) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, ErrInvalidTypedData)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("test %d: error %q doesn't mention %q", i, err, tt.want)
+		}
+	}
+}
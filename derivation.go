@@ -0,0 +1,86 @@
+package usbwallet
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts"
+)
+
+// DerivationScheme maps the index of an account to its derivation path, defining
+// the order in which the accounts of a wallet are enumerated. Different wallet
+// software lays out the accounts of the same seed differently, so the scheme must
+// match the one the accounts were created with for them to be found.
+type DerivationScheme func(index uint32) accounts.DerivationPath
+
+// BIP44Scheme enumerates accounts by incrementing the address index of the first
+// BIP-44 account: m/44'/60'/0'/0/x. It is the layout used by most software wallets
+// and the default if none is configured.
+func BIP44Scheme(index uint32) accounts.DerivationPath {
+	path := append(accounts.DerivationPath{}, accounts.DefaultBaseDerivationPath...)
+	path[4] += index
+	return path
+}
+
+// LedgerLiveScheme enumerates accounts by incrementing the BIP-44 account index,
+// deriving the first address of each: m/44'/60'/x'/0/0, as done by Ledger Live.
+func LedgerLiveScheme(index uint32) accounts.DerivationPath {
+	path := append(accounts.DerivationPath{}, accounts.DefaultBaseDerivationPath...)
+	path[2] += index
+	return path
+}
+
+// LegacyLedgerScheme enumerates accounts on the non-standard four component path
+// m/44'/60'/0'/x used by the early Ledger Ethereum apps and by MyEtherWallet for
+// Ledger devices.
+func LegacyLedgerScheme(index uint32) accounts.DerivationPath {
+	path := append(accounts.DerivationPath{}, accounts.LegacyLedgerBaseDerivationPath...)
+	path[3] += index
+	return path
+}
+
+// TemplateScheme creates a derivation scheme from a path template containing a
+// single x placeholder component (hardened as x') substituted with the account
+// index, e.g. m/44'/60'/x'/0/0 or m/44'/60'/0'/0/x. Templates are parsed like
+// derivation paths, so relative ones are rooted at m/44'/60'/0'/0.
+func TemplateScheme(template string) (DerivationScheme, error) {
+	components := strings.Split(template, "/")
+
+	placeholder := -1
+	for i, component := range components {
+		if strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(component), "'")) == "x" {
+			if placeholder >= 0 {
+				return nil, fmt.Errorf("multiple placeholders in derivation template %q", template)
+			}
+			placeholder = i
+		}
+	}
+	if placeholder < 0 {
+		return nil, fmt.Errorf("missing placeholder in derivation template %q", template)
+	}
+	// Parse the template with two different indices and locate the component that
+	// changed, sidestepping any root the parser prepends to relative paths
+	substitute := func(index string) (accounts.DerivationPath, error) {
+		parts := append([]string{}, components...)
+		parts[placeholder] = strings.Replace(parts[placeholder], "x", index, 1)
+		return accounts.ParseDerivationPath(strings.Join(parts, "/"))
+	}
+	base, err := substitute("0")
+	if err != nil {
+		return nil, fmt.Errorf("invalid derivation template %q: %w", template, err)
+	}
+	next, err := substitute("1")
+	if err != nil {
+		return nil, fmt.Errorf("invalid derivation template %q: %w", template, err)
+	}
+	position := len(base) - len(components) + placeholder
+	if len(base) != len(next) || position < 0 || next[position] != base[position]+1 {
+		return nil, errors.New("unsupported derivation template")
+	}
+	return func(index uint32) accounts.DerivationPath {
+		path := append(accounts.DerivationPath{}, base...)
+		path[position] += index
+		return path
+	}, nil
+}
@@ -0,0 +1,41 @@
+package usbwallet
+
+import (
+	"testing"
+)
+
+// Tests that derivation templates substitute the account index into their
+// placeholder component, and that malformed templates are rejected.
+func TestTemplateScheme(t *testing.T) {
+	tests := []struct {
+		template string
+		index    uint32
+		want     string // Empty if the template is invalid
+	}{
+		{"m/44'/60'/x'/0/0", 3, "m/44'/60'/3'/0/0"},
+		{"m/44'/60'/0'/0/x", 7, "m/44'/60'/0'/0/7"},
+		{"m/44'/60'/0'/x", 1, "m/44'/60'/0'/1"},
+		{"m/44'/60'/0'/x'", 2, "m/44'/60'/0'/2'"},
+		{"x", 5, "m/44'/60'/0'/0/5"},
+		{"m/44'/60'/0'/0/0", 0, ""},
+		{"m/44'/60'/x'/0/x", 0, ""},
+		{"m/44'/60'/x/y", 0, ""},
+		{"m/44'/60'/xx/0", 0, ""},
+	}
+	for i, tt := range tests {
+		scheme, err := TemplateScheme(tt.template)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("test %d: invalid template %q accepted", i, tt.template)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: failed to parse template %q: %v", i, tt.template, err)
+			continue
+		}
+		if have := scheme(tt.index).String(); have != tt.want {
+			t.Errorf("test %d: path mismatch: have %s, want %s", i, have, tt.want)
+		}
+	}
+}
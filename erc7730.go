@@ -0,0 +1,345 @@
+package usbwallet
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// ERC7730Descriptor is the clear signing metadata of the contract calls described
+// by an ERC-7730 descriptor: where the contract is deployed, and how each of its
+// methods is to be displayed.
+//
+// The Ethereum app only displays metadata signed by Ledger, so a descriptor cannot
+// be provided to the device as is. It allows finding the method a transaction
+// calls and how to present it (e.g. on the host, before sending the transaction),
+// and which signed token descriptors (WithLedgerTokens) the device needs to clear
+// sign it, which WithERC7730 provides automatically.
+type ERC7730Descriptor struct {
+	Owner       string                    // Display name of the contract owner
+	Deployments []ERC7730Deployment       // Chains and addresses the contract is deployed at
+	Token       *ERC7730Token             // Token metadata if the contract is a token, nil otherwise
+	Formats     map[[4]byte]ERC7730Format // Display formats of the methods by selector
+}
+
+// ERC7730Deployment is a chain and address a described contract is deployed at.
+type ERC7730Deployment struct {
+	ChainID uint64
+	Address common.Address
+}
+
+// ERC7730Token is the metadata of a described token contract.
+type ERC7730Token struct {
+	Name     string
+	Ticker   string
+	Decimals uint32
+}
+
+// ERC7730Format describes how to display the calls of a contract method.
+type ERC7730Format struct {
+	Signature string         // Canonical method signature, empty if keyed by selector only
+	Intent    string         // Short description of the call (e.g. Send)
+	Fields    []ERC7730Field // Parameters to display, in display order
+
+	params []erc7730Param // Top level parameters of the method, nil if keyed by selector only
+}
+
+// erc7730Param is a top level parameter of a described method.
+type erc7730Param struct {
+	name string // Parameter name, empty if unnamed
+	kind string // Canonical parameter type
+}
+
+// ERC7730Field is a displayed parameter of a contract method call.
+type ERC7730Field struct {
+	Path   string // Path of the parameter within the call data (e.g. to, legs.[].amount)
+	Label  string // Label displayed for the parameter
+	Format string // Display format of the value (e.g. tokenAmount, addressName)
+
+	Token     common.Address // Constant token of a tokenAmount value, zero if given by path
+	TokenPath string         // Path of the token of a tokenAmount value (e.g. @.to, tokenIn)
+}
+
+// erc7730JSON is the subset of the ERC-7730 descriptor JSON the parser consumes.
+type erc7730JSON struct {
+	Context struct {
+		Contract *struct {
+			Deployments []struct {
+				ChainID uint64         `json:"chainId"`
+				Address common.Address `json:"address"`
+			} `json:"deployments"`
+		} `json:"contract"`
+	} `json:"context"`
+	Metadata struct {
+		Owner string `json:"owner"`
+		Token *struct {
+			Name     string `json:"name"`
+			Ticker   string `json:"ticker"`
+			Decimals uint32 `json:"decimals"`
+		} `json:"token"`
+	} `json:"metadata"`
+	Display struct {
+		Formats map[string]struct {
+			Intent json.RawMessage    `json:"intent"`
+			Fields []erc7730FieldJSON `json:"fields"`
+		} `json:"formats"`
+	} `json:"display"`
+}
+
+// erc7730FieldJSON is a displayed field of a format, possibly grouping nested ones.
+type erc7730FieldJSON struct {
+	Path   string `json:"path"`
+	Label  string `json:"label"`
+	Format string `json:"format"`
+	Params struct {
+		Token     string `json:"token"`
+		TokenPath string `json:"tokenPath"`
+	} `json:"params"`
+	Fields []erc7730FieldJSON `json:"fields"`
+}
+
+// LoadERC7730 parses an ERC-7730 contract descriptor, extracting the deployments
+// of the contract and the selectors and display hints of its methods. Formats may
+// be keyed by human readable method signatures (with or without parameter names)
+// or by 0x prefixed selectors. Descriptors of EIP-712 messages, and included
+// descriptors (which must be merged by the caller) are not supported.
+func LoadERC7730(descriptor []byte) (*ERC7730Descriptor, error) {
+	var raw erc7730JSON
+	if err := json.Unmarshal(descriptor, &raw); err != nil {
+		return nil, fmt.Errorf("erc7730: %w", err)
+	}
+	if raw.Context.Contract == nil {
+		return nil, errors.New("erc7730: not a contract descriptor")
+	}
+	desc := &ERC7730Descriptor{
+		Owner:   raw.Metadata.Owner,
+		Formats: make(map[[4]byte]ERC7730Format, len(raw.Display.Formats)),
+	}
+	for _, deployment := range raw.Context.Contract.Deployments {
+		desc.Deployments = append(desc.Deployments, ERC7730Deployment{ChainID: deployment.ChainID, Address: deployment.Address})
+	}
+	if token := raw.Metadata.Token; token != nil {
+		desc.Token = &ERC7730Token{Name: token.Name, Ticker: token.Ticker, Decimals: token.Decimals}
+	}
+	for key, format := range raw.Display.Formats {
+		var (
+			selector [4]byte
+			parsed   ERC7730Format
+			err      error
+		)
+		if strings.HasPrefix(key, "0x") {
+			blob, err := hexutil.Decode(key)
+			if err != nil || len(blob) != 4 {
+				return nil, fmt.Errorf("erc7730: invalid selector %q", key)
+			}
+			copy(selector[:], blob)
+		} else {
+			signature, params, err := erc7730Signature(key)
+			if err != nil {
+				return nil, fmt.Errorf("erc7730: invalid method %q: %w", key, err)
+			}
+			copy(selector[:], crypto.Keccak256([]byte(signature)))
+			parsed.Signature, parsed.params = signature, params
+		}
+		if _, ok := desc.Formats[selector]; ok {
+			return nil, fmt.Errorf("erc7730: duplicate format for selector %x", selector)
+		}
+		// Intents are either a plain string or a label to value map, keep the former
+		var intent string
+		if json.Unmarshal(format.Intent, &intent) == nil {
+			parsed.Intent = intent
+		}
+		if parsed.Fields, err = erc7730Fields(format.Fields, nil); err != nil {
+			return nil, fmt.Errorf("erc7730: invalid format %q: %w", key, err)
+		}
+		desc.Formats[selector] = parsed
+	}
+	return desc, nil
+}
+
+// erc7730Fields flattens the possibly nested displayed fields of a format.
+func erc7730Fields(fields []erc7730FieldJSON, flat []ERC7730Field) ([]ERC7730Field, error) {
+	for _, field := range fields {
+		if field.Path != "" && field.Label != "" {
+			parsed := ERC7730Field{Path: field.Path, Label: field.Label, Format: field.Format}
+			if field.Format == "tokenAmount" {
+				if token := field.Params.Token; token != "" {
+					if !common.IsHexAddress(token) {
+						return nil, fmt.Errorf("invalid token %q of %s", token, field.Path)
+					}
+					parsed.Token = common.HexToAddress(token)
+				}
+				parsed.TokenPath = field.Params.TokenPath
+			}
+			flat = append(flat, parsed)
+		}
+		var err error
+		if flat, err = erc7730Fields(field.Fields, flat); err != nil {
+			return nil, err
+		}
+	}
+	return flat, nil
+}
+
+// Match returns the display format of a transaction calling a described method of
+// the contract on one of its deployments, if any.
+func (d *ERC7730Descriptor) Match(chainID uint64, to common.Address, data []byte) (ERC7730Format, bool) {
+	if len(data) < 4 {
+		return ERC7730Format{}, false
+	}
+	for _, deployment := range d.Deployments {
+		if deployment.ChainID == chainID && deployment.Address == to {
+			format, ok := d.Formats[[4]byte(data[:4])]
+			return format, ok
+		}
+	}
+	return ERC7730Format{}, false
+}
+
+// Tokens returns the tokens whose amounts are displayed for a transaction calling a
+// described method of the contract on one of its deployments. Besides constant
+// ones, tokens can only be read from the called contract (@.to) and from top level
+// address parameters which aren't preceded by static tuples or arrays.
+func (d *ERC7730Descriptor) Tokens(chainID uint64, to common.Address, data []byte) []common.Address {
+	format, ok := d.Match(chainID, to, data)
+	if !ok {
+		return nil
+	}
+	var tokens []common.Address
+	for _, field := range format.Fields {
+		if field.Format != "tokenAmount" {
+			continue
+		}
+		switch {
+		case field.Token != (common.Address{}):
+			tokens = append(tokens, field.Token)
+		case field.TokenPath == "@.to":
+			tokens = append(tokens, to)
+		case field.TokenPath != "":
+			if token, ok := format.address(data[4:], field.TokenPath); ok {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+// address reads the top level address parameter at the given path from the ABI
+// encoded arguments of a call.
+func (f ERC7730Format) address(args []byte, path string) (common.Address, bool) {
+	name := strings.TrimPrefix(path, "#.")
+
+	var offset int
+	for _, param := range f.params {
+		if param.name == name {
+			if param.kind != "address" || len(args) < offset+32 {
+				return common.Address{}, false
+			}
+			return common.BytesToAddress(args[offset : offset+32]), true
+		}
+		// Static tuples and arrays are encoded in place, so their size depends on
+		// their components: only skip parameters with a single word head
+		if !strings.HasSuffix(param.kind, "[]") && strings.ContainsAny(param.kind, "([") {
+			return common.Address{}, false
+		}
+		offset += 32
+	}
+	return common.Address{}, false
+}
+
+// erc7730Signature canonicalizes a human readable method signature (e.g.
+// "transfer(address to, uint256 amount)") into the form hashed into its selector
+// (e.g. "transfer(address,uint256)"), dropping parameter names and expanding the
+// int and uint aliases. The names and canonical types of the parameters are also
+// returned.
+func erc7730Signature(method string) (string, []erc7730Param, error) {
+	open := strings.IndexByte(method, '(')
+	if open <= 0 {
+		return "", nil, errors.New("missing parameter list")
+	}
+	name := strings.TrimSpace(method[:open])
+	list, params, rest, err := erc7730Params(method[open:])
+	if err != nil {
+		return "", nil, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return "", nil, fmt.Errorf("trailing characters %q", rest)
+	}
+	return name + list, params, nil
+}
+
+// erc7730Params canonicalizes the parenthesized parameter list at the start of the
+// input, returning it and its parameters along with the remaining input.
+func erc7730Params(input string) (string, []erc7730Param, string, error) {
+	if !strings.HasPrefix(input, "(") {
+		return "", nil, "", errors.New("missing parameter list")
+	}
+	var (
+		out    bytes.Buffer
+		param  strings.Builder
+		params []erc7730Param
+		rest   = input[1:]
+	)
+	out.WriteByte('(')
+	flush := func() error {
+		fields := strings.Fields(param.String())
+		param.Reset()
+		if len(fields) == 0 {
+			return errors.New("empty parameter")
+		}
+		kind := fields[0]
+		for _, alias := range []string{"int", "uint"} {
+			if kind == alias || strings.HasPrefix(kind, alias+"[") {
+				kind = alias + "256" + kind[len(alias):]
+			}
+		}
+		out.WriteString(kind)
+
+		// Data locations may precede the name (e.g. bytes calldata data)
+		var name string
+		if len(fields) > 1 {
+			name = fields[len(fields)-1]
+		}
+		params = append(params, erc7730Param{name: name, kind: kind})
+		return nil
+	}
+	for len(rest) > 0 {
+		switch c := rest[0]; c {
+		case '(':
+			// Tuple parameter, canonicalize its components as a nested list
+			if strings.TrimSpace(param.String()) != "" {
+				return "", nil, "", fmt.Errorf("unexpected tuple after %q", param.String())
+			}
+			tuple, _, remaining, err := erc7730Params(rest)
+			if err != nil {
+				return "", nil, "", err
+			}
+			param.WriteString(tuple)
+			rest = remaining
+			continue
+		case ',':
+			if err := flush(); err != nil {
+				return "", nil, "", err
+			}
+			out.WriteByte(',')
+		case ')':
+			if out.Len() > 1 || strings.TrimSpace(param.String()) != "" {
+				if err := flush(); err != nil {
+					return "", nil, "", err
+				}
+			}
+			out.WriteByte(')')
+			return out.String(), params, rest[1:], nil
+		default:
+			param.WriteByte(c)
+		}
+		rest = rest[1:]
+	}
+	return "", nil, "", errors.New("unterminated parameter list")
+}
@@ -0,0 +1,169 @@
+package usbwallet
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// erc7730TestDescriptor is a trimmed down ERC-7730 descriptor of an ERC-20 token
+// with a batched method taking a tuple array.
+const erc7730TestDescriptor = `{
+	"$schema": "https://eips.ethereum.org/assets/eip-7730/erc7730-v1.schema.json",
+	"context": {
+		"$id": "Test token",
+		"contract": {
+			"deployments": [
+				{"chainId": 1, "address": "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48"},
+				{"chainId": 10, "address": "0x0b2C639c533813f4Aa9D7837CAf62653d097Ff85"}
+			]
+		}
+	},
+	"metadata": {
+		"owner": "Circle",
+		"token": {"name": "USD Coin", "ticker": "USDC", "decimals": 6}
+	},
+	"display": {
+		"formats": {
+			"transfer(address to, uint256 value)": {
+				"intent": "Send",
+				"fields": [
+					{"path": "to", "label": "To", "format": "addressName"},
+					{"path": "value", "label": "Amount", "format": "tokenAmount", "params": {"tokenPath": "@.to"}}
+				]
+			},
+			"0x095ea7b3": {
+				"intent": {"Approve": "spending"},
+				"fields": [{"path": "spender", "label": "Spender", "format": "addressName"}]
+			},
+			"batch((address to, uint amount)[] legs, uint256 deadline)": {
+				"intent": "Batch send",
+				"fields": [
+					{"path": "legs", "fields": [{"path": "legs.[].amount", "label": "Amount", "format": "tokenAmount"}]},
+					{"path": "deadline", "label": "Deadline", "format": "date"}
+				]
+			},
+			"swap(bytes calldata route, address tokenIn, uint256 amountIn, address tokenOut, uint256 minOut)": {
+				"intent": "Swap",
+				"fields": [
+					{"path": "amountIn", "label": "Send", "format": "tokenAmount", "params": {"tokenPath": "tokenIn"}},
+					{"path": "minOut", "label": "Receive", "format": "tokenAmount", "params": {"tokenPath": "#.tokenOut"}},
+					{"path": "amountIn", "label": "Fee", "format": "tokenAmount", "params": {"token": "0x4200000000000000000000000000000000000006"}}
+				]
+			}
+		}
+	}
+}`
+
+// Tests that ERC-7730 descriptors are parsed into the selectors and display hints
+// of the described methods, matched against contract calls.
+func TestLoadERC7730(t *testing.T) {
+	desc, err := LoadERC7730([]byte(erc7730TestDescriptor))
+	if err != nil {
+		t.Fatalf("failed to load descriptor: %v", err)
+	}
+	if desc.Owner != "Circle" || desc.Token == nil || *desc.Token != (ERC7730Token{Name: "USD Coin", Ticker: "USDC", Decimals: 6}) {
+		t.Errorf("metadata mismatch: have %q %+v", desc.Owner, desc.Token)
+	}
+	if len(desc.Deployments) != 2 || desc.Deployments[1].ChainID != 10 {
+		t.Errorf("deployments mismatch: have %+v", desc.Deployments)
+	}
+	tests := []struct {
+		selector string
+		want     ERC7730Format
+	}{
+		{"a9059cbb", ERC7730Format{
+			Signature: "transfer(address,uint256)",
+			Intent:    "Send",
+			Fields: []ERC7730Field{
+				{Path: "to", Label: "To", Format: "addressName"},
+				{Path: "value", Label: "Amount", Format: "tokenAmount", TokenPath: "@.to"},
+			},
+			params: []erc7730Param{{"to", "address"}, {"value", "uint256"}},
+		}},
+		{"095ea7b3", ERC7730Format{
+			Fields: []ERC7730Field{{Path: "spender", Label: "Spender", Format: "addressName"}},
+		}},
+		{common.Bytes2Hex(crypto.Keccak256([]byte("batch((address,uint256)[],uint256)"))[:4]), ERC7730Format{
+			Signature: "batch((address,uint256)[],uint256)",
+			Intent:    "Batch send",
+			Fields: []ERC7730Field{
+				{Path: "legs.[].amount", Label: "Amount", Format: "tokenAmount"},
+				{Path: "deadline", Label: "Deadline", Format: "date"},
+			},
+			params: []erc7730Param{{"legs", "(address,uint256)[]"}, {"deadline", "uint256"}},
+		}},
+	}
+	for i, tt := range tests {
+		data := common.FromHex(tt.selector + "00")
+
+		format, ok := desc.Match(10, common.HexToAddress("0x0b2C639c533813f4Aa9D7837CAf62653d097Ff85"), data)
+		if !ok {
+			t.Errorf("test %d: call of %s not matched", i, tt.selector)
+			continue
+		}
+		if !reflect.DeepEqual(format, tt.want) {
+			t.Errorf("test %d: format mismatch: have %+v, want %+v", i, format, tt.want)
+		}
+		if _, ok := desc.Match(5, common.HexToAddress("0x0b2C639c533813f4Aa9D7837CAf62653d097Ff85"), data); ok {
+			t.Errorf("test %d: call on another chain matched", i)
+		}
+	}
+	if _, ok := desc.Match(1, common.HexToAddress("0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48"), common.FromHex("0x23b872dd")); ok {
+		t.Errorf("undescribed method matched")
+	}
+}
+
+// Tests that the tokens whose amounts a described call displays are read from the
+// descriptor and the call data.
+func TestERC7730Tokens(t *testing.T) {
+	desc, err := LoadERC7730([]byte(erc7730TestDescriptor))
+	if err != nil {
+		t.Fatalf("failed to load descriptor: %v", err)
+	}
+	var (
+		contract = common.HexToAddress("0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48")
+		tokenIn  = common.HexToAddress("0x1111111111111111111111111111111111111111")
+		tokenOut = common.HexToAddress("0x2222222222222222222222222222222222222222")
+		weth     = common.HexToAddress("0x4200000000000000000000000000000000000006")
+		word     = func(b []byte) string { return common.Bytes2Hex(common.LeftPadBytes(b, 32)) }
+		swap     = common.Bytes2Hex(crypto.Keccak256([]byte("swap(bytes,address,uint256,address,uint256)"))[:4])
+	)
+	tests := []struct {
+		chainID uint64
+		data    string
+		want    []common.Address
+	}{
+		{1, "a9059cbb" + word(tokenIn.Bytes()) + word([]byte{1}), []common.Address{contract}},
+		{5, "a9059cbb" + word(tokenIn.Bytes()) + word([]byte{1}), nil},
+		{1, "095ea7b3", nil},
+		{1, swap + word([]byte{0xa0}) + word(tokenIn.Bytes()) + word([]byte{1}) + word(tokenOut.Bytes()) + word([]byte{2}), []common.Address{tokenIn, tokenOut, weth}},
+		{1, swap + word([]byte{0xa0}) + word(tokenIn.Bytes()), []common.Address{tokenIn, weth}},
+	}
+	for i, tt := range tests {
+		if have := desc.Tokens(tt.chainID, contract, common.FromHex(tt.data)); !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("test %d: tokens mismatch: have %x, want %x", i, have, tt.want)
+		}
+	}
+}
+
+// Tests that malformed ERC-7730 descriptors are rejected.
+func TestLoadERC7730Invalid(t *testing.T) {
+	tests := []string{
+		`{`,
+		`{"context": {"eip712": {}}, "display": {"formats": {}}}`,
+		`{"context": {"contract": {}}, "display": {"formats": {"0x0102": {}}}}`,
+		`{"context": {"contract": {}}, "display": {"formats": {"transfer": {}}}}`,
+		`{"context": {"contract": {}}, "display": {"formats": {"transfer(address,": {}}}}`,
+		`{"context": {"contract": {}}, "display": {"formats": {"transfer(address,,uint256)": {}}}}`,
+		`{"context": {"contract": {}}, "display": {"formats": {"transfer(address to,uint256 value)": {}, "0xa9059cbb": {}}}}`,
+		`{"context": {"contract": {}}, "display": {"formats": {"0xa9059cbb": {"fields": [{"path": "value", "label": "Amount", "format": "tokenAmount", "params": {"token": "0x01"}}]}}}}`,
+	}
+	for i, tt := range tests {
+		if _, err := LoadERC7730([]byte(tt)); err == nil {
+			t.Errorf("test %d: invalid descriptor accepted", i)
+		}
+	}
+}
@@ -17,8 +17,13 @@
 package usbwallet
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math/big"
 	"runtime"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -35,30 +40,265 @@ const LedgerScheme = "ledger"
 // TrezorScheme is the protocol scheme prefixing account and wallet URLs.
 const TrezorScheme = "trezor"
 
+// KeepKeyScheme is the protocol scheme prefixing account and wallet URLs.
+const KeepKeyScheme = "keepkey"
+
 // refreshCycle is the maximum time between wallet refreshes (if USB hotplug
 // notifications don't work).
 const refreshCycle = time.Second
 
+// hotplugRefreshCycle is the maximum time between wallet refreshes if USB hotplug
+// notifications work. Refreshes are still done periodically in case a
+// notification is missed (e.g. while a confirmation was pending).
+const hotplugRefreshCycle = 10 * time.Second
+
+// enumerateTimeout is the maximum time to wait for the USB devices to be listed,
+// after which the refresh is abandoned (e.g. a flaky device being mid-reset).
+const enumerateTimeout = 5 * time.Second
+
 // refreshThrottling is the minimum time between wallet refreshes to avoid USB
 // trashing.
 const refreshThrottling = 500 * time.Millisecond
 
+// USB backend used for device discovery and access, replaceable to test the hub
+// and the wallets without any physical devices attached.
+var (
+	usbSupported = usb.Supported
+	usbEnumerate = usb.EnumerateContext
+	usbHotplug   = usb.Hotplug
+	usbIsRaw     = usb.DeviceInfo.Raw
+	usbOpen      = usb.DeviceInfo.OpenContext
+	usbRetain    = usb.Retain
+	usbRelease   = usb.Release
+)
+
+// Option configures optional behaviour of the hardware wallets managed by a Hub.
+type Option func(*config)
+
+// config contains the optional settings of the hub and the vendor specific drivers.
+type config struct {
+	serials      map[string]bool      // USB serial numbers of the devices to track (nil = all)
+	passphrase   PassphraseFunc       // Host side prompt for the Trezor passphrase
+	pin          PinFunc              // Host side prompt for the Trezor PIN matrix
+	button       ButtonFunc           // Host side notification of Trezor confirmation requests
+	hideHash     bool                 // Whether Trezors sign typed data without showing the message hash
+	tokens       []LedgerTokenInfo    // ERC-20 token descriptors to provide to Ledgers
+	nfts         []LedgerNFTInfo      // NFT collection descriptors to provide to Ledgers
+	plugins      []LedgerPluginInfo   // Contract method plugin descriptors to provide to Ledgers
+	erc7730      []*ERC7730Descriptor // Clear signing descriptors selecting the tokens to provide to Ledgers
+	hashFallback bool                 // Whether Ledgers may blind sign too complex typed data by hash
+	skipDescs    bool                 // Whether Ledgers sign transactions without providing descriptors
+	maxMessage   uint64               // Maximum length of personal messages Ledgers sign (0 = default)
+	retry        RetryPolicy          // Policy for retrying transient USB transport failures
+	traffic      log.Logger           // Logger for the device traffic, nil if disabled
+	metrics      SignMetrics          // Hooks invoked around signing operations, nil if disabled
+	noEIP155     bool                 // Whether legacy transactions are signed without replay protection
+	chainID      *big.Int             // Chain ID typed data domains must be bound to, nil if unchecked
+	scheme       DerivationScheme     // Account layout scanned without a base path (nil = BIP44Scheme)
+	timeouts     Timeouts             // Limits on the duration of device operations
+	verifySigner bool                 // Whether signatures are checked against a fresh derivation
+	stableURLs   bool                 // Whether wallet URLs identify devices by serial instead of USB path
+}
+
+// RetryPolicy configures how data exchanges failing due to transient USB transport
+// errors (e.g. a stalled pipe or a short read) are retried. Errors reported by the
+// device itself are never retried, neither are exchanges whose request (or part
+// of it) was already sent, as the device might act on it and prompt the user twice.
+type RetryPolicy struct {
+	Attempts int           // Total number of attempts, including the first one
+	Backoff  time.Duration // Delay before the first retry, doubled after each one
+}
+
+// defaultRetryPolicy is the retry policy used if none is configured.
+var defaultRetryPolicy = RetryPolicy{Attempts: 3, Backoff: 50 * time.Millisecond}
+
+// delay returns the time to wait before the given retry attempt (1 based).
+func (p RetryPolicy) delay(retry int) time.Duration {
+	return p.Backoff << (retry - 1)
+}
+
+// Timeouts limits how long device operations may take, separately for the ones
+// prompting the user for confirmation (signing, displaying an address for review),
+// which may legitimately wait for minutes, and the background ones (deriving
+// addresses, providing metadata), which should answer promptly. A zero duration
+// means no timeout, which is the default for both.
+//
+// Expired operations fail with context.DeadlineExceeded. On Ledgers, a prompt left
+// on screen is dismissed by the user before the device is usable again; Trezors
+// are sent a cancel request.
+type Timeouts struct {
+	Interactive time.Duration // Limit on operations waiting for user confirmation
+	Background  time.Duration // Limit on operations not involving the user
+}
+
+// timeout returns the limit on an operation depending on whether it prompts the
+// user, zero if unlimited.
+func (t Timeouts) timeout(interactive bool) time.Duration {
+	if interactive {
+		return t.Interactive
+	}
+	return t.Background
+}
+
+// WithSerials restricts the hub to the devices with the given USB serial numbers,
+// allowing a specific device to be targeted among several identical ones. Devices
+// not reporting a serial number are never matched.
+func WithSerials(serials ...string) Option {
+	return func(c *config) {
+		c.serials = make(map[string]bool, len(serials))
+		for _, serial := range serials {
+			c.serials[serial] = true
+		}
+	}
+}
+
+// WithRetryPolicy sets how exchanges failing due to transient USB transport errors
+// are retried, reopening the device before each retry. An Attempts count of 1 or
+// less disables retries.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *config) {
+		c.retry = policy
+	}
+}
+
+// WithTrafficLogger logs every data exchange with the devices at debug level on
+// the given logger, to aid debugging device issues in the field. Only metadata is
+// logged (Ledger APDU headers and status words, Trezor message types and payload
+// lengths), never the exchanged data itself.
+func WithTrafficLogger(logger log.Logger) Option {
+	return func(c *config) {
+		c.traffic = logger
+	}
+}
+
+// WithSignMetrics invokes the given hooks around every signing operation of the
+// wallets, allowing latencies and error rates to be tracked without this package
+// depending on any metrics library.
+func WithSignMetrics(metrics SignMetrics) Option {
+	return func(c *config) {
+		c.metrics = metrics
+	}
+}
+
+// LegacyNoEIP155 signs legacy transactions without EIP-155 replay protection, with
+// a 27/28 V value lacking the chain ID term, for private chains predating it. The
+// chain ID passed to SignTx is ignored for legacy transactions; typed ones always
+// carry their chain ID. Without the option, only a nil or zero chain ID does so.
+func LegacyNoEIP155() Option {
+	return func(c *config) {
+		c.noEIP155 = true
+	}
+}
+
+// ExpectChainID rejects signing EIP-712 typed data whose domain is bound to another
+// chain than the given one, or to none at all, with ErrChainIDMismatch before
+// anything is sent to the device. As their domain can't be checked, pre-hashed
+// typed data passed to SignData is rejected too. A nil chain ID leaves the domains
+// unchecked.
+func ExpectChainID(chainID *big.Int) Option {
+	return func(c *config) {
+		if chainID == nil {
+			c.chainID = nil
+			return
+		}
+		c.chainID = new(big.Int).Set(chainID)
+	}
+}
+
+// WithDerivationScheme sets the layout of the accounts scanned by ScanAccounts when
+// no base path is given, such as LedgerLiveScheme or a TemplateScheme. Without the
+// option, BIP44Scheme (m/44'/60'/0'/0/x) is used. Scans from an explicit base path
+// always increment its last component.
+func WithDerivationScheme(scheme DerivationScheme) Option {
+	return func(c *config) {
+		c.scheme = scheme
+	}
+}
+
+// WithTimeouts limits the duration of device operations, picking the interactive
+// or background limit depending on whether the operation prompts the user. The
+// limits apply on top of any deadline of the contexts passed to the wallets.
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(c *config) {
+		c.timeouts = timeouts
+	}
+}
+
+// VerifySigner checks every signature produced by SignTx, SignText, SignData and
+// the typed data signing methods by recovering its signer and comparing it to the address
+// derived again for the account's path, failing with ErrSignerMismatch if they
+// differ. It guards against device or firmware bugs signing with the wrong key,
+// at the cost of an extra derivation round-trip per signature.
+func VerifySigner() Option {
+	return func(c *config) {
+		c.verifySigner = true
+	}
+}
+
+// WithStableURLs identifies the wallets in their URLs by the USB serial number of
+// their device (e.g. trezor://serial:8A3F0C21D95E7B40) instead of the platform
+// specific USB path, which changes as the device is reconnected or plugged into
+// another port.
+// The same device thus maps to the same wallet (and account) URLs across
+// reconnects.
+//
+// Devices not reporting a serial number, reporting one constant across all the
+// devices of their vendor (as Ledgers do), or sharing it with another attached
+// device of the hub, cannot be told apart before being opened and keep path based
+// URLs. Wallet.StableID falls back to
+// the fingerprint of the seed for them.
+func WithStableURLs() Option {
+	return func(c *config) {
+		c.stableURLs = true
+	}
+}
+
+// driverFactory constructs the vendor specific driver handling a discovered USB
+// device.
+type driverFactory func(logger log.Logger, config *config) driver
+
+// schemeDriver returns the factory of the driver speaking the vendor protocol of
+// the given wallet scheme.
+func schemeDriver(scheme string) (driverFactory, error) {
+	switch scheme {
+	case LedgerScheme:
+		return newLedgerDriver, nil
+	case TrezorScheme, KeepKeyScheme:
+		return newTrezorDriver, nil
+	default:
+		return nil, fmt.Errorf("unsupported wallet scheme %q", scheme)
+	}
+}
+
+// hubProducts is a set of USB products discovered by a hub, along with the driver
+// handling them.
+type hubProducts struct {
+	vendorID   uint16        // USB vendor identifier used for device discovery
+	productIDs []uint16      // USB product identifiers used for device discovery
+	makeDriver driverFactory // Factory method to construct a vendor specific driver
+}
+
 // Hub is a accounts.Backend that can find and handle generic USB hardware wallets.
 type Hub struct {
-	scheme     string                  // Protocol scheme prefixing account and wallet URLs.
-	vendorID   uint16                  // USB vendor identifier used for device discovery
-	productIDs []uint16                // USB product identifiers used for device discovery
-	usageID    uint16                  // USB usage page identifier used for macOS device discovery
-	endpointID int                     // USB endpoint identifier used for non-macOS device discovery
-	makeDriver func(log.Logger) driver // Factory method to construct a vendor specific driver
+	scheme     string        // Protocol scheme prefixing account and wallet URLs.
+	products   []hubProducts // USB products used for device discovery, built-in ones first
+	usageID    uint16        // USB usage page identifier used for macOS device discovery
+	endpointID int           // USB endpoint identifier used for non-macOS device discovery
+	config     *config       // User supplied settings passed to the drivers
 
 	refreshed   time.Time               // Time instance when the list of wallets was last refreshed
+	refreshing  chan struct{}           // Channel closed when the running refresh finishes (nil if idle)
+	interval    time.Duration           // Time between periodic refreshes (0 = default cycle)
+	reschedule  chan struct{}           // Channel to notify the updater of an interval change
+	unsubscribe chan struct{}           // Channel to notify the updater of a subscriber leaving
 	wallets     []Wallet                // List of USB wallet devices currently tracking
 	updateFeed  event.Feed              // Event feed to notify wallet additions/removals
 	updateScope event.SubscriptionScope // Subscription scope tracking current live listeners
 	updating    bool                    // Whether the event notification loop is running
 
-	quit chan chan error
+	quit     chan struct{}  // Channel closed to stop the event notification loop
+	updaters sync.WaitGroup // Running event notification loops, waited for on close
+	closed   bool           // Whether the hub was closed, releasing all the devices
 
 	stateLock sync.RWMutex // Protects the internals of the hub from racey access
 
@@ -69,7 +309,7 @@ type Hub struct {
 }
 
 // NewLedgerHub creates a new hardware wallet manager for Ledger devices.
-func NewLedgerHub() (*Hub, error) {
+func NewLedgerHub(opts ...Option) (*Hub, error) {
 	return newHub(LedgerScheme, 0x2c97, []uint16{
 
 		// Device definitions taken from
@@ -80,42 +320,58 @@ func NewLedgerHub() (*Hub, error) {
 		0x0001, /* Ledger Nano S */
 		0x0004, /* Ledger Nano X */
 		0x0005, /* Ledger Nano S Plus */
-		0x0006, /* Ledger Nano FTS */
+		0x0006, /* Ledger Stax (formerly Nano FTS) */
 		0x0007, /* Ledger Flex */
 
 		0x0000, /* WebUSB Ledger Blue */
 		0x1000, /* WebUSB Ledger Nano S */
 		0x4000, /* WebUSB Ledger Nano X */
 		0x5000, /* WebUSB Ledger Nano S Plus */
-		0x6000, /* WebUSB Ledger Nano FTS */
+		0x6000, /* WebUSB Ledger Stax (formerly Nano FTS) */
 		0x7000, /* WebUSB Ledger Flex */
-	}, 0xffa0, 0, newLedgerDriver)
+	}, 0xffa0, 0, newLedgerDriver, opts)
 }
 
 // NewTrezorHubWithHID creates a new hardware wallet manager for Trezor devices.
-func NewTrezorHubWithHID() (*Hub, error) {
-	return newHub(TrezorScheme, 0x534c, []uint16{0x0001 /* Trezor HID */}, 0xff00, 0, newTrezorDriver)
+func NewTrezorHubWithHID(opts ...Option) (*Hub, error) {
+	return newHub(TrezorScheme, 0x534c, []uint16{0x0001 /* Trezor HID */}, 0xff00, 0, newTrezorDriver, opts)
 }
 
 // NewTrezorHubWithWebUSB creates a new hardware wallet manager for Trezor devices with
-// firmware version > 1.8.0
-func NewTrezorHubWithWebUSB() (*Hub, error) {
-	return newHub(TrezorScheme, 0x1209, []uint16{0x53c1 /* Trezor WebUSB */}, 0xffff /* No usage id on webusb, don't match unset (0) */, 0, newTrezorDriver)
+// firmware version > 1.8.0, along with OneKey devices which are Trezor forks. The
+// Trezor Model T, Safe 3 and Safe 5 all share the same WebUSB product ID and are
+// told apart by the model reported in their features.
+func NewTrezorHubWithWebUSB(opts ...Option) (*Hub, error) {
+	return newHub(TrezorScheme, 0x1209, []uint16{0x53c1 /* Trezor WebUSB */, 0x4f4a /* OneKey Classic/Mini WebUSB */}, 0xffff /* No usage id on webusb, don't match unset (0) */, 0, newTrezorDriver, opts)
+}
+
+// NewKeepKeyHub creates a new hardware wallet manager for KeepKey devices. The
+// KeepKey speaks the Trezor protocol (with the same 64 byte report framing), so
+// it is handled by the Trezor driver.
+func NewKeepKeyHub(opts ...Option) (*Hub, error) {
+	return newHub(KeepKeyScheme, 0x2b24, []uint16{0x0001 /* KeepKey HID */, 0x0002 /* KeepKey WebUSB */}, 0xff00, 0, newTrezorDriver, opts)
 }
 
 // newHub creates a new hardware wallet manager for generic USB devices.
-func newHub(scheme string, vendorID uint16, productIDs []uint16, usageID uint16, endpointID int, makeDriver func(log.Logger) driver) (*Hub, error) {
-	if !usb.Supported() {
+func newHub(scheme string, vendorID uint16, productIDs []uint16, usageID uint16, endpointID int, makeDriver driverFactory, opts []Option) (*Hub, error) {
+	if !usbSupported() {
 		return nil, errors.New("unsupported platform")
 	}
+	cfg := &config{retry: defaultRetryPolicy}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	usbRetain() // Released when the hub is closed
+
 	hub := &Hub{
-		scheme:     scheme,
-		vendorID:   vendorID,
-		productIDs: productIDs,
-		usageID:    usageID,
-		endpointID: endpointID,
-		makeDriver: makeDriver,
-		quit:       make(chan chan error),
+		scheme:      scheme,
+		products:    []hubProducts{{vendorID: vendorID, productIDs: productIDs, makeDriver: makeDriver}},
+		usageID:     usageID,
+		endpointID:  endpointID,
+		config:      cfg,
+		quit:        make(chan struct{}),
+		reschedule:  make(chan struct{}, 1),
+		unsubscribe: make(chan struct{}, 1),
 	}
 	hub.refreshWallets()
 	return hub, nil
@@ -135,76 +391,217 @@ func (hub *Hub) Wallets() []Wallet {
 	return cpy
 }
 
-// refreshWallets scans the USB devices attached to the machine and updates the
-// list of wallets based on the found devices.
-func (hub *Hub) refreshWallets() {
-	// Don't scan the USB like crazy it the user fetches wallets in a loop
+// Refresh forces an immediate scan of the USB devices, bypassing the refresh
+// throttling, and returns all the wallets tracked afterwards. If a scan is already
+// running, it waits for that one to finish instead of enumerating again.
+func (hub *Hub) Refresh() []Wallet {
+	hub.refresh(true)
+
 	hub.stateLock.RLock()
-	elapsed := time.Since(hub.refreshed)
+	defer hub.stateLock.RUnlock()
+
+	cpy := make([]Wallet, len(hub.wallets))
+	copy(cpy, hub.wallets)
+	return cpy
+}
+
+// SetRefreshInterval sets the time between the periodic scans of the USB devices
+// run while there are subscribers, taking effect immediately. Intervals shorter
+// than the refresh throttling (500ms) are raised to it; zero or a negative one
+// restores the default (1s, or 10s if USB hotplug notifications are available).
+func (hub *Hub) SetRefreshInterval(d time.Duration) {
+	if d > 0 && d < refreshThrottling {
+		d = refreshThrottling
+	}
+	hub.stateLock.Lock()
+	hub.interval = max(d, 0)
+	hub.stateLock.Unlock()
+
+	select {
+	case hub.reschedule <- struct{}{}:
+	default: // An interval change is already pending
+	}
+}
+
+// DeviceDescriptor describes an attached hardware wallet found by DiscoverDevices.
+type DeviceDescriptor struct {
+	URL       accounts.URL // URL of the wallet tracking the device in the hub
+	Vendor    string       // Wallet vendor (LedgerScheme, TrezorScheme or KeepKeyScheme), empty if unknown
+	Model     string       // Device model as far as the USB identifiers tell (e.g. Ledger Nano X)
+	Path      string       // Platform-specific USB device path
+	Serial    string       // USB serial number, empty if not reported
+	VendorID  uint16       // USB vendor identifier
+	ProductID uint16       // USB product identifier
+}
+
+// DiscoverDevices lists the attached devices the hub tracks, without opening any
+// of them, as opening a device may steal it from another process using it. This
+// allows presenting a device picker to the user, opening the wallet with the URL
+// of the selected one only. The list of tracked wallets is not updated.
+func (hub *Hub) DiscoverDevices() ([]DeviceDescriptor, error) {
+	hub.stateLock.RLock()
+	products := hub.products
 	hub.stateLock.RUnlock()
 
-	if elapsed < refreshThrottling {
-		return
+	groups, _, err := hub.enumerate(products)
+	if err != nil {
+		return nil, err
 	}
-	// If USB enumeration is continually failing, don't keep trying indefinitely
-	if hub.enumFails.Load() > 2 {
-		return
+	urls, _ := hub.deviceURLs(groups)
+
+	descriptors := make([]DeviceDescriptor, 0, len(groups))
+	for i, group := range groups {
+		info := group[0]
+		vendor, model := describeDevice(info)
+		descriptors = append(descriptors, DeviceDescriptor{
+			URL:       urls[i],
+			Vendor:    vendor,
+			Model:     model,
+			Path:      info.Path,
+			Serial:    info.Serial,
+			VendorID:  info.VendorID,
+			ProductID: info.ProductID,
+		})
 	}
-	// Retrieve the current list of USB wallet devices
-	var devices []usb.DeviceInfo
+	return descriptors, nil
+}
 
-	if runtime.GOOS == "linux" {
-		// hidapi on Linux opens the device during enumeration to retrieve some infos,
-		// breaking the Ledger protocol if that is waiting for user confirmation. This
-		// is a bug acknowledged at Ledger, but it won't be fixed on old devices so we
-		// need to prevent concurrent comms ourselves. The more elegant solution would
-		// be to ditch enumeration in favor of hotplug events, but that don't work yet
-		// on Windows so if we need to hack it anyway, this is more elegant for now.
-		hub.commsLock.Lock()
-		if hub.commsPend > 0 { // A confirmation is pending, don't refresh
-			hub.commsLock.Unlock()
-			return
-		}
+// vendorSerials are the USB serial numbers reported by every device of a vendor,
+// which don't tell devices apart even if only one of them is attached at a time.
+var vendorSerials = map[uint16]string{
+	0x2c97: "0001", // Ledger
+}
+
+// uniqueSerial returns the USB serial number of a device if it identifies it, or
+// empty if the device doesn't report one or reports its vendor's constant one.
+func uniqueSerial(info usb.DeviceInfo) string {
+	if serial, ok := vendorSerials[info.VendorID]; ok && info.Serial == serial {
+		return ""
 	}
-	infos, err := usb.Enumerate(hub.vendorID, 0)
-	if err != nil {
-		failcount := hub.enumFails.Add(1)
-		if runtime.GOOS == "linux" {
-			// See rationale before the enumeration why this is needed and only on Linux.
-			hub.commsLock.Unlock()
+	return info.Serial
+}
+
+// deviceURLs returns the URLs of the wallets tracking the given devices, along
+// with the serial numbers identifying each device among them (empty if it doesn't
+// report a unique one, or shares it with another device). URLs contain the serial numbers
+// if the WithStableURLs option is set, the USB paths otherwise.
+func (hub *Hub) deviceURLs(groups [][]usb.DeviceInfo) ([]accounts.URL, []string) {
+	counts := make(map[string]int)
+	for _, group := range groups {
+		counts[uniqueSerial(group[0])]++
+	}
+	var (
+		urls    = make([]accounts.URL, len(groups))
+		serials = make([]string, len(groups))
+	)
+	for i, group := range groups {
+		urls[i] = accounts.URL{Scheme: hub.scheme, Path: group[0].Path}
+		if serial := uniqueSerial(group[0]); serial != "" && counts[serial] == 1 {
+			serials[i] = serial
+			if hub.config.stableURLs {
+				urls[i].Path = "serial:" + serial
+			}
 		}
-		log.Error("Failed to enumerate USB devices", "hub", hub.scheme,
-			"vendor", hub.vendorID, "failcount", failcount, "err", err)
+	}
+	return urls, serials
+}
+
+// describeDevice derives the vendor and model of a device from its USB identifiers,
+// falling back to the product string the device reports for unknown ones.
+func describeDevice(info usb.DeviceInfo) (vendor string, model string) {
+	switch {
+	case info.VendorID == 0x2c97:
+		return LedgerScheme, ledgerModel(info.ProductID)
+	case info.VendorID == 0x534c && info.ProductID == 0x0001:
+		return TrezorScheme, "Trezor Model One"
+	case info.VendorID == 0x1209 && info.ProductID == 0x53c1:
+		return TrezorScheme, "Trezor" // Model T, Safe 3 and Safe 5 share the product ID
+	case info.VendorID == 0x1209 && info.ProductID == 0x4f4a:
+		return TrezorScheme, "OneKey"
+	case info.VendorID == 0x2b24:
+		return KeepKeyScheme, "KeepKey"
+	default:
+		return "", info.Product
+	}
+}
+
+// refreshWallets scans the USB devices attached to the machine and updates the
+// list of wallets based on the found devices.
+func (hub *Hub) refreshWallets() {
+	hub.refresh(false)
+}
+
+// refresh scans the USB devices attached to the machine and updates the list of
+// wallets, firing the wallet events. Unless forced, scans are throttled to avoid
+// USB trashing. Overlapping scans are coalesced: if one is already running, the
+// call waits for it to finish instead of enumerating again.
+func (hub *Hub) refresh(force bool) {
+	hub.stateLock.Lock()
+	if running := hub.refreshing; running != nil {
+		hub.stateLock.Unlock()
+		<-running
 		return
 	}
-	hub.enumFails.Store(0)
+	// Don't scan the USB like crazy it the user fetches wallets in a loop
+	if hub.closed || (!force && time.Since(hub.refreshed) < refreshThrottling) {
+		hub.stateLock.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	hub.refreshing = done
+	products := hub.products
+	hub.stateLock.Unlock()
 
-	for _, info := range infos {
-		for _, id := range hub.productIDs {
-			// We check both the raw ProductID (legacy) and just the upper byte, as Ledger
-			// uses `MMII`, encoding a model (MM) and an interface bitfield (II)
-			mmOnly := info.ProductID & 0xff00
-			// Windows and Macos use UsageID matching, Linux uses Interface matching
-			if (info.ProductID == id || mmOnly == id) && (info.UsagePage == hub.usageID || info.Interface == hub.endpointID) {
-				devices = append(devices, info)
-				break
-			}
-		}
+	events := hub.rescan(products)
+
+	hub.stateLock.Lock()
+	hub.refreshing = nil
+	hub.stateLock.Unlock()
+	close(done)
+
+	// Fire all wallet events and return
+	for _, event := range events {
+		hub.updateFeed.Send(event)
 	}
-	if runtime.GOOS == "linux" {
-		// See rationale before the enumeration why this is needed and only on Linux.
-		hub.commsLock.Unlock()
+}
+
+// rescan enumerates the USB devices of the given products and updates the list of
+// wallets based on the found devices, returning the wallet events to fire.
+func (hub *Hub) rescan(products []hubProducts) []accounts.WalletEvent {
+	// If USB enumeration is continually failing, don't keep trying indefinitely
+	if hub.enumFails.Load() > 2 {
+		return nil
+	}
+	groups, drivers, err := hub.enumerate(products)
+	if err != nil {
+		return nil
 	}
+
 	// Transform the current list of wallets into the new one
 	hub.stateLock.Lock()
 
+	if hub.closed { // Closed during enumeration, don't track anything anymore
+		hub.stateLock.Unlock()
+		return nil
+	}
+
 	var (
-		wallets = make([]Wallet, 0, len(devices))
+		wallets = make([]Wallet, 0, len(groups))
 		events  []accounts.WalletEvent
-	)
 
-	for _, device := range devices {
-		url := accounts.URL{Scheme: hub.scheme, Path: device.Path}
+		urls, serials = hub.deviceURLs(groups)
+		order         = make([]int, len(groups))
+	)
+	// Devices are enumerated in USB path order, but the wallets are tracked in
+	// URL order, which differs if identified by serial
+	for i := range order {
+		order[i] = i
+	}
+	if hub.config.stableURLs {
+		slices.SortStableFunc(order, func(a, b int) int { return urls[a].Cmp(urls[b]) })
+	}
+	for _, i := range order {
+		group, device, url := groups[i], groups[i][0], urls[i]
 
 		// Drop wallets in front of the next device or those that failed for some reason
 		for len(hub.wallets) > 0 {
@@ -217,10 +614,19 @@ func (hub *Hub) refreshWallets() {
 			events = append(events, accounts.WalletEvent{Wallet: hub.wallets[0], Kind: accounts.WalletDropped})
 			hub.wallets = hub.wallets[1:]
 		}
+		// If the device was reconnected on another USB path, an open wallet follows
+		// it by reopening the device by serial, but a closed one would try to open
+		// the stale path, so replace that
+		if len(hub.wallets) > 0 && hub.wallets[0].URL().Cmp(url) == 0 {
+			if w, ok := hub.wallets[0].(*wallet); ok && w.info.Path != device.Path && !w.opened() {
+				events = append(events, accounts.WalletEvent{Wallet: hub.wallets[0], Kind: accounts.WalletDropped})
+				hub.wallets = hub.wallets[1:]
+			}
+		}
 		// If there are no more wallets or the device is before the next, wrap new wallet
 		if len(hub.wallets) == 0 || hub.wallets[0].URL().Cmp(url) > 0 {
 			logger := log.New("url", url)
-			wallet := &wallet{hub: hub, driver: hub.makeDriver(logger), url: &url, info: device, log: logger}
+			wallet := &wallet{hub: hub, driver: drivers[device.Path](logger, hub.config), url: &url, serial: serials[i], info: device, interfaces: group, log: logger}
 
 			events = append(events, accounts.WalletEvent{Wallet: wallet, Kind: accounts.WalletArrived})
 			wallets = append(wallets, wallet)
@@ -241,10 +647,185 @@ func (hub *Hub) refreshWallets() {
 	hub.wallets = wallets
 	hub.stateLock.Unlock()
 
-	// Fire all wallet events and return
-	for _, event := range events {
-		hub.updateFeed.Send(event)
+	return events
+}
+
+// errEnumerationDeferred is returned if the USB devices cannot be enumerated as a
+// device is waiting for user confirmation, which enumeration would break.
+var errEnumerationDeferred = errors.New("enumeration deferred while a device awaits confirmation")
+
+// enumerate lists the USB devices of the given products the hub tracks, without
+// opening any of them. The matching interfaces are grouped per physical device,
+// along with the factories of the drivers handling them keyed by device path.
+func (hub *Hub) enumerate(products []hubProducts) ([][]usb.DeviceInfo, map[string]driverFactory, error) {
+	// Retrieve the current list of USB wallet devices
+	var devices []usb.DeviceInfo
+
+	if runtime.GOOS == "linux" {
+		// hidapi on Linux opens the device during enumeration to retrieve some infos,
+		// breaking the Ledger protocol if that is waiting for user confirmation. This
+		// is a bug acknowledged at Ledger, but it won't be fixed on old devices so we
+		// need to prevent concurrent comms ourselves. The more elegant solution would
+		// be to ditch enumeration in favor of hotplug events, but that don't work yet
+		// on Windows so if we need to hack it anyway, this is more elegant for now.
+		hub.commsLock.Lock()
+		if hub.commsPend > 0 { // A confirmation is pending, don't refresh
+			hub.commsLock.Unlock()
+			return nil, nil, errEnumerationDeferred
+		}
+	}
+	var infos []usb.DeviceInfo
+	for i, product := range products {
+		if slices.ContainsFunc(products[:i], func(p hubProducts) bool { return p.vendorID == product.vendorID }) {
+			continue // vendor already enumerated
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), enumerateTimeout)
+		found, err := usbEnumerate(ctx, product.vendorID, 0)
+		cancel()
+		if err != nil {
+			failcount := hub.enumFails.Add(1)
+			if runtime.GOOS == "linux" {
+				// See rationale before the enumeration why this is needed and only on Linux.
+				hub.commsLock.Unlock()
+			}
+			log.Error("Failed to enumerate USB devices", "hub", hub.scheme,
+				"vendor", product.vendorID, "failcount", failcount, "err", err)
+			return nil, nil, err
+		}
+		infos = append(infos, found...)
+	}
+	hub.enumFails.Store(0)
+
+	var (
+		fallback []usb.DeviceInfo
+		drivers  = make(map[string]driverFactory)
+	)
+	for _, info := range infos {
+		if hub.config.serials != nil && (info.Serial == "" || !hub.config.serials[info.Serial]) {
+			continue
+		}
+		makeDriver := matchProduct(products, info)
+		if makeDriver == nil {
+			continue
+		}
+		// Windows and Macos use UsageID matching, Linux uses Interface matching
+		if info.UsagePage == hub.usageID || info.Interface == hub.endpointID {
+			devices = append(devices, info)
+		} else if usbIsRaw(info) {
+			fallback = append(fallback, info)
+		} else {
+			continue
+		}
+		drivers[info.Path] = makeDriver
+	}
+	// If no HID interface was found, the platform may not expose them at all (e.g.
+	// the U2F-free WebUSB interface of a Ledger Nano X). Fall back to the vendor's
+	// raw USB interfaces, which speak the same 64 byte framed protocol.
+	if len(devices) == 0 {
+		devices = fallback
+	}
+	// Devices of multiple vendors are enumerated separately, but the wallets are
+	// tracked in URL order
+	if len(products) > 1 {
+		slices.SortStableFunc(devices, func(a, b usb.DeviceInfo) int { return strings.Compare(a.Path, b.Path) })
+	}
+	if runtime.GOOS == "linux" {
+		// See rationale before the enumeration why this is needed and only on Linux.
+		hub.commsLock.Unlock()
+	}
+	// A device may expose multiple matching interfaces (e.g. plugin interfaces next
+	// to the Ethereum one), track them as a single wallet and let the driver pick
+	return groupInterfaces(devices), drivers, nil
+}
+
+// groupInterfaces collects the matching interfaces of each physical device, in
+// enumeration order. Interfaces are attributed to the same device by their vendor,
+// product and serial. If that is ambiguous (no serial reported, or an interface
+// number seen twice as with multiple identical devices plugged in), the interfaces
+// are kept apart, each tracked as a separate wallet.
+func groupInterfaces(infos []usb.DeviceInfo) [][]usb.DeviceInfo {
+	type deviceKey struct {
+		vendorID  uint16
+		productID uint16
+		serial    string
+	}
+	// Find all the devices whose interfaces cannot be told apart
+	var (
+		seen  = make(map[deviceKey][]int)
+		split = make(map[deviceKey]bool)
+	)
+	for _, info := range infos {
+		key := deviceKey{info.VendorID, info.ProductID, info.Serial}
+		if info.Serial == "" || slices.Contains(seen[key], info.Interface) {
+			split[key] = true
+		}
+		seen[key] = append(seen[key], info.Interface)
+	}
+	// Group the interfaces of all the unambiguous devices
+	var (
+		groups [][]usb.DeviceInfo
+		index  = make(map[deviceKey]int)
+	)
+	for _, info := range infos {
+		key := deviceKey{info.VendorID, info.ProductID, info.Serial}
+		if i, ok := index[key]; ok && !split[key] {
+			groups[i] = append(groups[i], info)
+			continue
+		}
+		index[key] = len(groups)
+		groups = append(groups, []usb.DeviceInfo{info})
+	}
+	return groups
+}
+
+// matchProduct returns the factory of the driver handling a discovered device, or
+// nil if the device is not one of the products the hub discovers.
+func matchProduct(products []hubProducts, info usb.DeviceInfo) driverFactory {
+	for _, product := range products {
+		if product.vendorID != info.VendorID {
+			continue
+		}
+		for _, id := range product.productIDs {
+			// We check both the raw ProductID (legacy) and just the upper byte, as Ledger
+			// uses `MMII`, encoding a model (MM) and an interface bitfield (II)
+			mmOnly := info.ProductID & 0xff00
+			if info.ProductID == id || mmOnly == id {
+				return product.makeDriver
+			}
+		}
+	}
+	return nil
+}
+
+// RegisterDevice teaches the hub to discover additional USB products, such as a
+// development device reporting a non-standard product ID, handling them with the
+// vendor protocol of the given scheme (LedgerScheme, TrezorScheme or KeepKeyScheme).
+// Products the hub already discovers are ignored. It is safe to call concurrently
+// with enumeration, the new products are picked up on the next one.
+func (hub *Hub) RegisterDevice(vendorID uint16, productIDs []uint16, scheme string) error {
+	driver, err := schemeDriver(scheme)
+	if err != nil {
+		return err
+	}
+	hub.stateLock.Lock()
+	defer hub.stateLock.Unlock()
+
+	var fresh []uint16
+	for _, id := range productIDs {
+		known := slices.ContainsFunc(hub.products, func(p hubProducts) bool {
+			return p.vendorID == vendorID && slices.Contains(p.productIDs, id)
+		})
+		if !known && !slices.Contains(fresh, id) {
+			fresh = append(fresh, id)
+		}
+	}
+	if len(fresh) == 0 {
+		return nil
 	}
+	// Never modify the list in place, enumeration may be iterating over it
+	hub.products = append(slices.Clip(hub.products), hubProducts{vendorID: vendorID, productIDs: fresh, makeDriver: driver})
+	hub.refreshed = time.Time{}
+	return nil
 }
 
 // Subscribe implements accounts.Backend, creating an async subscription to
@@ -254,25 +835,89 @@ func (hub *Hub) Subscribe(sink chan<- accounts.WalletEvent) event.Subscription {
 	hub.stateLock.Lock()
 	defer hub.stateLock.Unlock()
 
+	// If the hub was closed, no events will ever be fired, end the subscription
+	if hub.closed {
+		return event.NewSubscription(func(<-chan struct{}) error { return nil })
+	}
 	// Subscribe the caller and track the subscriber count
-	sub := hub.updateScope.Track(hub.updateFeed.Subscribe(sink))
+	sub := &hubSubscription{Subscription: hub.updateScope.Track(hub.updateFeed.Subscribe(sink)), hub: hub}
 
 	// Subscribers require an active notification loop, start it
 	if !hub.updating {
 		hub.updating = true
+		hub.updaters.Add(1)
 		go hub.updater()
 	}
 	return sub
 }
 
+// hubSubscription is a wallet event subscription notifying the updater when it
+// ends, so the notification loop (and the hotplug watcher) stops right away once
+// the last subscriber leaves instead of at its next refresh.
+type hubSubscription struct {
+	event.Subscription
+	hub *Hub
+}
+
+// Unsubscribe implements event.Subscription, ending the subscription and waking
+// the notification loop to check for remaining subscribers.
+func (sub *hubSubscription) Unsubscribe() {
+	sub.Subscription.Unsubscribe()
+
+	select {
+	case sub.hub.unsubscribe <- struct{}{}:
+	default: // A check is already pending
+	}
+}
+
 // updater is responsible for maintaining an up-to-date list of wallets managed
 // by the USB hub, and for firing wallet addition/removal events.
 func (hub *Hub) updater() {
+	defer hub.updaters.Done()
+
+	// Refresh on USB hotplug notifications if supported, polling otherwise
+	fallback := refreshCycle
+
+	changes, stop, err := usbHotplug()
+	if err != nil {
+		log.Debug("USB hotplug notifications unavailable, polling", "hub", hub.scheme, "err", err)
+	} else {
+		defer stop()
+		fallback = hotplugRefreshCycle
+	}
 	for {
-		// TODO: Wait for a USB hotplug event (not supported yet) or a refresh timeout
-		// <-hub.changes
-		time.Sleep(refreshCycle)
+		hub.stateLock.RLock()
+		cycle := hub.interval
+		hub.stateLock.RUnlock()
 
+		if cycle == 0 {
+			cycle = fallback
+		}
+		// Wait for a USB hotplug event or a refresh timeout
+		select {
+		case <-changes:
+			// Give the device a moment to settle (and the refresh throttling to
+			// expire) before enumerating
+			time.Sleep(refreshThrottling)
+		case <-time.After(cycle):
+		case <-hub.reschedule:
+			continue // Restart the wait with the new interval
+		case <-hub.unsubscribe:
+			// Stop right away if the last subscriber left, keep waiting otherwise
+			hub.stateLock.Lock()
+			if hub.updateScope.Count() == 0 {
+				hub.updating = false
+				hub.stateLock.Unlock()
+				return
+			}
+			hub.stateLock.Unlock()
+			continue
+		case <-hub.quit:
+			hub.stateLock.Lock()
+			hub.updating = false
+			hub.stateLock.Unlock()
+			return
+		}
 		// Run the wallet refresher
 		hub.refreshWallets()
 
@@ -286,3 +931,40 @@ func (hub *Hub) updater() {
 		hub.stateLock.Unlock()
 	}
 }
+
+// Close releases all the USB devices held by the hub: it stops the refresh loop,
+// ends all event subscriptions and closes every wallet. Requests in flight are
+// cancelled (see Wallet.Cancel) and waited for before closing their wallet. The
+// hub discovers no devices afterwards, closing it again is a no-op.
+//
+// Note, the libusb context used for raw USB enumeration is shared by all the hubs
+// of the process, so it is only released along with the last one.
+func (hub *Hub) Close() error {
+	hub.stateLock.Lock()
+	if hub.closed {
+		hub.stateLock.Unlock()
+		return nil
+	}
+	hub.closed = true
+	close(hub.quit)
+
+	wallets := hub.wallets
+	hub.wallets = nil
+	hub.stateLock.Unlock()
+
+	// Wait for the event notification loop to stop and end all subscriptions
+	hub.updaters.Wait()
+	hub.updateScope.Close()
+
+	// Abort any pending requests and release the devices
+	var errs []error
+	for _, wallet := range wallets {
+		wallet.Cancel() // Fails if the wallet is not open, nothing to abort then
+		if err := wallet.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", wallet.URL(), err))
+		}
+	}
+	usbRelease()
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,796 @@
+package usbwallet
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/base/usbwallet/usb"
+	"github.com/ethereum/go-ethereum/accounts"
+)
+
+// setTestUSB replaces the USB backend with one reporting the given devices for
+// the duration of a test.
+func setTestUSB(t *testing.T, infos []usb.DeviceInfo) {
+	supported, enumerate, hotplug, raw := usbSupported, usbEnumerate, usbHotplug, usbIsRaw
+	retain, release := usbRetain, usbRelease
+	t.Cleanup(func() {
+		usbSupported, usbEnumerate, usbHotplug, usbIsRaw = supported, enumerate, hotplug, raw
+		usbRetain, usbRelease = retain, release
+	})
+	usbSupported = func() bool { return true }
+	usbRetain, usbRelease = func() {}, func() {}
+	usbHotplug = func() (<-chan struct{}, func(), error) { return nil, nil, usb.ErrUnsupportedPlatform }
+	usbIsRaw = func(info usb.DeviceInfo) bool { return strings.HasPrefix(info.Path, "raw:") }
+	usbEnumerate = func(ctx context.Context, vendorID uint16, productID uint16) ([]usb.DeviceInfo, error) {
+		var matches []usb.DeviceInfo
+		for _, info := range infos {
+			if info.VendorID == vendorID {
+				matches = append(matches, info)
+			}
+		}
+		return matches, nil
+	}
+}
+
+// Tests that KeepKey devices are discovered by the KeepKey hub and handled by
+// the Trezor driver.
+func TestKeepKeyHub(t *testing.T) {
+	setTestUSB(t, []usb.DeviceInfo{
+		{Path: "keepkey-hid", VendorID: 0x2b24, ProductID: 0x0001, UsagePage: 0xff00},
+		{Path: "keepkey-webusb", VendorID: 0x2b24, ProductID: 0x0002, Interface: 0},
+		{Path: "keepkey-other", VendorID: 0x2b24, ProductID: 0x0003, Interface: 0},
+		{Path: "trezor", VendorID: 0x1209, ProductID: 0x53c1, Interface: 0},
+	})
+	hub, err := NewKeepKeyHub()
+	if err != nil {
+		t.Fatalf("failed to create hub: %v", err)
+	}
+	wallets := hub.Wallets()
+	if len(wallets) != 2 {
+		t.Fatalf("wallet count mismatch: have %d, want %d", len(wallets), 2)
+	}
+	for i, path := range []string{"keepkey-hid", "keepkey-webusb"} {
+		if url := wallets[i].URL(); url.Scheme != KeepKeyScheme || url.Path != path {
+			t.Errorf("wallet %d: url mismatch: have %v, want %s://%s", i, url, KeepKeyScheme, path)
+		}
+		if _, ok := wallets[i].(*wallet).driver.(*trezorDriver); !ok {
+			t.Errorf("wallet %d: driver mismatch: have %T, want *trezorDriver", i, wallets[i].(*wallet).driver)
+		}
+	}
+}
+
+// Tests that OneKey devices are discovered by the Trezor WebUSB hub.
+func TestOneKeyHub(t *testing.T) {
+	setTestUSB(t, []usb.DeviceInfo{
+		{Path: "onekey", VendorID: 0x1209, ProductID: 0x4f4a, Interface: 0},
+		{Path: "trezor", VendorID: 0x1209, ProductID: 0x53c1, Interface: 0},
+	})
+	hub, err := NewTrezorHubWithWebUSB()
+	if err != nil {
+		t.Fatalf("failed to create hub: %v", err)
+	}
+	wallets := hub.Wallets()
+	if len(wallets) != 2 {
+		t.Fatalf("wallet count mismatch: have %d, want %d", len(wallets), 2)
+	}
+	for i, path := range []string{"onekey", "trezor"} {
+		if url := wallets[i].URL(); url.Scheme != TrezorScheme || url.Path != path {
+			t.Errorf("wallet %d: url mismatch: have %v, want %s://%s", i, url, TrezorScheme, path)
+		}
+		if _, ok := wallets[i].(*wallet).driver.(*trezorDriver); !ok {
+			t.Errorf("wallet %d: driver mismatch: have %T, want *trezorDriver", i, wallets[i].(*wallet).driver)
+		}
+	}
+}
+
+// Tests that all Ledger models are discovered, matching on the model byte of the
+// product ID alongside the HID usage page (macOS, Windows) or interface (Linux).
+func TestLedgerHubModels(t *testing.T) {
+	tests := []struct {
+		model     string
+		productID uint16
+		usagePage uint16
+		iface     int
+		match     bool
+	}{
+		// Linux matches the HID interface, not the usage page
+		{"nanos-linux", 0x1011, 0, 0, true},
+		{"nanox-linux", 0x4011, 0, 0, true},
+		{"nanosp-linux", 0x5011, 0, 0, true},
+		{"stax-linux", 0x6011, 0, 0, true},
+		{"flex-linux", 0x7011, 0, 0, true},
+		{"flex-linux-legacy", 0x0007, 0, 0, true},
+		{"flex-linux-u2f", 0x7011, 0, 1, false},
+
+		// macOS and Windows match the usage page, the interface is unknown
+		{"nanos-mac", 0x1015, 0xffa0, -1, true},
+		{"nanox-mac", 0x4015, 0xffa0, -1, true},
+		{"nanosp-mac", 0x5015, 0xffa0, -1, true},
+		{"stax-mac", 0x6015, 0xffa0, -1, true},
+		{"flex-mac", 0x7015, 0xffa0, -1, true},
+		{"stax-mac-legacy", 0x0006, 0xffa0, -1, true},
+		{"stax-mac-u2f", 0x6015, 0xf1d0, -1, false},
+
+		// Unknown models are ignored
+		{"unknown-linux", 0x9011, 0, 0, false},
+		{"unknown-mac", 0x9015, 0xffa0, -1, false},
+	}
+	for _, tt := range tests {
+		setTestUSB(t, []usb.DeviceInfo{{Path: tt.model, VendorID: 0x2c97, ProductID: tt.productID, UsagePage: tt.usagePage, Interface: tt.iface}})
+
+		hub, err := NewLedgerHub()
+		if err != nil {
+			t.Fatalf("%s: failed to create hub: %v", tt.model, err)
+		}
+		if wallets := hub.Wallets(); (len(wallets) == 1) != tt.match {
+			t.Errorf("%s: match mismatch: have %v, want %v", tt.model, len(wallets) == 1, tt.match)
+		}
+	}
+}
+
+// Tests that the raw WebUSB interface of a Ledger is only used if no HID interface
+// of the device could be enumerated.
+func TestLedgerHubRawFallback(t *testing.T) {
+	tests := []struct {
+		infos []usb.DeviceInfo
+		path  string
+	}{
+		// HID available, the raw interface is ignored
+		{
+			infos: []usb.DeviceInfo{
+				{Path: "hid", VendorID: 0x2c97, ProductID: 0x4011, Interface: 0},
+				{Path: "raw:webusb", VendorID: 0x2c97, ProductID: 0x4011, Interface: 2},
+			},
+			path: "hid",
+		},
+		// HID missing, the raw interface is used
+		{
+			infos: []usb.DeviceInfo{
+				{Path: "raw:webusb", VendorID: 0x2c97, ProductID: 0x4011, Interface: 2},
+			},
+			path: "raw:webusb",
+		},
+		// HID missing, non-raw interfaces (e.g. U2F) are never used
+		{
+			infos: []usb.DeviceInfo{
+				{Path: "u2f", VendorID: 0x2c97, ProductID: 0x4011, Interface: 1},
+			},
+		},
+		// Raw interfaces of unknown models are ignored
+		{
+			infos: []usb.DeviceInfo{
+				{Path: "raw:unknown", VendorID: 0x2c97, ProductID: 0x9011, Interface: 2},
+			},
+		},
+	}
+	for i, tt := range tests {
+		setTestUSB(t, tt.infos)
+
+		hub, err := NewLedgerHub()
+		if err != nil {
+			t.Fatalf("test %d: failed to create hub: %v", i, err)
+		}
+		wallets := hub.Wallets()
+		switch {
+		case tt.path == "" && len(wallets) != 0:
+			t.Errorf("test %d: unexpected wallets: have %d, want 0", i, len(wallets))
+		case tt.path != "" && len(wallets) != 1:
+			t.Errorf("test %d: wallet count mismatch: have %d, want 1", i, len(wallets))
+		case tt.path != "" && wallets[0].URL().Path != tt.path:
+			t.Errorf("test %d: wallet path mismatch: have %s, want %s", i, wallets[0].URL().Path, tt.path)
+		}
+	}
+}
+
+// Tests that all matching interfaces of a Ledger are tracked as a single wallet,
+// opening the one carrying the APDU channel, while interfaces which cannot be told
+// apart are kept as separate wallets.
+func TestLedgerHubInterfaces(t *testing.T) {
+	tests := []struct {
+		infos  []usb.DeviceInfo
+		opened []string
+	}{
+		// Plugin interface enumerated first, the APDU one is opened
+		{
+			infos: []usb.DeviceInfo{
+				{Path: "plugin", VendorID: 0x2c97, ProductID: 0x4011, Serial: "0001", UsagePage: 0xffa0, Interface: 2},
+				{Path: "apdu", VendorID: 0x2c97, ProductID: 0x4011, Serial: "0001", UsagePage: 0xffa0, Interface: 0},
+			},
+			opened: []string{"apdu"},
+		},
+		// Identical devices plugged in, interfaces kept apart
+		{
+			infos: []usb.DeviceInfo{
+				{Path: "first", VendorID: 0x2c97, ProductID: 0x4011, Serial: "0001", Interface: 0},
+				{Path: "second", VendorID: 0x2c97, ProductID: 0x4011, Serial: "0001", Interface: 0},
+			},
+			opened: []string{"first", "second"},
+		},
+		// No serial reported, interfaces kept apart
+		{
+			infos: []usb.DeviceInfo{
+				{Path: "first", VendorID: 0x2c97, ProductID: 0x4011, Interface: 0},
+				{Path: "second", VendorID: 0x2c97, ProductID: 0x4011, UsagePage: 0xffa0, Interface: 2},
+			},
+			opened: []string{"first", "second"},
+		},
+	}
+	open := usbOpen
+	t.Cleanup(func() { usbOpen = open })
+
+	for i, tt := range tests {
+		setTestUSB(t, tt.infos)
+
+		var opened []string
+		usbOpen = func(info usb.DeviceInfo, ctx context.Context) (usb.Device, error) {
+			opened = append(opened, info.Path)
+			return nil, usb.ErrDeviceGone
+		}
+		hub, err := NewLedgerHub()
+		if err != nil {
+			t.Fatalf("test %d: failed to create hub: %v", i, err)
+		}
+		for _, wallet := range hub.Wallets() {
+			wallet.Open("")
+		}
+		if !slices.Equal(opened, tt.opened) {
+			t.Errorf("test %d: opened interfaces mismatch: have %v, want %v", i, opened, tt.opened)
+		}
+	}
+}
+
+// Tests that hotplug notifications trigger a refresh, firing wallet events, and
+// that the notifications are stopped once all subscribers leave.
+func TestHubHotplug(t *testing.T) {
+	setTestUSB(t, nil)
+
+	var (
+		lock    sync.Mutex
+		infos   []usb.DeviceInfo
+		changes = make(chan struct{}, 1)
+		stopped = make(chan struct{})
+	)
+	usbEnumerate = func(ctx context.Context, vendorID uint16, productID uint16) ([]usb.DeviceInfo, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		return infos, nil
+	}
+	usbHotplug = func() (<-chan struct{}, func(), error) {
+		return changes, func() { close(stopped) }, nil
+	}
+	hub, err := NewLedgerHub()
+	if err != nil {
+		t.Fatalf("failed to create hub: %v", err)
+	}
+	sink := make(chan accounts.WalletEvent, 1)
+	sub := hub.Subscribe(sink)
+
+	// Plug in a Ledger and ensure it's reported well before the next poll
+	lock.Lock()
+	infos = []usb.DeviceInfo{{Path: "ledger", VendorID: 0x2c97, ProductID: 0x4011, Interface: 0}}
+	lock.Unlock()
+	changes <- struct{}{}
+
+	select {
+	case event := <-sink:
+		if event.Kind != accounts.WalletArrived || event.Wallet.URL().Path != "ledger" {
+			t.Fatalf("event mismatch: have %v %v, want arrival of ledger", event.Kind, event.Wallet.URL())
+		}
+	case <-time.After(hotplugRefreshCycle / 2):
+		t.Fatalf("wallet arrival not reported")
+	}
+	// Unsubscribe and ensure the hotplug notifications are stopped without waiting
+	// for another event or the next poll
+	sub.Unsubscribe()
+
+	select {
+	case <-stopped:
+	case <-time.After(hotplugRefreshCycle / 2):
+		t.Fatalf("hotplug notifications not stopped")
+	}
+}
+
+// Tests that the hub can be restricted to devices with specific serial numbers.
+func TestHubSerials(t *testing.T) {
+	setTestUSB(t, []usb.DeviceInfo{
+		{Path: "ledger-1", VendorID: 0x2c97, ProductID: 0x4011, Serial: "0001"},
+		{Path: "ledger-2", VendorID: 0x2c97, ProductID: 0x4011, Serial: "0002"},
+		{Path: "ledger-3", VendorID: 0x2c97, ProductID: 0x4011, Serial: "0003"},
+		{Path: "ledger-4", VendorID: 0x2c97, ProductID: 0x4011},
+	})
+	tests := []struct {
+		opts  []Option
+		paths []string
+	}{
+		{nil, []string{"ledger-1", "ledger-2", "ledger-3", "ledger-4"}},
+		{[]Option{WithSerials("0002")}, []string{"ledger-2"}},
+		{[]Option{WithSerials("0001", "0003")}, []string{"ledger-1", "ledger-3"}},
+		{[]Option{WithSerials("")}, nil},
+	}
+	for i, tt := range tests {
+		hub, err := NewLedgerHub(tt.opts...)
+		if err != nil {
+			t.Fatalf("test %d: failed to create hub: %v", i, err)
+		}
+		wallets := hub.Wallets()
+		if len(wallets) != len(tt.paths) {
+			t.Fatalf("test %d: wallet count mismatch: have %d, want %d", i, len(wallets), len(tt.paths))
+		}
+		for j, wallet := range wallets {
+			if wallet.URL().Path != tt.paths[j] {
+				t.Errorf("test %d, wallet %d: path mismatch: have %s, want %s", i, j, wallet.URL().Path, tt.paths[j])
+			}
+			if want := map[string]string{"ledger-1": "0001", "ledger-2": "0002", "ledger-3": "0003"}[tt.paths[j]]; wallet.Serial() != want {
+				t.Errorf("test %d, wallet %d: serial mismatch: have %q, want %q", i, j, wallet.Serial(), want)
+			}
+		}
+	}
+}
+
+// Tests that wallet URLs identify devices by their serial numbers if requested,
+// mapping a device reconnected on another USB path to the same URL, and that
+// devices without a unique serial number keep path based URLs.
+func TestHubStableURLs(t *testing.T) {
+	infos := []usb.DeviceInfo{
+		{Path: "ledger-1", VendorID: 0x2c97, ProductID: 0x4011, Serial: "0002"},
+		{Path: "ledger-2", VendorID: 0x2c97, ProductID: 0x4011, Serial: "0004"},
+		{Path: "ledger-3", VendorID: 0x2c97, ProductID: 0x4011},
+		{Path: "ledger-4", VendorID: 0x2c97, ProductID: 0x5011, Serial: "0003"},
+		{Path: "ledger-5", VendorID: 0x2c97, ProductID: 0x6011, Serial: "0003"},
+		{Path: "ledger-6", VendorID: 0x2c97, ProductID: 0x6011, Serial: "0001"}, // Constant across all Ledgers
+	}
+	setTestUSB(t, infos)
+
+	tests := []struct {
+		opts  []Option
+		paths []string
+		ids   []string
+	}{
+		{nil, []string{"ledger-1", "ledger-2", "ledger-3", "ledger-4", "ledger-5", "ledger-6"}, []string{"serial:0002", "serial:0004", "", "", "", ""}},
+		{[]Option{WithStableURLs()}, []string{"ledger-3", "ledger-4", "ledger-5", "ledger-6", "serial:0002", "serial:0004"}, []string{"", "", "", "", "serial:0002", "serial:0004"}},
+	}
+	for i, tt := range tests {
+		hub, err := NewLedgerHub(tt.opts...)
+		if err != nil {
+			t.Fatalf("test %d: failed to create hub: %v", i, err)
+		}
+		wallets := hub.Wallets()
+		if len(wallets) != len(tt.paths) {
+			t.Fatalf("test %d: wallet count mismatch: have %d, want %d", i, len(wallets), len(tt.paths))
+		}
+		for j, wallet := range wallets {
+			if wallet.URL().Path != tt.paths[j] {
+				t.Errorf("test %d, wallet %d: path mismatch: have %s, want %s", i, j, wallet.URL().Path, tt.paths[j])
+			}
+			if tt.ids[j] == "" {
+				continue // Seed fingerprint, requires opening the device
+			}
+			if id, err := wallet.StableID(); err != nil || id != tt.ids[j] {
+				t.Errorf("test %d, wallet %d: stable id mismatch: have %q (err %v), want %q", i, j, id, err, tt.ids[j])
+			}
+		}
+		descriptors, err := hub.DiscoverDevices()
+		if err != nil {
+			t.Fatalf("test %d: failed to discover devices: %v", i, err)
+		}
+		for _, descriptor := range descriptors {
+			if !slices.ContainsFunc(wallets, func(w Wallet) bool { return w.URL() == descriptor.URL }) {
+				t.Errorf("test %d: discovered device %s not tracked", i, descriptor.URL)
+			}
+		}
+	}
+	// Reconnect a device on another USB path and ensure its URL is retained
+	hub, err := NewLedgerHub(WithStableURLs())
+	if err != nil {
+		t.Fatalf("failed to create hub: %v", err)
+	}
+	before := hub.Wallets()
+
+	infos[1].Path = "ledger-9"
+	hub.stateLock.Lock()
+	hub.refreshed = time.Time{}
+	hub.stateLock.Unlock()
+
+	after := hub.Wallets()
+	if len(after) != len(before) {
+		t.Fatalf("wallet count mismatch after reconnect: have %d, want %d", len(after), len(before))
+	}
+	for i := range after {
+		if after[i].URL() != before[i].URL() {
+			t.Errorf("wallet %d: url mismatch after reconnect: have %v, want %v", i, after[i].URL(), before[i].URL())
+		}
+	}
+	if path := after[5].(*wallet).info.Path; path != "ledger-9" {
+		t.Errorf("reconnected wallet path mismatch: have %s, want %s", path, "ledger-9")
+	}
+	if after[4] != before[4] {
+		t.Errorf("untouched wallet replaced on reconnect")
+	}
+	// Reconnect an open device on another USB path and ensure its wallet is kept,
+	// following the device by serial instead of being replaced
+	open := usbOpen
+	t.Cleanup(func() { usbOpen = open })
+
+	ledger := newLedgerTestDevice([3]byte{1, 10, 4})
+	usbOpen = func(info usb.DeviceInfo, ctx context.Context) (usb.Device, error) {
+		return NewMockLedger(ledger.handle), nil
+	}
+	if err := after[4].Open(""); err != nil {
+		t.Fatalf("failed to open wallet: %v", err)
+	}
+	defer after[4].Close()
+
+	infos[0].Path = "ledger-8"
+	hub.stateLock.Lock()
+	hub.refreshed = time.Time{}
+	hub.stateLock.Unlock()
+
+	if wallets := hub.Wallets(); len(wallets) != len(after) || wallets[4] != after[4] {
+		t.Errorf("open wallet replaced on reconnect")
+	}
+}
+
+// Tests that additional products can be registered with a hub at runtime, even
+// while it is enumerating, and that already known products are not duplicated.
+func TestHubRegisterDevice(t *testing.T) {
+	setTestUSB(t, []usb.DeviceInfo{
+		{Path: "a-custom", VendorID: 0x1234, ProductID: 0x0042, Interface: 0},
+		{Path: "b-ledger", VendorID: 0x2c97, ProductID: 0x4011, Interface: 0},
+		{Path: "c-dev-ledger", VendorID: 0x2c97, ProductID: 0xab01, Interface: 0},
+		{Path: "d-unknown", VendorID: 0x1234, ProductID: 0x0043, Interface: 0},
+	})
+	hub, err := NewLedgerHub()
+	if err != nil {
+		t.Fatalf("failed to create hub: %v", err)
+	}
+	if wallets := hub.Wallets(); len(wallets) != 1 {
+		t.Fatalf("wallet count mismatch before registration: have %d, want %d", len(wallets), 1)
+	}
+	// Register the extra products concurrently with enumeration
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := hub.RegisterDevice(0x2c97, []uint16{0x4000, 0xab01}, LedgerScheme); err != nil {
+				t.Errorf("failed to register ledger products: %v", err)
+			}
+			if err := hub.RegisterDevice(0x1234, []uint16{0x0042, 0x0042}, TrezorScheme); err != nil {
+				t.Errorf("failed to register trezor products: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			hub.Wallets()
+		}()
+	}
+	wg.Wait()
+
+	if err := hub.RegisterDevice(0x1234, []uint16{0x0044}, "unknown"); err == nil {
+		t.Errorf("registration with unknown scheme accepted")
+	}
+	if len(hub.products) != 3 {
+		t.Fatalf("product set count mismatch: have %d, want %d", len(hub.products), 3)
+	}
+	for i, want := range [][]uint16{{0xab01}, {0x0042}} {
+		if have := hub.products[1+i].productIDs; !slices.Equal(have, want) {
+			t.Errorf("registration %d: product mismatch: have %x, want %x", i, have, want)
+		}
+	}
+	hub.stateLock.Lock()
+	hub.refreshed = time.Time{}
+	hub.stateLock.Unlock()
+
+	wallets := hub.Wallets()
+	if len(wallets) != 3 {
+		t.Fatalf("wallet count mismatch: have %d, want %d", len(wallets), 3)
+	}
+	for i, path := range []string{"a-custom", "b-ledger", "c-dev-ledger"} {
+		if url := wallets[i].URL(); url.Path != path {
+			t.Errorf("wallet %d: url mismatch: have %v, want %s", i, url, path)
+		}
+	}
+	if _, ok := wallets[0].(*wallet).driver.(*trezorDriver); !ok {
+		t.Errorf("custom wallet driver mismatch: have %T, want *trezorDriver", wallets[0].(*wallet).driver)
+	}
+	if _, ok := wallets[2].(*wallet).driver.(*ledgerDriver); !ok {
+		t.Errorf("development wallet driver mismatch: have %T, want *ledgerDriver", wallets[2].(*wallet).driver)
+	}
+}
+
+// Tests that closing a hub cancels the requests in flight, closes its wallets and
+// ends all subscriptions, and that closing it again is a no-op.
+func TestHubClose(t *testing.T) {
+	setTestUSB(t, []usb.DeviceInfo{{Path: "ledger", VendorID: 0x2c97, ProductID: 0x4011, Interface: 0}})
+
+	device := newLedgerTestDevice([3]byte{1, 10, 4})
+	open := usbOpen
+	t.Cleanup(func() { usbOpen = open })
+	usbOpen = func(info usb.DeviceInfo, ctx context.Context) (usb.Device, error) { return device, nil }
+
+	hub, err := NewLedgerHub()
+	if err != nil {
+		t.Fatalf("failed to create hub: %v", err)
+	}
+	sub := hub.Subscribe(make(chan accounts.WalletEvent, 8))
+
+	usbWallet := hub.Wallets()[0]
+	if err := usbWallet.Open(""); err != nil {
+		t.Fatalf("failed to open wallet: %v", err)
+	}
+	account, err := usbWallet.Derive(accounts.DefaultBaseDerivationPath, true)
+	if err != nil {
+		t.Fatalf("failed to derive account: %v", err)
+	}
+	// Start a signature the user never confirms and close the hub once in flight
+	device.block = make(chan struct{})
+	defer close(device.block)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := usbWallet.SignText(account, []byte("hello"))
+		errc <- err
+	}()
+	driver := usbWallet.(*wallet).driver.(*ledgerDriver)
+	for {
+		driver.abortLock.Lock()
+		inflight := driver.abort != nil
+		driver.abortLock.Unlock()
+
+		if inflight {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := hub.Close(); err != nil {
+		t.Fatalf("failed to close hub: %v", err)
+	}
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("pending signature error mismatch: have %v, want %v", err, context.Canceled)
+	}
+	if _, err := usbWallet.SignText(account, []byte("hello")); !errors.Is(err, accounts.ErrWalletClosed) {
+		t.Errorf("signature after close error mismatch: have %v, want %v", err, accounts.ErrWalletClosed)
+	}
+	select {
+	case <-sub.Err():
+	case <-time.After(time.Second):
+		t.Errorf("subscription not ended")
+	}
+	if wallets := hub.Wallets(); len(wallets) != 0 {
+		t.Errorf("wallets tracked after close: %d", len(wallets))
+	}
+	if err := hub.Close(); err != nil {
+		t.Errorf("failed to close hub again: %v", err)
+	}
+	// Subscriptions to a closed hub end immediately
+	select {
+	case <-hub.Subscribe(make(chan accounts.WalletEvent)).Err():
+	case <-time.After(time.Second):
+		t.Errorf("subscription to closed hub not ended")
+	}
+}
+
+// Tests that every hub holds the shared USB context until closed, releasing it only
+// once however many times it's closed.
+func TestHubCloseReleasesUSB(t *testing.T) {
+	setTestUSB(t, nil)
+
+	var users atomic.Int32
+	usbRetain = func() { users.Add(1) }
+	usbRelease = func() { users.Add(-1) }
+
+	ledgerHub, err := NewLedgerHub()
+	if err != nil {
+		t.Fatalf("failed to create Ledger hub: %v", err)
+	}
+	trezorHub, err := NewTrezorHubWithHID()
+	if err != nil {
+		t.Fatalf("failed to create Trezor hub: %v", err)
+	}
+	if n := users.Load(); n != 2 {
+		t.Fatalf("USB context users mismatch: have %d, want 2", n)
+	}
+	for i := 0; i < 2; i++ {
+		ledgerHub.Close()
+	}
+	if n := users.Load(); n != 1 {
+		t.Fatalf("USB context users after closing a hub mismatch: have %d, want 1", n)
+	}
+	trezorHub.Close()
+	if n := users.Load(); n != 0 {
+		t.Fatalf("USB context users after closing all hubs mismatch: have %d, want 0", n)
+	}
+}
+
+// Tests that a manual refresh bypasses the throttling, and that overlapping scans
+// are coalesced into a single enumeration.
+func TestHubRefresh(t *testing.T) {
+	setTestUSB(t, nil)
+
+	var (
+		lock    sync.Mutex
+		infos   []usb.DeviceInfo
+		scans   int
+		entered = make(chan struct{}, 1)
+		release chan struct{}
+	)
+	usbEnumerate = func(ctx context.Context, vendorID uint16, productID uint16) ([]usb.DeviceInfo, error) {
+		lock.Lock()
+		scans++
+		wait := release
+		lock.Unlock()
+
+		if wait != nil {
+			entered <- struct{}{}
+			<-wait
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		return infos, nil
+	}
+	hub, err := NewLedgerHub()
+	if err != nil {
+		t.Fatalf("failed to create hub: %v", err)
+	}
+	// Plug in a Ledger, throttled listing misses it, a manual refresh doesn't
+	lock.Lock()
+	infos = []usb.DeviceInfo{{Path: "ledger", VendorID: 0x2c97, ProductID: 0x4011, Interface: 0}}
+	lock.Unlock()
+
+	if wallets := hub.Wallets(); len(wallets) != 0 {
+		t.Fatalf("throttled refresh found wallets: %d", len(wallets))
+	}
+	if wallets := hub.Refresh(); len(wallets) != 1 {
+		t.Fatalf("wallet count mismatch: have %d, want 1", len(wallets))
+	}
+	// Start a scan and ensure a manual refresh waits for it instead of enumerating
+	lock.Lock()
+	scans, release = 0, make(chan struct{})
+	lock.Unlock()
+
+	done := make(chan []Wallet)
+	go func() { done <- hub.Refresh() }()
+	<-entered
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		lock.Lock()
+		close(release)
+		lock.Unlock()
+	}()
+	if wallets := hub.Refresh(); len(wallets) != 1 {
+		t.Errorf("coalesced wallet count mismatch: have %d, want 1", len(wallets))
+	}
+	if wallets := <-done; len(wallets) != 1 {
+		t.Errorf("wallet count mismatch: have %d, want 1", len(wallets))
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if scans != 1 {
+		t.Errorf("enumeration count mismatch: have %d, want 1", scans)
+	}
+}
+
+// Tests that the refresh interval overrides the default cycle, taking effect
+// without waiting for the pending one.
+func TestHubRefreshInterval(t *testing.T) {
+	setTestUSB(t, nil)
+
+	var (
+		lock  sync.Mutex
+		infos []usb.DeviceInfo
+	)
+	usbEnumerate = func(ctx context.Context, vendorID uint16, productID uint16) ([]usb.DeviceInfo, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		return infos, nil
+	}
+	hub, err := NewLedgerHub()
+	if err != nil {
+		t.Fatalf("failed to create hub: %v", err)
+	}
+	hub.SetRefreshInterval(time.Hour)
+
+	sink := make(chan accounts.WalletEvent, 1)
+	defer hub.Subscribe(sink).Unsubscribe()
+
+	// Plug in a Ledger and ensure it's not picked up on the default cycle
+	lock.Lock()
+	infos = []usb.DeviceInfo{{Path: "ledger", VendorID: 0x2c97, ProductID: 0x4011, Interface: 0}}
+	lock.Unlock()
+
+	select {
+	case event := <-sink:
+		t.Fatalf("unexpected event before the interval: %v %v", event.Kind, event.Wallet.URL())
+	case <-time.After(refreshCycle + refreshCycle/4):
+	}
+	// Restore the default cycle and ensure the device is picked up
+	hub.SetRefreshInterval(0)
+
+	select {
+	case event := <-sink:
+		if event.Kind != accounts.WalletArrived {
+			t.Fatalf("event mismatch: have %v, want arrival", event.Kind)
+		}
+	case <-time.After(2 * refreshCycle):
+		t.Fatalf("wallet arrival not reported")
+	}
+	// Too short intervals are raised to the throttling
+	hub.SetRefreshInterval(time.Millisecond)
+	hub.stateLock.RLock()
+	defer hub.stateLock.RUnlock()
+	if hub.interval != refreshThrottling {
+		t.Errorf("interval mismatch: have %v, want %v", hub.interval, refreshThrottling)
+	}
+}
+
+// Tests that attached devices are described by their USB identifiers without any
+// of them being opened.
+func TestHubDiscoverDevices(t *testing.T) {
+	tests := []struct {
+		newHub func(...Option) (*Hub, error)
+		infos  []usb.DeviceInfo
+		want   []DeviceDescriptor
+	}{
+		{
+			newHub: NewLedgerHub,
+			infos: []usb.DeviceInfo{
+				{Path: "nanox-apdu", VendorID: 0x2c97, ProductID: 0x4011, Serial: "0001", UsagePage: 0xffa0, Interface: 0},
+				{Path: "nanox-plugin", VendorID: 0x2c97, ProductID: 0x4011, Serial: "0001", UsagePage: 0xffa0, Interface: 2},
+				{Path: "nanosp", VendorID: 0x2c97, ProductID: 0x5011, UsagePage: 0xffa0},
+			},
+			want: []DeviceDescriptor{
+				{URL: accounts.URL{Scheme: LedgerScheme, Path: "nanox-apdu"}, Vendor: LedgerScheme, Model: "Ledger Nano X", Path: "nanox-apdu", Serial: "0001", VendorID: 0x2c97, ProductID: 0x4011},
+				{URL: accounts.URL{Scheme: LedgerScheme, Path: "nanosp"}, Vendor: LedgerScheme, Model: "Ledger Nano S Plus", Path: "nanosp", VendorID: 0x2c97, ProductID: 0x5011},
+			},
+		},
+		{
+			newHub: NewTrezorHubWithWebUSB,
+			infos: []usb.DeviceInfo{
+				{Path: "onekey", VendorID: 0x1209, ProductID: 0x4f4a, Interface: 0},
+				{Path: "trezor", VendorID: 0x1209, ProductID: 0x53c1, Serial: "T1", Interface: 0},
+			},
+			want: []DeviceDescriptor{
+				{URL: accounts.URL{Scheme: TrezorScheme, Path: "onekey"}, Vendor: TrezorScheme, Model: "OneKey", Path: "onekey", VendorID: 0x1209, ProductID: 0x4f4a},
+				{URL: accounts.URL{Scheme: TrezorScheme, Path: "trezor"}, Vendor: TrezorScheme, Model: "Trezor", Path: "trezor", Serial: "T1", VendorID: 0x1209, ProductID: 0x53c1},
+			},
+		},
+		{
+			newHub: NewKeepKeyHub,
+			infos: []usb.DeviceInfo{
+				{Path: "keepkey", VendorID: 0x2b24, ProductID: 0x0002, Interface: 0},
+			},
+			want: []DeviceDescriptor{
+				{URL: accounts.URL{Scheme: KeepKeyScheme, Path: "keepkey"}, Vendor: KeepKeyScheme, Model: "KeepKey", Path: "keepkey", VendorID: 0x2b24, ProductID: 0x0002},
+			},
+		},
+	}
+	open := usbOpen
+	t.Cleanup(func() { usbOpen = open })
+
+	for i, tt := range tests {
+		setTestUSB(t, tt.infos)
+		usbOpen = func(info usb.DeviceInfo, ctx context.Context) (usb.Device, error) {
+			t.Errorf("test %d: device %s opened during discovery", i, info.Path)
+			return nil, usb.ErrDeviceGone
+		}
+		hub, err := tt.newHub()
+		if err != nil {
+			t.Fatalf("test %d: failed to create hub: %v", i, err)
+		}
+		have, err := hub.DiscoverDevices()
+		if err != nil {
+			t.Fatalf("test %d: failed to discover devices: %v", i, err)
+		}
+		if !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("test %d: descriptors mismatch:\nhave %+v\nwant %+v", i, have, tt.want)
+		}
+	}
+}
@@ -21,14 +21,22 @@
 package usbwallet
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/ecdsa"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/big"
-	"strconv"
+	"slices"
+	"sync"
 
+	"github.com/base/usbwallet/usb"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
 	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
@@ -38,6 +46,9 @@ import (
 	"github.com/ethereum/go-ethereum/rlp"
 )
 
+// ledgerClass is an enumeration encoding the supported Ledger instruction classes.
+type ledgerClass byte
+
 // ledgerOpcode is an enumeration encoding the supported Ledger opcodes.
 type ledgerOpcode byte
 
@@ -53,23 +64,177 @@ type ledgerParam2 byte
 type ledgerStatus uint16
 
 const (
-	ledgerOpRetrieveAddress  ledgerOpcode = 0x02 // Returns the public key and Ethereum address for a given BIP 32 path
-	ledgerOpSignTransaction  ledgerOpcode = 0x04 // Signs an Ethereum transaction after having the user validate the parameters
-	ledgerOpGetConfiguration ledgerOpcode = 0x06 // Returns specific wallet application configuration
-	ledgerOpSignTypedMessage ledgerOpcode = 0x0c // Signs an Ethereum message following the EIP 712 specification
+	ledgerClaEthereum  ledgerClass = 0xe0 // Instructions handled by the Ethereum app
+	ledgerClaDashboard ledgerClass = 0xb0 // Instructions handled by the BOLOS SDK, regardless of the app running
+
+	ledgerOpGetAppAndVersion  ledgerOpcode = 0x01 // Returns the name and version of the running app (dashboard class)
+	ledgerOpRetrieveAddress   ledgerOpcode = 0x02 // Returns the public key and Ethereum address for a given BIP 32 path
+	ledgerOpSignTransaction   ledgerOpcode = 0x04 // Signs an Ethereum transaction after having the user validate the parameters
+	ledgerOpGetConfiguration  ledgerOpcode = 0x06 // Returns specific wallet application configuration
+	ledgerOpProvideERC20      ledgerOpcode = 0x0a // Provides a signed ERC-20 token descriptor for display
+	ledgerOpProvideNFT        ledgerOpcode = 0x14 // Provides a signed NFT collection descriptor for display
+	ledgerOpSetExternalPlugin ledgerOpcode = 0x12 // Selects the external plugin (e.g. swap) decoding the next contract call
+	ledgerOpSetPlugin         ledgerOpcode = 0x16 // Selects the plugin decoding the next contract call
+	ledgerOpSignTypedMessage  ledgerOpcode = 0x0c // Signs an Ethereum message following the EIP 712 specification
+	ledgerOpSignAuthorization ledgerOpcode = 0x34 // Signs an EIP-7702 authorization after having the user validate it
 
 	ledgerP1DirectlyFetchAddress    ledgerParam1 = 0x00 // Return address directly from the wallet
+	ledgerP1ConfirmFetchAddress     ledgerParam1 = 0x01 // Display address and wait for user confirmation before returning
 	ledgerP1InitTypedMessageData    ledgerParam1 = 0x00 // First chunk of Typed Message data
 	ledgerP1InitTransactionData     ledgerParam1 = 0x00 // First transaction data block for signing
 	ledgerP1ContTransactionData     ledgerParam1 = 0x80 // Subsequent transaction data block for signing
+	ledgerP1InitAuthorizationData   ledgerParam1 = 0x01 // First authorization data block for signing
+	ledgerP1ContAuthorizationData   ledgerParam1 = 0x00 // Subsequent authorization data block for signing
 	ledgerP2DiscardAddressChainCode ledgerParam2 = 0x00 // Do not return the chain code along with the address
+	ledgerP2ReturnAddressChainCode  ledgerParam2 = 0x01 // Return the chain code along with the address
 	ledgerP2ProcessAndStartFlow     ledgerParam2 = 0x00 // Process and start transaction signing flow
 	ledgerP2V0Implementation        ledgerParam2 = 0x00 // EIP-712 V0 implementation (hashes only)
 
-	ledgerStatusNormalEnd ledgerStatus = 0x9000
-	ledgerEip155Size      int          = 3 // Size of the EIP-155 chain_id,r,s in unsigned transactions
+	ledgerStatusNormalEnd          ledgerStatus = 0x9000
+	ledgerStatusLocked             ledgerStatus = 0x5515 // The device is locked
+	ledgerStatusAppNotOpen         ledgerStatus = 0x6511 // The Ethereum app is not open
+	ledgerStatusSecurity           ledgerStatus = 0x6982 // Security status not satisfied, device locked
+	ledgerStatusUserRejected       ledgerStatus = 0x6985 // The user denied the request on the device
+	ledgerStatusInvalidData        ledgerStatus = 0x6a80 // The request data is invalid
+	ledgerStatusInsufficientMemory ledgerStatus = 0x6a84 // The app ran out of memory processing the request
+	ledgerStatusWrongParams        ledgerStatus = 0x6b00 // Incorrect P1 or P2 parameters
+	ledgerStatusWrongINS           ledgerStatus = 0x6d00 // Instruction not supported by the app (or its version)
+	ledgerStatusWrongCLA           ledgerStatus = 0x6e00 // Class not supported, wrong app open
+	ledgerEip155Size               int          = 3      // Size of the EIP-155 chain_id,r,s in unsigned transactions
 )
 
+// Flags reported by the Ethereum app's configuration, see LedgerAppConfig.
+const (
+	LedgerFlagBlindSigning  byte = 0x01 // Arbitrary data (blind) signing enabled by the user
+	LedgerFlagERC20External byte = 0x02 // ERC-20 token information needs to be provided externally
+)
+
+// LedgerTokenInfo is an ERC-20 token descriptor signed by Ledger (as published in
+// its crypto asset list), allowing the Ethereum app to display token transfers
+// with the ticker and decimals instead of raw integers.
+type LedgerTokenInfo struct {
+	Ticker    string         // Token ticker displayed by the device (e.g. USDC)
+	Address   common.Address // Address of the token contract
+	Decimals  uint32         // Number of decimals of the token amounts
+	ChainID   uint32         // Chain the token contract is deployed on
+	Signature []byte         // Ledger signature over the descriptor
+}
+
+// WithLedgerTokens configures ERC-20 token descriptors to provide to the Ledger
+// whenever a transaction is sent to one of the token contracts on their chain.
+func WithLedgerTokens(tokens ...LedgerTokenInfo) Option {
+	return func(c *config) {
+		c.tokens = append(c.tokens, tokens...)
+	}
+}
+
+// LedgerNFTInfo is an NFT (ERC-721 or ERC-1155) collection descriptor signed by
+// Ledger, allowing the Ethereum app to display the collection name for transfers
+// of its tokens.
+type LedgerNFTInfo struct {
+	Address    common.Address // Address of the collection contract
+	ChainID    uint64         // Chain the collection contract is deployed on
+	Descriptor []byte         // Signed descriptor as published by Ledger
+}
+
+// WithLedgerNFTs configures NFT collection descriptors to provide to the Ledger
+// whenever a transaction is sent to one of the collections on their chain.
+func WithLedgerNFTs(nfts ...LedgerNFTInfo) Option {
+	return func(c *config) {
+		c.nfts = append(c.nfts, nfts...)
+	}
+}
+
+// LedgerPluginInfo is a contract method descriptor signed by Ledger (as published
+// in its crypto asset list), selecting the Ethereum app plugin which decodes calls
+// of the method, so DeFi contract calls display the method and its parameters
+// instead of requiring blind signing.
+type LedgerPluginInfo struct {
+	Address    common.Address // Address of the contract
+	Selector   [4]byte        // Selector of the contract method
+	ChainID    uint64         // Chain the contract is deployed on
+	Descriptor []byte         // Signed descriptor as published by Ledger
+	External   bool           // Whether the descriptor selects an external plugin (e.g. swap)
+}
+
+// WithLedgerPlugins configures plugin descriptors to provide to the Ledger whenever
+// a transaction calls one of the contract methods on their chain.
+func WithLedgerPlugins(plugins ...LedgerPluginInfo) Option {
+	return func(c *config) {
+		c.plugins = append(c.plugins, plugins...)
+	}
+}
+
+// WithERC7730 configures ERC-7730 clear signing descriptors of contracts. When a
+// transaction calls a described method, the token descriptors (WithLedgerTokens)
+// of the tokens whose amounts the call displays are provided to the Ledger too,
+// not only the one of the called contract (e.g. the tokens swapped by a router).
+func WithERC7730(descriptors ...*ERC7730Descriptor) Option {
+	return func(c *config) {
+		c.erc7730 = append(c.erc7730, descriptors...)
+	}
+}
+
+// SkipClearSigning stops providing the configured token, NFT collection and plugin
+// descriptors to Ledgers before signing transactions, saving their round-trips
+// when signing high volumes of transactions whose details need no review (e.g.
+// on a trusted internal chain). Contract calls are then blind signed, requiring
+// blind signing to be enabled in the Ethereum app settings. The signatures are
+// identical either way, the descriptors only affect what the device displays.
+func SkipClearSigning() Option {
+	return func(c *config) {
+		c.skipDescs = true
+	}
+}
+
+// AllowHashFallback lets Ledgers blind sign the EIP-712 hash of typed data that is
+// too complex to be streamed to the device (ErrLedgerTypedDataTooComplex), instead
+// of failing. The signature is the same, but the user can only verify the hashes,
+// and blind signing must be enabled in the Ethereum app settings.
+func AllowHashFallback() Option {
+	return func(c *config) {
+		c.hashFallback = true
+	}
+}
+
+// ledgerMaxMessageSize is the default limit on the length of personal messages
+// signed by Ledgers. The Ethereum app hashes the message as it is streamed without
+// buffering it, so the only limit it has is the 4 byte length field of the request.
+const ledgerMaxMessageSize = math.MaxUint32
+
+// WithLedgerMaxMessageSize limits the length of personal messages sent to Ledgers
+// for signing, rejecting longer ones with ErrLedgerMessageTooLong before anything
+// is sent to the device. Messages are streamed in 255 byte chunks, each a round
+// trip to the device, so huge ones take a long time to sign. A size of zero or
+// above the default (2^32-1 bytes) restores the default.
+func WithLedgerMaxMessageSize(size uint64) Option {
+	return func(c *config) {
+		c.maxMessage = size
+		if size > ledgerMaxMessageSize {
+			c.maxMessage = 0
+		}
+	}
+}
+
+// ledgerEip712Version is the first Ethereum app version able to sign EIP-712 typed
+// data streamed to it.
+var ledgerEip712Version = [3]byte{1, 5, 0}
+
+// ledgerTypedTxVersion is the first Ethereum app version able to parse EIP-2930 and
+// EIP-1559 typed transactions.
+var ledgerTypedTxVersion = [3]byte{1, 9, 0}
+
+// ledgerNFTVersion is the first Ethereum app version accepting NFT descriptors.
+var ledgerNFTVersion = [3]byte{1, 9, 0}
+
+// ledgerBlobTxVersion is the first Ethereum app version able to parse EIP-4844
+// blob transactions.
+var ledgerBlobTxVersion = [3]byte{1, 11, 0}
+
+// ledgerSetCodeVersion is the first Ethereum app version able to parse EIP-7702
+// set code transactions and sign standalone authorizations.
+var ledgerSetCodeVersion = [3]byte{1, 15, 0}
+
 var ledgerStatuses = map[ledgerStatus]string{
 	0x5515: "Device is locked",
 	0x6001: "Mode check fail",
@@ -77,7 +242,7 @@ var ledgerStatuses = map[ledgerStatus]string{
 	0x6502: "Output buffer too small for chainId conversion",
 	0x6511: "Ethereum app not open",
 	//0x68xx: "Internal error (Please report)",
-	0x6982: "Security status not satisfied (Canceled by user)",
+	0x6982: "Security status not satisfied (Device locked)",
 	0x6983: "Wrong Data length",
 	0x6984: "Plugin not installed",
 	0x6985: "Condition not satisfied",
@@ -86,13 +251,90 @@ var ledgerStatuses = map[ledgerStatus]string{
 	0x6A84: "Insufficient memory",
 	0x6A88: "Data not found",
 	0x6B00: "Incorrect parameter P1 or P2",
-	0x6D00: "Incorrect parameter INS",
-	0x6E00: "Incorrect parameter CLA",
+	0x6D00: "Instruction not supported",
+	0x6E00: "Class not supported (Ethereum app not open)",
 	0x6F00: "Incorrect parameter CLA",
 	0x6F01: "Technical problem (Internal error, please report)",
 	0x911C: "Command code not supported (i.e. Ledger-PKI not yet available)",
 }
 
+// ledgerMaxPathLength is the maximum number of BIP-32 derivations the Ledger can
+// perform in a single request.
+const ledgerMaxPathLength = 10
+
+// ledgerEthereumApp is the name the Ethereum app reports when queried.
+const ledgerEthereumApp = "Ethereum"
+
+// ErrWrongApp is returned if a different app than Ethereum is running on the
+// Ledger. The concrete error is a *WrongAppError naming the running app.
+var ErrWrongApp = errors.New("ledger: wrong app open")
+
+// WrongAppError is the error returned if the Ledger is running an app other than
+// the Ethereum one (e.g. Bitcoin or the dashboard, reported as "BOLOS").
+type WrongAppError struct {
+	App string // Name of the app running on the Ledger
+}
+
+// Error implements the error interface, naming the app actually running.
+func (e *WrongAppError) Error() string {
+	return fmt.Sprintf("%v: %s running, please open the Ethereum app", ErrWrongApp, e.App)
+}
+
+// Is allows errors.Is to match the error against ErrWrongApp.
+func (e *WrongAppError) Is(target error) bool {
+	return target == ErrWrongApp
+}
+
+// ErrLedgerLocked is returned if the Ledger refused a request because the device
+// is locked and needs to be unlocked with its PIN.
+var ErrLedgerLocked = errors.New("ledger: device locked")
+
+// ErrLedgerAppNotOpen is returned if the Ledger refused a request because the
+// Ethereum app is not open (e.g. the dashboard or a different app is running).
+var ErrLedgerAppNotOpen = errors.New("ledger: Ethereum app not open")
+
+// ErrLedgerBusy is returned if a request is made while the Ledger still prompts
+// the user for an abandoned one, until they dismiss it on the device.
+var ErrLedgerBusy = errors.New("ledger: device busy with an abandoned request")
+
+// ledgerError is the error returned if the Ledger responds with a status word
+// other than 0x9000.
+type ledgerError struct {
+	status ledgerStatus
+}
+
+// String returns the human-readable description of the status word.
+func (e *ledgerError) String() string {
+	if s, ok := ledgerStatuses[e.status]; ok {
+		return s
+	}
+	return "unknown error"
+}
+
+// Error implements the error interface, returning the status word along with
+// its description.
+func (e *ledgerError) Error() string {
+	return fmt.Sprintf("%v: 0x%04x (%s)", errLedgerInvalidStatus, uint16(e.status), e.String())
+}
+
+// Is allows errors.Is to match a status word failure against errLedgerInvalidStatus
+// and against the exported sentinel errors of the well known status words.
+func (e *ledgerError) Is(target error) bool {
+	switch target {
+	case errLedgerInvalidStatus:
+		return true
+	case ErrUserRejected:
+		return e.status == ledgerStatusUserRejected
+	case ErrLedgerLocked:
+		return e.status == ledgerStatusLocked || e.status == ledgerStatusSecurity
+	case ErrLedgerAppNotOpen:
+		return e.status == ledgerStatusAppNotOpen || e.status == ledgerStatusWrongCLA
+	case accounts.ErrNotSupported:
+		return e.status == ledgerStatusWrongINS
+	}
+	return false
+}
+
 // errLedgerReplyInvalidHeader is the error message returned by a Ledger data exchange
 // if the device replies with a mismatching header. This usually means the device
 // is in browser mode.
@@ -102,29 +344,63 @@ var errLedgerReplyInvalidHeader = errors.New("ledger: invalid reply header")
 // when a response does arrive, but it does not contain the expected data.
 var errLedgerInvalidVersionReply = errors.New("ledger: invalid version reply")
 
+// errLedgerInvalidAppReply is the error message returned by a Ledger app query
+// when a response does arrive, but it does not contain the expected data.
+var errLedgerInvalidAppReply = errors.New("ledger: invalid app reply")
+
 // errLedgerInvalidStatus is the error message returned if the ledger doesn't respond with a
 // 0x9000 status.
 var errLedgerInvalidStatus = errors.New("ledger: invalid status")
 
 // ledgerDriver implements the communication with a Ledger hardware wallet.
 type ledgerDriver struct {
-	device  io.ReadWriter // USB device connection to communicate through
-	version [3]byte       // Current version of the Ledger firmware (zero if app is offline)
-	browser bool          // Flag whether the Ledger is in browser mode (reply channel mismatch)
-	failure error         // Any failure that would make the device unusable
-	log     log.Logger    // Contextual logger to tag the ledger with its id
+	device       io.ReadWriter        // USB device connection to communicate through
+	version      [3]byte              // Current version of the Ledger firmware (zero if app is offline)
+	flags        byte                 // Current configuration flags of the Ethereum app
+	app          string               // Name of the app running on the Ledger (empty if unknown)
+	browser      bool                 // Flag whether the Ledger is in browser mode (reply channel mismatch)
+	failure      error                // Any failure that would make the device unusable
+	infoLock     sync.RWMutex         // Protects the version, flags, app and failure refreshed by health checks
+	pending      chan struct{}        // Closed when an abandoned (cancelled) exchange drained its reply
+	abort        func()               // Cancels the exchange in flight, nil if none
+	flow         func()               // Cancels the multi-APDU request in progress, nil if none
+	abortLock    sync.Mutex           // Protects the abort functions from concurrent Cancel calls
+	tokens       []LedgerTokenInfo    // ERC-20 token descriptors provided before signing
+	nfts         []LedgerNFTInfo      // NFT collection descriptors provided before signing
+	plugins      []LedgerPluginInfo   // Contract method plugin descriptors provided before signing
+	erc7730      []*ERC7730Descriptor // Clear signing descriptors selecting the tokens to provide
+	hashFallback bool                 // Whether too complex typed data may be blind signed by hash
+	skipDescs    bool                 // Whether transactions are signed without providing descriptors
+	maxMessage   uint64               // Maximum length of personal messages to sign
+	retry        RetryPolicy          // Policy for retrying transient USB transport failures
+	timeouts     Timeouts             // Limits on the duration of interactive and background exchanges
+	traffic      log.Logger           // Logger for the APDU traffic, nil if disabled
+	log          log.Logger           // Contextual logger to tag the ledger with its id
 }
 
 // newLedgerDriver creates a new instance of a Ledger USB protocol driver.
-func newLedgerDriver(logger log.Logger) driver {
+func newLedgerDriver(logger log.Logger, config *config) driver {
 	return &ledgerDriver{
-		log: logger,
+		tokens:       config.tokens,
+		nfts:         config.nfts,
+		plugins:      config.plugins,
+		erc7730:      config.erc7730,
+		hashFallback: config.hashFallback,
+		skipDescs:    config.skipDescs,
+		maxMessage:   cmp.Or(config.maxMessage, ledgerMaxMessageSize),
+		retry:        config.retry,
+		timeouts:     config.timeouts,
+		traffic:      config.traffic,
+		log:          logger,
 	}
 }
 
 // Status implements usbwallet.driver, returning various states the Ledger can
 // currently be in.
 func (w *ledgerDriver) Status() (string, error) {
+	w.infoLock.RLock() // Read without the comms lock, racing with health checks
+	defer w.infoLock.RUnlock()
+
 	if w.failure != nil {
 		return fmt.Sprintf("Failed: %v", w.failure), w.failure
 	}
@@ -144,39 +420,94 @@ func (w *ledgerDriver) offline() bool {
 	return w.version == [3]byte{0, 0, 0}
 }
 
+// atLeast returns whether the Ethereum app version is at least the given one.
+//
+// The method assumes that the state lock is held!
+func (w *ledgerDriver) atLeast(version [3]byte) bool {
+	for i := range version {
+		if w.version[i] != version[i] {
+			return w.version[i] > version[i]
+		}
+	}
+	return true
+}
+
 // Open implements usbwallet.driver, attempting to initialize the connection to the
 // Ledger hardware wallet. The Ledger does not require a user passphrase, so that
 // parameter is silently discarded.
 func (w *ledgerDriver) Open(device io.ReadWriter, passphrase string) error {
 	w.device, w.failure = device, nil
 
-	_, err := w.ledgerDerive(accounts.DefaultBaseDerivationPath)
+	_, err := w.ledgerDerive(accounts.DefaultBaseDerivationPath, false)
 	if err != nil {
 		// Ethereum app is not running or in browser mode, nothing more to do, return
 		if errors.Is(err, errLedgerReplyInvalidHeader) {
 			w.browser = true
+			return nil
+		}
+		// If a different app is running, tell the user which one
+		if w.app, err = w.ledgerApp(); err == nil && w.app != ledgerEthereumApp {
+			return &WrongAppError{App: w.app}
 		}
 		return nil
 	}
+	w.app = ledgerEthereumApp
+
 	// Try to resolve the Ethereum app's version, will fail prior to v1.0.2
-	if w.version, err = w.ledgerVersion(); err != nil {
+	if w.version, w.flags, err = w.ledgerConfiguration(); err != nil {
 		w.version = [3]byte{1, 0, 0} // Assume worst case, can't verify if v1.0.0 or v1.0.1
 	}
 	return nil
 }
 
+// SelectInterface implements usbwallet.driver, picking the interface carrying the
+// APDU channel of the Ethereum app. Newer Ledger apps expose plugin interfaces on
+// further endpoints which may match the Ledger usage page too, but never answer
+// the APDUs, timing out every exchange. The APDU channel is the first interface,
+// or failing that, the first one with the Ledger usage page.
+func (w *ledgerDriver) SelectInterface(infos []usb.DeviceInfo) usb.DeviceInfo {
+	if i := slices.IndexFunc(infos, func(info usb.DeviceInfo) bool { return info.Interface == 0 }); i >= 0 {
+		return infos[i]
+	}
+	if i := slices.IndexFunc(infos, func(info usb.DeviceInfo) bool { return info.UsagePage == 0xffa0 }); i >= 0 {
+		return infos[i]
+	}
+	return infos[0]
+}
+
 // Close implements usbwallet.driver, cleaning up and metadata maintained within
 // the Ledger driver.
 func (w *ledgerDriver) Close() error {
-	w.browser, w.version = false, [3]byte{}
+	w.browser, w.version, w.flags, w.app, w.pending = false, [3]byte{}, 0, "", nil
 	return nil
 }
 
 // Heartbeat implements usbwallet.driver, performing a sanity check against the
-// Ledger to see if it's still online.
+// Ledger to see if it's still online, refreshing the app version (it might have
+// been updated and reopened in the mean time).
 func (w *ledgerDriver) Heartbeat() error {
-	if _, err := w.ledgerVersion(); err != nil && !errors.Is(err, errLedgerInvalidVersionReply) {
-		w.failure = err
+	version, flags, err := w.ledgerConfiguration()
+	if err == nil {
+		w.infoLock.Lock()
+		w.version, w.flags = version, flags
+		w.infoLock.Unlock()
+		return nil
+	}
+	// A device still prompting for an abandoned request is alive, just busy
+	if errors.Is(err, ErrLedgerBusy) {
+		return nil
+	}
+	if !errors.Is(err, errLedgerInvalidVersionReply) {
+		// If the Ethereum app was closed, report the app that replaced it
+		app := w.app
+		if errors.Is(err, ErrLedgerAppNotOpen) {
+			if running, appErr := w.ledgerApp(); appErr == nil && running != ledgerEthereumApp {
+				app, err = running, &WrongAppError{App: running}
+			}
+		}
+		w.infoLock.Lock()
+		w.app, w.failure = app, err
+		w.infoLock.Unlock()
 		return err
 	}
 	return nil
@@ -185,7 +516,150 @@ func (w *ledgerDriver) Heartbeat() error {
 // Derive implements usbwallet.driver, sending a derivation request to the Ledger
 // and returning the Ethereum address located on that derivation path.
 func (w *ledgerDriver) Derive(path accounts.DerivationPath) (common.Address, error) {
-	return w.ledgerDerive(path)
+	return w.ledgerDerive(path, false)
+}
+
+// ExtendedPublicKey implements usbwallet.driver, retrieving the extended public
+// key located on the derivation path from the Ledger.
+func (w *ledgerDriver) ExtendedPublicKey(path accounts.DerivationPath) (*hdkeychain.ExtendedKey, error) {
+	// If the Ethereum app doesn't run, abort
+	if w.offline() {
+		return nil, accounts.ErrWalletClosed
+	}
+	return w.ledgerExtendedPublicKey(path)
+}
+
+// PublicKey implements usbwallet.driver, retrieving the public key located on the
+// derivation path from the Ledger.
+func (w *ledgerDriver) PublicKey(path accounts.DerivationPath) (*ecdsa.PublicKey, error) {
+	// If the Ethereum app doesn't run, abort
+	if w.offline() {
+		return nil, accounts.ErrWalletClosed
+	}
+	return w.ledgerPublicKey(path)
+}
+
+// ConfirmAddress implements usbwallet.driver, displaying the Ethereum address
+// located on the derivation path on the Ledger and waiting for the user to
+// confirm or reject it.
+func (w *ledgerDriver) ConfirmAddress(path accounts.DerivationPath) (common.Address, error) {
+	// If the Ethereum app doesn't run, abort
+	if w.offline() {
+		return common.Address{}, accounts.ErrWalletClosed
+	}
+	return w.ledgerDerive(path, true)
+}
+
+// Cancel implements usbwallet.driver, abandoning the exchange in flight (e.g. a
+// signature waiting to be confirmed), which fails with context.Canceled. Requests
+// split into several APDUs are stopped before their next one if cancelled between
+// two. The app has no command to abort a request, so the prompt stays on the
+// device until the user dismisses it physically; any subsequent request fails
+// with ErrLedgerBusy until then.
+func (w *ledgerDriver) Cancel() error {
+	w.abortLock.Lock()
+	defer w.abortLock.Unlock()
+
+	if w.abort != nil {
+		w.abort()
+	}
+	if w.flow != nil {
+		w.flow()
+	}
+	return nil
+}
+
+// ledgerFlow derives a context for a request split into several APDUs (e.g. the
+// chunks of a transaction), which Cancel aborts even between two of them. The
+// returned function ends the request.
+func (w *ledgerDriver) ledgerFlow(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	w.abortLock.Lock()
+	w.flow = cancel
+	w.abortLock.Unlock()
+
+	return ctx, func() {
+		w.abortLock.Lock()
+		w.flow = nil
+		w.abortLock.Unlock()
+
+		cancel()
+	}
+}
+
+// LedgerAppConfig implements usbwallet.driver, retrieving the version and the
+// configuration flags of the Ethereum app running on the Ledger.
+func (w *ledgerDriver) LedgerAppConfig() ([3]byte, byte, error) {
+	// If the Ethereum app doesn't run, abort
+	if w.offline() {
+		return [3]byte{}, 0, accounts.ErrWalletClosed
+	}
+	return w.ledgerConfiguration()
+}
+
+// Attestation implements usbwallet.driver. The genuine check of a Ledger runs
+// between the dashboard and Ledger's servers over a secure channel, which the
+// Ethereum app doesn't expose, so no attestation can be retrieved.
+func (w *ledgerDriver) Attestation(challenge []byte) (*Attestation, error) {
+	return nil, fmt.Errorf("ledger attestation: %w", accounts.ErrNotSupported)
+}
+
+// DeviceInfo implements usbwallet.driver, returning the running app and its
+// configuration. The Ethereum app cannot report the model or firmware version.
+func (w *ledgerDriver) DeviceInfo() DeviceInfo {
+	w.infoLock.RLock()
+	defer w.infoLock.RUnlock()
+
+	info := DeviceInfo{App: w.app, Flags: w.flags}
+	if !w.offline() {
+		info.AppVersion = fmt.Sprintf("%d.%d.%d", w.version[0], w.version[1], w.version[2])
+	}
+	return info
+}
+
+// Capabilities implements usbwallet.driver, deriving the supported features from
+// the version of the Ethereum app. Nothing is supported while the app is offline.
+func (w *ledgerDriver) Capabilities() Capabilities {
+	w.infoLock.RLock()
+	defer w.infoLock.RUnlock()
+
+	if w.offline() {
+		return Capabilities{}
+	}
+	return Capabilities{
+		TypedDataNative: w.atLeast(ledgerEip712Version),
+		NestedArrays:    w.atLeast(ledgerEip712Version),
+		BlobTx:          w.atLeast(ledgerBlobTxVersion),
+		AccessListTx:    w.atLeast(ledgerTypedTxVersion),
+		DynamicFeeTx:    w.atLeast(ledgerTypedTxVersion),
+		ClearSigning:    w.atLeast(ledgerFilteringVersion),
+	}
+}
+
+// ledgerModels maps the model byte of the Ledger USB product identifiers to the
+// device names.
+var ledgerModels = map[uint16]string{
+	0x00: "Ledger Blue",
+	0x10: "Ledger Nano S",
+	0x40: "Ledger Nano X",
+	0x50: "Ledger Nano S Plus",
+	0x60: "Ledger Stax",
+	0x70: "Ledger Flex",
+}
+
+// ledgerModel derives the device model from a USB product identifier, the model
+// being encoded in the high byte (MM) of the current identifiers, or enumerated
+// in the low nibble of the original ones.
+func ledgerModel(productID uint16) string {
+	id := productID >> 8
+	if productID < 0x100 {
+		id = productID << 4
+	}
+	if model, ok := ledgerModels[id]; ok {
+		return model
+	}
+	return "Ledger"
 }
 
 // SignTx implements usbwallet.driver, sending the transaction to the Ledger and
@@ -195,6 +669,12 @@ func (w *ledgerDriver) Derive(path accounts.DerivationPath) (common.Address, err
 // too old to sign EIP-155 transactions, but such is requested nonetheless, an error
 // will be returned opposed to silently signing in Homestead mode.
 func (w *ledgerDriver) SignTx(path accounts.DerivationPath, tx *types.Transaction, chainID *big.Int) (common.Address, *types.Transaction, error) {
+	return w.SignTxContext(context.Background(), path, tx, chainID)
+}
+
+// SignTxContext is identical to SignTx, but aborts waiting for the user to confirm
+// or deny the transaction if the context is cancelled, returning ctx.Err().
+func (w *ledgerDriver) SignTxContext(ctx context.Context, path accounts.DerivationPath, tx *types.Transaction, chainID *big.Int) (common.Address, *types.Transaction, error) {
 	// If the Ethereum app doesn't run, abort
 	if w.offline() {
 		return common.Address{}, nil, accounts.ErrWalletClosed
@@ -204,8 +684,143 @@ func (w *ledgerDriver) SignTx(path accounts.DerivationPath, tx *types.Transactio
 		//lint:ignore ST1005 brand name displayed on the console
 		return common.Address{}, nil, fmt.Errorf("Ledger v%d.%d.%d doesn't support signing this transaction, please update to v1.0.3 at least", w.version[0], w.version[1], w.version[2])
 	}
+	if tx.Type() != types.LegacyTxType && !w.atLeast(ledgerTypedTxVersion) {
+		//lint:ignore ST1005 brand name displayed on the console
+		return common.Address{}, nil, fmt.Errorf("Ledger v%d.%d.%d doesn't support signing typed transactions, please update to v%d.%d.%d at least",
+			w.version[0], w.version[1], w.version[2], ledgerTypedTxVersion[0], ledgerTypedTxVersion[1], ledgerTypedTxVersion[2])
+	}
+	if tx.Type() == types.BlobTxType && !w.atLeast(ledgerBlobTxVersion) {
+		//lint:ignore ST1005 brand name displayed on the console
+		return common.Address{}, nil, fmt.Errorf("Ledger v%d.%d.%d doesn't support signing blob transactions, please update to v%d.%d.%d at least",
+			w.version[0], w.version[1], w.version[2], ledgerBlobTxVersion[0], ledgerBlobTxVersion[1], ledgerBlobTxVersion[2])
+	}
+	if tx.Type() == types.SetCodeTxType && !w.atLeast(ledgerSetCodeVersion) {
+		//lint:ignore ST1005 brand name displayed on the console
+		return common.Address{}, nil, fmt.Errorf("Ledger v%d.%d.%d doesn't support signing set code transactions, please update to v%d.%d.%d at least",
+			w.version[0], w.version[1], w.version[2], ledgerSetCodeVersion[0], ledgerSetCodeVersion[1], ledgerSetCodeVersion[2])
+	}
+	if err := validatePath(path, ledgerMaxPathLength); err != nil {
+		return common.Address{}, nil, err
+	}
+	ctx, done := w.ledgerFlow(ctx)
+	defer done()
+
+	// Provide the descriptors of the token or collection the transaction is sent to
+	if !w.skipDescs {
+		if err := w.ledgerProvideDescriptors(ctx, tx, chainID); err != nil {
+			return common.Address{}, nil, err
+		}
+	}
 	// All infos gathered and metadata checks out, request signing
-	return w.ledgerSign(path, tx, chainID)
+	return w.ledgerSign(ctx, path, tx, chainID)
+}
+
+// ledgerProvideDescriptors sends the configured token, NFT collection and plugin
+// descriptors of the transaction's recipient on the signing chain to the Ledger.
+// Failures are only logged, as the device can still sign (albeit with opaque
+// data displayed), but context cancellation is reported.
+func (w *ledgerDriver) ledgerProvideDescriptors(ctx context.Context, tx *types.Transaction, chainID *big.Int) error {
+	if tx.To() == nil {
+		return nil
+	}
+	if chainID == nil {
+		chainID = tx.ChainId()
+	}
+	if !chainID.IsUint64() {
+		return nil
+	}
+	// Besides the called contract, provide the tokens the call displays amounts of
+	tokens := []common.Address{*tx.To()}
+	for _, desc := range w.erc7730 {
+		tokens = append(tokens, desc.Tokens(chainID.Uint64(), *tx.To(), tx.Data())...)
+	}
+	for _, token := range w.tokens {
+		if slices.Contains(tokens, token.Address) && uint64(token.ChainID) == chainID.Uint64() {
+			if err := w.ledgerProvideTokenInfo(ctx, token); err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+				w.log.Warn("Failed to provide token info to the Ledger", "token", token.Ticker, "err", err)
+			}
+		}
+	}
+	for _, nft := range w.nfts {
+		if nft.Address == *tx.To() && nft.ChainID == chainID.Uint64() {
+			if !w.atLeast(ledgerNFTVersion) {
+				w.log.Debug("Ledger app too old for NFT descriptors", "collection", nft.Address)
+				continue
+			}
+			if _, err := w.ledgerExchangeContext(ctx, ledgerOpProvideNFT, 0, 0, nft.Descriptor); err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+				w.log.Warn("Failed to provide NFT info to the Ledger", "collection", nft.Address, "err", err)
+			}
+		}
+	}
+	if data := tx.Data(); len(data) >= 4 {
+		for _, plugin := range w.plugins {
+			if plugin.Address == *tx.To() && plugin.ChainID == chainID.Uint64() && bytes.Equal(plugin.Selector[:], data[:4]) {
+				if err := w.ledgerSetPlugin(ctx, plugin.Descriptor, plugin.External); err != nil {
+					if ctx.Err() != nil {
+						return err
+					}
+					w.log.Warn("Failed to provide plugin info to the Ledger", "contract", plugin.Address, "selector", hexutil.Bytes(plugin.Selector[:]), "err", err)
+				}
+				break // The app decodes the call with a single plugin
+			}
+		}
+	}
+	return nil
+}
+
+// SetPlugin sends a signed plugin descriptor to the Ledger, selecting the plugin
+// (or external plugin) decoding the contract call of the next transaction signed.
+func (w *ledgerDriver) SetPlugin(descriptor []byte, external bool) error {
+	if w.offline() {
+		return accounts.ErrWalletClosed
+	}
+	return w.ledgerSetPlugin(context.Background(), descriptor, external)
+}
+
+// ledgerSetPlugin sends a signed plugin descriptor to the Ledger, selecting the
+// plugin decoding the contract call of the next transaction signed.
+//
+// The plugin selection protocol is defined as follows:
+//
+//	CLA | INS | P1 | P2 | Lc       | Le
+//	----+-----+----+----+----------+---
+//	 E0 | 12  | 00 | 00 | variable | 00    (external plugin)
+//	 E0 | 16  | 00 | 00 | variable | 00
+//
+// Where the input is the descriptor as signed by Ledger, and the output is empty.
+func (w *ledgerDriver) ledgerSetPlugin(ctx context.Context, descriptor []byte, external bool) error {
+	op := ledgerOpSetPlugin
+	if external {
+		op = ledgerOpSetExternalPlugin
+	}
+	_, err := w.ledgerExchangeContext(ctx, op, 0, 0, descriptor)
+	return err
+}
+
+// SignAuthorization implements usbwallet.driver, sending the EIP-7702 authorization
+// to the Ledger and waiting for the user to confirm or deny delegating the account.
+func (w *ledgerDriver) SignAuthorization(path accounts.DerivationPath, auth types.SetCodeAuthorization) ([]byte, error) {
+	// If the Ethereum app doesn't run, abort
+	if w.offline() {
+		return nil, accounts.ErrWalletClosed
+	}
+	// Ensure the wallet is capable of signing authorizations
+	if !w.atLeast(ledgerSetCodeVersion) {
+		//lint:ignore ST1005 brand name displayed on the console
+		return nil, fmt.Errorf("Ledger v%d.%d.%d doesn't support signing EIP-7702 authorizations, please update to v%d.%d.%d at least",
+			w.version[0], w.version[1], w.version[2], ledgerSetCodeVersion[0], ledgerSetCodeVersion[1], ledgerSetCodeVersion[2])
+	}
+	// All infos gathered and metadata checks out, request signing
+	ctx, done := w.ledgerFlow(context.Background())
+	defer done()
+
+	return w.ledgerSignAuthorization(ctx, path, auth)
 }
 
 // SignTypedHash implements usbwallet.driver, sending the message to the Ledger and
@@ -218,18 +833,50 @@ func (w *ledgerDriver) SignTypedHash(path accounts.DerivationPath, domainHash []
 		return nil, accounts.ErrWalletClosed
 	}
 	// Ensure the wallet is capable of signing the given transaction
-	if w.version[0] < 1 && w.version[1] < 5 {
+	if !w.atLeast(ledgerEip712Version) {
 		//lint:ignore ST1005 brand name displayed on the console
 		return nil, fmt.Errorf("Ledger version >= 1.5.0 required for EIP-712 signing (found version v%d.%d.%d)", w.version[0], w.version[1], w.version[2])
 	}
+	if err := validatePath(path, ledgerMaxPathLength); err != nil {
+		return nil, err
+	}
+	// Hashes can only be blind signed, fail fast if the user didn't enable it
+	if err := w.ledgerCheckBlindSigning(); err != nil {
+		return nil, err
+	}
 	// All infos gathered and metadata checks out, request signing
 	return w.ledgerSignTypedHash(path, domainHash, messageHash)
 }
 
+// ledgerCheckBlindSigning ensures that blind signing is enabled in the settings of
+// the Ethereum app, refreshing the configuration as the user might have toggled
+// it since the last heartbeat.
+func (w *ledgerDriver) ledgerCheckBlindSigning() error {
+	version, flags, err := w.ledgerConfiguration()
+	if err != nil {
+		return err
+	}
+	w.infoLock.Lock()
+	w.version, w.flags = version, flags
+	w.infoLock.Unlock()
+
+	if flags&LedgerFlagBlindSigning == 0 {
+		return fmt.Errorf("%w: enable \"Blind signing\" in the Ethereum app settings on the Ledger", ErrBlindSigningDisabled)
+	}
+	return nil
+}
+
 // ledgerVersion retrieves the current version of the Ethereum wallet app running
 // on the Ledger wallet.
+func (w *ledgerDriver) ledgerVersion() ([3]byte, error) {
+	version, _, err := w.ledgerConfiguration()
+	return version, err
+}
+
+// ledgerConfiguration retrieves the current version of the Ethereum wallet app
+// running on the Ledger wallet, along with the flags of its configuration.
 //
-// The version retrieval protocol is defined as follows:
+// The configuration retrieval protocol is defined as follows:
 //
 //	CLA | INS | P1 | P2 | Lc | Le
 //	----+-----+----+----+----+---
@@ -240,26 +887,171 @@ func (w *ledgerDriver) SignTypedHash(path accounts.DerivationPath, domainHash []
 //	Description                                        | Length
 //	---------------------------------------------------+--------
 //	Flags 01: arbitrary data signature enabled by user | 1 byte
+//	Flags 02: ERC 20 Token information needs to be     |
+//	          provided externally                      |
 //	Application major version                          | 1 byte
 //	Application minor version                          | 1 byte
 //	Application patch version                          | 1 byte
-func (w *ledgerDriver) ledgerVersion() ([3]byte, error) {
+func (w *ledgerDriver) ledgerConfiguration() ([3]byte, byte, error) {
 	// Send the request and wait for the response
 	reply, err := w.ledgerExchange(ledgerOpGetConfiguration, 0, 0, nil)
 	if err != nil {
-		return [3]byte{}, err
+		return [3]byte{}, 0, err
 	}
 	if len(reply) != 4 {
-		return [3]byte{}, errLedgerInvalidVersionReply
+		return [3]byte{}, 0, errLedgerInvalidVersionReply
 	}
 	// Cache the version for future reference
 	var version [3]byte
 	copy(version[:], reply[1:])
-	return version, nil
+	return version, reply[0], nil
+}
+
+// ledgerApp retrieves the name of the app currently running on the Ledger. The
+// query is handled by the BOLOS SDK, so it works in any app and the dashboard.
+//
+// The app and version retrieval protocol is defined as follows:
+//
+//	CLA | INS | P1 | P2 | Lc
+//	----+-----+----+----+----
+//	 B0 | 01  | 00 | 00 | 00
+//
+// With no input data, and the output data being:
+//
+//	Description                   | Length
+//	------------------------------+-------------------
+//	Format (always 01)            | 1 byte
+//	Length of the app name        | 1 byte
+//	App name                      | arbitrary
+//	Length of the app version     | 1 byte
+//	App version                   | arbitrary
+//	Length of the flags           | 1 byte
+//	Flags                         | arbitrary
+func (w *ledgerDriver) ledgerApp() (string, error) {
+	// Send the request and wait for the response
+	reply, err := w.ledgerExchangeClass(context.Background(), ledgerClaDashboard, ledgerOpGetAppAndVersion, 0, 0, nil)
+	if err != nil {
+		return "", err
+	}
+	if len(reply) < 2 || reply[0] != 0x01 || len(reply) < 2+int(reply[1]) {
+		return "", errLedgerInvalidAppReply
+	}
+	return string(reply[2 : 2+int(reply[1])]), nil
 }
 
 // ledgerDerive retrieves the currently active Ethereum address from a Ledger
-// wallet at the specified derivation path.
+// wallet at the specified derivation path. If display is set, the Ledger shows
+// the address and waits for the user to confirm it before returning.
+func (w *ledgerDriver) ledgerDerive(derivationPath []uint32, display bool) (common.Address, error) {
+	if err := validatePath(derivationPath, ledgerMaxPathLength); err != nil {
+		return common.Address{}, err
+	}
+	p1 := ledgerP1DirectlyFetchAddress
+	if display {
+		p1 = ledgerP1ConfirmFetchAddress
+	}
+	address, pubkey, _, err := w.ledgerRetrieveAddress(derivationPath, p1, ledgerP2DiscardAddressChainCode)
+	if err != nil {
+		return common.Address{}, err
+	}
+	// If the user confirmed the address, make sure it belongs to the public key
+	if display {
+		if _, err := ledgerCheckPubkey(address, pubkey); err != nil {
+			return common.Address{}, err
+		}
+	}
+	return address, nil
+}
+
+// ledgerPublicKey retrieves the uncompressed public key at the specified derivation
+// path from a Ledger wallet, making sure it belongs to the address reported along.
+func (w *ledgerDriver) ledgerPublicKey(derivationPath []uint32) (*ecdsa.PublicKey, error) {
+	if err := validatePath(derivationPath, ledgerMaxPathLength); err != nil {
+		return nil, err
+	}
+	address, pubkey, _, err := w.ledgerRetrieveAddress(derivationPath, ledgerP1DirectlyFetchAddress, ledgerP2DiscardAddressChainCode)
+	if err != nil {
+		return nil, err
+	}
+	return ledgerCheckPubkey(address, pubkey)
+}
+
+// ledgerCheckPubkey parses an uncompressed public key returned by the Ledger and
+// checks that it hashes to the address returned in the same reply.
+func ledgerCheckPubkey(address common.Address, pubkey []byte) (*ecdsa.PublicKey, error) {
+	key, err := crypto.UnmarshalPubkey(pubkey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key in reply: %w", err)
+	}
+	if derived := crypto.PubkeyToAddress(*key); derived != address {
+		return nil, fmt.Errorf("address mismatch: displayed %s, derived %s", address.Hex(), derived.Hex())
+	}
+	return key, nil
+}
+
+// ledgerNormalizePubkey converts a public key returned by the Ledger into the 65
+// byte uncompressed form. Depending on the app version, the key is returned either
+// uncompressed (with or without the 0x04 prefix) or compressed.
+func ledgerNormalizePubkey(pubkey []byte) ([]byte, error) {
+	switch {
+	case len(pubkey) == 65 && pubkey[0] == 0x04:
+		return pubkey, nil
+	case len(pubkey) == 64:
+		return append([]byte{0x04}, pubkey...), nil
+	case len(pubkey) == 33 && (pubkey[0] == 0x02 || pubkey[0] == 0x03):
+		key, err := crypto.DecompressPubkey(pubkey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key in reply: %w", err)
+		}
+		return crypto.FromECDSAPub(key), nil
+	default:
+		return nil, fmt.Errorf("invalid public key in reply: %d bytes", len(pubkey))
+	}
+}
+
+// ledgerExtendedPublicKey retrieves the public key and chain code at the specified
+// derivation path from a Ledger wallet, assembling them into an extended public
+// key. The parent's public key is retrieved too to fill in its fingerprint.
+func (w *ledgerDriver) ledgerExtendedPublicKey(derivationPath []uint32) (*hdkeychain.ExtendedKey, error) {
+	if err := validatePath(derivationPath, ledgerMaxPathLength); err != nil {
+		return nil, err
+	}
+	_, pubkey, chainCode, err := w.ledgerRetrieveAddress(derivationPath, ledgerP1DirectlyFetchAddress, ledgerP2ReturnAddressChainCode)
+	if err != nil {
+		return nil, err
+	}
+	_, parent, _, err := w.ledgerRetrieveAddress(derivationPath[:len(derivationPath)-1], ledgerP1DirectlyFetchAddress, ledgerP2DiscardAddressChainCode)
+	if err != nil {
+		return nil, err
+	}
+	return newExtendedPublicKey(derivationPath, pubkey, chainCode, parent)
+}
+
+// ledgerEncodePath validates a derivation path and flattens it into the format
+// every Ledger request expects it in: a single byte component count followed by
+// the big endian components. The components are written verbatim, so hardened
+// ones keep their 0x80000000 marker exactly as accounts.ParseDerivationPath set
+// it, without it ever being applied again.
+func ledgerEncodePath(derivationPath []uint32) ([]byte, error) {
+	if err := validatePath(derivationPath, ledgerMaxPathLength); err != nil {
+		return nil, err
+	}
+	return ledgerAppendPath(make([]byte, 0, 1+4*len(derivationPath)), derivationPath), nil
+}
+
+// ledgerAppendPath flattens a derivation path onto buf without validating it, as
+// needed to address the master key (the parent of depth one paths).
+func ledgerAppendPath(buf []byte, derivationPath []uint32) []byte {
+	buf = append(buf, byte(len(derivationPath)))
+	for _, component := range derivationPath {
+		buf = binary.BigEndian.AppendUint32(buf, component)
+	}
+	return buf
+}
+
+// ledgerRetrieveAddress sends a derivation request to the Ledger wallet and
+// returns the Ethereum address, the uncompressed public key and, if requested,
+// the chain code located on the derivation path.
 //
 // The address derivation protocol is defined as follows:
 //
@@ -289,36 +1081,46 @@ func (w *ledgerDriver) ledgerVersion() ([3]byte, error) {
 //	Ethereum address length | 1 byte
 //	Ethereum address        | 40 bytes hex ascii
 //	Chain code if requested | 32 bytes
-func (w *ledgerDriver) ledgerDerive(derivationPath []uint32) (common.Address, error) {
-	// Flatten the derivation path into the Ledger request
-	path := make([]byte, 1+4*len(derivationPath))
-	path[0] = byte(len(derivationPath))
-	for i, component := range derivationPath {
-		binary.BigEndian.PutUint32(path[1+4*i:], component)
-	}
+func (w *ledgerDriver) ledgerRetrieveAddress(derivationPath []uint32, p1 ledgerParam1, p2 ledgerParam2) (common.Address, []byte, []byte, error) {
+	// Flatten the derivation path into the Ledger request, validated by the callers
+	path := ledgerAppendPath(nil, derivationPath)
+
 	// Send the request and wait for the response
-	reply, err := w.ledgerExchange(ledgerOpRetrieveAddress, ledgerP1DirectlyFetchAddress, ledgerP2DiscardAddressChainCode, path)
+	reply, err := w.ledgerExchange(ledgerOpRetrieveAddress, p1, p2, path)
 	if err != nil {
-		return common.Address{}, err
+		return common.Address{}, nil, nil, err
 	}
-	// Discard the public key, we don't need that for now
+	// Extract the public key
 	if len(reply) < 1 || len(reply) < 1+int(reply[0]) {
-		return common.Address{}, errors.New("reply lacks public key entry")
+		return common.Address{}, nil, nil, errors.New("reply lacks public key entry")
+	}
+	pubkey, err := ledgerNormalizePubkey(reply[1 : 1+int(reply[0])])
+	if err != nil {
+		return common.Address{}, nil, nil, err
 	}
 	reply = reply[1+int(reply[0]):]
 
 	// Extract the Ethereum hex address string
 	if len(reply) < 1 || len(reply) < 1+int(reply[0]) {
-		return common.Address{}, errors.New("reply lacks address entry")
+		return common.Address{}, nil, nil, errors.New("reply lacks address entry")
 	}
 	hexstr := reply[1 : 1+int(reply[0])]
+	reply = reply[1+int(reply[0]):]
 
-	// Decode the hex string into an Ethereum address and return
+	// Decode the hex string into an Ethereum address
 	var address common.Address
 	if _, err = hex.Decode(address[:], hexstr); err != nil {
-		return common.Address{}, err
+		return common.Address{}, nil, nil, err
 	}
-	return address, nil
+	// Extract the chain code if it was requested
+	var chainCode []byte
+	if p2 == ledgerP2ReturnAddressChainCode {
+		if len(reply) < 32 {
+			return common.Address{}, nil, nil, errors.New("reply lacks chain code entry")
+		}
+		chainCode = reply[:32]
+	}
+	return address, pubkey, chainCode, nil
 }
 
 // ledgerSign sends the transaction to the Ledger wallet, and waits for the user
@@ -355,40 +1157,25 @@ func (w *ledgerDriver) ledgerDerive(derivationPath []uint32) (common.Address, er
 //	signature V | 1 byte
 //	signature R | 32 bytes
 //	signature S | 32 bytes
-func (w *ledgerDriver) ledgerSign(derivationPath []uint32, tx *types.Transaction, chainID *big.Int) (common.Address, *types.Transaction, error) {
+//
+// If the stream is interrupted, no explicit reset is needed: the app discards the
+// partially received transaction when the next one's first block arrives, and the
+// next exchange drops any reply chunks left unread. A failed sign thus never leaks
+// continuation state into the next one on the same connection.
+func (w *ledgerDriver) ledgerSign(ctx context.Context, derivationPath []uint32, tx *types.Transaction, chainID *big.Int) (common.Address, *types.Transaction, error) {
 	// Flatten the derivation path into the Ledger request
-	path := make([]byte, 1+4*len(derivationPath))
-	path[0] = byte(len(derivationPath))
-	for i, component := range derivationPath {
-		binary.BigEndian.PutUint32(path[1+4*i:], component)
+	path, err := ledgerEncodePath(derivationPath)
+	if err != nil {
+		return common.Address{}, nil, err
+	}
+	// Typed transactions always carry their chain ID, use it if none was requested
+	if chainID == nil && tx.Type() != types.LegacyTxType {
+		chainID = tx.ChainId()
 	}
 	// Create the transaction RLP based on whether legacy or EIP155 signing was requested
-	var (
-		txrlp []byte
-		err   error
-	)
-	if chainID == nil {
-		if txrlp, err = rlp.EncodeToBytes([]interface{}{tx.Nonce(), tx.GasPrice(), tx.Gas(), tx.To(), tx.Value(), tx.Data()}); err != nil {
-			return common.Address{}, nil, err
-		}
-	} else {
-		if tx.Type() == types.DynamicFeeTxType {
-			if txrlp, err = rlp.EncodeToBytes([]interface{}{chainID, tx.Nonce(), tx.GasTipCap(), tx.GasFeeCap(), tx.Gas(), tx.To(), tx.Value(), tx.Data(), tx.AccessList()}); err != nil {
-				return common.Address{}, nil, err
-			}
-			// append type to transaction
-			txrlp = append([]byte{tx.Type()}, txrlp...)
-		} else if tx.Type() == types.AccessListTxType {
-			if txrlp, err = rlp.EncodeToBytes([]interface{}{chainID, tx.Nonce(), tx.GasPrice(), tx.Gas(), tx.To(), tx.Value(), tx.Data(), tx.AccessList()}); err != nil {
-				return common.Address{}, nil, err
-			}
-			// append type to transaction
-			txrlp = append([]byte{tx.Type()}, txrlp...)
-		} else if tx.Type() == types.LegacyTxType {
-			if txrlp, err = rlp.EncodeToBytes([]interface{}{tx.Nonce(), tx.GasPrice(), tx.Gas(), tx.To(), tx.Value(), tx.Data(), chainID, big.NewInt(0), big.NewInt(0)}); err != nil {
-				return common.Address{}, nil, err
-			}
-		}
+	txrlp, err := ledgerTxRLP(tx, chainID)
+	if err != nil {
+		return common.Address{}, nil, err
 	}
 	payload := append(path, txrlp...)
 
@@ -412,7 +1199,7 @@ func (w *ledgerDriver) ledgerSign(derivationPath []uint32, tx *types.Transaction
 			chunk = len(payload)
 		}
 		// Send the chunk over, ensuring it's processed correctly
-		reply, err = w.ledgerExchange(ledgerOpSignTransaction, p1, ledgerP2ProcessAndStartFlow, payload[:chunk])
+		reply, err = w.ledgerExchangeContext(ctx, ledgerOpSignTransaction, p1, ledgerP2ProcessAndStartFlow, payload[:chunk])
 		if err != nil {
 			return common.Address{}, nil, err
 		}
@@ -430,11 +1217,15 @@ func (w *ledgerDriver) ledgerSign(derivationPath []uint32, tx *types.Transaction
 	var signer types.Signer
 	if chainID == nil {
 		signer = new(types.HomesteadSigner)
+		// The app returns the 27 offset V, the signer expects the bare parity
+		signature[64] -= 27
 	} else {
 		signer = types.LatestSignerForChainID(chainID)
 		// For non-legacy transactions, V is 0 or 1, no need to subtract here.
 		if tx.Type() == types.LegacyTxType {
-			signature[64] -= byte(chainID.Uint64()*2 + 35)
+			if signature[64], err = ledgerParity(signature[64], chainID); err != nil {
+				return common.Address{}, nil, err
+			}
 		}
 	}
 	signed, err := tx.WithSignature(signer, signature)
@@ -448,6 +1239,176 @@ func (w *ledgerDriver) ledgerSign(derivationPath []uint32, tx *types.Transaction
 	return sender, signed, nil
 }
 
+// ledgerParity recovers the signature parity from the EIP-155 V value returned by
+// the Ledger for a legacy transaction. The app only returns the lowest byte of
+// V = chainID * 2 + 35 + parity, so the offset is computed on the full chain ID
+// modulo 256 rather than on a (possibly overflowing) fixed width integer.
+func ledgerParity(v byte, chainID *big.Int) (byte, error) {
+	offset := new(big.Int).Lsh(chainID, 1)
+	offset.Add(offset, big.NewInt(35))
+	offset.And(offset, big.NewInt(0xff))
+
+	parity := v - byte(offset.Uint64())
+	if parity > 1 {
+		return 0, fmt.Errorf("ledger: invalid signature V %d for chain %v", v, chainID)
+	}
+	return parity, nil
+}
+
+// ledgerTxRLP creates the unsigned transaction RLP streamed to the Ledger for
+// signing. Legacy transactions are encoded either in Homestead or EIP-155 mode
+// depending on whether a chain ID was requested, whereas typed transactions are
+// encoded as their EIP-2718 envelope: the type byte followed by the RLP list of
+// the signed fields.
+func ledgerTxRLP(tx *types.Transaction, chainID *big.Int) ([]byte, error) {
+	var fields []interface{}
+	switch tx.Type() {
+	case types.LegacyTxType:
+		if chainID == nil {
+			return rlp.EncodeToBytes([]interface{}{tx.Nonce(), tx.GasPrice(), tx.Gas(), tx.To(), tx.Value(), tx.Data()})
+		}
+		return rlp.EncodeToBytes([]interface{}{tx.Nonce(), tx.GasPrice(), tx.Gas(), tx.To(), tx.Value(), tx.Data(), chainID, big.NewInt(0), big.NewInt(0)})
+	case types.AccessListTxType:
+		// Note, an empty access list is a nil slice, which RLP encodes as an empty
+		// list. The field must never be omitted as the app validates the count.
+		fields = []interface{}{chainID, tx.Nonce(), tx.GasPrice(), tx.Gas(), tx.To(), tx.Value(), tx.Data(), tx.AccessList()}
+	case types.DynamicFeeTxType:
+		fields = []interface{}{chainID, tx.Nonce(), tx.GasTipCap(), tx.GasFeeCap(), tx.Gas(), tx.To(), tx.Value(), tx.Data(), tx.AccessList()}
+	case types.SetCodeTxType:
+		// Each authorization tuple encodes as (chainID, address, nonce, yParity, r, s)
+		fields = []interface{}{chainID, tx.Nonce(), tx.GasTipCap(), tx.GasFeeCap(), tx.Gas(), tx.To(), tx.Value(), tx.Data(), tx.AccessList(), tx.SetCodeAuthorizations()}
+	case types.BlobTxType:
+		// The blob sidecar is not part of the signed payload, only the hashes are
+		fields = []interface{}{chainID, tx.Nonce(), tx.GasTipCap(), tx.GasFeeCap(), tx.Gas(), tx.To(), tx.Value(), tx.Data(), tx.AccessList(), tx.BlobGasFeeCap(), tx.BlobHashes()}
+	default:
+		return nil, fmt.Errorf("ledger: unsupported transaction type %d", tx.Type())
+	}
+	txrlp, err := rlp.EncodeToBytes(fields)
+	if err != nil {
+		return nil, err
+	}
+	// Prepend the type byte to the transaction
+	return append([]byte{tx.Type()}, txrlp...), nil
+}
+
+// ledgerSignAuthorization sends an EIP-7702 authorization to the Ledger wallet,
+// and waits for the user to confirm or deny delegating the account's code.
+//
+// The authorization signing protocol is defined as follows:
+//
+//	CLA | INS | P1 | P2 | Lc  | Le
+//	----+-----+----+----+-----+---
+//	 E0 | 34  | 01: first authorization data block
+//	            00: subsequent authorization data block
+//	               | 00 | variable | variable
+//
+// Where the input for the first authorization block (first 255 bytes) is:
+//
+//	Description                                      | Length
+//	-------------------------------------------------+----------
+//	Number of BIP 32 derivations to perform (max 10) | 1 byte
+//	First derivation index (big endian)              | 4 bytes
+//	...                                              | 4 bytes
+//	Last derivation index (big endian)               | 4 bytes
+//	Authorization TLV length (big endian)            | 2 bytes
+//	Authorization TLV chunk                          | arbitrary
+//
+// And the authorization is TLV encoded (1 byte tag, 1 byte length, value) as:
+//
+//	Tag | Description
+//	----+------------------------------
+//	 00 | Structure version (always 1)
+//	 01 | Delegate address
+//	 02 | Chain ID (big endian)
+//	 03 | Nonce (big endian)
+//
+// And the output data is:
+//
+//	Description    | Length
+//	---------------+---------
+//	signature V    | 1 byte
+//	signature R    | 32 bytes
+//	signature S    | 32 bytes
+func (w *ledgerDriver) ledgerSignAuthorization(ctx context.Context, derivationPath []uint32, auth types.SetCodeAuthorization) ([]byte, error) {
+	// Flatten the derivation path into the Ledger request
+	path, err := ledgerEncodePath(derivationPath)
+	if err != nil {
+		return nil, err
+	}
+	// Create the TLV encoded authorization
+	nonce := new(big.Int).SetUint64(auth.Nonce).Bytes()
+
+	tlv := []byte{0x00, 1, 1}
+	tlv = append(append(tlv, 0x01, common.AddressLength), auth.Address[:]...)
+	tlv = append(append(tlv, 0x02, byte(len(auth.ChainID.Bytes()))), auth.ChainID.Bytes()...)
+	tlv = append(append(tlv, 0x03, byte(len(nonce))), nonce...)
+
+	payload := binary.BigEndian.AppendUint16(path, uint16(len(tlv)))
+	payload = append(payload, tlv...)
+
+	// Send the request and wait for the response
+	var (
+		p1    = ledgerP1InitAuthorizationData
+		reply []byte
+	)
+	for len(payload) > 0 {
+		// Calculate the size of the next data chunk
+		chunk := 255
+		if chunk > len(payload) {
+			chunk = len(payload)
+		}
+		// Send the chunk over, ensuring it's processed correctly
+		reply, err = w.ledgerExchangeContext(ctx, ledgerOpSignAuthorization, p1, 0, payload[:chunk])
+		if err != nil {
+			return nil, err
+		}
+		// Shift the payload and ensure subsequent chunks are marked as such
+		payload = payload[chunk:]
+		p1 = ledgerP1ContAuthorizationData
+	}
+	// Extract the Ethereum signature and do a sanity validation
+	if len(reply) != crypto.SignatureLength {
+		return nil, errors.New("reply lacks signature")
+	}
+	signature := append(reply[1:], reply[0])
+
+	// Authorizations carry the bare parity bit, strip any legacy offset
+	if signature[64] >= 27 {
+		signature[64] -= 27
+	}
+	return signature, nil
+}
+
+// ledgerProvideTokenInfo sends a signed ERC-20 token descriptor to the Ledger, to
+// be used when displaying the next transaction.
+//
+// The provisioning protocol is defined as follows:
+//
+//	CLA | INS | P1 | P2 | Lc       | Le
+//	----+-----+----+----+----------+---
+//	 E0 | 0A  | 00 | 00 | variable | 00
+//
+// Where the input is:
+//
+//	Description                   | Length
+//	------------------------------+----------
+//	Ticker length                 | 1 byte
+//	Ticker                        | variable
+//	Token contract address        | 20 bytes
+//	Number of decimals            | 4 bytes
+//	Chain ID                      | 4 bytes
+//	Token information signature   | variable
+func (w *ledgerDriver) ledgerProvideTokenInfo(ctx context.Context, token LedgerTokenInfo) error {
+	payload := append([]byte{byte(len(token.Ticker))}, token.Ticker...)
+	payload = append(payload, token.Address.Bytes()...)
+	payload = binary.BigEndian.AppendUint32(payload, token.Decimals)
+	payload = binary.BigEndian.AppendUint32(payload, token.ChainID)
+	payload = append(payload, token.Signature...)
+
+	_, err := w.ledgerExchangeContext(ctx, ledgerOpProvideERC20, 0, 0, payload)
+	return err
+}
+
 // ledgerSignTypedHash sends the transaction to the Ledger wallet, and waits for the user
 // to confirm or deny the transaction.
 //
@@ -477,20 +1438,16 @@ func (w *ledgerDriver) ledgerSign(derivationPath []uint32, tx *types.Transaction
 //	signature S | 32 bytes
 func (w *ledgerDriver) ledgerSignTypedHash(derivationPath []uint32, domainHash []byte, messageHash []byte) ([]byte, error) {
 	// Flatten the derivation path into the Ledger request
-	path := make([]byte, 1+4*len(derivationPath))
-	path[0] = byte(len(derivationPath))
-	for i, component := range derivationPath {
-		binary.BigEndian.PutUint32(path[1+4*i:], component)
+	path, err := ledgerEncodePath(derivationPath)
+	if err != nil {
+		return nil, err
 	}
 	// Create the 712 message
 	payload := append(path, domainHash...)
 	payload = append(payload, messageHash...)
 
 	// Send the request and wait for the response
-	var (
-		reply []byte
-		err   error
-	)
+	var reply []byte
 
 	// Send the message over, ensuring it's processed correctly
 	reply, err = w.ledgerExchange(ledgerOpSignTypedMessage, ledgerP1InitTypedMessageData, ledgerP2V0Implementation, payload)
@@ -541,23 +1498,113 @@ func (w *ledgerDriver) ledgerSignTypedHash(derivationPath []uint32, domainHash [
 //	APDU length              | 1 byte
 //	Optional APDU data       | arbitrary
 func (w *ledgerDriver) ledgerExchange(opcode ledgerOpcode, p1 ledgerParam1, p2 ledgerParam2, data []byte) ([]byte, error) {
-	for i := 1; ; i++ {
-		res, err := w._ledgerExchange(opcode, p1, p2, data)
-		// on failure, try the exchange 3 times in total
-		if err == nil || i == 3 {
-			return res, err
+	return w.ledgerExchangeContext(context.Background(), opcode, p1, p2, data)
+}
+
+// ledgerExchangeContext is identical to ledgerExchange, but stops waiting for the
+// reply of the device if the context is cancelled (or Cancel is called), returning
+// context.Canceled or the context's error. The configured timeouts are applied on
+// top of the context, depending on whether the request prompts the user.
+//
+// A USB read cannot be interrupted, and the Ledger will eventually answer the
+// abandoned request (e.g. when the user dismisses the prompt). To avoid the next
+// exchange receiving that stale reply, the cancelled exchange keeps running in
+// the background and any subsequent exchange fails with ErrLedgerBusy until it
+// drained the device. Waiting for it instead would hold the wallet's lock for
+// as long as the user leaves the prompt open, blocking even Close.
+func (w *ledgerDriver) ledgerExchangeContext(ctx context.Context, opcode ledgerOpcode, p1 ledgerParam1, p2 ledgerParam2, data []byte) ([]byte, error) {
+	return w.ledgerExchangeClass(ctx, ledgerClaEthereum, opcode, p1, p2, data)
+}
+
+// ledgerExchangeClass is identical to ledgerExchangeContext, but sends the request
+// with the given instruction class instead of the Ethereum app's one.
+func (w *ledgerDriver) ledgerExchangeClass(ctx context.Context, cla ledgerClass, opcode ledgerOpcode, p1 ledgerParam1, p2 ledgerParam2, data []byte) ([]byte, error) {
+	// Limit the exchange depending on whether the user is prompted
+	if timeout := w.timeouts.timeout(ledgerInteractive(cla, opcode, p1)); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	// Refuse to send anything until a previously cancelled exchange consumed its reply
+	if w.pending != nil {
+		select {
+		case <-w.pending:
+			w.pending = nil
+		default:
+			return nil, ErrLedgerBusy
 		}
 	}
+	// Don't send anything if cancelled in the mean time (e.g. between two chunks)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// Allow the exchange to be aborted by Cancel too
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w.abortLock.Lock()
+	w.abort = cancel
+	w.abortLock.Unlock()
+
+	defer func() {
+		w.abortLock.Lock()
+		w.abort = nil
+		w.abortLock.Unlock()
+	}()
+	var (
+		done  = make(chan struct{})
+		reply []byte
+		err   error
+	)
+	go func() {
+		defer close(done)
+
+		// Status words are never retried, so the user is never prompted twice
+		err = retryExchange(w.retry, w.device, w.log, func() (err error) {
+			reply, err = w._ledgerExchange(cla, opcode, p1, p2, data)
+			return err
+		})
+	}()
+	select {
+	case <-done:
+		return reply, err
+	case <-ctx.Done():
+		w.pending = done
+		return nil, ctx.Err()
+	}
+}
+
+// ledgerInteractive reports whether the device may wait for the user to review
+// and confirm the request before replying. All chunks of a signing request count,
+// as the app may start displaying the payload before receiving it in full.
+func ledgerInteractive(cla ledgerClass, opcode ledgerOpcode, p1 ledgerParam1) bool {
+	if cla != ledgerClaEthereum {
+		return false
+	}
+	switch opcode {
+	case ledgerOpSignTransaction, ledgerOpSignPersonalMessage, ledgerOpSignTypedMessage, ledgerOpSignAuthorization, ledgerOpEip712SendStructImpl:
+		return true
+	case ledgerOpRetrieveAddress:
+		return p1 == ledgerP1ConfirmFetchAddress
+	}
+	return false
 }
 
-func (w *ledgerDriver) _ledgerExchange(opcode ledgerOpcode, p1 ledgerParam1, p2 ledgerParam2, data []byte) ([]byte, error) {
+func (w *ledgerDriver) _ledgerExchange(cla ledgerClass, opcode ledgerOpcode, p1 ledgerParam1, p2 ledgerParam2, data []byte) ([]byte, error) {
+	// The payload length is a single byte, longer data must be split by the caller
+	if len(data) > 255 {
+		return nil, fmt.Errorf("ledger: APDU payload too long: %d bytes", len(data))
+	}
 	// Construct the message payload, possibly split into multiple chunks
 	apdu := make([]byte, 2, 7+len(data))
 
 	binary.BigEndian.PutUint16(apdu, uint16(5+len(data)))
-	apdu = append(apdu, []byte{0xe0, byte(opcode), byte(p1), byte(p2), byte(len(data))}...)
+	apdu = append(apdu, []byte{byte(cla), byte(opcode), byte(p1), byte(p2), byte(len(data))}...)
 	apdu = append(apdu, data...)
 
+	if w.traffic != nil {
+		w.traffic.Debug("Ledger APDU sent", "cla", byte(cla), "ins", byte(opcode), "p1", byte(p1), "p2", byte(p2), "len", len(data))
+	}
 	// Stream all the chunks to the device
 	header := []byte{0x01, 0x01, 0x05, 0x00, 0x00} // Channel ID and command tag appended
 	chunk := make([]byte, 64)
@@ -578,50 +1625,113 @@ func (w *ledgerDriver) _ledgerExchange(opcode ledgerOpcode, p1 ledgerParam1, p2
 		// Send over to the device
 		w.log.Trace("Data chunk sent to the Ledger", "chunk", hexutil.Bytes(chunk))
 		if _, err := w.device.Write(chunk); err != nil {
-			return nil, err
+			return nil, &transportError{err: err, sent: i > 0}
 		}
 	}
-	// Stream the reply back from the wallet in 64 byte chunks
-	var reply []byte
-	chunk = chunk[:64] // Yeah, we surely have enough space
+	// Stream the reply back from the wallet
+	reply, err := ledgerReadReply(w.device, w.log)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) < 2 {
+		return nil, errLedgerInvalidStatus
+	}
+	status := ledgerStatus(binary.BigEndian.Uint16(reply[len(reply)-2:]))
+	if w.traffic != nil {
+		w.traffic.Debug("Ledger APDU received", "ins", byte(opcode), "status", fmt.Sprintf("0x%04x", uint16(status)), "len", len(reply)-2)
+	}
+	if status != ledgerStatusNormalEnd {
+		return nil, &ledgerError{status: status}
+	}
+	return reply[:len(reply)-2], nil
+}
+
+// ledgerReadReply reads a framed reply from the Ledger and reassembles its APDU.
+//
+// The device sends the reply in 64 byte frames, but reads may return them in
+// arbitrary fragments (e.g. a device under load), so the frames are parsed as a
+// byte stream instead of at fixed offsets: every frame but the last is full, so
+// the next header directly follows the payload of the previous frame. Anything
+// read past the end of the reply is the padding of the last frame and dropped.
+func ledgerReadReply(device io.Reader, logger log.Logger) ([]byte, error) {
+	var (
+		chunk   = make([]byte, 64)
+		pending []byte // Bytes read from the device but not yet parsed
+		offset  int    // Position within the 64 byte frame being read
+		reply   []byte // Reassembled reply, nil until its first frame arrives
+		seq     uint16 // Sequence index of the next expected frame
+	)
+	// fill reads from the device until at least n unparsed bytes are available
+	fill := func(n int) error {
+		for len(pending) < n {
+			// Never read past the current frame, keeping stream transports aligned
+			read, err := device.Read(chunk[:64-offset])
+			if read > 0 {
+				offset = (offset + read) % 64
+				logger.Trace("Data chunk received from the Ledger", "chunk", hexutil.Bytes(chunk[:read]))
+				pending = append(pending, chunk[:read]...)
+			}
+			if len(pending) >= n {
+				return nil
+			}
+			if err != nil {
+				// Replies are only read after a complete request, which the
+				// device may already act on, so the exchange isn't retried
+				return &transportError{err: err, sent: true}
+			}
+		}
+		return nil
+	}
 	for {
-		// Read the next chunk from the Ledger wallet
-		if _, err := io.ReadFull(w.device, chunk); err != nil {
+		// Make sure the transport header matches
+		if err := fill(5); err != nil {
 			return nil, err
 		}
-		w.log.Trace("Data chunk received from the Ledger", "chunk", hexutil.Bytes(chunk))
-
-		// Make sure the transport header matches
-		if chunk[0] != 0x01 || chunk[1] != 0x01 || chunk[2] != 0x05 {
+		if pending[0] != 0x01 || pending[1] != 0x01 || pending[2] != 0x05 {
 			return nil, errLedgerReplyInvalidHeader
 		}
-		// If it's the first chunk, retrieve the total message length
-		var payload []byte
+		index := binary.BigEndian.Uint16(pending[3:5])
+		if reply == nil && index != 0 {
+			// Leftover of a reply abandoned by an interrupted exchange, drop it
+			logger.Debug("Dropping stale Ledger reply chunk", "seq", index)
+			if err := fill(64); err != nil {
+				return nil, err
+			}
+			pending = pending[64:]
+			continue
+		}
+		if index != seq {
+			return nil, fmt.Errorf("ledger: reply chunk %d out of sequence, want %d", index, seq)
+		}
+		pending = pending[5:]
 
-		if chunk[3] == 0x00 && chunk[4] == 0x00 {
-			reply = make([]byte, 0, int(binary.BigEndian.Uint16(chunk[5:7])))
-			payload = chunk[7:]
-		} else {
-			payload = chunk[5:]
+		// If it's the first chunk, retrieve the total message length. It may
+		// arrive in a different read than the header, so fill it separately.
+		space := 59
+		if index == 0 {
+			if err := fill(2); err != nil {
+				return nil, err
+			}
+			reply = make([]byte, 0, int(binary.BigEndian.Uint16(pending)))
+			pending, space = pending[2:], 57
 		}
-		// Append to the reply and stop when filled up
-		if left := cap(reply) - len(reply); left > len(payload) {
-			reply = append(reply, payload...)
-		} else {
-			reply = append(reply, payload[:left]...)
-			break
+		// Append the payload of the frame and stop when filled up
+		need := min(space, cap(reply)-len(reply))
+		if err := fill(need); err != nil {
+			return nil, err
 		}
-	}
-	if len(reply) < 2 {
-		return nil, errLedgerInvalidStatus
-	}
-	status := ledgerStatus(binary.BigEndian.Uint16(reply[len(reply)-2:]))
-	if status != ledgerStatusNormalEnd {
-		s := ledgerStatuses[status]
-		if s == "" {
-			s = "unknown error"
+		reply = append(reply, pending[:need]...)
+		pending = pending[need:]
+
+		if len(reply) == cap(reply) {
+			// Drain the padding of the last frame, so the next reply starts aligned
+			if offset != 0 {
+				if err := fill(len(pending) + 64 - offset); err != nil {
+					return nil, err
+				}
+			}
+			return reply, nil
 		}
-		return nil, fmt.Errorf("%w: 0x%s (%s)", errLedgerInvalidStatus, strconv.FormatUint(uint64(status), 16), s)
+		seq++
 	}
-	return reply[:len(reply)-2], nil
 }
@@ -1,15 +1,14 @@
 package usbwallet
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
-	"math/big"
 	"strings"
 
 	"github.com/ethereum/go-ethereum/accounts"
-	"github.com/ethereum/go-ethereum/common/math"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/signer/core/apitypes"
 )
@@ -18,6 +17,7 @@ const (
 	ledgerOpSignPersonalMessage  ledgerOpcode = 0x08 // Signs a personal message following the EIP 712 specification
 	ledgerOpEip712SendStructDef  ledgerOpcode = 0x1a // Sends EIP-712 struct types to the ledger
 	ledgerOpEip712SendStructImpl ledgerOpcode = 0x1c // Sends EIP-712 struct values to the ledger
+	ledgerOpEip712Filtering      ledgerOpcode = 0x1e // Sends EIP-712 clear signing filters to the ledger
 
 	ledgerP1CompleteSend       ledgerParam1 = 0x00 // Complete the value (in one go, or after partial)
 	ledgerP1PartialSend        ledgerParam1 = 0x01 // Send partial data
@@ -26,11 +26,53 @@ const (
 	ledgerP2Array              ledgerParam2 = 0x0f // Send EIP-712 array
 	ledgerP2StructField        ledgerParam2 = 0xff // Send EIP-712 struct field
 	ledgerP2FullImplementation ledgerParam2 = 0x01 // EIP-712 full implementation (typed data)
+	ledgerP2FilterActivate     ledgerParam2 = 0x00 // Activate EIP-712 filtering
+	ledgerP2FilterMessageInfo  ledgerParam2 = 0x0f // Send EIP-712 filtered message info (contract name)
+	ledgerP2FilterRawField     ledgerParam2 = 0xff // Send EIP-712 filter for a raw field
+
+	ledgerEip712MaxArrayLength = 255 // Maximum EIP-712 array length, encoded on a single byte by the app
+	ledgerEip712MaxDefLength   = 255 // Maximum EIP-712 struct definition payload, not splittable across APDUs
 )
 
+// ErrLedgerTypedDataTooComplex is returned if an EIP-712 message cannot be streamed
+// to the Ledger, either because it exceeds the limits of the protocol (e.g. a too
+// long struct definition or array) or because the app ran out of memory.
+var ErrLedgerTypedDataTooComplex = errors.New("ledger: typed data too complex for the device")
+
+// ErrLedgerMessageTooLong is returned if a personal message exceeds the length
+// limit of Ledger signing, see WithLedgerMaxMessageSize.
+var ErrLedgerMessageTooLong = errors.New("ledger: message too long")
+
+// ledgerFilteringVersion is the first Ethereum app version supporting EIP-712
+// clear signing filters.
+var ledgerFilteringVersion = [3]byte{1, 10, 0}
+
+// LedgerEIP712Filters contains the clear signing filters of an EIP-712 message,
+// as issued (and signed) by Ledger for the verifying contract. With filters, the
+// device displays the contract name and the labelled fields instead of the raw
+// struct, hiding all fields without a filter.
+type LedgerEIP712Filters struct {
+	Name      string              // Contract name displayed for the message
+	Signature []byte              // Ledger signature over the message info
+	Fields    []LedgerEIP712Field // Filters of the message fields to display
+}
+
+// LedgerEIP712Field is the clear signing filter of a single EIP-712 message field.
+type LedgerEIP712Field struct {
+	Path      string // Dot separated path of the field in the message, "[]" for array items
+	Label     string // Label displayed instead of the field name
+	Signature []byte // Ledger signature over the field filter
+}
+
 // SignText implements usbwallet.driver, sending the message to the Ledger and
 // waiting for the user to confirm or deny the signature.
 func (w *ledgerDriver) SignText(path accounts.DerivationPath, text []byte) ([]byte, error) {
+	return w.SignTextContext(context.Background(), path, text)
+}
+
+// SignTextContext is identical to SignText, but aborts waiting for the user to
+// confirm or deny the signature if the context is cancelled, returning ctx.Err().
+func (w *ledgerDriver) SignTextContext(ctx context.Context, path accounts.DerivationPath, text []byte) ([]byte, error) {
 	// If the Ethereum app doesn't run, abort
 	if w.offline() {
 		return nil, accounts.ErrWalletClosed
@@ -41,23 +83,94 @@ func (w *ledgerDriver) SignText(path accounts.DerivationPath, text []byte) ([]by
 		return nil, fmt.Errorf("Ledger version >= 1.5.0 required for EIP-712 signing (found version v%d.%d.%d)", w.version[0], w.version[1], w.version[2])
 	}
 	// All infos gathered and metadata checks out, request signing
-	return w.ledgerSignPersonalMessage(path, text)
+	ctx, done := w.ledgerFlow(ctx)
+	defer done()
+
+	return w.ledgerSignPersonalMessage(ctx, path, text)
 }
 
 // SignedTypedData implements usbwallet.driver, sending the message to the Ledger and
 // waiting for the user to sign or deny signing an EIP-712 typed data struct.
 func (w *ledgerDriver) SignedTypedData(path accounts.DerivationPath, data apitypes.TypedData) ([]byte, error) {
+	return w.SignedTypedDataFiltered(path, data, nil)
+}
+
+// SignedTypedDataFiltered is identical to SignedTypedData, but sends the clear
+// signing filters along with the message so the device can display it in a human
+// readable form. If the app is too old to support filtering, they are ignored.
+func (w *ledgerDriver) SignedTypedDataFiltered(path accounts.DerivationPath, data apitypes.TypedData, filters *LedgerEIP712Filters) ([]byte, error) {
+	data, err := decodeTypedBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return w.signTypedDataValues(path, data, newTypedDataValues(data), filters, func() ([]byte, []byte, error) {
+		return typedDataHashes(data)
+	})
+}
+
+// SignedTypedDataStream implements usbwallet.driver, streaming the message values
+// pulled from message to the Ledger as the device consumes them.
+func (w *ledgerDriver) SignedTypedDataStream(path accounts.DerivationPath, data apitypes.TypedData, message TypedDataValues) ([]byte, error) {
+	return w.signTypedDataValues(path, data, message, nil, func() ([]byte, []byte, error) {
+		domainHash, err := data.HashStruct("EIP712Domain", typedDomainMap(data))
+		if err != nil {
+			return nil, nil, err
+		}
+		messageHash, err := hashTypedDataValues(data, message)
+		if err != nil {
+			return nil, nil, err
+		}
+		return domainHash, messageHash, nil
+	})
+}
+
+// signTypedDataValues streams the typed data, with the message values provided by
+// message, to the Ledger and waits for the user to sign or deny signing it. If the
+// message is too complex for the device and hash fallback is enabled, the hashes
+// computed by hash are blind signed instead.
+func (w *ledgerDriver) signTypedDataValues(path accounts.DerivationPath, data apitypes.TypedData, message TypedDataValues, filters *LedgerEIP712Filters, hash func() (domainHash []byte, messageHash []byte, err error)) ([]byte, error) {
 	// If the Ethereum app doesn't run, abort
 	if w.offline() {
 		return nil, accounts.ErrWalletClosed
 	}
 	// Ensure the wallet is capable of signing the given transaction
-	if w.version[0] < 1 && w.version[1] < 5 {
+	if !w.atLeast(ledgerEip712Version) {
 		//lint:ignore ST1005 brand name displayed on the console
 		return nil, fmt.Errorf("Ledger version >= 1.5.0 required for EIP-712 signing (found version v%d.%d.%d)", w.version[0], w.version[1], w.version[2])
 	}
+	if filters != nil && !w.atLeast(ledgerFilteringVersion) {
+		w.log.Debug("Ledger app too old for EIP-712 filtering, ignoring filters", "version", fmt.Sprintf("v%d.%d.%d", w.version[0], w.version[1], w.version[2]))
+		filters = nil
+	}
 	// All infos gathered and metadata checks out, request signing
-	return w.ledgerSignTypedData(path, data)
+	signature, err := w.ledgerSignTypedData(path, data, message, filters)
+	if err == nil || !ledgerTypedDataTooComplex(err) {
+		return signature, err
+	}
+	if !errors.Is(err, ErrLedgerTypedDataTooComplex) {
+		err = fmt.Errorf("%w: %w", ErrLedgerTypedDataTooComplex, err)
+	}
+	if !w.hashFallback {
+		return nil, err
+	}
+	// The message can't be streamed, but the user opted into blind signing its hash
+	w.log.Warn("Typed data too complex for the Ledger, falling back to hash signing", "err", err)
+
+	domainHash, messageHash, herr := hash()
+	if herr != nil {
+		return nil, fmt.Errorf("ledger: error hashing typed data: %w", herr)
+	}
+	return w.SignTypedHash(path, domainHash, messageHash)
+}
+
+// ledgerTypedDataTooComplex reports whether streaming an EIP-712 message failed
+// due to the limits of the protocol or of the device's memory.
+func ledgerTypedDataTooComplex(err error) bool {
+	var lerr *ledgerError
+	if errors.As(err, &lerr) && lerr.status == ledgerStatusInsufficientMemory {
+		return true
+	}
+	return errors.Is(err, ErrLedgerTypedDataTooComplex)
 }
 
 // ledgerSignPersonalMessage sends the transaction to the Ledger wallet, and waits for the user
@@ -67,9 +180,11 @@ func (w *ledgerDriver) SignedTypedData(path accounts.DerivationPath, data apityp
 //
 //	CLA | INS | P1 | P2                          | Lc  | Le
 //	----+-----+----+-----------------------------+-----+---
-//	 E0 | 08  | 00 | implementation version : 00 | variable | variable
+//	 E0 | 08  | 00: first message data block
+//	            80: subsequent message data block
+//	                 | implementation version : 00 | variable | variable
 //
-// Where the input is:
+// Where the input for the first message block (first 255 bytes) is:
 //
 //	Description                                      | Length
 //	-------------------------------------------------+----------
@@ -77,7 +192,14 @@ func (w *ledgerDriver) SignedTypedData(path accounts.DerivationPath, data apityp
 //	First derivation index (big endian)              | 4 bytes
 //	...                                              | 4 bytes
 //	Last derivation index (big endian)               | 4 bytes
-//	text                                             | arbitrary
+//	Text length (big endian)                         | 4 bytes
+//	Text chunk                                       | arbitrary
+//
+// And the input for subsequent message blocks (first 255 bytes) are:
+//
+//	Description | Length
+//	------------+----------
+//	Text chunk  | arbitrary
 //
 // And the output data is:
 //
@@ -86,28 +208,37 @@ func (w *ledgerDriver) SignedTypedData(path accounts.DerivationPath, data apityp
 //	signature V | 1 byte
 //	signature R | 32 bytes
 //	signature S | 32 bytes
-func (w *ledgerDriver) ledgerSignPersonalMessage(derivationPath []uint32, text []byte) ([]byte, error) {
+func (w *ledgerDriver) ledgerSignPersonalMessage(ctx context.Context, derivationPath []uint32, text []byte) ([]byte, error) {
 	// Flatten the derivation path into the Ledger request
-	path := make([]byte, 5+4*len(derivationPath))
-	path[0] = byte(len(derivationPath))
-	for i, component := range derivationPath {
-		binary.BigEndian.PutUint32(path[1+4*i:], component)
+	path, err := ledgerEncodePath(derivationPath)
+	if err != nil {
+		return nil, err
 	}
-	binary.BigEndian.PutUint32(path[1+4*len(derivationPath):], uint32(len(text)))
+	if uint64(len(text)) > w.maxMessage {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrLedgerMessageTooLong, len(text), w.maxMessage)
+	}
+	path = binary.BigEndian.AppendUint32(path, uint32(len(text)))
+
 	// Create the 712 message
 	payload := append(path, text...)
 
 	// Send the request and wait for the response
 	var (
+		p1    = ledgerP1InitTransactionData
 		reply []byte
-		err   error
 	)
+	for len(payload) > 0 {
+		// Calculate the size of the next data chunk
+		chunk := min(len(payload), 255)
 
-	// Send the message over, ensuring it's processed correctly
-	reply, err = w.ledgerExchange(ledgerOpSignPersonalMessage, ledgerP1InitTransactionData, 0, payload)
-
-	if err != nil {
-		return nil, err
+		// Send the chunk over, ensuring it's processed correctly
+		reply, err = w.ledgerExchangeContext(ctx, ledgerOpSignPersonalMessage, p1, 0, payload[:chunk])
+		if err != nil {
+			return nil, err
+		}
+		// Shift the payload and ensure subsequent chunks are marked as such
+		payload = payload[chunk:]
+		p1 = ledgerP1ContTransactionData
 	}
 
 	// Extract the Ethereum signature and do a sanity validation
@@ -123,6 +254,9 @@ func (w *ledgerDriver) ledgerSignPersonalMessage(derivationPath []uint32, text [
 //
 // The typed data struct fields and values need to be sent to the Ledger first.
 // See https://github.com/LedgerHQ/app-ethereum/blob/develop/doc/eip712.md.
+// If clear signing filters are given, filtering is activated after the struct
+// definitions, the message info is sent after the domain values and each field
+// filter right before the value it applies to.
 //
 // After the data is sent, the signing protocol is defined as follows:
 //
@@ -146,17 +280,66 @@ func (w *ledgerDriver) ledgerSignPersonalMessage(derivationPath []uint32, text [
 //	signature V | 1 byte
 //	signature R | 32 bytes
 //	signature S | 32 bytes
-func (w *ledgerDriver) ledgerSignTypedData(derivationPath []uint32, data apitypes.TypedData) ([]byte, error) {
+func (w *ledgerDriver) ledgerSignTypedData(derivationPath []uint32, data apitypes.TypedData, message TypedDataValues, filters *LedgerEIP712Filters) ([]byte, error) {
+	// Flatten the derivation path into the Ledger request
+	path, err := ledgerEncodePath(derivationPath)
+	if err != nil {
+		return nil, err
+	}
+	ctx, done := w.ledgerFlow(context.Background())
+	defer done()
+
+	exchange := func(opcode ledgerOpcode, p1 ledgerParam1, p2 ledgerParam2, data []byte) ([]byte, error) {
+		return w.ledgerExchangeContext(ctx, opcode, p1, p2, data)
+	}
+	if err := ledgerSendTypedData(data, message, filters, exchange); err != nil {
+		return nil, err
+	}
+	// Send the message over, ensuring it's processed correctly
+	reply, err := exchange(ledgerOpSignTypedMessage, 0, ledgerP2FullImplementation, path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Extract the Ethereum signature and do a sanity validation
+	if len(reply) != crypto.SignatureLength {
+		return nil, fmt.Errorf("invalid signature length: %d", len(reply))
+	}
+	signature := append(reply[1:], reply[0])
+	return signature, nil
+}
+
+// ledgerExchangeFunc sends a single APDU command to the Ledger, returning the reply.
+type ledgerExchangeFunc func(opcode ledgerOpcode, p1 ledgerParam1, p2 ledgerParam2, data []byte) ([]byte, error)
+
+// ledgerSendTypedData streams the EIP-712 struct definitions, then the domain and
+// message values (the latter pulled from message, along with the clear signing
+// filters, if any) through exchange, leaving the device ready to sign the message.
+func ledgerSendTypedData(data apitypes.TypedData, message TypedDataValues, filters *LedgerEIP712Filters, exchange ledgerExchangeFunc) error {
 	// Check if the EIP712Domain and primary type are present in the data
 	domainStruct := data.Types["EIP712Domain"]
 	if domainStruct == nil {
-		return nil, fmt.Errorf("EIP712Domain type is required")
+		return fmt.Errorf("EIP712Domain type is required")
 	}
 	primaryType := data.Types[data.PrimaryType]
 	if primaryType == nil {
-		return nil, fmt.Errorf("primary type %s not found in types", data.PrimaryType)
+		return fmt.Errorf("primary type %s not found in types", data.PrimaryType)
 	}
 
+	// Ensure the clear signing filters fit into their single byte length prefixes
+	if filters != nil {
+		if len(filters.Name) > 255 || len(filters.Signature) > 255 || len(filters.Fields) > 255 {
+			return errors.New("EIP-712 message filter too long")
+		}
+		for _, field := range filters.Fields {
+			if len(field.Label) > 255 || len(field.Signature) > 255 {
+				return fmt.Errorf("EIP-712 filter of field %s too long", field.Path)
+			}
+		}
+	}
+	// Message field filters by path, set once the domain has been sent
+	var filtered map[string]LedgerEIP712Field
+
 	// sendField is a function for sending an EIP-712 struct field name + type
 	sendField := func(field apitypes.Type) error {
 		dt, name, byteLength, arrays, err := parseType(data, field)
@@ -164,6 +347,14 @@ func (w *ledgerDriver) ledgerSignTypedData(derivationPath []uint32, data apitype
 			return err
 		}
 
+		// The app has no notion of fixed point numbers, send them as their
+		// underlying scaled integers, which is how they are ABI encoded.
+		switch dt {
+		case FixedPointType:
+			dt = IntType
+		case UfixedPointType:
+			dt = UintType
+		}
 		typeDesc := byte(dt)
 
 		var typeName []byte
@@ -185,6 +376,9 @@ func (w *ledgerDriver) ledgerSignTypedData(derivationPath []uint32, data apitype
 				if length == nil {
 					arrayLevels = append(arrayLevels, 0)
 				} else {
+					if *length > ledgerEip712MaxArrayLength {
+						return fmt.Errorf("%w: array length %d of field %s exceeds maximum %d", ErrLedgerTypedDataTooComplex, *length, field.Name, ledgerEip712MaxArrayLength)
+					}
 					arrayLevels = append(arrayLevels, 1, byte(*length))
 				}
 			}
@@ -196,78 +390,73 @@ func (w *ledgerDriver) ledgerSignTypedData(derivationPath []uint32, data apitype
 		payload = append(payload, arrayLevels...)
 		payload = append(payload, byte(len(field.Name)))
 		payload = append(payload, []byte(field.Name)...)
-		_, err = w.ledgerExchange(ledgerOpEip712SendStructDef, 0, ledgerP2StructField, payload)
+
+		// Struct definitions have no multi-part protocol, unlike values
+		if len(payload) > ledgerEip712MaxDefLength {
+			return fmt.Errorf("%w: definition of field %s too long: %d bytes, maximum %d", ErrLedgerTypedDataTooComplex, field.Name, len(payload), ledgerEip712MaxDefLength)
+		}
+		_, err = exchange(ledgerOpEip712SendStructDef, 0, ledgerP2StructField, payload)
 		return err
 	}
 
-	// sendValue is a recursive function that sends the value of a field
-	var sendValue func(t, name string, value interface{}) error
-	sendValue = func(t, name string, value interface{}) error {
-		if value == nil {
-			return fmt.Errorf("nil value for field %s", name)
-		}
+	// sendValue is a recursive function that sends the value of a field, pulling
+	// it from the member path of values
+	var sendValue func(t, name, path string, values TypedDataValues, member []uint32) error
+	sendValue = func(t, name, path string, values TypedDataValues, member []uint32) error {
 		if strings.HasSuffix(t, "]") {
-			a, ok := value.([]interface{})
-			if !ok {
-				return fmt.Errorf("expected array for field %s, got %T", name, value)
+			items, err := values.Len(member)
+			if err != nil {
+				return fmt.Errorf("invalid array for field %s: %w", name, err)
+			}
+			if items > ledgerEip712MaxArrayLength {
+				return fmt.Errorf("%w: array length %d of field %s exceeds maximum %d", ErrLedgerTypedDataTooComplex, items, name, ledgerEip712MaxArrayLength)
 			}
-			if _, err := w.ledgerExchange(ledgerOpEip712SendStructImpl, ledgerP1CompleteSend, ledgerP2Array, []byte{byte(len(a))}); err != nil {
+			if _, err := exchange(ledgerOpEip712SendStructImpl, ledgerP1CompleteSend, ledgerP2Array, []byte{byte(items)}); err != nil {
 				return fmt.Errorf("failed to send array length: %w", err)
 			}
 			t = t[:strings.LastIndex(t, "[")]
-			for _, item := range a {
-				if err := sendValue(t, name, item); err != nil {
+			for i := 0; i < items; i++ {
+				if err := sendValue(t, name, path+".[]", values, append(member[:len(member):len(member)], uint32(i))); err != nil {
 					return fmt.Errorf("failed to send array item: %w", err)
 				}
 			}
 			return nil
 		}
-		s := data.Types[t]
-		if s != nil {
-			m, ok := value.(map[string]interface{})
-			if !ok {
-				return fmt.Errorf("expected struct for field %s, got %T", name, value)
-			}
-			for _, field := range s {
-				if err := sendValue(field.Type, field.Name, m[field.Name]); err != nil {
+		if s := data.Types[t]; s != nil {
+			for i, field := range s {
+				fieldPath := field.Name
+				if path != "" {
+					fieldPath = path + "." + field.Name
+				}
+				if err := sendValue(field.Type, field.Name, fieldPath, values, append(member[:len(member):len(member)], uint32(i))); err != nil {
 					return fmt.Errorf("failed to send struct field %s: %w", field.Name, err)
 				}
 			}
 			return nil
 		}
-		var enc []byte
-		var err error
-		switch v := value.(type) {
-		case string:
-			if t == "string" {
-				enc = []byte(v)
-			} else if strings.HasPrefix(v, "0x") {
-				enc, err = hex.DecodeString(v[2:])
-				if err != nil {
-					return fmt.Errorf("failed to decode hex string for field %s: %w", name, err)
-				}
-			} else {
-				return fmt.Errorf("invalid string value for field %s: %s", name, v)
-			}
-		case bool:
-			if v {
-				enc = []byte{1}
-			} else {
-				enc = []byte{0}
-			}
-		case float64:
-			enc = new(big.Int).SetInt64(int64(v)).Bytes()
-		case *math.HexOrDecimal256:
-			if v == nil {
-				return fmt.Errorf("nil value for field %s", name)
+		value, err := values.Value(member)
+		if err != nil {
+			return fmt.Errorf("invalid value for field %s: %w", name, err)
+		}
+		if value == nil {
+			return fmt.Errorf("nil value for field %s", name)
+		}
+		dt, _, byteLength, _, err := parseType(data, apitypes.Type{Name: name, Type: t})
+		if err != nil {
+			return fmt.Errorf("failed to parse type of field %s: %w", name, err)
+		}
+		enc, err := ledgerEncodeValue(dt, byteLength, name, value)
+		if err != nil {
+			return err
+		}
+		if filter, ok := filtered[path]; ok {
+			payload := append([]byte{byte(len(filter.Label))}, filter.Label...)
+			payload = append(payload, byte(len(filter.Signature)))
+			payload = append(payload, filter.Signature...)
+			if _, err := exchange(ledgerOpEip712Filtering, 0, ledgerP2FilterRawField, payload); err != nil {
+				return fmt.Errorf("failed to send filter of field %s: %w", path, err)
 			}
-			h := big.Int(*v)
-			enc = (&h).Bytes()
-
-		default:
-			return fmt.Errorf("unsupported type for field %s: %T", name, value)
 		}
-
 		chunk := 255
 		payload := binary.BigEndian.AppendUint16([]byte{}, uint16(len(enc)))
 		payload = append(payload, enc...)
@@ -277,7 +466,7 @@ func (w *ledgerDriver) ledgerSignTypedData(derivationPath []uint32, data apitype
 				chunk = len(payload)
 				p1 = ledgerP1CompleteSend
 			}
-			if _, err := w.ledgerExchange(ledgerOpEip712SendStructImpl, p1, ledgerP2StructField, payload[:chunk]); err != nil {
+			if _, err := exchange(ledgerOpEip712SendStructImpl, p1, ledgerP2StructField, payload[:chunk]); err != nil {
 				return fmt.Errorf("failed to send field %s: %w", name, err)
 			}
 			payload = payload[chunk:]
@@ -285,52 +474,190 @@ func (w *ledgerDriver) ledgerSignTypedData(derivationPath []uint32, data apitype
 		return nil
 	}
 
-	// first send all the EIP-712 struct definitions
-	for name, fields := range data.Types {
-		_, err := w.ledgerExchange(ledgerOpEip712SendStructDef, 0, ledgerP2StructName, []byte(name))
+	// first send all the EIP-712 struct definitions, dependencies first
+	for _, name := range orderedTypes(data.Types) {
+		fields := data.Types[name]
+		if len(name) > ledgerEip712MaxDefLength {
+			return fmt.Errorf("%w: type name %s too long: %d bytes, maximum %d", ErrLedgerTypedDataTooComplex, name, len(name), ledgerEip712MaxDefLength)
+		}
+		_, err := exchange(ledgerOpEip712SendStructDef, 0, ledgerP2StructName, []byte(name))
 		if err != nil {
-			return nil, fmt.Errorf("failed to send type name %s: %w", name, err)
+			return fmt.Errorf("failed to send type name %s: %w", name, err)
 		}
 		for _, field := range fields {
 			if err := sendField(field); err != nil {
-				return nil, fmt.Errorf("failed to send field %s: %w", field.Name, err)
+				return fmt.Errorf("failed to send field %s: %w", field.Name, err)
 			}
 		}
 	}
 
+	// activate clear signing if filters were supplied
+	if filters != nil {
+		if _, err := exchange(ledgerOpEip712Filtering, 0, ledgerP2FilterActivate, nil); err != nil {
+			return fmt.Errorf("failed to activate filtering: %w", err)
+		}
+	}
+
 	// send the EIP-712 domain field values
-	if _, err := w.ledgerExchange(ledgerOpEip712SendStructImpl, ledgerP1CompleteSend, ledgerP2RootStruct, []byte("EIP712Domain")); err != nil {
-		return nil, fmt.Errorf("failed to send domain type name: %w", err)
+	if _, err := exchange(ledgerOpEip712SendStructImpl, ledgerP1CompleteSend, ledgerP2RootStruct, []byte("EIP712Domain")); err != nil {
+		return fmt.Errorf("failed to send domain type name: %w", err)
+	}
+	if err := sendValue("EIP712Domain", "domain", "", newTypedDomainValues(data), nil); err != nil {
+		return fmt.Errorf("failed to send domain fields: %w", err)
 	}
-	if err := sendValue("EIP712Domain", "domain", data.Domain.Map()); err != nil {
-		return nil, fmt.Errorf("failed to send domain fields: %w", err)
+
+	// send the message info for clear signing, filtering the message fields
+	if filters != nil {
+		filtered = make(map[string]LedgerEIP712Field, len(filters.Fields))
+		for _, field := range filters.Fields {
+			filtered[field.Path] = field
+		}
+		count, err := ledgerCountFilters(data, message, filtered)
+		if err != nil {
+			return err
+		}
+		if count > 255 {
+			return fmt.Errorf("EIP-712 message filter count %d too high, maximum 255", count)
+		}
+		payload := append([]byte{byte(len(filters.Name))}, filters.Name...)
+		payload = append(payload, byte(count), byte(len(filters.Signature)))
+		payload = append(payload, filters.Signature...)
+		if _, err := exchange(ledgerOpEip712Filtering, 0, ledgerP2FilterMessageInfo, payload); err != nil {
+			return fmt.Errorf("failed to send message info: %w", err)
+		}
 	}
 
 	// send the message field values
-	if _, err := w.ledgerExchange(ledgerOpEip712SendStructImpl, ledgerP1CompleteSend, ledgerP2RootStruct, []byte(data.PrimaryType)); err != nil {
-		return nil, fmt.Errorf("failed to send primary type name: %w", err)
+	if _, err := exchange(ledgerOpEip712SendStructImpl, ledgerP1CompleteSend, ledgerP2RootStruct, []byte(data.PrimaryType)); err != nil {
+		return fmt.Errorf("failed to send primary type name: %w", err)
 	}
-	if err := sendValue(data.PrimaryType, "message", data.Message); err != nil {
-		return nil, fmt.Errorf("failed to send primary type fields: %w", err)
+	if err := sendValue(data.PrimaryType, "message", "", message, nil); err != nil {
+		return fmt.Errorf("failed to send primary type fields: %w", err)
 	}
+	return nil
+}
 
-	// Flatten the derivation path into the Ledger request
-	path := make([]byte, 1+4*len(derivationPath))
-	path[0] = byte(len(derivationPath))
-	for i, component := range derivationPath {
-		binary.BigEndian.PutUint32(path[1+4*i:], component)
+// ledgerCountFilters counts the field filters sent along with the message values,
+// which the app expects upfront: the filter of a field within an array is sent
+// once per item, the filter of a field missing from the message never.
+func ledgerCountFilters(data apitypes.TypedData, message TypedDataValues, filtered map[string]LedgerEIP712Field) (int, error) {
+	var count func(t, path string, member []uint32) (int, error)
+	count = func(t, path string, member []uint32) (int, error) {
+		if strings.HasSuffix(t, "]") {
+			items, err := message.Len(member)
+			if err != nil {
+				return 0, fmt.Errorf("invalid array for field %s: %w", path, err)
+			}
+			if items > ledgerEip712MaxArrayLength {
+				return 0, fmt.Errorf("%w: array length %d of field %s exceeds maximum %d", ErrLedgerTypedDataTooComplex, items, path, ledgerEip712MaxArrayLength)
+			}
+			t = t[:strings.LastIndex(t, "[")]
+
+			var total int
+			for i := 0; i < items; i++ {
+				n, err := count(t, path+".[]", append(member[:len(member):len(member)], uint32(i)))
+				if err != nil {
+					return 0, err
+				}
+				total += n
+			}
+			return total, nil
+		}
+		if s := data.Types[t]; s != nil {
+			var total int
+			for i, field := range s {
+				fieldPath := field.Name
+				if path != "" {
+					fieldPath = path + "." + field.Name
+				}
+				n, err := count(field.Type, fieldPath, append(member[:len(member):len(member)], uint32(i)))
+				if err != nil {
+					return 0, err
+				}
+				total += n
+			}
+			return total, nil
+		}
+		if _, ok := filtered[path]; ok {
+			return 1, nil
+		}
+		return 0, nil
 	}
+	return count(data.PrimaryType, "", nil)
+}
 
-	// Send the message over, ensuring it's processed correctly
-	reply, err := w.ledgerExchange(ledgerOpSignTypedMessage, 0, ledgerP2FullImplementation, path)
+// ValidateLedgerTypedData checks that typed data can be serialized for signing on
+// a Ledger: all types are known, arrays are well-formed, values are of the
+// expected types and nothing exceeds the Ledger's limits (other devices have
+// their own). The data is decoded, hashed and encoded exactly as for signing, but
+// discarded instead of being sent, so no device is ever touched.
+func ValidateLedgerTypedData(data apitypes.TypedData) error {
+	data, err := decodeTypedBytes(data)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	err = ledgerSendTypedData(data, newTypedDataValues(data), nil, func(ledgerOpcode, ledgerParam1, ledgerParam2, []byte) ([]byte, error) {
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+	if _, _, err := typedDataHashes(data); err != nil {
+		return fmt.Errorf("ledger: error hashing typed data: %w", err)
+	}
+	return nil
+}
 
-	// Extract the Ethereum signature and do a sanity validation
-	if len(reply) != crypto.SignatureLength {
-		return nil, fmt.Errorf("invalid signature length: %d", len(reply))
+// ledgerEncodeValue encodes a primitive EIP-712 value as the Ethereum app expects
+// it: integers as unpadded big-endian numbers (two's complement of the field
+// width for negative ones), booleans as a single byte, strings as raw bytes and
+// everything else (addresses, bytes) from hex strings. Values not fitting the
+// declared width of the field (or not matching it exactly for addresses and
+// fixed size bytes) are rejected.
+func ledgerEncodeValue(dt dataType, byteLength int, name string, value interface{}) ([]byte, error) {
+	switch dt {
+	case IntType, UintType, FixedPointType, UfixedPointType:
+		enc, err := encodeInteger(value, dt == IntType || dt == FixedPointType, byteLength)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer for field %s: %w", name, err)
+		}
+		if enc = bytes.TrimLeft(enc, "\x00"); len(enc) == 0 {
+			enc = []byte{0}
+		}
+		return enc, nil
+
+	case BoolType:
+		v, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("expected bool for field %s, got %T", name, value)
+		}
+		if v {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+
+	case StringType:
+		v, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected string for field %s, got %T", name, value)
+		}
+		return []byte(v), nil
+
+	case AddressType:
+		address, err := parseAddress(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address for field %s: %w", name, err)
+		}
+		return address.Bytes(), nil
+
+	default:
+		enc, err := parseBytes(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bytes for field %s: %w", name, err)
+		}
+		if dt == FixedBytesType && len(enc) != byteLength {
+			return nil, fmt.Errorf("invalid length for field %s: have %d bytes, want %d", name, len(enc), byteLength)
+		}
+		return enc, nil
 	}
-	signature := append(reply[1:], reply[0])
-	return signature, nil
 }
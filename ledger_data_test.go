@@ -0,0 +1,515 @@
+package usbwallet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+// newTestTypedData creates an EIP-712 typed data struct with the given message
+// type fields and values.
+func newTestTypedData(fields []apitypes.Type, message apitypes.TypedDataMessage) apitypes.TypedData {
+	chainID := math.HexOrDecimal256(*math.NewHexOrDecimal256(1))
+	return apitypes.TypedData{
+		Types: apitypes.Types{
+			"EIP712Domain": {
+				{Name: "name", Type: "string"},
+				{Name: "chainId", Type: "uint256"},
+			},
+			"Message": fields,
+		},
+		PrimaryType: "Message",
+		Domain: apitypes.TypedDataDomain{
+			Name:    "Test",
+			ChainId: &chainID,
+		},
+		Message: message,
+	}
+}
+
+// testLedgerSignTypedData signs typed data on an emulated Ledger and checks that
+// the recovered signer matches the address derived on the same path.
+func testLedgerSignTypedData(t *testing.T, driver *ledgerDriver, device *ledgerTestDevice, data apitypes.TypedData) []byte {
+	t.Helper()
+
+	path := accounts.DefaultBaseDerivationPath
+	address, err := driver.Derive(path)
+	if err != nil {
+		t.Fatalf("failed to derive address: %v", err)
+	}
+	hash, _, err := apitypes.TypedDataAndHash(data)
+	if err != nil {
+		t.Fatalf("failed to hash typed data: %v", err)
+	}
+	device.typedHash = hash
+
+	sig, err := driver.SignedTypedData(path, data)
+	if err != nil {
+		t.Fatalf("failed to sign typed data: %v", err)
+	}
+	sig[64] -= 27
+	pubkey, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		t.Fatalf("failed to recover signer: %v", err)
+	}
+	if signer := crypto.PubkeyToAddress(*pubkey); signer != address {
+		t.Fatalf("signer mismatch: have %x, want %x", signer, address)
+	}
+	return sig
+}
+
+func TestLedgerSignTypedDataArrayLength(t *testing.T) {
+	fields := []apitypes.Type{{Name: "values", Type: "uint8[]"}}
+
+	items := func(n int) []interface{} {
+		values := make([]interface{}, n)
+		for i := range values {
+			values[i] = float64(i % 256)
+		}
+		return values
+	}
+	// Arrays at the protocol limit must be sent with their exact length
+	driver, device := newTestLedger(t)
+	testLedgerSignTypedData(t, driver, device, newTestTypedData(fields, apitypes.TypedDataMessage{"values": items(255)}))
+
+	var found bool
+	for _, apdu := range device.eip712 {
+		if ledgerParam2(apdu.p2) == ledgerP2Array {
+			if len(apdu.data) != 1 || apdu.data[0] != 255 {
+				t.Fatalf("array length mismatch: have %x, want ff", apdu.data)
+			}
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("array length not sent")
+	}
+	// Arrays above the protocol limit must be rejected instead of wrapping around
+	device.eip712 = nil
+
+	_, err := driver.SignedTypedData(accounts.DefaultBaseDerivationPath, newTestTypedData(fields, apitypes.TypedDataMessage{"values": items(256)}))
+	if err == nil || !strings.Contains(err.Error(), "exceeds maximum") {
+		t.Fatalf("oversized array error mismatch: have %v", err)
+	}
+	for _, apdu := range device.eip712 {
+		if ledgerParam2(apdu.p2) == ledgerP2Array {
+			t.Fatalf("oversized array length sent to device: %x", apdu.data)
+		}
+	}
+	// Fixed size arrays above the protocol limit must be rejected too
+	fields = []apitypes.Type{{Name: "values", Type: "uint8[256]"}}
+	_, err = driver.SignedTypedData(accounts.DefaultBaseDerivationPath, newTestTypedData(fields, apitypes.TypedDataMessage{"values": items(256)}))
+	if err == nil || !strings.Contains(err.Error(), "exceeds maximum") {
+		t.Fatalf("oversized fixed array error mismatch: have %v", err)
+	}
+}
+
+func TestLedgerEncodeValue(t *testing.T) {
+	tests := []struct {
+		dt         dataType
+		byteLength int
+		value      interface{}
+		want       string
+		fail       bool
+	}{
+		{dt: UintType, byteLength: 32, value: float64(0), want: "00"},
+		{dt: UintType, byteLength: 32, value: float64(1 << 60), want: "1000000000000000"},
+		{dt: UintType, byteLength: 32, value: "0x1fffffffffffff1", want: "01fffffffffffff1"},
+		{dt: UintType, byteLength: 32, value: "115792089237316195423570985008687907853269984665640564039457584007913129639935", want: strings.Repeat("ff", 32)},
+		{dt: UintType, byteLength: 32, value: big.NewInt(256), want: "0100"},
+		{dt: UintType, byteLength: 32, value: math.NewHexOrDecimal256(255), want: "ff"},
+		{dt: IntType, byteLength: 1, value: float64(-1), want: "ff"},
+		{dt: IntType, byteLength: 32, value: "-1", want: strings.Repeat("ff", 32)},
+		{dt: IntType, byteLength: 2, value: float64(127), want: "7f"},
+		{dt: UintType, byteLength: 32, value: json.Number("115792089237316195423570985008687907853269984665640564039457584007913129639935"), want: strings.Repeat("ff", 32)},
+		{dt: IntType, byteLength: 1, value: json.Number("-1"), want: "ff"},
+		{dt: UintType, byteLength: 1, value: float64(-1), fail: true},
+		{dt: UintType, byteLength: 1, value: float64(256), fail: true},
+		{dt: BoolType, value: true, want: "01"},
+		{dt: StringType, value: "hi", want: "6869"},
+		{dt: AddressType, byteLength: 20, value: "0x0102030405060708090a0b0c0d0e0f1011121314", want: "0102030405060708090a0b0c0d0e0f1011121314"},
+		{dt: AddressType, byteLength: 20, value: "0x0102", fail: true},
+		{dt: FixedBytesType, byteLength: 4, value: "0x01020304", want: "01020304"},
+		{dt: FixedBytesType, byteLength: 4, value: "0x0102030405", fail: true},
+		{dt: FixedBytesType, byteLength: 4, value: "0x010203", fail: true},
+		{dt: BytesType, value: "0x0102030405", want: "0102030405"},
+		{dt: BytesType, value: "AQIDBAU=", want: "0102030405"},
+		{dt: BytesType, value: []byte{1, 2, 3, 4, 5}, want: "0102030405"},
+		{dt: FixedBytesType, byteLength: 4, value: "AQIDBA==", want: "01020304"},
+		{dt: FixedBytesType, byteLength: 4, value: "AQIDBAU=", fail: true},
+		{dt: BytesType, value: "AQIDBAU", fail: true},
+	}
+	for i, tt := range tests {
+		enc, err := ledgerEncodeValue(tt.dt, tt.byteLength, "field", tt.value)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("test %d: expected failure, got %x", i, enc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: failed to encode %v: %v", i, tt.value, err)
+			continue
+		}
+		if hex.EncodeToString(enc) != tt.want {
+			t.Errorf("test %d: encoding mismatch: have %x, want %s", i, enc, tt.want)
+		}
+	}
+}
+
+// Tests that large and negative integers are streamed to the Ledger without
+// losing precision.
+func TestLedgerSignTypedDataIntegers(t *testing.T) {
+	fields := []apitypes.Type{{Name: "amount", Type: "uint256"}, {Name: "delta", Type: "int8"}}
+	message := apitypes.TypedDataMessage{
+		"amount": "115792089237316195423570985008687907853269984665640564039457584007913129639935",
+		"delta":  float64(-2),
+	}
+	driver, device := newTestLedger(t)
+	testLedgerSignTypedData(t, driver, device, newTestTypedData(fields, message))
+
+	var values []string
+	for _, apdu := range device.eip712 {
+		if ledgerOpcode(apdu.ins) == ledgerOpEip712SendStructImpl && ledgerParam2(apdu.p2) == ledgerP2StructField {
+			values = append(values, hex.EncodeToString(apdu.data))
+		}
+	}
+	want := []string{"000454657374", "000101", "0020" + strings.Repeat("ff", 32), "0001fe"}
+	if strings.Join(values, ",") != strings.Join(want, ",") {
+		t.Fatalf("field values mismatch: have %v, want %v", values, want)
+	}
+}
+
+// Tests that oversized fixed size byte values are rejected before being streamed
+// to the Ledger.
+func TestLedgerSignTypedDataFixedBytesLength(t *testing.T) {
+	fields := []apitypes.Type{{Name: "selector", Type: "bytes4"}}
+
+	driver, _ := newTestLedger(t)
+	_, err := driver.SignedTypedData(accounts.DefaultBaseDerivationPath, newTestTypedData(fields, apitypes.TypedDataMessage{"selector": "0x0102030405"}))
+	if err == nil || !strings.Contains(err.Error(), "invalid length for field selector") {
+		t.Fatalf("oversized bytes4 error mismatch: have %v", err)
+	}
+}
+
+// Tests that bytes values given as base64 are streamed to the Ledger and signed
+// identically to their hex form, both top level and nested in structs and arrays.
+func TestLedgerSignTypedDataBase64(t *testing.T) {
+	newData := func(data, selector, blob interface{}) apitypes.TypedData {
+		typed := newTestTypedData([]apitypes.Type{
+			{Name: "data", Type: "bytes"},
+			{Name: "selectors", Type: "bytes4[]"},
+			{Name: "inner", Type: "Inner"},
+		}, apitypes.TypedDataMessage{
+			"data":      data,
+			"selectors": []interface{}{selector, selector},
+			"inner":     map[string]interface{}{"blob": blob},
+		})
+		typed.Types["Inner"] = []apitypes.Type{{Name: "blob", Type: "bytes"}}
+		return typed
+	}
+	driver, device := newTestLedger(t)
+	want := testLedgerSignTypedData(t, driver, device, newData("0x0102030405", "0xa9059cbb", "0x"))
+	stream := device.eip712
+
+	for i, data := range []apitypes.TypedData{
+		newData("AQIDBAU=", "qQWcuw==", ""),
+		newData([]byte{1, 2, 3, 4, 5}, []byte{0xa9, 0x05, 0x9c, 0xbb}, []byte{}),
+		newData(hexutil.Bytes{1, 2, 3, 4, 5}, [4]byte{0xa9, 0x05, 0x9c, 0xbb}, []byte(nil)),
+	} {
+		device.eip712 = nil
+		have, err := driver.SignedTypedData(accounts.DefaultBaseDerivationPath, data)
+		if err != nil {
+			t.Fatalf("test %d: failed to sign typed data: %v", i, err)
+		}
+		have[64] -= 27
+		if !bytes.Equal(have, want) {
+			t.Errorf("test %d: signature mismatch: have %x, want %x", i, have, want)
+		}
+		if !reflect.DeepEqual(device.eip712, stream) {
+			t.Errorf("test %d: streamed typed data mismatch", i)
+		}
+	}
+	// Ensure malformed base64 is rejected before anything is streamed
+	device.eip712 = nil
+	if _, err := driver.SignedTypedData(accounts.DefaultBaseDerivationPath, newData("AQIDBAU", "qQWcuw==", "")); !errors.Is(err, ErrInvalidTypedData) {
+		t.Fatalf("malformed base64 error mismatch: have %v, want %v", err, ErrInvalidTypedData)
+	}
+	if len(device.eip712) != 0 {
+		t.Fatalf("%d typed data commands streamed for malformed base64", len(device.eip712))
+	}
+}
+
+func TestLedgerSignTypedDataLongPayloads(t *testing.T) {
+	// Values longer than an APDU are streamed in multiple parts
+	driver, device := newTestLedger(t)
+	fields := []apitypes.Type{{Name: "text", Type: "string"}}
+	testLedgerSignTypedData(t, driver, device, newTestTypedData(fields, apitypes.TypedDataMessage{"text": strings.Repeat("x", 600)}))
+
+	var partial int
+	for _, apdu := range device.eip712 {
+		if apdu.ins == byte(ledgerOpEip712SendStructImpl) && apdu.p1 == byte(ledgerP1PartialSend) {
+			partial++
+		}
+	}
+	if partial != 2 {
+		t.Fatalf("partial value chunks mismatch: have %d, want 2", partial)
+	}
+	// Struct definitions cannot be split, oversized ones must be rejected upfront
+	name := strings.Repeat("Nested", 50)
+	data := newTestTypedData([]apitypes.Type{{Name: "inner", Type: name}}, apitypes.TypedDataMessage{"inner": map[string]interface{}{"value": "ok"}})
+	data.Types[name] = []apitypes.Type{{Name: "value", Type: "string"}}
+
+	driver, _ = newTestLedger(t)
+	if _, err := driver.SignedTypedData(accounts.DefaultBaseDerivationPath, data); err == nil || !strings.Contains(err.Error(), "too long") {
+		t.Fatalf("oversized definition error mismatch: have %v, want too long", err)
+	}
+}
+
+func TestLedgerSignTypedDataFilters(t *testing.T) {
+	fields := []apitypes.Type{
+		{Name: "to", Type: "address"},
+		{Name: "amounts", Type: "uint256[]"},
+	}
+	data := newTestTypedData(fields, apitypes.TypedDataMessage{
+		"to":      "0x1234567890123456789012345678901234567890",
+		"amounts": []interface{}{float64(1), float64(2)},
+	})
+	filters := &LedgerEIP712Filters{
+		Name:      "Test",
+		Signature: []byte{0xaa},
+		Fields: []LedgerEIP712Field{
+			{Path: "amounts.[]", Label: "Amount", Signature: []byte{0xbb}},
+		},
+	}
+	// Filters are sent after the domain and ahead of each matching value, counting
+	// the filter of an array item field once per item
+	driver, device := newTestLedger(t)
+	hash, _, _ := apitypes.TypedDataAndHash(data)
+	device.typedHash = hash
+
+	if _, err := driver.SignedTypedDataFiltered(accounts.DefaultBaseDerivationPath, data, filters); err != nil {
+		t.Fatalf("failed to sign filtered typed data: %v", err)
+	}
+	var (
+		messageInfo, fieldFilters int
+		lastFilter                bool
+	)
+	for _, apdu := range device.eip712 {
+		if apdu.ins != byte(ledgerOpEip712Filtering) {
+			if lastFilter && (apdu.ins != byte(ledgerOpEip712SendStructImpl) || apdu.p2 != byte(ledgerP2StructField)) {
+				t.Fatalf("field filter not followed by a value")
+			}
+			lastFilter = false
+			continue
+		}
+		switch ledgerParam2(apdu.p2) {
+		case ledgerP2FilterMessageInfo:
+			messageInfo++
+			if want := []byte{4, 'T', 'e', 's', 't', 2, 1, 0xaa}; string(apdu.data) != string(want) {
+				t.Fatalf("message info mismatch: have %x, want %x", apdu.data, want)
+			}
+		case ledgerP2FilterRawField:
+			fieldFilters++
+			lastFilter = true
+		}
+	}
+	if messageInfo != 1 || fieldFilters != 2 {
+		t.Fatalf("filter count mismatch: have %d/%d, want 1/2", messageInfo, fieldFilters)
+	}
+	// Apps without filtering support sign the message unfiltered
+	device = newLedgerTestDevice([3]byte{1, 9, 19})
+	driver = newLedgerDriver(log.Root(), new(config)).(*ledgerDriver)
+	if err := driver.Open(device, ""); err != nil {
+		t.Fatalf("failed to open ledger: %v", err)
+	}
+	device.typedHash = hash
+	if _, err := driver.SignedTypedDataFiltered(accounts.DefaultBaseDerivationPath, data, filters); err != nil {
+		t.Fatalf("failed to sign unfiltered typed data: %v", err)
+	}
+	for _, apdu := range device.eip712 {
+		if apdu.ins == byte(ledgerOpEip712Filtering) {
+			t.Fatalf("filter sent to app without filtering support")
+		}
+	}
+}
+
+// Tests that typed data whose values are pulled on demand is streamed to the Ledger
+// exactly as when decoded into memory, also when falling back to hash signing.
+func TestLedgerSignTypedDataStream(t *testing.T) {
+	stream := &testTypedDataStream{legs: 4}
+	data := newTestStreamTypedData()
+	data.Message = stream.message()
+
+	driver, device := newTestLedger(t)
+	want := testLedgerSignTypedData(t, driver, device, data)
+	streamed := device.eip712
+
+	device.eip712 = nil
+	have, err := driver.SignedTypedDataStream(accounts.DefaultBaseDerivationPath, newTestStreamTypedData(), stream)
+	if err != nil {
+		t.Fatalf("failed to sign streamed typed data: %v", err)
+	}
+	have[64] -= 27
+	if !bytes.Equal(have, want) {
+		t.Errorf("signature mismatch: have %x, want %x", have, want)
+	}
+	if !reflect.DeepEqual(device.eip712, streamed) {
+		t.Errorf("streamed typed data mismatch")
+	}
+	if stream.pulls == 0 {
+		t.Errorf("no values pulled from the stream")
+	}
+	// Emulate the app running out of memory and ensure the hash is computed from the stream
+	device = newLedgerTestDevice([3]byte{1, 10, 4})
+	device.MockTransport = NewMockLedger(func(cla, ins, p1, p2 byte, data []byte) ([]byte, uint16) {
+		if ledgerOpcode(ins) == ledgerOpEip712SendStructDef {
+			return nil, uint16(ledgerStatusInsufficientMemory)
+		}
+		return device.handle(cla, ins, p1, p2, data)
+	})
+	driver = newLedgerDriver(log.Root(), &config{hashFallback: true}).(*ledgerDriver)
+	if err := driver.Open(device, ""); err != nil {
+		t.Fatalf("failed to open ledger: %v", err)
+	}
+	if have, err = driver.SignedTypedDataStream(accounts.DefaultBaseDerivationPath, newTestStreamTypedData(), stream); err != nil {
+		t.Fatalf("failed to hash sign streamed typed data: %v", err)
+	}
+	have[64] -= 27
+	if !bytes.Equal(have, want) {
+		t.Errorf("fallback signature mismatch: have %x, want %x", have, want)
+	}
+}
+
+// Tests that typed data too complex for the Ledger is only blind signed by hash if
+// the fallback was allowed, producing the same signature as streaming it.
+func TestLedgerSignTypedDataHashFallback(t *testing.T) {
+	data := newTestTypedData([]apitypes.Type{{Name: "value", Type: "uint256"}}, apitypes.TypedDataMessage{"value": "42"})
+
+	driver, device := newTestLedger(t)
+	streamed := testLedgerSignTypedData(t, driver, device, data)
+
+	for _, fallback := range []bool{false, true} {
+		// Emulate the app running out of memory while receiving the struct definitions
+		device := newLedgerTestDevice([3]byte{1, 10, 4})
+		device.MockTransport = NewMockLedger(func(cla, ins, p1, p2 byte, data []byte) ([]byte, uint16) {
+			if ledgerOpcode(ins) == ledgerOpEip712SendStructDef {
+				return nil, uint16(ledgerStatusInsufficientMemory)
+			}
+			return device.handle(cla, ins, p1, p2, data)
+		})
+		driver := newLedgerDriver(log.Root(), &config{hashFallback: fallback}).(*ledgerDriver)
+		if err := driver.Open(device, ""); err != nil {
+			t.Fatalf("fallback %v: failed to open ledger: %v", fallback, err)
+		}
+		sig, err := driver.SignedTypedData(accounts.DefaultBaseDerivationPath, data)
+		if !fallback {
+			if !errors.Is(err, ErrLedgerTypedDataTooComplex) {
+				t.Errorf("fallback %v: error mismatch: have %v, want %v", fallback, err, ErrLedgerTypedDataTooComplex)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("fallback %v: failed to sign typed data: %v", fallback, err)
+		}
+		sig[64] -= 27
+		if !bytes.Equal(sig, streamed) {
+			t.Errorf("fallback %v: signature mismatch: have %x, want %x", fallback, sig, streamed)
+		}
+	}
+}
+
+// Tests that typed data is validated by the same encoding as used for signing on
+// a Ledger, without a device.
+func TestValidateLedgerTypedData(t *testing.T) {
+	tests := []struct {
+		fields  []apitypes.Type
+		message apitypes.TypedDataMessage
+		err     string // Substring of the expected error, empty if valid
+	}{
+		{
+			fields:  []apitypes.Type{{Name: "to", Type: "address"}, {Name: "amounts", Type: "uint256[]"}},
+			message: apitypes.TypedDataMessage{"to": "0x0000000000000000000000000000000000000001", "amounts": []interface{}{"1", "0x2"}},
+		},
+		{
+			fields:  []apitypes.Type{{Name: "data", Type: "bytes"}, {Name: "hash", Type: "bytes4"}},
+			message: apitypes.TypedDataMessage{"data": []byte{1, 2}, "hash": "AQIDBA=="},
+		},
+		{
+			fields:  []apitypes.Type{{Name: "to", Type: "address"}},
+			message: apitypes.TypedDataMessage{"to": "0x0000000000000000000000000000000000000001", "from": "0x0000000000000000000000000000000000000002"},
+			err:     "extra data",
+		},
+		{
+			fields:  []apitypes.Type{{Name: "to", Type: "Person"}},
+			message: apitypes.TypedDataMessage{"to": "alice"},
+			err:     "unknown type",
+		},
+		{
+			fields:  []apitypes.Type{{Name: "amounts", Type: "uint256[]"}},
+			message: apitypes.TypedDataMessage{"amounts": "1"},
+			err:     "expected array",
+		},
+		{
+			fields:  []apitypes.Type{{Name: "to", Type: "address"}},
+			message: apitypes.TypedDataMessage{"to": float64(1)},
+			err:     "expected address string",
+		},
+		{
+			fields:  []apitypes.Type{{Name: "to", Type: "address"}},
+			message: apitypes.TypedDataMessage{},
+			err:     "nil value",
+		},
+		{
+			fields:  []apitypes.Type{{Name: "values", Type: "uint8[]"}},
+			message: apitypes.TypedDataMessage{"values": make([]interface{}, 256)},
+			err:     ErrLedgerTypedDataTooComplex.Error(),
+		},
+	}
+	for i, tt := range tests {
+		err := ValidateLedgerTypedData(newTestTypedData(tt.fields, tt.message))
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("test %d: valid data rejected: %v", i, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("test %d: error mismatch: have %v, want %q", i, err, tt.err)
+		}
+	}
+}
+
+// Tests that typed data with EIP712Domain fields missing from the domain streams
+// to the Ledger with the missing fields set to zero, signing the same digest as
+// hashed on the host.
+func TestLedgerSignTypedDataMissingDomainFields(t *testing.T) {
+	for _, omit := range [][2]bool{{false, true}, {true, false}, {true, true}} {
+		data := newTestDomainTypedData(omit[0], omit[1])
+
+		driver, device := newTestLedger(t)
+		address, err := driver.Derive(accounts.DefaultBaseDerivationPath)
+		if err != nil {
+			t.Fatalf("omit %v: failed to derive address: %v", omit, err)
+		}
+		if device.typedHash, err = typedDataDigest(data, newTypedDataValues(data)); err != nil {
+			t.Fatalf("omit %v: failed to hash typed data: %v", omit, err)
+		}
+		sig, err := driver.SignedTypedData(accounts.DefaultBaseDerivationPath, data)
+		if err != nil {
+			t.Fatalf("omit %v: failed to sign typed data: %v", omit, err)
+		}
+		if signer, err := recoverSigner(device.typedHash, sig); err != nil || signer != address {
+			t.Errorf("omit %v: signer mismatch: have %x (%v), want %x", omit, signer, err, address)
+		}
+	}
+}
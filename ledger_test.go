@@ -0,0 +1,1609 @@
+package usbwallet
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/base/usbwallet/trezor"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/holiman/uint256"
+	"google.golang.org/protobuf/proto"
+)
+
+// ledgerTestDevice is an in-memory emulation of a Ledger running the Ethereum
+// app, executing the APDUs reassembled by a mock transport.
+type ledgerTestDevice struct {
+	version [3]byte // Ethereum app version reported by the configuration query
+	flags   byte    // Ethereum app flags reported by the configuration query
+	app     string  // Name of the running app, Ethereum opcodes fail unless "Ethereum"
+
+	*MockTransport // In-memory transport framing the APDUs and replies
+
+	txdata    []byte           // Transaction payload accumulated across signing chunks
+	authdata  []byte           // Authorization payload accumulated across signing chunks
+	msgdata   []byte           // Personal message payload accumulated across signing chunks
+	eip712    []ledgerTestAPDU // EIP-712 struct definitions and values streamed to the device
+	typedHash []byte           // EIP-712 hash to sign after the typed data was streamed
+	tokens    [][]byte         // ERC-20 token descriptors provided to the device
+	nfts      [][]byte         // NFT collection descriptors provided to the device
+	plugins   []ledgerTestAPDU // Plugin selection requests sent to the device
+
+	pubkey  func([]byte) []byte // If set, converts the returned public keys (emulating other app versions)
+	block   chan struct{}       // If set, reads block until closed (emulating pending user confirmation)
+	reject  bool                // Whether the user denies all confirmation requests
+	prompts int                 // Number of requests the user was prompted to confirm
+}
+
+// ledgerTestAPDU is a single command received by the emulated Ledger.
+type ledgerTestAPDU struct {
+	ins, p1, p2 byte
+	data        []byte
+}
+
+// newLedgerTestDevice creates an emulated Ledger reporting the given app version.
+func newLedgerTestDevice(version [3]byte) *ledgerTestDevice {
+	d := &ledgerTestDevice{version: version, flags: LedgerFlagBlindSigning, app: ledgerEthereumApp}
+	d.MockTransport = NewMockLedger(d.handle)
+	return d
+}
+
+// ledgerTestSeed is the BIP-32 seed the emulated Ledger derives its keys from. It
+// is the BIP-39 seed of the "abandon abandon ... about" test mnemonic, so derived
+// addresses can be checked against other implementations.
+var ledgerTestSeed = common.FromHex("0x5eb00bbddcf069084889a8ab9155568165f5c453ccb85e70811aaed6f6da5fc19a5ac40b389cd370d086206dec8aa6c43daea6690f20ad3d8d48b2d2ce9e38e4")
+
+// ledgerTestNode derives the BIP-32 node the emulated Ledger uses for a given
+// derivation path.
+func ledgerTestNode(path []uint32) *hdkeychain.ExtendedKey {
+	node, err := hdkeychain.NewMaster(ledgerTestSeed, &chaincfg.MainNetParams)
+	if err != nil {
+		panic(err)
+	}
+	for _, component := range path {
+		if node, err = node.Derive(component); err != nil {
+			panic(err)
+		}
+	}
+	return node
+}
+
+// ledgerTestKey derives the private key the emulated Ledger uses for a given
+// derivation path.
+func ledgerTestKey(path []uint32) *ecdsa.PrivateKey {
+	priv, err := ledgerTestNode(path).ECPrivKey()
+	if err != nil {
+		panic(err)
+	}
+	key, err := crypto.ToECDSA(priv.Serialize())
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// Read implements io.Reader, returning the framed replies of the device.
+func (d *ledgerTestDevice) Read(buf []byte) (int, error) {
+	if d.block != nil {
+		<-d.block
+	}
+	return d.MockTransport.Read(buf)
+}
+
+// handle emulates the Ethereum app, executing a single APDU command.
+func (d *ledgerTestDevice) handle(cla, ins, p1, p2 byte, data []byte) ([]byte, uint16) {
+	if ledgerClass(cla) == ledgerClaDashboard && ledgerOpcode(ins) == ledgerOpGetAppAndVersion {
+		reply := append([]byte{0x01, byte(len(d.app))}, d.app...)
+		return append(reply, 0x05, '1', '.', '0', '.', '0', 0x01, 0x00), 0x9000
+	}
+	if ledgerClass(cla) != ledgerClaEthereum || d.app != ledgerEthereumApp {
+		return nil, 0x6e00
+	}
+	switch ledgerOpcode(ins) {
+	case ledgerOpGetConfiguration:
+		return append([]byte{d.flags}, d.version[:]...), 0x9000
+
+	case ledgerOpRetrieveAddress:
+		if ledgerParam1(p1) == ledgerP1ConfirmFetchAddress {
+			if d.prompts++; d.reject {
+				return nil, 0x6985
+			}
+		}
+		path, _ := ledgerTestPath(data)
+		key := ledgerTestKey(path)
+
+		pubkey := crypto.FromECDSAPub(&key.PublicKey)
+		if d.pubkey != nil {
+			pubkey = d.pubkey(pubkey)
+		}
+		address := hex.EncodeToString(crypto.PubkeyToAddress(key.PublicKey).Bytes())
+
+		reply := append([]byte{byte(len(pubkey))}, pubkey...)
+		reply = append(reply, byte(len(address)))
+		reply = append(reply, address...)
+		if ledgerParam2(p2) == ledgerP2ReturnAddressChainCode {
+			reply = append(reply, ledgerTestNode(path).ChainCode()...)
+		}
+		return reply, 0x9000
+
+	case ledgerOpSignTransaction:
+		if ledgerParam1(p1) == ledgerP1InitTransactionData {
+			d.txdata = nil
+		}
+		d.txdata = append(d.txdata, data...)
+		return d.signTx()
+
+	case ledgerOpEip712SendStructDef, ledgerOpEip712SendStructImpl, ledgerOpEip712Filtering:
+		d.eip712 = append(d.eip712, ledgerTestAPDU{ins, p1, p2, append([]byte{}, data...)})
+		return nil, 0x9000
+
+	case ledgerOpProvideERC20:
+		d.tokens = append(d.tokens, append([]byte{}, data...))
+		return []byte{byte(len(d.tokens) - 1)}, 0x9000
+
+	case ledgerOpProvideNFT:
+		d.nfts = append(d.nfts, append([]byte{}, data...))
+		return nil, 0x9000
+
+	case ledgerOpSetPlugin, ledgerOpSetExternalPlugin:
+		d.plugins = append(d.plugins, ledgerTestAPDU{ins: ins, data: append([]byte{}, data...)})
+		return nil, 0x9000
+
+	case ledgerOpSignPersonalMessage:
+		if ledgerParam1(p1) == ledgerP1InitTransactionData {
+			d.msgdata = nil
+		}
+		d.msgdata = append(d.msgdata, data...)
+
+		path, text := ledgerTestPath(d.msgdata)
+		if len(text) < 4 || len(text)-4 < int(binary.BigEndian.Uint32(text)) {
+			return nil, 0x9000 // Wait for the rest of the message
+		}
+		if d.prompts++; d.reject {
+			return nil, 0x6985
+		}
+		return d.signHash(path, accounts.TextHash(text[4:]))
+
+	case ledgerOpSignTypedMessage:
+		path, hashes := ledgerTestPath(data)
+		if ledgerParam2(p2) == ledgerP2V0Implementation {
+			return d.signHash(path, crypto.Keccak256([]byte{0x19, 0x01}, hashes))
+		}
+		// The emulator doesn't hash the streamed struct, sign the one set up by the test
+		return d.signHash(path, d.typedHash)
+
+	case ledgerOpSignAuthorization:
+		if ledgerParam1(p1) == ledgerP1InitAuthorizationData {
+			d.authdata = nil
+		}
+		d.authdata = append(d.authdata, data...)
+		return d.signAuthorization()
+	}
+	return nil, 0x6d00
+}
+
+// signHash signs a message hash with the key on the given derivation path, the
+// V value being offset by 27 as the app does for messages.
+func (d *ledgerTestDevice) signHash(path []uint32, hash []byte) ([]byte, uint16) {
+	sig, err := crypto.Sign(hash, ledgerTestKey(path))
+	if err != nil {
+		return nil, 0x6a80
+	}
+	return append([]byte{sig[64] + 27}, sig[:64]...), 0x9000
+}
+
+// signAuthorization signs the accumulated EIP-7702 authorization if it's complete,
+// or waits for more chunks otherwise.
+func (d *ledgerTestDevice) signAuthorization() ([]byte, uint16) {
+	path, tlv := ledgerTestPath(d.authdata)
+	if len(tlv) < 2 || len(tlv) < 2+int(binary.BigEndian.Uint16(tlv)) {
+		return nil, 0x9000
+	}
+	tlv = tlv[2:]
+
+	var auth types.SetCodeAuthorization
+	for len(tlv) > 0 {
+		tag, value := tlv[0], tlv[2:2+int(tlv[1])]
+		switch tag {
+		case 0x01:
+			auth.Address = common.BytesToAddress(value)
+		case 0x02:
+			auth.ChainID.SetBytes(value)
+		case 0x03:
+			auth.Nonce = new(big.Int).SetBytes(value).Uint64()
+		}
+		tlv = tlv[2+len(value):]
+	}
+	signed, err := types.SignSetCode(ledgerTestKey(path), auth)
+	if err != nil {
+		return nil, 0x6a80
+	}
+	reply := append([]byte{signed.V}, signed.R.PaddedBytes(32)...)
+	return append(reply, signed.S.PaddedBytes(32)...), 0x9000
+}
+
+// signTx signs the accumulated transaction payload if it's complete, or waits
+// for more chunks otherwise.
+func (d *ledgerTestDevice) signTx() ([]byte, uint16) {
+	path, txrlp := ledgerTestPath(d.txdata)
+
+	// Strip the type byte off typed transactions and wait until the RLP is complete
+	var kind byte
+	if len(txrlp) > 0 && txrlp[0] <= 0x7f {
+		kind, txrlp = txrlp[0], txrlp[1:]
+	}
+	if _, _, rest, err := rlp.Split(txrlp); err != nil || len(rest) != 0 {
+		return nil, 0x9000
+	}
+	// Transaction complete, sign it and encode V the way the app does
+	hash := crypto.Keccak256(txrlp)
+	if kind != types.LegacyTxType {
+		hash = crypto.Keccak256(append([]byte{kind}, txrlp...))
+	}
+	sig, err := crypto.Sign(hash, ledgerTestKey(path))
+	if err != nil {
+		return nil, 0x6a80
+	}
+	v := sig[64]
+	if kind == types.LegacyTxType {
+		var fields []rlp.RawValue
+		if err := rlp.DecodeBytes(txrlp, &fields); err != nil {
+			return nil, 0x6a80
+		}
+		v += 27
+		if len(fields) == 9 {
+			chainID := new(big.Int)
+			if err := rlp.DecodeBytes(fields[6], chainID); err != nil {
+				return nil, 0x6a80
+			}
+			// Only the lowest byte of V is returned, even for huge chain IDs
+			v = byte(new(big.Int).Add(new(big.Int).Lsh(chainID, 1), big.NewInt(int64(sig[64])+35)).Bits()[0])
+		}
+	}
+	return append([]byte{v}, sig[:64]...), 0x9000
+}
+
+// ledgerTestPath splits a serialized derivation path off the front of a payload.
+func ledgerTestPath(data []byte) ([]uint32, []byte) {
+	path := make([]uint32, data[0])
+	for i := range path {
+		path[i] = binary.BigEndian.Uint32(data[1+4*i:])
+	}
+	return path, data[1+4*len(path):]
+}
+
+// newTestLedger creates a Ledger driver opened on top of an emulated device.
+func newTestLedger(t *testing.T) (*ledgerDriver, *ledgerTestDevice) {
+	t.Helper()
+
+	device := newLedgerTestDevice([3]byte{1, 10, 4})
+	driver := newLedgerDriver(log.Root(), new(config)).(*ledgerDriver)
+	if err := driver.Open(device, ""); err != nil {
+		t.Fatalf("failed to open ledger: %v", err)
+	}
+	if driver.offline() {
+		t.Fatalf("ledger offline after open")
+	}
+	return driver, device
+}
+
+// Tests that transactions are split into APDUs correctly when their payload (the
+// derivation path and transaction RLP) is around a multiple of the APDU payload
+// limit: every byte is sent exactly once and no empty continuation is sent.
+func TestLedgerSignTxChunkBoundaries(t *testing.T) {
+	to := common.HexToAddress("0x1234567890123456789012345678901234567890")
+	makeTx := func(typed bool, data []byte) *types.Transaction {
+		if typed {
+			return types.NewTx(&types.DynamicFeeTx{ChainID: big.NewInt(1), Nonce: 1, GasTipCap: big.NewInt(1), GasFeeCap: big.NewInt(2), Gas: 21000, To: &to, Data: data})
+		}
+		return types.NewTx(&types.LegacyTx{Nonce: 1, GasPrice: big.NewInt(1), Gas: 21000, To: &to, Data: data})
+	}
+	pathSize := 1 + 4*len(accounts.DefaultBaseDerivationPath)
+
+	for _, typed := range []bool{false, true} {
+		for _, size := range []int{149, 150, 254, 255, 256, 257, 509, 510, 511} {
+			// Find the transaction with a payload of the exact size to test
+			var tx *types.Transaction
+			for n := 0; n < size && tx == nil; n++ {
+				candidate := makeTx(typed, bytes.Repeat([]byte{0xaa}, n))
+				if txrlp, _ := ledgerTxRLP(candidate, big.NewInt(1)); pathSize+len(txrlp) == size {
+					tx = candidate
+				}
+			}
+			if tx == nil {
+				t.Fatalf("typed %v, size %d: no transaction with matching payload size", typed, size)
+			}
+			device := newLedgerTestDevice([3]byte{1, 11, 0})
+
+			var chunks []int
+			device.MockTransport = NewMockLedger(func(cla, ins, p1, p2 byte, data []byte) ([]byte, uint16) {
+				if ledgerOpcode(ins) == ledgerOpSignTransaction {
+					chunks = append(chunks, len(data))
+				}
+				return device.handle(cla, ins, p1, p2, data)
+			})
+			driver := newLedgerDriver(log.Root(), new(config)).(*ledgerDriver)
+			if err := driver.Open(device, ""); err != nil {
+				t.Fatalf("typed %v, size %d: failed to open ledger: %v", typed, size, err)
+			}
+			testLedgerSignTx(t, driver, tx, big.NewInt(1))
+
+			total := 0
+			for i, chunk := range chunks {
+				if chunk == 0 || chunk > 255 {
+					t.Errorf("typed %v, size %d: chunk %d: invalid size %d", typed, size, i, chunk)
+				}
+				total += chunk
+			}
+			if total != size {
+				t.Errorf("typed %v, size %d: sent bytes mismatch: have %d, want %d", typed, size, total, size)
+			}
+			if !typed && chunks[len(chunks)-1] <= ledgerEip155Size {
+				t.Errorf("typed %v, size %d: final chunk only carries %d bytes", typed, size, chunks[len(chunks)-1])
+			}
+		}
+	}
+}
+
+// testLedgerSignTx signs a transaction on an emulated Ledger and checks that the
+// recovered sender matches the address derived on the same path.
+func testLedgerSignTx(t *testing.T, driver *ledgerDriver, tx *types.Transaction, chainID *big.Int) *types.Transaction {
+	t.Helper()
+
+	path := accounts.DefaultBaseDerivationPath
+
+	address, err := driver.Derive(path)
+	if err != nil {
+		t.Fatalf("failed to derive address: %v", err)
+	}
+	sender, signed, err := driver.SignTx(path, tx, chainID)
+	if err != nil {
+		t.Fatalf("failed to sign transaction: %v", err)
+	}
+	if sender != address {
+		t.Fatalf("sender mismatch: have %x, want %x", sender, address)
+	}
+	if signed.Type() != tx.Type() {
+		t.Fatalf("transaction type mismatch: have %d, want %d", signed.Type(), tx.Type())
+	}
+	if recovered, err := types.Sender(types.LatestSignerForChainID(signed.ChainId()), signed); err != nil || recovered != address {
+		t.Fatalf("recovered sender mismatch: have %x, want %x (err %v)", recovered, address, err)
+	}
+	return signed
+}
+
+func TestLedgerSignLegacyTx(t *testing.T) {
+	to := common.HexToAddress("0x1234567890123456789012345678901234567890")
+	tx := types.NewTx(&types.LegacyTx{
+		Nonce:    7,
+		GasPrice: big.NewInt(1_000_000_000),
+		Gas:      21000,
+		To:       &to,
+		Value:    big.NewInt(1),
+	})
+	driver, _ := newTestLedger(t)
+	testLedgerSignTx(t, driver, tx, big.NewInt(1))
+}
+
+func TestLedgerProvideTokenInfo(t *testing.T) {
+	usdc := LedgerTokenInfo{
+		Ticker:    "USDC",
+		Address:   common.HexToAddress("0x833589fCD6eDb6E08f4c7C32D4f71b54bdA02913"),
+		Decimals:  6,
+		ChainID:   8453,
+		Signature: []byte{0x30, 0x44},
+	}
+	device := newLedgerTestDevice([3]byte{1, 10, 4})
+	driver := newLedgerDriver(log.Root(), &config{tokens: []LedgerTokenInfo{usdc}}).(*ledgerDriver)
+	if err := driver.Open(device, ""); err != nil {
+		t.Fatalf("failed to open ledger: %v", err)
+	}
+	transfer := func(to common.Address, chainID int64) *types.Transaction {
+		return types.NewTx(&types.DynamicFeeTx{
+			ChainID:   big.NewInt(chainID),
+			GasFeeCap: big.NewInt(1),
+			Gas:       50000,
+			To:        &to,
+			Data:      common.FromHex("0xa9059cbb"),
+		})
+	}
+	// Transactions to other contracts or chains must not provide the descriptor
+	testLedgerSignTx(t, driver, transfer(common.Address{0x01}, 8453), nil)
+	testLedgerSignTx(t, driver, transfer(usdc.Address, 1), nil)
+	if len(device.tokens) != 0 {
+		t.Fatalf("token info provided for unknown token: %x", device.tokens)
+	}
+	// Transactions to the token on its chain must provide it ahead of signing
+	testLedgerSignTx(t, driver, transfer(usdc.Address, 8453), nil)
+	if len(device.tokens) != 1 {
+		t.Fatalf("token info provided %d times, want 1", len(device.tokens))
+	}
+	want := append([]byte{4}, "USDC"...)
+	want = append(want, usdc.Address.Bytes()...)
+	want = append(want, 0, 0, 0, 6, 0, 0, 0x21, 0x05, 0x30, 0x44)
+	if !bytes.Equal(device.tokens[0], want) {
+		t.Fatalf("token info mismatch: have %x, want %x", device.tokens[0], want)
+	}
+}
+
+// Tests that the tokens a call described by an ERC-7730 descriptor displays amounts
+// of are provided before signing, besides the called contract.
+func TestLedgerProvideERC7730Tokens(t *testing.T) {
+	var (
+		router = common.HexToAddress("0x6fF5693b99212Da76ad316178A184AB56D299b43")
+		weth   = LedgerTokenInfo{Ticker: "WETH", Address: common.HexToAddress("0x4200000000000000000000000000000000000006"), Decimals: 18, ChainID: 8453}
+		usdc   = LedgerTokenInfo{Ticker: "USDC", Address: common.HexToAddress("0x833589fCD6eDb6E08f4c7C32D4f71b54bdA02913"), Decimals: 6, ChainID: 8453}
+	)
+	desc, err := LoadERC7730([]byte(`{
+		"context": {"contract": {"deployments": [{"chainId": 8453, "address": "` + router.Hex() + `"}]}},
+		"display": {"formats": {"sell(address token, uint256 amount)": {
+			"fields": [{"path": "amount", "label": "Amount", "format": "tokenAmount", "params": {"tokenPath": "token"}}]
+		}}}
+	}`))
+	if err != nil {
+		t.Fatalf("failed to load descriptor: %v", err)
+	}
+	device := newLedgerTestDevice([3]byte{1, 10, 4})
+	driver := newLedgerDriver(log.Root(), &config{tokens: []LedgerTokenInfo{weth, usdc}, erc7730: []*ERC7730Descriptor{desc}}).(*ledgerDriver)
+	if err := driver.Open(device, ""); err != nil {
+		t.Fatalf("failed to open ledger: %v", err)
+	}
+	data := append(crypto.Keccak256([]byte("sell(address,uint256)"))[:4], common.LeftPadBytes(usdc.Address.Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes([]byte{1}, 32)...)
+
+	testLedgerSignTx(t, driver, types.NewTx(&types.DynamicFeeTx{ChainID: big.NewInt(8453), GasFeeCap: big.NewInt(1), Gas: 90000, To: &router, Data: data}), nil)
+	if len(device.tokens) != 1 || !bytes.Contains(device.tokens[0], usdc.Address.Bytes()) {
+		t.Fatalf("token infos mismatch: have %x, want the one of %s", device.tokens, usdc.Ticker)
+	}
+}
+
+func TestLedgerProvideNFTInfo(t *testing.T) {
+	collection := LedgerNFTInfo{
+		Address:    common.HexToAddress("0xBC4CA0EdA7647A8aB7C2061c2E118A18a936f13D"),
+		ChainID:    1,
+		Descriptor: []byte{0x01, 0x01, 0x04, 'B', 'A', 'Y', 'C'},
+	}
+	transfer := types.NewTx(&types.LegacyTx{
+		GasPrice: big.NewInt(1),
+		Gas:      80000,
+		To:       &collection.Address,
+		Data:     common.FromHex("0x42842e0e"),
+	})
+	for _, tt := range []struct {
+		version [3]byte
+		sent    int
+	}{
+		{[3]byte{1, 8, 9}, 0}, // NFT descriptors unsupported, skipped
+		{[3]byte{1, 10, 4}, 1},
+	} {
+		device := newLedgerTestDevice(tt.version)
+		driver := newLedgerDriver(log.Root(), &config{nfts: []LedgerNFTInfo{collection}}).(*ledgerDriver)
+		if err := driver.Open(device, ""); err != nil {
+			t.Fatalf("failed to open ledger: %v", err)
+		}
+		testLedgerSignTx(t, driver, transfer, big.NewInt(1))
+		if len(device.nfts) != tt.sent {
+			t.Fatalf("app v%d.%d.%d: NFT info provided %d times, want %d", tt.version[0], tt.version[1], tt.version[2], len(device.nfts), tt.sent)
+		}
+		if tt.sent > 0 && !bytes.Equal(device.nfts[0], collection.Descriptor) {
+			t.Fatalf("NFT info mismatch: have %x, want %x", device.nfts[0], collection.Descriptor)
+		}
+	}
+}
+
+// Tests that the plugin descriptor of a contract method is provided before signing
+// transactions calling it, selecting the external plugin if requested, and that
+// descriptors can be sent explicitly to Ledgers only.
+func TestLedgerProvidePlugin(t *testing.T) {
+	contract := common.HexToAddress("0xDef1C0ded9bec7F1a1670819833240f027b25EfF")
+	plugins := []LedgerPluginInfo{
+		{Address: contract, Selector: [4]byte{0x41, 0x55, 0x65, 0xb0}, ChainID: 1, Descriptor: []byte{0x01, 0x01, 0x02, 'o', 'x'}},
+		{Address: contract, Selector: [4]byte{0xd9, 0x62, 0x7a, 0xa4}, ChainID: 1, Descriptor: []byte{0x04, 's', 'w', 'a', 'p'}, External: true},
+	}
+	call := func(chainID int64, data string) *types.Transaction {
+		return types.NewTx(&types.DynamicFeeTx{ChainID: big.NewInt(chainID), GasFeeCap: big.NewInt(1), Gas: 200000, To: &contract, Data: common.FromHex(data)})
+	}
+	tests := []struct {
+		tx  *types.Transaction
+		ins ledgerOpcode // Plugin selection opcode, 0 if none is sent
+		sel int          // Index of the plugin sent
+	}{
+		{call(1, "0x415565b0000000"), ledgerOpSetPlugin, 0},
+		{call(1, "0xd9627aa4000000"), ledgerOpSetExternalPlugin, 1},
+		{call(1, "0xa9059cbb000000"), 0, 0}, // Unknown method
+		{call(5, "0x415565b0000000"), 0, 0}, // Other chain
+		{call(1, "0x4155"), 0, 0},           // Truncated selector
+	}
+	for i, tt := range tests {
+		device := newLedgerTestDevice([3]byte{1, 10, 4})
+		driver := newLedgerDriver(log.Root(), &config{plugins: plugins}).(*ledgerDriver)
+		if err := driver.Open(device, ""); err != nil {
+			t.Fatalf("test %d: failed to open ledger: %v", i, err)
+		}
+		testLedgerSignTx(t, driver, tt.tx, nil)
+		switch {
+		case tt.ins == 0 && len(device.plugins) != 0:
+			t.Errorf("test %d: unexpected plugin selection: %v", i, device.plugins)
+		case tt.ins != 0 && len(device.plugins) != 1:
+			t.Errorf("test %d: plugin selection count mismatch: have %d, want 1", i, len(device.plugins))
+		case tt.ins != 0 && (ledgerOpcode(device.plugins[0].ins) != tt.ins || !bytes.Equal(device.plugins[0].data, plugins[tt.sel].Descriptor)):
+			t.Errorf("test %d: plugin selection mismatch: have %x %x, want %x %x", i, device.plugins[0].ins, device.plugins[0].data, tt.ins, plugins[tt.sel].Descriptor)
+		}
+	}
+	// Explicitly provided descriptors are sent as is, non-Ledgers reject them
+	device := newLedgerTestDevice([3]byte{1, 10, 4})
+	ledgerWallet, err := NewWallet(LedgerScheme, device)
+	if err != nil {
+		t.Fatalf("failed to create wallet: %v", err)
+	}
+	if err := ledgerWallet.SetPlugin(plugins[0].Descriptor, false); !errors.Is(err, accounts.ErrWalletClosed) {
+		t.Fatalf("closed wallet error mismatch: have %v, want %v", err, accounts.ErrWalletClosed)
+	}
+	if err := ledgerWallet.Open(""); err != nil {
+		t.Fatalf("failed to open wallet: %v", err)
+	}
+	defer ledgerWallet.Close()
+
+	for i, external := range []bool{false, true} {
+		if err := ledgerWallet.SetPlugin(plugins[0].Descriptor, external); err != nil {
+			t.Fatalf("external %v: failed to set plugin: %v", external, err)
+		}
+		op := ledgerOpSetPlugin
+		if external {
+			op = ledgerOpSetExternalPlugin
+		}
+		if len(device.plugins) != i+1 || ledgerOpcode(device.plugins[i].ins) != op || !bytes.Equal(device.plugins[i].data, plugins[0].Descriptor) {
+			t.Fatalf("external %v: plugin selection mismatch: have %v", external, device.plugins)
+		}
+	}
+	trezorWallet, err := NewWallet(TrezorScheme, NewMockTrezor(func(request proto.Message) proto.Message {
+		switch request.(type) {
+		case *trezor.EndSession:
+			return new(trezor.Success)
+		case *trezor.Initialize, *trezor.GetFeatures:
+			return &trezor.Features{MajorVersion: proto.Uint32(2), MinorVersion: proto.Uint32(9), PatchVersion: proto.Uint32(1)}
+		}
+		return &trezor.Failure{Code: trezor.Failure_Failure_UnexpectedMessage.Enum()}
+	}))
+	if err != nil {
+		t.Fatalf("failed to create trezor wallet: %v", err)
+	}
+	if err := trezorWallet.Open(""); err != nil {
+		t.Fatalf("failed to open trezor wallet: %v", err)
+	}
+	defer trezorWallet.Close()
+
+	if err := trezorWallet.SetPlugin(plugins[0].Descriptor, false); !errors.Is(err, accounts.ErrNotSupported) {
+		t.Fatalf("trezor error mismatch: have %v, want %v", err, accounts.ErrNotSupported)
+	}
+}
+
+// Tests that skipping clear signing sends no descriptors ahead of transactions,
+// while producing the same signatures as with them.
+func TestLedgerSkipClearSigning(t *testing.T) {
+	contract := common.HexToAddress("0x833589fCD6eDb6E08f4c7C32D4f71b54bdA02913")
+	cfg := config{
+		tokens:  []LedgerTokenInfo{{Ticker: "USDC", Address: contract, Decimals: 6, ChainID: 1, Signature: []byte{0x30, 0x44}}},
+		plugins: []LedgerPluginInfo{{Address: contract, Selector: [4]byte{0xa9, 0x05, 0x9c, 0xbb}, ChainID: 1, Descriptor: []byte{0x01, 0x01, 0x02, 'o', 'x'}}},
+	}
+	tx := types.NewTx(&types.DynamicFeeTx{ChainID: big.NewInt(1), GasFeeCap: big.NewInt(1), Gas: 50000, To: &contract, Data: common.FromHex("0xa9059cbb000000")})
+
+	var signatures [][]byte
+	for _, skip := range []bool{false, true} {
+		cfg.skipDescs = skip
+
+		device := newLedgerTestDevice([3]byte{1, 10, 4})
+		driver := newLedgerDriver(log.Root(), &cfg).(*ledgerDriver)
+		if err := driver.Open(device, ""); err != nil {
+			t.Fatalf("skip %v: failed to open ledger: %v", skip, err)
+		}
+		signed := testLedgerSignTx(t, driver, tx, nil)
+
+		if sent := len(device.tokens) + len(device.plugins); (sent == 0) != skip {
+			t.Errorf("skip %v: %d descriptors sent", skip, sent)
+		}
+		v, r, s := signed.RawSignatureValues()
+		signatures = append(signatures, append(append(r.Bytes(), s.Bytes()...), v.Bytes()...))
+	}
+	if !bytes.Equal(signatures[0], signatures[1]) {
+		t.Errorf("signature mismatch: have %x, want %x", signatures[1], signatures[0])
+	}
+}
+
+func TestLedgerSignLegacyTxLargeChainID(t *testing.T) {
+	to := common.HexToAddress("0x1234567890123456789012345678901234567890")
+	tx := types.NewTx(&types.LegacyTx{
+		Nonce:    1,
+		GasPrice: big.NewInt(1_000_000_000),
+		Gas:      21000,
+		To:       &to,
+		Value:    big.NewInt(1),
+	})
+	driver, _ := newTestLedger(t)
+	for _, chainID := range []*big.Int{
+		big.NewInt(7777777),
+		big.NewInt(11155111),
+		new(big.Int).Add(new(big.Int).Lsh(big.NewInt(1), 32), big.NewInt(5)),
+		new(big.Int).Add(new(big.Int).Lsh(big.NewInt(1), 64), big.NewInt(7)),
+	} {
+		signed := testLedgerSignTx(t, driver, tx, chainID)
+		if signed.ChainId().Cmp(chainID) != 0 {
+			t.Fatalf("chain ID mismatch: have %v, want %v", signed.ChainId(), chainID)
+		}
+	}
+}
+
+func TestLedgerSignDynamicFeeTx(t *testing.T) {
+	to := common.HexToAddress("0x1234567890123456789012345678901234567890")
+	tx := types.NewTx(&types.DynamicFeeTx{
+		ChainID:   big.NewInt(8453),
+		Nonce:     42,
+		GasTipCap: big.NewInt(1_000_000),
+		GasFeeCap: big.NewInt(2_000_000_000),
+		Gas:       50000,
+		To:        &to,
+		Value:     big.NewInt(1_000_000_000_000_000_000),
+		Data:      common.FromHex("0xa9059cbb"),
+	})
+	// Old Ethereum apps must reject typed transactions before touching the device
+	driver, _ := newTestLedger(t)
+	driver.version = [3]byte{1, 8, 9}
+	if _, _, err := driver.SignTx(accounts.DefaultBaseDerivationPath, tx, big.NewInt(8453)); err == nil {
+		t.Fatalf("dynamic fee transaction signed by unsupported app version")
+	}
+	driver.version = ledgerTypedTxVersion
+	signed := testLedgerSignTx(t, driver, tx, big.NewInt(8453))
+
+	// Typed transactions carry the bare parity bit, no EIP-155 adjustment
+	if v, _, _ := signed.RawSignatureValues(); v.Uint64() > 1 {
+		t.Fatalf("dynamic fee transaction V not a parity bit: %v", v)
+	}
+	// Typed transactions carry their own chain ID, signing without one must work
+	testLedgerSignTx(t, driver, tx, nil)
+}
+
+func TestLedgerSignAccessListTx(t *testing.T) {
+	to := common.HexToAddress("0x1234567890123456789012345678901234567890")
+
+	// Large access list to span multiple APDU chunks
+	var list types.AccessList
+	for i := 0; i < 4; i++ {
+		list = append(list, types.AccessTuple{
+			Address:     common.BigToAddress(big.NewInt(int64(i + 1))),
+			StorageKeys: []common.Hash{common.BigToHash(big.NewInt(int64(i))), common.BigToHash(big.NewInt(int64(i + 100)))},
+		})
+	}
+	driver, _ := newTestLedger(t)
+	for _, accessList := range []types.AccessList{nil, {}, list} {
+		tx := types.NewTx(&types.AccessListTx{
+			ChainID:    big.NewInt(1),
+			Nonce:      3,
+			GasPrice:   big.NewInt(1_000_000_000),
+			Gas:        80000,
+			To:         &to,
+			Value:      big.NewInt(1),
+			AccessList: accessList,
+		})
+		// Ensure the access list is always encoded, even if empty
+		txrlp, err := ledgerTxRLP(tx, big.NewInt(1))
+		if err != nil {
+			t.Fatalf("failed to encode transaction: %v", err)
+		}
+		if txrlp[0] != types.AccessListTxType {
+			t.Fatalf("type byte mismatch: have %d, want %d", txrlp[0], types.AccessListTxType)
+		}
+		var fields []rlp.RawValue
+		if err := rlp.DecodeBytes(txrlp[1:], &fields); err != nil {
+			t.Fatalf("failed to decode transaction: %v", err)
+		}
+		if len(fields) != 8 {
+			t.Fatalf("field count mismatch: have %d, want 8", len(fields))
+		}
+		if len(accessList) == 0 && !bytes.Equal(fields[7], []byte{0xc0}) {
+			t.Fatalf("empty access list encoding mismatch: have %x, want c0", fields[7])
+		}
+		testLedgerSignTx(t, driver, tx, big.NewInt(1))
+	}
+}
+
+func TestLedgerSignBlobTx(t *testing.T) {
+	tx := types.NewTx(&types.BlobTx{
+		ChainID:    uint256.NewInt(1),
+		Nonce:      1,
+		GasTipCap:  uint256.NewInt(1_000_000),
+		GasFeeCap:  uint256.NewInt(2_000_000_000),
+		Gas:        21000,
+		To:         common.HexToAddress("0x1234567890123456789012345678901234567890"),
+		BlobFeeCap: uint256.NewInt(3_000_000_000),
+		BlobHashes: []common.Hash{{0x01, 0x02}, {0x01, 0x03}},
+		Sidecar:    &types.BlobTxSidecar{},
+	})
+	// Old Ethereum apps must reject blob transactions before touching the device
+	driver, _ := newTestLedger(t)
+	driver.version = [3]byte{1, 10, 4}
+	if _, _, err := driver.SignTx(accounts.DefaultBaseDerivationPath, tx, big.NewInt(1)); err == nil {
+		t.Fatalf("blob transaction signed by unsupported app version")
+	}
+	// Newer apps must sign the transaction, leaving the sidecar intact
+	driver.version = ledgerBlobTxVersion
+	signed := testLedgerSignTx(t, driver, tx, big.NewInt(1))
+	if signed.BlobTxSidecar() == nil {
+		t.Fatalf("blob sidecar dropped from signed transaction")
+	}
+}
+
+func TestLedgerSignSetCodeTx(t *testing.T) {
+	auths := []types.SetCodeAuthorization{
+		{ChainID: *uint256.NewInt(1), Address: common.HexToAddress("0x01"), Nonce: 1, V: 1, R: *uint256.NewInt(2), S: *uint256.NewInt(3)},
+		{ChainID: *uint256.NewInt(0), Address: common.HexToAddress("0x02"), Nonce: 9, V: 0, R: *uint256.NewInt(4), S: *uint256.NewInt(5)},
+		{ChainID: *uint256.NewInt(1), Address: common.HexToAddress("0x03"), Nonce: 0, V: 1, R: *uint256.NewInt(6), S: *uint256.NewInt(7)},
+	}
+	// Old Ethereum apps must reject set code transactions before touching the device
+	driver, _ := newTestLedger(t)
+	if _, _, err := driver.SignTx(accounts.DefaultBaseDerivationPath, types.NewTx(&types.SetCodeTx{ChainID: uint256.NewInt(1), AuthList: auths}), big.NewInt(1)); err == nil {
+		t.Fatalf("set code transaction signed by unsupported app version")
+	}
+	driver.version = ledgerSetCodeVersion
+	for _, list := range [][]types.SetCodeAuthorization{nil, auths} {
+		tx := types.NewTx(&types.SetCodeTx{
+			ChainID:   uint256.NewInt(1),
+			Nonce:     5,
+			GasTipCap: uint256.NewInt(1_000_000),
+			GasFeeCap: uint256.NewInt(2_000_000_000),
+			Gas:       100000,
+			To:        common.HexToAddress("0x1234567890123456789012345678901234567890"),
+			AuthList:  list,
+		})
+		signed := testLedgerSignTx(t, driver, tx, big.NewInt(1))
+		if have := signed.SetCodeAuthorizations(); len(have) != len(list) {
+			t.Fatalf("authorization count mismatch: have %d, want %d", len(have), len(list))
+		}
+	}
+}
+
+func TestLedgerSignAuthorization(t *testing.T) {
+	driver, _ := newTestLedger(t)
+	path := accounts.DefaultBaseDerivationPath
+
+	// Old Ethereum apps must reject authorizations before touching the device
+	if _, err := driver.SignAuthorization(path, types.SetCodeAuthorization{}); err == nil {
+		t.Fatalf("authorization signed by unsupported app version")
+	}
+	driver.version = ledgerSetCodeVersion
+
+	address, err := driver.Derive(path)
+	if err != nil {
+		t.Fatalf("failed to derive address: %v", err)
+	}
+	auth := types.SetCodeAuthorization{
+		ChainID: *uint256.NewInt(8453),
+		Address: common.HexToAddress("0x63c0c19a282a1b52b07dd5a65b58948a07dae32b"),
+		Nonce:   17,
+	}
+	sig, err := driver.SignAuthorization(path, auth)
+	if err != nil {
+		t.Fatalf("failed to sign authorization: %v", err)
+	}
+	if len(sig) != crypto.SignatureLength || sig[64] > 1 {
+		t.Fatalf("invalid authorization signature: %x", sig)
+	}
+	auth.R.SetBytes(sig[:32])
+	auth.S.SetBytes(sig[32:64])
+	auth.V = sig[64]
+
+	if authority, err := auth.Authority(); err != nil || authority != address {
+		t.Fatalf("authority mismatch: have %x, want %x (err %v)", authority, address, err)
+	}
+}
+
+func TestLedgerExchangeCancel(t *testing.T) {
+	driver, device := newTestLedger(t)
+	path := accounts.DefaultBaseDerivationPath
+
+	address, err := driver.Derive(path)
+	if err != nil {
+		t.Fatalf("failed to derive address: %v", err)
+	}
+	// Start a signature the user never confirms and abandon it
+	device.block = make(chan struct{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := driver.SignTextContext(ctx, path, []byte("hello")); err != context.DeadlineExceeded {
+		t.Fatalf("cancelled signature error mismatch: have %v, want %v", err, context.DeadlineExceeded)
+	}
+	// Subsequent exchanges must fail fast until the stale reply is drained
+	if _, err := driver.ledgerExchange(ledgerOpGetConfiguration, 0, 0, nil); !errors.Is(err, ErrLedgerBusy) {
+		t.Fatalf("pending exchange error mismatch: have %v, want %v", err, ErrLedgerBusy)
+	}
+	// Once the user dismisses the prompt, the next exchange must get its own reply
+	close(device.block)
+	<-driver.pending
+
+	derived, err := driver.Derive(path)
+	if err != nil {
+		t.Fatalf("failed to derive address after cancellation: %v", err)
+	}
+	if derived != address {
+		t.Fatalf("address mismatch after cancellation: have %x, want %x", derived, address)
+	}
+}
+
+// Tests that hardened path components reach the device unaltered through both the
+// derivation and signing requests, yielding the address other implementations
+// derive for the standard test mnemonic.
+func TestLedgerDeriveHardenedPath(t *testing.T) {
+	path, err := accounts.ParseDerivationPath("m/44'/60'/0'/0/0")
+	if err != nil {
+		t.Fatalf("failed to parse derivation path: %v", err)
+	}
+	encoded, err := ledgerEncodePath(path)
+	if err != nil {
+		t.Fatalf("failed to encode derivation path: %v", err)
+	}
+	if want := common.FromHex("0x058000002c8000003c800000000000000000000000"); !bytes.Equal(encoded, want) {
+		t.Fatalf("encoded path mismatch: have %x, want %x", encoded, want)
+	}
+	want := common.HexToAddress("0x9858EfFD232B4033E47d90003D41EC34EcaEda94")
+
+	driver, _ := newTestLedger(t)
+	address, err := driver.Derive(path)
+	if err != nil {
+		t.Fatalf("failed to derive address: %v", err)
+	}
+	if address != want {
+		t.Errorf("derived address mismatch: have %x, want %x", address, want)
+	}
+	xpub, err := driver.ExtendedPublicKey(path[:len(path)-1])
+	if err != nil {
+		t.Fatalf("failed to retrieve extended public key: %v", err)
+	}
+	if address, err := deriveAddress(xpub, path[len(path)-1]); err != nil || address != want {
+		t.Errorf("locally derived address mismatch: have %x, want %x (err %v)", address, want, err)
+	}
+	signature, err := driver.SignText(path, []byte("hello"))
+	if err != nil {
+		t.Fatalf("failed to sign message: %v", err)
+	}
+	signature[64] -= 27
+	pubkey, err := crypto.SigToPub(accounts.TextHash([]byte("hello")), signature)
+	if err != nil {
+		t.Fatalf("failed to recover signer: %v", err)
+	}
+	if signer := crypto.PubkeyToAddress(*pubkey); signer != want {
+		t.Errorf("signer mismatch: have %x, want %x", signer, want)
+	}
+}
+
+// Tests that public keys returned in any of the formats used across app versions
+// are normalized, yielding the same keys and addresses.
+func TestLedgerPubkeyFormats(t *testing.T) {
+	tests := []struct {
+		convert func([]byte) []byte
+		fail    bool
+	}{
+		{convert: func(key []byte) []byte { return key }},
+		{convert: func(key []byte) []byte { return key[1:] }},
+		{convert: func(key []byte) []byte {
+			pub, _ := crypto.UnmarshalPubkey(key)
+			return crypto.CompressPubkey(pub)
+		}},
+		{convert: func(key []byte) []byte { return key[1:33] }, fail: true},
+		{convert: func(key []byte) []byte { return append([]byte{0x05}, key[1:33]...) }, fail: true},
+	}
+	path := accounts.DefaultBaseDerivationPath
+	want := ledgerTestKey(path).PublicKey
+
+	for i, tt := range tests {
+		driver, device := newTestLedger(t)
+		device.pubkey = tt.convert
+
+		key, err := driver.PublicKey(path)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("test %d: invalid public key accepted", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: failed to retrieve public key: %v", i, err)
+			continue
+		}
+		if !key.Equal(&want) {
+			t.Errorf("test %d: public key mismatch: have %x, want %x", i, crypto.FromECDSAPub(key), crypto.FromECDSAPub(&want))
+		}
+		if address, err := driver.ConfirmAddress(path); err != nil || address != crypto.PubkeyToAddress(want) {
+			t.Errorf("test %d: confirmed address mismatch: have %x (%v), want %x", i, address, err, crypto.PubkeyToAddress(want))
+		}
+		xpub, err := driver.ExtendedPublicKey(path[:len(path)-1])
+		if err != nil {
+			t.Errorf("test %d: failed to retrieve extended public key: %v", i, err)
+			continue
+		}
+		if address, err := deriveAddress(xpub, path[len(path)-1]); err != nil || address != crypto.PubkeyToAddress(want) {
+			t.Errorf("test %d: locally derived address mismatch: have %x (%v), want %x", i, address, err, crypto.PubkeyToAddress(want))
+		}
+	}
+}
+
+// Tests that personal messages longer than a single APDU are streamed in chunks,
+// and that messages over the configured limit are rejected before being sent.
+func TestLedgerSignLongMessage(t *testing.T) {
+	driver, device := newTestLedger(t)
+	path := accounts.DefaultBaseDerivationPath
+
+	text := bytes.Repeat([]byte("0123456789abcdef"), 64) // 1KB, way over a single APDU
+	signature, err := driver.SignText(path, text)
+	if err != nil {
+		t.Fatalf("failed to sign long message: %v", err)
+	}
+	if want := 1 + 4*len(path) + 4 + len(text); len(device.msgdata) != want {
+		t.Fatalf("streamed payload length mismatch: have %d, want %d", len(device.msgdata), want)
+	}
+	if signature[64] >= 27 {
+		signature[64] -= 27
+	}
+	pubkey, err := crypto.SigToPub(accounts.TextHash(text), signature)
+	if err != nil {
+		t.Fatalf("failed to recover signer: %v", err)
+	}
+	if signer, want := crypto.PubkeyToAddress(*pubkey), crypto.PubkeyToAddress(ledgerTestKey(path).PublicKey); signer != want {
+		t.Fatalf("signer mismatch: have %x, want %x", signer, want)
+	}
+	// Limit the message length and ensure longer ones never reach the device
+	cfg := new(config)
+	WithLedgerMaxMessageSize(uint64(len(text) - 1))(cfg)
+
+	driver = newLedgerDriver(log.Root(), cfg).(*ledgerDriver)
+	if err := driver.Open(device, ""); err != nil {
+		t.Fatalf("failed to open ledger: %v", err)
+	}
+	prompts := device.prompts
+	if _, err := driver.SignText(path, text); !errors.Is(err, ErrLedgerMessageTooLong) {
+		t.Fatalf("error mismatch: have %v, want %v", err, ErrLedgerMessageTooLong)
+	}
+	if device.prompts != prompts {
+		t.Fatalf("too long message sent to the device")
+	}
+	if _, err := driver.SignText(path, text[1:]); err != nil {
+		t.Fatalf("failed to sign message at the limit: %v", err)
+	}
+}
+
+// Tests that requests prompting the user are told apart from background ones.
+func TestLedgerInteractive(t *testing.T) {
+	tests := []struct {
+		cla    ledgerClass
+		opcode ledgerOpcode
+		p1     ledgerParam1
+		want   bool
+	}{
+		{ledgerClaEthereum, ledgerOpRetrieveAddress, ledgerP1DirectlyFetchAddress, false},
+		{ledgerClaEthereum, ledgerOpRetrieveAddress, ledgerP1ConfirmFetchAddress, true},
+		{ledgerClaEthereum, ledgerOpSignTransaction, ledgerP1ContTransactionData, true},
+		{ledgerClaEthereum, ledgerOpSignPersonalMessage, 0, true},
+		{ledgerClaEthereum, ledgerOpEip712SendStructDef, 0, false},
+		{ledgerClaEthereum, ledgerOpEip712SendStructImpl, 0, true},
+		{ledgerClaEthereum, ledgerOpProvideERC20, 0, false},
+		{ledgerClaEthereum, ledgerOpGetConfiguration, 0, false},
+		{ledgerClaDashboard, ledgerOpGetAppAndVersion, 0, false},
+	}
+	for i, tt := range tests {
+		if have := ledgerInteractive(tt.cla, tt.opcode, tt.p1); have != tt.want {
+			t.Errorf("test %d: interactive mismatch: have %v, want %v", i, have, tt.want)
+		}
+	}
+}
+
+// Tests that the configured timeouts abort exchanges the device doesn't answer,
+// picking the limit by whether the request prompts the user.
+func TestLedgerTimeouts(t *testing.T) {
+	driver, device := newTestLedger(t)
+	path := accounts.DefaultBaseDerivationPath
+
+	// Start a signature the user never confirms, limited by the interactive timeout
+	driver.timeouts = Timeouts{Interactive: 50 * time.Millisecond}
+	device.block = make(chan struct{})
+
+	start := time.Now()
+	if _, err := driver.SignText(path, []byte("hello")); err != context.DeadlineExceeded {
+		t.Fatalf("expired signature error mismatch: have %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("signature expired too early: %v", elapsed)
+	}
+	// Requests made while the prompt is still open fail fast instead of waiting
+	if _, err := driver.Derive(path); !errors.Is(err, ErrLedgerBusy) {
+		t.Fatalf("busy derivation error mismatch: have %v, want %v", err, ErrLedgerBusy)
+	}
+	if err := driver.Heartbeat(); err != nil {
+		t.Fatalf("busy device failed heartbeat: %v", err)
+	}
+	close(device.block)
+	<-driver.pending
+
+	if _, err := driver.Derive(path); err != nil {
+		t.Fatalf("failed to derive address after timeout: %v", err)
+	}
+}
+
+// Tests that a signature waiting for confirmation can be abandoned with Cancel,
+// and that the device is usable again once the prompt is dismissed.
+func TestLedgerCancel(t *testing.T) {
+	driver, device := newTestLedger(t)
+	path := accounts.DefaultBaseDerivationPath
+
+	// Cancelling without any request in flight is a no-op
+	if err := driver.Cancel(); err != nil {
+		t.Fatalf("failed to cancel idle device: %v", err)
+	}
+	if _, err := driver.Derive(path); err != nil {
+		t.Fatalf("failed to derive address after idle cancel: %v", err)
+	}
+	// Start a signature the user never confirms and cancel it once in flight
+	device.block = make(chan struct{})
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := driver.SignText(path, []byte("hello"))
+		errc <- err
+	}()
+	for {
+		driver.abortLock.Lock()
+		inflight := driver.abort != nil
+		driver.abortLock.Unlock()
+
+		if inflight {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := driver.Cancel(); err != nil {
+		t.Fatalf("failed to cancel signature: %v", err)
+	}
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled signature error mismatch: have %v, want %v", err, context.Canceled)
+	}
+	// Until the user dismisses the prompt, other requests fail fast
+	if _, err := driver.SignText(path, []byte("hello")); !errors.Is(err, ErrLedgerBusy) {
+		t.Fatalf("busy signature error mismatch: have %v, want %v", err, ErrLedgerBusy)
+	}
+	// Once the user dismisses the prompt, the device must be usable again
+	close(device.block)
+	<-driver.pending
+
+	if _, err := driver.SignText(path, []byte("hello")); err != nil {
+		t.Fatalf("failed to sign after cancellation: %v", err)
+	}
+}
+
+// Tests that a request split into several APDUs is stopped before its next one if
+// cancelled between two, and that cancelling once it ended is a no-op.
+func TestLedgerCancelBetweenChunks(t *testing.T) {
+	driver, device := newTestLedger(t)
+
+	path, err := ledgerEncodePath(accounts.DefaultBaseDerivationPath)
+	if err != nil {
+		t.Fatalf("failed to encode path: %v", err)
+	}
+	text := bytes.Repeat([]byte{'a'}, 300)
+	payload := append(binary.BigEndian.AppendUint32(path, uint32(len(text))), text...)
+
+	ctx, done := driver.ledgerFlow(context.Background())
+	if _, err := driver.ledgerExchangeContext(ctx, ledgerOpSignPersonalMessage, ledgerP1InitTransactionData, 0, payload[:255]); err != nil {
+		t.Fatalf("failed to send first chunk: %v", err)
+	}
+	if err := driver.Cancel(); err != nil {
+		t.Fatalf("failed to cancel between chunks: %v", err)
+	}
+	if _, err := driver.ledgerExchangeContext(ctx, ledgerOpSignPersonalMessage, ledgerP1ContTransactionData, 0, payload[255:]); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled chunk error mismatch: have %v, want %v", err, context.Canceled)
+	}
+	if len(device.msgdata) != 255 {
+		t.Fatalf("chunk sent after cancellation: have %d bytes, want 255", len(device.msgdata))
+	}
+	done()
+
+	// The next request must not be affected by cancelling the ended one
+	if err := driver.Cancel(); err != nil {
+		t.Fatalf("failed to cancel idle device: %v", err)
+	}
+	if _, err := driver.SignText(accounts.DefaultBaseDerivationPath, text); err != nil {
+		t.Fatalf("failed to sign after cancellation: %v", err)
+	}
+}
+
+// Tests that attestations are refused by Ledgers, whose genuine check isn't
+// exposed by the Ethereum app.
+func TestLedgerAttestation(t *testing.T) {
+	driver, _ := newTestLedger(t)
+	if _, err := driver.Attestation([]byte("challenge")); !errors.Is(err, accounts.ErrNotSupported) {
+		t.Fatalf("error mismatch: have %v, want %v", err, accounts.ErrNotSupported)
+	}
+}
+
+func TestLedgerUserRejected(t *testing.T) {
+	driver, device := newTestLedger(t)
+	device.reject = true
+
+	_, err := driver.SignText(accounts.DefaultBaseDerivationPath, []byte("hello"))
+	if !errors.Is(err, ErrUserRejected) {
+		t.Fatalf("rejection error mismatch: have %v, want %v", err, ErrUserRejected)
+	}
+	if device.prompts != 1 {
+		t.Fatalf("user prompted %d times, want 1", device.prompts)
+	}
+}
+
+func TestLedgerStatusErrors(t *testing.T) {
+	tests := []struct {
+		status ledgerStatus
+		target error
+		text   string
+	}{
+		{0x6985, ErrUserRejected, "ledger: invalid status: 0x6985 (Condition not satisfied)"},
+		{0x6982, ErrLedgerLocked, "ledger: invalid status: 0x6982 (Security status not satisfied (Device locked))"},
+		{0x5515, ErrLedgerLocked, "ledger: invalid status: 0x5515 (Device is locked)"},
+		{0x6d00, accounts.ErrNotSupported, "ledger: invalid status: 0x6d00 (Instruction not supported)"},
+		{0x6e00, ErrLedgerAppNotOpen, "ledger: invalid status: 0x6e00 (Class not supported (Ethereum app not open))"},
+		{0x6a80, nil, "ledger: invalid status: 0x6a80 (Invalid data)"},
+		{0x6b00, nil, "ledger: invalid status: 0x6b00 (Incorrect parameter P1 or P2)"},
+		{0x1234, nil, "ledger: invalid status: 0x1234 (unknown error)"},
+	}
+	for _, tt := range tests {
+		err := error(&ledgerError{status: tt.status})
+		if err.Error() != tt.text {
+			t.Errorf("0x%04x: message mismatch: have %q, want %q", tt.status, err.Error(), tt.text)
+		}
+		if !errors.Is(err, errLedgerInvalidStatus) {
+			t.Errorf("0x%04x: not an invalid status error", tt.status)
+		}
+		for _, sentinel := range []error{ErrUserRejected, ErrLedgerLocked, ErrLedgerAppNotOpen, accounts.ErrNotSupported} {
+			if errors.Is(err, sentinel) != (sentinel == tt.target) {
+				t.Errorf("0x%04x: sentinel %v match mismatch", tt.status, sentinel)
+			}
+		}
+	}
+	// Ensure the status words are surfaced from actual exchanges too
+	driver, _ := newTestLedger(t)
+	if _, err := driver.ledgerExchange(0xff, 0, 0, nil); !errors.Is(err, accounts.ErrNotSupported) {
+		t.Fatalf("unknown instruction error mismatch: have %v, want %v", err, accounts.ErrNotSupported)
+	}
+}
+
+func TestLedgerConfirmAddress(t *testing.T) {
+	driver, device := newTestLedger(t)
+	path := accounts.DefaultBaseDerivationPath
+
+	address, err := driver.Derive(path)
+	if err != nil {
+		t.Fatalf("failed to derive address: %v", err)
+	}
+	confirmed, err := driver.ConfirmAddress(path)
+	if err != nil {
+		t.Fatalf("failed to confirm address: %v", err)
+	}
+	if confirmed != address || device.prompts != 1 {
+		t.Fatalf("confirmation mismatch: have %x (%d prompts), want %x (1 prompt)", confirmed, device.prompts, address)
+	}
+	device.reject = true
+	if _, err := driver.ConfirmAddress(path); !errors.Is(err, ErrUserRejected) {
+		t.Fatalf("rejection error mismatch: have %v, want %v", err, ErrUserRejected)
+	}
+}
+
+func TestLedgerExtendedPublicKey(t *testing.T) {
+	driver, _ := newTestLedger(t)
+
+	// Retrieve the account level extended key and ensure it matches the device's
+	xpub, err := driver.ExtendedPublicKey(accounts.DefaultRootDerivationPath)
+	if err != nil {
+		t.Fatalf("failed to retrieve extended public key: %v", err)
+	}
+	want, err := ledgerTestNode(accounts.DefaultRootDerivationPath).Neuter()
+	if err != nil {
+		t.Fatalf("failed to neuter reference key: %v", err)
+	}
+	if xpub.String() != want.String() {
+		t.Fatalf("extended public key mismatch: have %s, want %s", xpub, want)
+	}
+	// Derive the first few accounts locally and compare with the device
+	for i := uint32(0); i < 20; i++ {
+		child, err := xpub.Derive(i)
+		if err != nil {
+			t.Fatalf("index %d: failed to derive child key: %v", i, err)
+		}
+		pubkey, err := child.ECPubKey()
+		if err != nil {
+			t.Fatalf("index %d: failed to extract public key: %v", i, err)
+		}
+		key, err := crypto.UnmarshalPubkey(pubkey.SerializeUncompressed())
+		if err != nil {
+			t.Fatalf("index %d: failed to convert public key: %v", i, err)
+		}
+		path := append(accounts.DerivationPath{}, accounts.DefaultRootDerivationPath...)
+		address, err := driver.Derive(append(path, i))
+		if err != nil {
+			t.Fatalf("index %d: failed to derive address: %v", i, err)
+		}
+		if local := crypto.PubkeyToAddress(*key); local != address {
+			t.Fatalf("index %d: address mismatch: have %x, want %x", i, local, address)
+		}
+	}
+}
+
+// Tests that the public key on a derivation path is retrieved from the device and
+// matches the derived address.
+func TestLedgerPublicKey(t *testing.T) {
+	driver, _ := newTestLedger(t)
+	path := accounts.DefaultBaseDerivationPath
+
+	key, err := driver.PublicKey(path)
+	if err != nil {
+		t.Fatalf("failed to retrieve public key: %v", err)
+	}
+	if want := ledgerTestKey(path).PublicKey; !key.Equal(&want) {
+		t.Fatalf("public key mismatch: have %x, want %x", crypto.FromECDSAPub(key), crypto.FromECDSAPub(&want))
+	}
+	address, err := driver.Derive(path)
+	if err != nil {
+		t.Fatalf("failed to derive address: %v", err)
+	}
+	if have := crypto.PubkeyToAddress(*key); have != address {
+		t.Fatalf("address mismatch: have %x, want %x", have, address)
+	}
+}
+
+// Tests that the Ethereum app configuration is retrieved and parsed.
+func TestLedgerAppConfig(t *testing.T) {
+	driver, device := newTestLedger(t)
+
+	for _, flags := range []byte{0, LedgerFlagBlindSigning, LedgerFlagBlindSigning | LedgerFlagERC20External} {
+		device.flags = flags
+
+		version, have, err := driver.LedgerAppConfig()
+		if err != nil {
+			t.Fatalf("flags %#x: failed to retrieve app config: %v", flags, err)
+		}
+		if version != device.version {
+			t.Errorf("flags %#x: version mismatch: have %v, want %v", flags, version, device.version)
+		}
+		if have != flags {
+			t.Errorf("flags mismatch: have %#x, want %#x", have, flags)
+		}
+	}
+	// Ensure the query is rejected if the app is not open
+	driver.Close()
+	if _, _, err := driver.LedgerAppConfig(); !errors.Is(err, accounts.ErrWalletClosed) {
+		t.Fatalf("closed app config error mismatch: have %v, want %v", err, accounts.ErrWalletClosed)
+	}
+}
+
+// Tests that a Ledger running a different app than Ethereum is reported with the
+// name of the app, both when opening and when the app is switched afterwards.
+func TestLedgerWrongApp(t *testing.T) {
+	// Open the Ledger while the Bitcoin app is running
+	device := newLedgerTestDevice([3]byte{1, 10, 4})
+	device.app = "Bitcoin"
+
+	driver := newLedgerDriver(log.Root(), new(config)).(*ledgerDriver)
+	err := driver.Open(device, "")
+	if !errors.Is(err, ErrWrongApp) {
+		t.Fatalf("open error mismatch: have %v, want %v", err, ErrWrongApp)
+	}
+	var wrong *WrongAppError
+	if !errors.As(err, &wrong) || wrong.App != "Bitcoin" {
+		t.Fatalf("running app mismatch: have %v, want Bitcoin", err)
+	}
+	// Switch to the Ethereum app, then back to the dashboard
+	device.app = ledgerEthereumApp
+	if err := driver.Open(device, ""); err != nil {
+		t.Fatalf("failed to open ledger: %v", err)
+	}
+	if driver.app != ledgerEthereumApp {
+		t.Fatalf("running app mismatch: have %q, want %q", driver.app, ledgerEthereumApp)
+	}
+	if err := driver.Heartbeat(); err != nil {
+		t.Fatalf("heartbeat failed: %v", err)
+	}
+	device.app = "BOLOS"
+	if err := driver.Heartbeat(); !errors.As(err, &wrong) || wrong.App != "BOLOS" {
+		t.Fatalf("heartbeat error mismatch: have %v, want BOLOS running", err)
+	}
+}
+
+// Tests that the Ledger models are derived from both the original and the current
+// (interface carrying) USB product identifiers.
+func TestLedgerModel(t *testing.T) {
+	tests := []struct {
+		productID uint16
+		model     string
+	}{
+		{0x0001, "Ledger Nano S"},
+		{0x0004, "Ledger Nano X"},
+		{0x4011, "Ledger Nano X"},
+		{0x5015, "Ledger Nano S Plus"},
+		{0x6011, "Ledger Stax"},
+		{0x0007, "Ledger Flex"},
+		{0x9011, "Ledger"},
+	}
+	for _, tt := range tests {
+		if model := ledgerModel(tt.productID); model != tt.model {
+			t.Errorf("product %#04x: model mismatch: have %q, want %q", tt.productID, model, tt.model)
+		}
+	}
+}
+
+// Tests that the device info reports the running app and its configuration.
+func TestLedgerDeviceInfo(t *testing.T) {
+	driver, _ := newTestLedger(t)
+
+	want := DeviceInfo{App: ledgerEthereumApp, AppVersion: "1.10.4", Flags: LedgerFlagBlindSigning}
+	if info := driver.DeviceInfo(); info != want {
+		t.Fatalf("device info mismatch: have %+v, want %+v", info, want)
+	}
+}
+
+// Tests that hash signing fails fast if blind signing is disabled on the device.
+func TestLedgerSignTypedHashBlindSigning(t *testing.T) {
+	driver, device := newTestLedger(t)
+	domainHash, messageHash := crypto.Keccak256([]byte("domain")), crypto.Keccak256([]byte("message"))
+
+	device.flags = 0
+	if _, err := driver.SignTypedHash(accounts.DefaultBaseDerivationPath, domainHash, messageHash); !errors.Is(err, ErrBlindSigningDisabled) {
+		t.Fatalf("error mismatch: have %v, want %v", err, ErrBlindSigningDisabled)
+	}
+	// Enabling the setting must be picked up without reopening the wallet
+	device.flags = LedgerFlagBlindSigning
+	if _, err := driver.SignTypedHash(accounts.DefaultBaseDerivationPath, domainHash, messageHash); err != nil {
+		t.Fatalf("failed to sign typed hash: %v", err)
+	}
+}
+
+// Tests that the supported features are derived from the Ethereum app version.
+func TestLedgerCapabilities(t *testing.T) {
+	tests := []struct {
+		version [3]byte
+		caps    Capabilities
+	}{
+		{[3]byte{1, 4, 0}, Capabilities{}},
+		{[3]byte{1, 5, 0}, Capabilities{TypedDataNative: true, NestedArrays: true}},
+		{[3]byte{1, 9, 19}, Capabilities{TypedDataNative: true, NestedArrays: true, AccessListTx: true, DynamicFeeTx: true}},
+		{[3]byte{1, 10, 4}, Capabilities{TypedDataNative: true, NestedArrays: true, AccessListTx: true, DynamicFeeTx: true, ClearSigning: true}},
+		{[3]byte{1, 11, 0}, Capabilities{TypedDataNative: true, NestedArrays: true, AccessListTx: true, DynamicFeeTx: true, ClearSigning: true, BlobTx: true}},
+	}
+	for i, tt := range tests {
+		device := newLedgerTestDevice(tt.version)
+		driver := newLedgerDriver(log.Root(), new(config)).(*ledgerDriver)
+		if err := driver.Open(device, ""); err != nil {
+			t.Fatalf("test %d: failed to open ledger: %v", i, err)
+		}
+		if caps := driver.Capabilities(); caps != tt.caps {
+			t.Errorf("test %d: capabilities mismatch: have %+v, want %+v", i, caps, tt.caps)
+		}
+	}
+	// Nothing is supported while the Ethereum app is closed
+	device := newLedgerTestDevice([3]byte{1, 11, 0})
+	device.app = "BOLOS"
+
+	driver := newLedgerDriver(log.Root(), new(config)).(*ledgerDriver)
+	if err := driver.Open(device, ""); err == nil {
+		t.Fatalf("ledger opened with the Ethereum app closed")
+	}
+	if caps := driver.Capabilities(); caps != (Capabilities{}) {
+		t.Errorf("offline capabilities mismatch: have %+v, want none", caps)
+	}
+}
+
+// Tests that derivation paths the Ledger can't derive are rejected before any
+// request is sent to the device.
+func TestLedgerPathValidation(t *testing.T) {
+	tests := []struct {
+		length int  // Number of derivation path components
+		valid  bool // Whether the path should be accepted
+	}{
+		{0, false},
+		{1, true},
+		{10, true},
+		{11, false},
+		{256, false},
+	}
+	for i, tt := range tests {
+		driver, device := newTestLedger(t)
+		flaky := &flakyTestDevice{ReadWriter: device}
+		driver.device = flaky
+
+		path := make(accounts.DerivationPath, tt.length)
+		for j := range path {
+			path[j] = uint32(j)
+		}
+		ops := []func() error{
+			func() error { _, err := driver.Derive(path); return err },
+			func() error { _, err := driver.ExtendedPublicKey(path); return err },
+			func() error { _, err := driver.PublicKey(path); return err },
+			func() error { _, err := driver.SignText(path, []byte("hello")); return err },
+			func() error { _, err := driver.SignTypedHash(path, make([]byte, 32), make([]byte, 32)); return err },
+			func() error {
+				_, _, err := driver.SignTx(path, types.NewTx(&types.LegacyTx{Gas: 21000}), big.NewInt(1))
+				return err
+			},
+		}
+		for j, op := range ops {
+			flaky.writes = 0
+			err := op()
+			if tt.valid {
+				if errors.Is(err, ErrInvalidDerivationPath) {
+					t.Errorf("test %d, op %d: valid path rejected: %v", i, j, err)
+				}
+				continue
+			}
+			if !errors.Is(err, ErrInvalidDerivationPath) {
+				t.Errorf("test %d, op %d: error mismatch: have %v, want %v", i, j, err, ErrInvalidDerivationPath)
+			}
+			if flaky.writes != 0 {
+				t.Errorf("test %d, op %d: %d writes sent for an invalid path", i, j, flaky.writes)
+			}
+		}
+	}
+}
+
+// Tests that a transaction sign interrupted mid-stream, either while sending the
+// payload or while receiving the signature, doesn't break the next sign on the
+// same connection.
+func TestLedgerSignInterrupted(t *testing.T) {
+	to := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	tx := types.NewTx(&types.DynamicFeeTx{ChainID: big.NewInt(1), Gas: 21000, GasFeeCap: big.NewInt(1), To: &to, Data: make([]byte, 600)})
+
+	for _, interrupt := range []string{"write", "read"} {
+		driver, device := newTestLedger(t)
+		flaky := &flakyTestDevice{ReadWriter: device, fails: make(map[int]bool), readFails: make(map[int]bool)}
+		driver.device = flaky
+
+		// Measure a clean sign to locate the chunks to interrupt
+		testLedgerSignTx(t, driver, tx, big.NewInt(1))
+		reads := flaky.reads
+		if _, _, err := driver.SignTx(accounts.DefaultBaseDerivationPath, tx, big.NewInt(1)); err != nil {
+			t.Fatalf("%s: failed to sign transaction: %v", interrupt, err)
+		}
+		switch interrupt {
+		case "write":
+			// The first 255 byte APDU spans 5 frames, fail the second APDU
+			flaky.fails[flaky.writes+6] = true
+		case "read":
+			// Fail the last frame of the signature, leaving it unread
+			flaky.readFails[2*flaky.reads-reads] = true
+		}
+		if _, _, err := driver.SignTx(accounts.DefaultBaseDerivationPath, tx, big.NewInt(1)); !errors.Is(err, errFlakyWrite) {
+			t.Fatalf("%s: interrupted sign error mismatch: have %v, want %v", interrupt, err, errFlakyWrite)
+		}
+		testLedgerSignTx(t, driver, tx, big.NewInt(1))
+	}
+}
+
+// fragmentedTestReader returns its data in fragments of the given sizes, as a
+// Ledger under load may deliver its HID frames.
+type fragmentedTestReader struct {
+	data   []byte
+	splits []byte
+	reads  int
+}
+
+func (r *fragmentedTestReader) Read(buf []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	size := len(buf)
+	if len(r.splits) > 0 {
+		size = min(size, int(r.splits[r.reads%len(r.splits)])%64+1)
+	}
+	r.reads++
+
+	n := copy(buf[:size], r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// Tests that Ledger replies are reassembled correctly regardless of how the
+// frames are fragmented across reads, and that arbitrary data never panics.
+func FuzzLedgerReadReply(f *testing.F) {
+	f.Add([]byte{0x90, 0x00}, []byte{})
+	f.Add([]byte{0x90, 0x00}, []byte{5, 1})
+	f.Add(bytes.Repeat([]byte{0xaa}, 200), []byte{6})
+	f.Add(bytes.Repeat([]byte{0xbb}, 57), []byte{63, 4, 0, 62})
+	f.Add(bytes.Repeat([]byte{0xcc}, 400), []byte{31, 17, 0, 2})
+
+	f.Fuzz(func(t *testing.T, reply []byte, splits []byte) {
+		// Arbitrary device output must fail cleanly
+		ledgerReadReply(&fragmentedTestReader{data: reply, splits: splits}, log.Root())
+
+		// Well framed replies must be reassembled exactly
+		reply = reply[:min(len(reply), 0xffff)]
+
+		device := new(MockTransport)
+		device.frameLedger(reply)
+
+		have, err := ledgerReadReply(&fragmentedTestReader{data: device.reply.Bytes(), splits: splits}, log.Root())
+		if err != nil {
+			t.Fatalf("failed to read reply: %v", err)
+		}
+		if !bytes.Equal(have, reply) {
+			t.Fatalf("reply mismatch: have %x, want %x", have, reply)
+		}
+	})
+}
+
+func TestLedgerReadReplyFragmented(t *testing.T) {
+	frames := func(seq ...uint16) []byte {
+		var blob []byte
+		for _, index := range seq {
+			frame := make([]byte, 64)
+			copy(frame, []byte{0x01, 0x01, 0x05})
+			binary.BigEndian.PutUint16(frame[3:], index)
+			if index == 0 {
+				binary.BigEndian.PutUint16(frame[5:], 100)
+			}
+			blob = append(blob, frame...)
+		}
+		return blob
+	}
+	tests := []struct {
+		data   []byte
+		splits []byte
+		err    error
+	}{
+		// Length header split across reads
+		{data: frames(0, 1), splits: []byte{5, 0, 63}},
+		{data: frames(0, 1), splits: []byte{6, 62}},
+		// Stale frame of an abandoned reply, delivered in fragments
+		{data: frames(3, 0, 1), splits: []byte{9, 53}},
+		// Out of order and truncated frames
+		{data: frames(0, 2), err: errors.New("ledger: reply chunk 2 out of sequence, want 1")},
+		{data: frames(0, 1)[:90], splits: []byte{10}, err: io.EOF},
+		{data: []byte{0x01, 0x01, 0x06, 0x00, 0x00}, err: errLedgerReplyInvalidHeader},
+	}
+	for i, tt := range tests {
+		reply, err := ledgerReadReply(&fragmentedTestReader{data: tt.data, splits: tt.splits}, log.Root())
+		switch {
+		case tt.err == nil && err != nil:
+			t.Errorf("test %d: failed to read reply: %v", i, err)
+		case tt.err == nil && len(reply) != 100:
+			t.Errorf("test %d: reply length mismatch: have %d, want 100", i, len(reply))
+		case tt.err != nil && (err == nil || (!errors.Is(err, tt.err) && err.Error() != tt.err.Error())):
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
+
+// Tests that consecutive Ledger replies delivered in fragments are both read, the
+// padding of the last frame of the first not leaking into the second.
+func TestLedgerReadReplyConsecutive(t *testing.T) {
+	device := new(MockTransport)
+	device.frameLedger([]byte{0x01, 0x90, 0x00})
+	device.frameLedger([]byte{0x02, 0x90, 0x00})
+
+	reader := &fragmentedTestReader{data: device.reply.Bytes(), splits: []byte{8}}
+	for i, want := range [][]byte{{0x01, 0x90, 0x00}, {0x02, 0x90, 0x00}} {
+		reply, err := ledgerReadReply(reader, log.Root())
+		if err != nil {
+			t.Fatalf("reply %d: failed to read: %v", i, err)
+		}
+		if !bytes.Equal(reply, want) {
+			t.Errorf("reply %d: mismatch: have %x, want %x", i, reply, want)
+		}
+	}
+}
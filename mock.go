@@ -0,0 +1,200 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// This file contains in-memory transports emulating the USB framing of hardware
+// wallets, allowing code built on top of this package to be tested by scripting
+// the device's replies instead of attaching a physical device.
+
+package usbwallet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/base/usbwallet/trezor"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/log"
+	"google.golang.org/protobuf/proto"
+)
+
+// MockTransport is an in-memory device connection, reassembling the requests
+// streamed by a driver and framing the scripted replies for it to read back.
+type MockTransport struct {
+	ledger bool                        // Whether Ledger (APDU) or Trezor (protobuf) framing is used
+	handle func(request []byte) []byte // Handler for the reassembled requests
+
+	request []byte       // Request being reassembled from chunks
+	pending int          // Total length of the request being reassembled
+	reply   bytes.Buffer // Framed replies waiting to be read by the driver
+	lock    sync.Mutex   // Protects the buffers from concurrent access
+}
+
+// NewMockLedger creates an in-memory Ledger connection, invoking the handler with
+// each APDU command sent by the driver and returning its reply data and status
+// word (e.g. 0x9000 for success, 0x6985 for user rejection).
+func NewMockLedger(handler func(cla, ins, p1, p2 byte, data []byte) ([]byte, uint16)) *MockTransport {
+	return &MockTransport{
+		ledger: true,
+		handle: func(apdu []byte) []byte {
+			if len(apdu) < 5 || len(apdu) < 5+int(apdu[4]) {
+				return []byte{0x67, 0x00} // Wrong length
+			}
+			reply, status := handler(apdu[0], apdu[1], apdu[2], apdu[3], apdu[5:5+int(apdu[4])])
+			return binary.BigEndian.AppendUint16(append([]byte{}, reply...), status)
+		},
+	}
+}
+
+// NewMockTrezor creates an in-memory Trezor connection, invoking the handler with
+// each message sent by the driver and returning its reply (e.g. a trezor.Failure
+// with Failure_ActionCancelled for user rejection).
+func NewMockTrezor(handler func(request proto.Message) proto.Message) *MockTransport {
+	return &MockTransport{
+		handle: func(message []byte) []byte {
+			kind := binary.BigEndian.Uint16(message)
+
+			var reply proto.Message
+			if request := trezor.New(kind); request == nil {
+				reply = mockTrezorFailure(fmt.Sprintf("unknown message %d", kind))
+			} else if err := proto.Unmarshal(message[2:], request); err != nil {
+				reply = mockTrezorFailure(err.Error())
+			} else {
+				reply = handler(request)
+			}
+			data, err := proto.Marshal(reply)
+			if err != nil {
+				panic(err)
+			}
+			return append(binary.BigEndian.AppendUint16(nil, trezor.Type(reply)), data...)
+		},
+	}
+}
+
+// mockTrezorFailure creates a Trezor failure reply for a malformed request.
+func mockTrezorFailure(message string) *trezor.Failure {
+	code := trezor.Failure_Failure_DataError
+	return &trezor.Failure{Code: &code, Message: &message}
+}
+
+// Write implements io.Writer, accepting a single 64 byte chunk from the driver.
+func (t *MockTransport) Write(chunk []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.ledger {
+		// Ledger chunks are prefixed by the channel, tag and sequence number
+		if binary.BigEndian.Uint16(chunk[3:5]) == 0 {
+			t.pending = int(binary.BigEndian.Uint16(chunk[5:7]))
+			t.request = append([]byte{}, chunk[7:]...)
+		} else {
+			t.request = append(t.request, chunk[5:]...)
+		}
+	} else {
+		// Trezor chunks are prefixed by a report ID, the first with the message header
+		if t.request == nil {
+			t.pending = 2 + int(binary.BigEndian.Uint32(chunk[5:9]))
+			t.request = append(append([]byte{}, chunk[3:5]...), chunk[9:]...)
+		} else {
+			t.request = append(t.request, chunk[1:]...)
+		}
+	}
+	if len(t.request) < t.pending {
+		return len(chunk), nil
+	}
+	request := t.request[:t.pending]
+	t.request, t.pending = nil, 0
+
+	if t.ledger {
+		t.frameLedger(t.handle(request))
+	} else {
+		t.frameTrezor(t.handle(request))
+	}
+	return len(chunk), nil
+}
+
+// frameLedger splits a reply into 64 byte Ledger HID frames.
+func (t *MockTransport) frameLedger(reply []byte) {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(len(reply)))
+	payload = append(payload, reply...)
+	for i := 0; len(payload) > 0; i++ {
+		chunk := make([]byte, 64)
+		copy(chunk, []byte{0x01, 0x01, 0x05})
+		binary.BigEndian.PutUint16(chunk[3:], uint16(i))
+		payload = payload[copy(chunk[5:], payload):]
+		t.reply.Write(chunk)
+	}
+}
+
+// frameTrezor splits a reply (message type and payload) into 64 byte Trezor
+// reports.
+func (t *MockTransport) frameTrezor(reply []byte) {
+	payload := append([]byte{0x23, 0x23}, reply[:2]...)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(len(reply)-2))
+	payload = append(payload, reply[2:]...)
+	for len(payload) > 0 {
+		chunk := make([]byte, 64)
+		chunk[0] = 0x3f
+		payload = payload[copy(chunk[1:], payload):]
+		t.reply.Write(chunk)
+	}
+}
+
+// Read implements io.Reader, returning the framed replies. If no reply is queued
+// (i.e. the handler was not invoked yet), io.EOF is returned.
+func (t *MockTransport) Read(buf []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.reply.Read(buf)
+}
+
+// Close implements io.Closer, discarding any partial request or unread reply so
+// the transport can be reused by reopening the wallet.
+func (t *MockTransport) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.request, t.pending = nil, 0
+	t.reply.Reset()
+	return nil
+}
+
+// NewWallet creates a wallet communicating through an already connected transport
+// instead of a discovered USB device (e.g. a MockTransport in tests). The scheme
+// selects the vendor protocol; the wallet needs to be opened before use.
+func NewWallet(scheme string, transport io.ReadWriteCloser, opts ...Option) (Wallet, error) {
+	makeDriver, err := schemeDriver(scheme)
+	if err != nil {
+		return nil, err
+	}
+	cfg := new(config)
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	url := accounts.URL{Scheme: scheme, Path: fmt.Sprintf("transport-%p", transport)}
+	logger := log.New("url", url)
+
+	return &wallet{
+		hub:       &Hub{scheme: scheme, config: cfg},
+		driver:    makeDriver(logger, cfg),
+		url:       &url,
+		transport: transport,
+		log:       logger,
+	}, nil
+}
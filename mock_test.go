@@ -0,0 +1,1239 @@
+package usbwallet
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/base/usbwallet/trezor"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"google.golang.org/protobuf/proto"
+)
+
+// Tests that a wallet can be driven through a scripted Ledger transport, both
+// returning a canned signature and the user rejecting the request.
+func TestMockLedgerWallet(t *testing.T) {
+	key, _ := crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	signature := append([]byte{0x1b}, bytes.Repeat([]byte{0x11}, 64)...)
+
+	reject := false
+	transport := NewMockLedger(func(cla, ins, p1, p2 byte, data []byte) ([]byte, uint16) {
+		switch ledgerOpcode(ins) {
+		case ledgerOpGetConfiguration:
+			return []byte{0x01, 1, 10, 4}, 0x9000
+		case ledgerOpRetrieveAddress:
+			pubkey := crypto.FromECDSAPub(&key.PublicKey)
+			address := hex.EncodeToString(crypto.PubkeyToAddress(key.PublicKey).Bytes())
+
+			reply := append([]byte{byte(len(pubkey))}, pubkey...)
+			return append(append(reply, byte(len(address))), address...), 0x9000
+		case ledgerOpSignPersonalMessage:
+			if reject {
+				return nil, 0x6985
+			}
+			return signature, 0x9000
+		}
+		return nil, 0x6d00
+	})
+	wallet, err := NewWallet(LedgerScheme, transport)
+	if err != nil {
+		t.Fatalf("failed to create wallet: %v", err)
+	}
+	if err := wallet.Open(""); err != nil {
+		t.Fatalf("failed to open wallet: %v", err)
+	}
+	defer wallet.Close()
+
+	account, err := wallet.Derive(accounts.DefaultBaseDerivationPath, true)
+	if err != nil {
+		t.Fatalf("failed to derive account: %v", err)
+	}
+	if account.Address != crypto.PubkeyToAddress(key.PublicKey) {
+		t.Fatalf("address mismatch: have %x, want %x", account.Address, crypto.PubkeyToAddress(key.PublicKey))
+	}
+	sig, err := wallet.SignText(account, []byte("hello"))
+	if err != nil {
+		t.Fatalf("failed to sign text: %v", err)
+	}
+	if want := append(signature[1:], signature[0]); !bytes.Equal(sig, want) {
+		t.Fatalf("signature mismatch: have %x, want %x", sig, want)
+	}
+	reject = true
+	if _, err := wallet.SignText(account, []byte("hello")); !errors.Is(err, ErrUserRejected) {
+		t.Fatalf("rejection error mismatch: have %v, want %v", err, ErrUserRejected)
+	}
+}
+
+// Tests that a wallet can be driven through a scripted Trezor transport, both
+// returning a canned signature and the user rejecting the request.
+func TestMockTrezorWallet(t *testing.T) {
+	address := common.HexToAddress("0x0102030405060708090a0b0c0d0e0f1011121314")
+	signature := bytes.Repeat([]byte{0x22}, 65)
+
+	reject := false
+	transport := NewMockTrezor(func(request proto.Message) proto.Message {
+		switch request.(type) {
+		case *trezor.EndSession, *trezor.Ping:
+			return new(trezor.Success)
+		case *trezor.Initialize, *trezor.GetFeatures:
+			return &trezor.Features{MajorVersion: proto.Uint32(2), MinorVersion: proto.Uint32(9), PatchVersion: proto.Uint32(1)}
+		case *trezor.EthereumGetAddress:
+			return &trezor.EthereumAddress{Address: proto.String(address.Hex())}
+		case *trezor.EthereumSignMessage:
+			if reject {
+				return &trezor.Failure{Code: trezor.Failure_Failure_ActionCancelled.Enum()}
+			}
+			return &trezor.EthereumMessageSignature{Signature: signature, Address: proto.String(address.Hex())}
+		}
+		return &trezor.Failure{Code: trezor.Failure_Failure_UnexpectedMessage.Enum()}
+	})
+	wallet, err := NewWallet(TrezorScheme, transport)
+	if err != nil {
+		t.Fatalf("failed to create wallet: %v", err)
+	}
+	if err := wallet.Open(""); err != nil {
+		t.Fatalf("failed to open wallet: %v", err)
+	}
+	defer wallet.Close()
+
+	account, err := wallet.Derive(accounts.DefaultBaseDerivationPath, true)
+	if err != nil {
+		t.Fatalf("failed to derive account: %v", err)
+	}
+	if account.Address != address {
+		t.Fatalf("address mismatch: have %x, want %x", account.Address, address)
+	}
+	sig, err := wallet.SignText(account, []byte("hello"))
+	if err != nil {
+		t.Fatalf("failed to sign text: %v", err)
+	}
+	if !bytes.Equal(sig, signature) {
+		t.Fatalf("signature mismatch: have %x, want %x", sig, signature)
+	}
+	reject = true
+	if _, err := wallet.SignText(account, []byte("hello")); !errors.Is(err, ErrUserRejected) {
+		t.Fatalf("rejection error mismatch: have %v, want %v", err, ErrUserRejected)
+	}
+}
+
+// Tests that SignTextHash returns the EIP-191 digest the devices signed, and that
+// a signature over any other digest is rejected.
+func TestWalletSignTextHash(t *testing.T) {
+	key, _ := crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	address := crypto.PubkeyToAddress(key.PublicKey)
+
+	newTrezor := func(digest func([]byte) []byte) io.ReadWriteCloser {
+		return NewMockTrezor(func(request proto.Message) proto.Message {
+			switch request := request.(type) {
+			case *trezor.EndSession, *trezor.Ping:
+				return new(trezor.Success)
+			case *trezor.Initialize, *trezor.GetFeatures:
+				return &trezor.Features{MajorVersion: proto.Uint32(2), MinorVersion: proto.Uint32(9), PatchVersion: proto.Uint32(1)}
+			case *trezor.EthereumGetAddress:
+				return &trezor.EthereumAddress{Address: proto.String(address.Hex())}
+			case *trezor.EthereumSignMessage:
+				signature, _ := crypto.Sign(digest(request.Message), key)
+				signature[64] += 27
+				return &trezor.EthereumMessageSignature{Signature: signature, Address: proto.String(address.Hex())}
+			}
+			return &trezor.Failure{Code: trezor.Failure_Failure_UnexpectedMessage.Enum()}
+		})
+	}
+	tests := []struct {
+		scheme    string
+		transport io.ReadWriteCloser
+		valid     bool
+	}{
+		{LedgerScheme, newLedgerTestDevice([3]byte{1, 10, 4}), true},
+		{TrezorScheme, newTrezor(accounts.TextHash), true},
+		{TrezorScheme, newTrezor(func(text []byte) []byte { return crypto.Keccak256(text) }), false}, // Signing the unprefixed text
+	}
+	for i, tt := range tests {
+		usbWallet, err := NewWallet(tt.scheme, tt.transport)
+		if err != nil {
+			t.Fatalf("test %d: failed to create wallet: %v", i, err)
+		}
+		if err := usbWallet.Open(""); err != nil {
+			t.Fatalf("test %d: failed to open wallet: %v", i, err)
+		}
+		account, err := usbWallet.Derive(accounts.DefaultBaseDerivationPath, true)
+		if err != nil {
+			t.Fatalf("test %d: failed to derive account: %v", i, err)
+		}
+		signature, hash, err := usbWallet.SignTextHash(account, []byte("hello"))
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("test %d: signature over another digest accepted", i)
+			}
+			usbWallet.Close()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test %d: failed to sign: %v", i, err)
+		}
+		if want := accounts.TextHash([]byte("hello")); !bytes.Equal(hash, want) {
+			t.Errorf("test %d: digest mismatch: have %x, want %x", i, hash, want)
+		}
+		signature[64] -= 27
+		if pubkey, err := crypto.SigToPub(hash, signature); err != nil || crypto.PubkeyToAddress(*pubkey) != account.Address {
+			t.Errorf("test %d: signature not over the returned digest: %v", i, err)
+		}
+		usbWallet.Close()
+	}
+}
+
+// Tests that derived addresses are cached until the wallet is closed, with pinned
+// and displayed derivations always querying the device.
+func TestWalletDeriveCache(t *testing.T) {
+	device := newLedgerTestDevice([3]byte{1, 10, 4})
+
+	var derives int
+	transport := NewMockLedger(func(cla, ins, p1, p2 byte, data []byte) ([]byte, uint16) {
+		if ledgerOpcode(ins) == ledgerOpRetrieveAddress {
+			derives++
+		}
+		return device.handle(cla, ins, p1, p2, data)
+	})
+	wallet, err := NewWallet(LedgerScheme, transport)
+	if err != nil {
+		t.Fatalf("failed to create wallet: %v", err)
+	}
+	for i, tt := range []struct {
+		pin    bool
+		show   bool
+		reopen bool
+		hit    bool
+	}{
+		{pin: false, reopen: true, hit: true},
+		{pin: false, hit: false}, // cached
+		{pin: true, hit: true},   // pinning always queries the device
+		{pin: false, hit: false},
+		{pin: true, show: true, hit: true}, // displaying always queries the device
+		{pin: false, hit: false},
+		{pin: false, reopen: true, hit: true}, // cache dropped on close
+		{pin: true, show: true, hit: true},
+	} {
+		if tt.reopen {
+			wallet.Close()
+			if err := wallet.Open(""); err != nil {
+				t.Fatalf("failed to open wallet: %v", err)
+			}
+		}
+		before, prompts := derives, device.prompts
+		if tt.show {
+			_, err = wallet.DeriveAndShow(accounts.DefaultBaseDerivationPath, tt.pin)
+		} else {
+			_, err = wallet.Derive(accounts.DefaultBaseDerivationPath, tt.pin)
+		}
+		if err != nil {
+			t.Fatalf("test %d: failed to derive account: %v", i, err)
+		}
+		if hit := derives > before; hit != tt.hit {
+			t.Errorf("test %d: device queried mismatch: have %v, want %v", i, hit, tt.hit)
+		}
+		if shown := device.prompts > prompts; shown != tt.show {
+			t.Errorf("test %d: address display mismatch: have %v, want %v", i, shown, tt.show)
+		}
+	}
+	// Ensure a rejected address isn't pinned
+	device.reject = true
+	if _, err := wallet.DeriveAndShow(accounts.DerivationPath{0x80000000 + 44, 0x80000000 + 60, 0x80000000, 0, 1}, true); !errors.Is(err, ErrUserRejected) {
+		t.Errorf("rejection error mismatch: have %v, want %v", err, ErrUserRejected)
+	}
+	if n := len(wallet.Accounts()); n != 1 {
+		t.Errorf("pinned accounts mismatch: have %d, want 1", n)
+	}
+	wallet.Close()
+}
+
+// newTestDeriveWallet creates an opened wallet on top of an emulated Ledger,
+// counting the address derivations executed by the device and failing the ones
+// after the given limit (if non-zero).
+func newTestDeriveWallet(tb testing.TB, limit int) (*wallet, *int) {
+	device := newLedgerTestDevice([3]byte{1, 10, 4})
+
+	derives := new(int)
+	transport := NewMockLedger(func(cla, ins, p1, p2 byte, data []byte) ([]byte, uint16) {
+		if ledgerOpcode(ins) == ledgerOpRetrieveAddress && ledgerParam2(p2) != ledgerP2ReturnAddressChainCode {
+			if *derives++; limit > 0 && *derives > limit {
+				return nil, 0x6a80
+			}
+		}
+		return device.handle(cla, ins, p1, p2, data)
+	})
+	w, err := NewWallet(LedgerScheme, transport)
+	if err != nil {
+		tb.Fatalf("failed to create wallet: %v", err)
+	}
+	if err := w.Open(""); err != nil {
+		tb.Fatalf("failed to open wallet: %v", err)
+	}
+	*derives = 0
+	return w.(*wallet), derives
+}
+
+// testDerivePaths returns the default derivation paths of the first n accounts,
+// the hardened flag being set on their last components if requested.
+func testDerivePaths(n int, hardened bool) []accounts.DerivationPath {
+	paths := make([]accounts.DerivationPath, n)
+	for i := range paths {
+		index := uint32(i)
+		if hardened {
+			index += 0x80000000
+		}
+		paths[i] = append(append(accounts.DerivationPath{}, accounts.DefaultRootDerivationPath...), index)
+	}
+	return paths
+}
+
+// Tests that account scanning stops after the gap limit of consecutive unused
+// accounts, pinning the used ones and deriving them locally from the parent key.
+func TestWalletScanAccounts(t *testing.T) {
+	tests := []struct {
+		used  []int // Indices of the used accounts
+		gap   int   // Gap limit of the scan
+		found []int // Indices of the accounts expected to be found
+	}{
+		{used: nil, gap: 5, found: nil},
+		{used: []int{0}, gap: 1, found: []int{0}},
+		{used: []int{0, 2, 5}, gap: 3, found: []int{0, 2, 5}},
+		{used: []int{0, 2, 5}, gap: 2, found: []int{0, 2}},
+		{used: []int{1}, gap: 1, found: nil},
+	}
+	for i, tt := range tests {
+		wallet, derives := newTestDeriveWallet(t, 0)
+
+		paths := testDerivePaths(20, false)
+		used := make(map[common.Address]bool)
+		for _, index := range tt.used {
+			address, err := wallet.driver.Derive(paths[index])
+			if err != nil {
+				t.Fatalf("test %d: failed to derive address %d: %v", i, index, err)
+			}
+			used[address] = true
+		}
+		*derives = 0
+
+		found, err := wallet.ScanAccounts(paths[0], tt.gap, func(address common.Address) bool { return used[address] })
+		if err != nil {
+			t.Fatalf("test %d: failed to scan accounts: %v", i, err)
+		}
+		if *derives > 1 {
+			t.Errorf("test %d: device derivations mismatch: have %d, want at most 1 (parent key)", i, *derives)
+		}
+		if len(found) != len(tt.found) {
+			t.Errorf("test %d: found accounts mismatch: have %d, want %d", i, len(found), len(tt.found))
+		}
+		for j := 0; j < len(found) && j < len(tt.found); j++ {
+			if !used[found[j].Address] || !strings.HasSuffix(found[j].URL.Path, paths[tt.found[j]].String()) {
+				t.Errorf("test %d, account %d: unexpected account %v", i, j, found[j])
+			}
+			if !wallet.Contains(found[j]) {
+				t.Errorf("test %d, account %d: account not pinned", i, j)
+			}
+		}
+		wallet.Close()
+	}
+}
+
+// Tests that account scans reject out of range gap limits, and stop with an error
+// instead of wrapping around when running out of indices on the base path.
+func TestWalletScanAccountsBounds(t *testing.T) {
+	w, _ := newTestDeriveWallet(t, 0)
+	defer w.Close()
+
+	allUsed := func(common.Address) bool { return true }
+	for _, gap := range []int{-1, 0, maxGapLimit + 1} {
+		if _, err := w.ScanAccounts(nil, gap, allUsed); err == nil {
+			t.Errorf("gap limit %d: scan succeeded", gap)
+		}
+	}
+	tests := []struct {
+		last  uint32 // Last component of the base path
+		found int    // Number of accounts expected before running out of indices
+	}{
+		{0x7ffffffe, 2},
+		{0x7fffffff, 1},
+		{0xfffffffe, 2},
+		{0xffffffff, 1},
+	}
+	for i, tt := range tests {
+		base := append(append(accounts.DerivationPath{}, accounts.DefaultRootDerivationPath...), tt.last)
+
+		found, err := w.ScanAccounts(base, 1, allUsed)
+		if !errors.Is(err, ErrInvalidDerivationPath) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, ErrInvalidDerivationPath)
+		}
+		if len(found) != tt.found {
+			t.Errorf("test %d: found accounts mismatch: have %d, want %d", i, len(found), tt.found)
+		}
+	}
+}
+
+// Tests that scanning without a base path enumerates the accounts according to the
+// configured derivation scheme, defaulting to the BIP-44 layout.
+func TestWalletScanAccountsScheme(t *testing.T) {
+	tests := []struct {
+		opts   []Option
+		scheme DerivationScheme
+	}{
+		{nil, BIP44Scheme},
+		{[]Option{WithDerivationScheme(LedgerLiveScheme)}, LedgerLiveScheme},
+		{[]Option{WithDerivationScheme(LegacyLedgerScheme)}, LegacyLedgerScheme},
+	}
+	for i, tt := range tests {
+		device := newLedgerTestDevice([3]byte{1, 10, 4})
+		w, err := NewWallet(LedgerScheme, NewMockLedger(device.handle), tt.opts...)
+		if err != nil {
+			t.Fatalf("test %d: failed to create wallet: %v", i, err)
+		}
+		if err := w.Open(""); err != nil {
+			t.Fatalf("test %d: failed to open wallet: %v", i, err)
+		}
+		used := map[common.Address]bool{
+			crypto.PubkeyToAddress(ledgerTestKey(tt.scheme(0)).PublicKey): true,
+			crypto.PubkeyToAddress(ledgerTestKey(tt.scheme(2)).PublicKey): true,
+		}
+		found, err := w.(*wallet).ScanAccounts(nil, 2, func(address common.Address) bool { return used[address] })
+		if err != nil {
+			t.Fatalf("test %d: failed to scan accounts: %v", i, err)
+		}
+		if len(found) != 2 {
+			t.Fatalf("test %d: found accounts mismatch: have %d, want 2", i, len(found))
+		}
+		for j, index := range []uint32{0, 2} {
+			if !strings.HasSuffix(found[j].URL.Path, "/"+tt.scheme(index).String()) {
+				t.Errorf("test %d, account %d: path mismatch: have %s, want %s", i, j, found[j].URL.Path, tt.scheme(index))
+			}
+		}
+		w.Close()
+	}
+}
+
+// Tests that batch derivation derives non-hardened children locally from a single
+// extended key, and returns the addresses derived so far if the device fails.
+func TestWalletDeriveBatch(t *testing.T) {
+	wallet, derives := newTestDeriveWallet(t, 0)
+	defer wallet.Close()
+
+	paths := append(testDerivePaths(50, false), testDerivePaths(1, true)...)
+	addresses, err := wallet.DeriveBatch(paths)
+	if err != nil {
+		t.Fatalf("failed to derive batch: %v", err)
+	}
+	if *derives > 2 {
+		t.Fatalf("device derivations mismatch: have %d, want at most 2 (parent key and hardened path)", *derives)
+	}
+	for i, path := range paths {
+		address, err := wallet.driver.Derive(path)
+		if err != nil {
+			t.Fatalf("path %v: failed to derive address: %v", path, err)
+		}
+		if addresses[i] != address {
+			t.Errorf("path %v: address mismatch: have %x, want %x", path, addresses[i], address)
+		}
+	}
+	// Fail the device mid-batch and ensure the partial results are returned
+	failing, _ := newTestDeriveWallet(t, 2)
+	defer failing.Close()
+
+	addresses, err = failing.DeriveBatch(testDerivePaths(5, true))
+	if err == nil {
+		t.Fatalf("failing batch succeeded")
+	}
+	if len(addresses) != 2 {
+		t.Fatalf("partial addresses mismatch: have %d, want 2", len(addresses))
+	}
+}
+
+func BenchmarkWalletDerive(b *testing.B) {
+	wallet, _ := newTestDeriveWallet(b, 0)
+	defer wallet.Close()
+
+	paths := testDerivePaths(50, false)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, path := range paths {
+			if _, err := wallet.Derive(path, true); err != nil {
+				b.Fatalf("failed to derive account: %v", err)
+			}
+		}
+	}
+}
+
+func BenchmarkWalletDeriveBatch(b *testing.B) {
+	wallet, _ := newTestDeriveWallet(b, 0)
+	defer wallet.Close()
+
+	paths := testDerivePaths(50, false)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		wallet.derived = make(map[string]common.Address) // Measure uncached derivations
+		if _, err := wallet.DeriveBatch(paths); err != nil {
+			b.Fatalf("failed to derive batch: %v", err)
+		}
+	}
+}
+
+// Tests that the health of a wallet reflects the responsiveness of the device,
+// reporting the metrics Ledgers don't expose as unknown.
+func TestWalletDeviceHealth(t *testing.T) {
+	device := newLedgerTestDevice([3]byte{1, 10, 4})
+	w, err := NewWallet(LedgerScheme, device)
+	if err != nil {
+		t.Fatalf("failed to create wallet: %v", err)
+	}
+	if health, err := w.DeviceHealth(); !errors.Is(err, accounts.ErrWalletClosed) || health.Connected {
+		t.Fatalf("closed wallet health mismatch: have %+v, %v, want disconnected, %v", health, err, accounts.ErrWalletClosed)
+	}
+	if err := w.Open(""); err != nil {
+		t.Fatalf("failed to open wallet: %v", err)
+	}
+	defer w.Close()
+
+	health, err := w.DeviceHealth()
+	if err != nil {
+		t.Fatalf("failed to check device health: %v", err)
+	}
+	if !health.Connected || health.Battery != HealthUnknown || health.RSSI != HealthUnknown {
+		t.Fatalf("health mismatch: have %+v", health)
+	}
+	// Ensure an unresponsive app is reported as disconnected
+	device.app = "BOLOS"
+	if health, err = w.DeviceHealth(); err == nil || health.Connected || health.Latency != 0 {
+		t.Fatalf("unresponsive device health mismatch: have %+v, %v", health, err)
+	}
+}
+
+// Tests that pinging a wallet checks the device, refreshing its cached version.
+func TestWalletPing(t *testing.T) {
+	device := newLedgerTestDevice([3]byte{1, 10, 4})
+	w, err := NewWallet(LedgerScheme, device)
+	if err != nil {
+		t.Fatalf("failed to create wallet: %v", err)
+	}
+	if err := w.Ping(); !errors.Is(err, accounts.ErrWalletClosed) {
+		t.Fatalf("closed wallet ping error mismatch: have %v, want %v", err, accounts.ErrWalletClosed)
+	}
+	if err := w.Open(""); err != nil {
+		t.Fatalf("failed to open wallet: %v", err)
+	}
+	defer w.Close()
+
+	device.version = [3]byte{1, 11, 0}
+	if err := w.Ping(); err != nil {
+		t.Fatalf("failed to ping wallet: %v", err)
+	}
+	if version := w.(*wallet).driver.(*ledgerDriver).version; version != device.version {
+		t.Fatalf("cached version mismatch: have %v, want %v", version, device.version)
+	}
+}
+
+// Tests that the detailed status of a wallet tracks it being closed, ready, busy,
+// locked or running another app.
+func TestWalletDetailedStatus(t *testing.T) {
+	device := newLedgerTestDevice([3]byte{1, 10, 4})
+
+	locked := false
+	device.MockTransport = NewMockLedger(func(cla, ins, p1, p2 byte, data []byte) ([]byte, uint16) {
+		if locked && ledgerOpcode(ins) == ledgerOpSignPersonalMessage {
+			return nil, uint16(ledgerStatusLocked)
+		}
+		return device.handle(cla, ins, p1, p2, data)
+	})
+	w, err := NewWallet(LedgerScheme, device)
+	if err != nil {
+		t.Fatalf("failed to create wallet: %v", err)
+	}
+	check := func(state WalletState) {
+		t.Helper()
+		if status, err := w.DetailedStatus(); err != nil || status.State != state {
+			t.Fatalf("status mismatch: have %v %q (err %v), want %v", status.State, status.Detail, err, state)
+		}
+	}
+	check(WalletClosed)
+	if err := w.Open(""); err != nil {
+		t.Fatalf("failed to open wallet: %v", err)
+	}
+	defer w.Close()
+	check(WalletReady)
+
+	account, err := w.Derive(accounts.DefaultBaseDerivationPath, true)
+	if err != nil {
+		t.Fatalf("failed to derive account: %v", err)
+	}
+	// A signature awaiting confirmation keeps the wallet busy
+	device.block = make(chan struct{})
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := w.SignText(account, []byte("hello"))
+		errc <- err
+	}()
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if status, _ := w.DetailedStatus(); status.State == WalletBusy {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("wallet not busy while signing")
+		}
+	}
+	close(device.block)
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	check(WalletReady)
+
+	// A signature refused by the locked device marks the wallet locked until the
+	// next successful operation
+	locked = true
+	if _, err := w.SignText(account, []byte("hello")); !errors.Is(err, ErrLedgerLocked) {
+		t.Fatalf("locked signature error mismatch: have %v, want %v", err, ErrLedgerLocked)
+	}
+	check(WalletLocked)
+
+	locked = false
+	if _, err := w.SignText(account, []byte("hello")); err != nil {
+		t.Fatalf("failed to sign after unlocking: %v", err)
+	}
+	check(WalletReady)
+
+	// Leaving the Ethereum app is noticed on the next ping
+	device.app = "BOLOS"
+	w.Ping()
+
+	status, _ := w.DetailedStatus()
+	if status.State != WalletWrongApp || status.Detail != "BOLOS app running" {
+		t.Fatalf("status mismatch: have %v %q, want %v %q", status.State, status.Detail, WalletWrongApp, "BOLOS app running")
+	}
+}
+
+// Tests that the device infos can be read while health checks refresh them (run
+// with the race detector to catch unguarded driver fields).
+func TestWalletInfoDuringPing(t *testing.T) {
+	trezorTransport := NewMockTrezor(func(request proto.Message) proto.Message {
+		switch request.(type) {
+		case *trezor.EndSession, *trezor.Ping:
+			return new(trezor.Success)
+		case *trezor.Initialize, *trezor.GetFeatures:
+			return &trezor.Features{MajorVersion: proto.Uint32(2), MinorVersion: proto.Uint32(9), PatchVersion: proto.Uint32(1)}
+		}
+		return &trezor.Failure{Code: trezor.Failure_Failure_UnexpectedMessage.Enum()}
+	})
+	tests := []struct {
+		scheme    string
+		transport io.ReadWriteCloser
+	}{
+		{LedgerScheme, newLedgerTestDevice([3]byte{1, 10, 4})},
+		{TrezorScheme, trezorTransport},
+	}
+	for _, tt := range tests {
+		w, err := NewWallet(tt.scheme, tt.transport)
+		if err != nil {
+			t.Fatalf("%s: failed to create wallet: %v", tt.scheme, err)
+		}
+		if err := w.Open(""); err != nil {
+			t.Fatalf("%s: failed to open wallet: %v", tt.scheme, err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 50; i++ {
+				w.Ping()
+			}
+		}()
+		for i := 0; i < 50; i++ {
+			w.DeviceInfo()
+			w.Capabilities()
+			w.DetailedStatus()
+		}
+		<-done
+		w.Close()
+	}
+}
+
+// Tests that concurrent operations on the same wallet are serialized end-to-end,
+// the chunks of their requests and replies never interleaving on the transport.
+func TestWalletConcurrentAccess(t *testing.T) {
+	transport := &serialTestTransport{MockTransport: newLedgerTestDevice([3]byte{1, 10, 4}).MockTransport}
+	wallet, err := NewWallet(LedgerScheme, transport)
+	if err != nil {
+		t.Fatalf("failed to create wallet: %v", err)
+	}
+	if err := wallet.Open(""); err != nil {
+		t.Fatalf("failed to open wallet: %v", err)
+	}
+	defer wallet.Close()
+
+	var (
+		signPaths   = testDerivePaths(8, false)
+		derivePaths = testDerivePaths(16, false)[8:]
+		signers     = make([]accounts.Account, len(signPaths))
+	)
+	for i, path := range signPaths {
+		account, err := wallet.Derive(path, true)
+		if err != nil {
+			t.Fatalf("account %d: failed to derive: %v", i, err)
+		}
+		signers[i] = account
+	}
+	// Multi chunk messages would get corrupted if the exchanges interleaved
+	text := bytes.Repeat([]byte("concurrent"), 10)
+
+	var (
+		wg   sync.WaitGroup
+		errc = make(chan error, 2*len(signPaths))
+	)
+	for i := range signPaths {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			sig, err := wallet.SignText(signers[i], text)
+			if err != nil {
+				errc <- fmt.Errorf("signer %d: failed to sign: %v", i, err)
+				return
+			}
+			sig[64] -= 27
+			pubkey, err := crypto.SigToPub(accounts.TextHash(text), sig)
+			if err != nil {
+				errc <- fmt.Errorf("signer %d: failed to recover signer: %v", i, err)
+				return
+			}
+			if have := crypto.PubkeyToAddress(*pubkey); have != signers[i].Address {
+				errc <- fmt.Errorf("signer %d: signer mismatch: have %x, want %x", i, have, signers[i].Address)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			account, err := wallet.Derive(derivePaths[i], false)
+			if err != nil {
+				errc <- fmt.Errorf("path %d: failed to derive: %v", i, err)
+				return
+			}
+			if want := crypto.PubkeyToAddress(ledgerTestKey(derivePaths[i]).PublicKey); account.Address != want {
+				errc <- fmt.Errorf("path %d: address mismatch: have %x, want %x", i, account.Address, want)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errc)
+
+	for err := range errc {
+		t.Error(err)
+	}
+	if overlaps := transport.overlaps.Load(); overlaps != 0 {
+		t.Errorf("exchanges interleaved %d times", overlaps)
+	}
+}
+
+// serialTestTransport wraps a Ledger mock transport, counting the requests sent
+// while the reply of a previous one was still being read.
+type serialTestTransport struct {
+	*MockTransport
+
+	busy     atomic.Bool  // Whether an exchange is in flight
+	overlaps atomic.Int32 // Number of requests started during another exchange
+}
+
+// Write implements io.Writer, flagging requests started mid-exchange.
+func (t *serialTestTransport) Write(chunk []byte) (int, error) {
+	if binary.BigEndian.Uint16(chunk[3:5]) == 0 && !t.busy.CompareAndSwap(false, true) {
+		t.overlaps.Add(1)
+	}
+	runtime.Gosched() // Give concurrent exchanges a chance to interleave
+	return t.MockTransport.Write(chunk)
+}
+
+// Read implements io.Reader, marking the exchange done once the reply is drained.
+func (t *serialTestTransport) Read(buf []byte) (int, error) {
+	n, err := t.MockTransport.Read(buf)
+
+	t.MockTransport.lock.Lock()
+	drained := t.MockTransport.reply.Len() == 0
+	t.MockTransport.lock.Unlock()
+
+	if drained {
+		t.busy.Store(false)
+	}
+	return n, err
+}
+
+// trafficTestHandler is a slog handler recording the messages and attributes of
+// the logged records.
+type trafficTestHandler struct {
+	records []map[string]string
+	lock    sync.Mutex
+}
+
+func (h *trafficTestHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *trafficTestHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *trafficTestHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *trafficTestHandler) Handle(_ context.Context, r slog.Record) error {
+	record := map[string]string{"msg": r.Message}
+	r.Attrs(func(attr slog.Attr) bool {
+		record[attr.Key] = attr.Value.String()
+		return true
+	})
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.records = append(h.records, record)
+	return nil
+}
+
+// find returns the first recorded entry with the given message and attributes.
+func (h *trafficTestHandler) find(msg string, attrs ...string) map[string]string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for _, record := range h.records {
+		match := record["msg"] == msg
+		for i := 0; match && i < len(attrs); i += 2 {
+			match = record[attrs[i]] == attrs[i+1]
+		}
+		if match {
+			return record
+		}
+	}
+	return nil
+}
+
+// Tests that the device traffic is logged on the configured traffic logger, with
+// the APDU headers and status words for Ledgers and the message types for Trezors.
+func TestWalletTrafficLogger(t *testing.T) {
+	// Ledger APDUs are logged with their headers and status words
+	handler := new(trafficTestHandler)
+	ledger, err := NewWallet(LedgerScheme, newLedgerTestDevice([3]byte{1, 10, 4}).MockTransport, WithTrafficLogger(log.NewLogger(handler)))
+	if err != nil {
+		t.Fatalf("failed to create ledger wallet: %v", err)
+	}
+	if err := ledger.Open(""); err != nil {
+		t.Fatalf("failed to open ledger wallet: %v", err)
+	}
+	defer ledger.Close()
+
+	if _, err := ledger.Derive(accounts.DefaultBaseDerivationPath, false); err != nil {
+		t.Fatalf("failed to derive ledger account: %v", err)
+	}
+	ins := fmt.Sprint(byte(ledgerOpRetrieveAddress))
+	if handler.find("Ledger APDU sent", "cla", fmt.Sprint(byte(ledgerClaEthereum)), "ins", ins, "len", "21") == nil {
+		t.Errorf("ledger request not logged")
+	}
+	if handler.find("Ledger APDU received", "ins", ins, "status", "0x9000") == nil {
+		t.Errorf("ledger reply not logged")
+	}
+	// Trezor messages are logged with their types
+	handler = new(trafficTestHandler)
+	address := common.HexToAddress("0x0102030405060708090a0b0c0d0e0f1011121314")
+
+	transport := NewMockTrezor(func(request proto.Message) proto.Message {
+		switch request.(type) {
+		case *trezor.Initialize, *trezor.GetFeatures:
+			return &trezor.Features{MajorVersion: proto.Uint32(2), MinorVersion: proto.Uint32(9), PatchVersion: proto.Uint32(1)}
+		case *trezor.EthereumGetAddress:
+			return &trezor.EthereumAddress{Address: proto.String(address.Hex())}
+		}
+		return &trezor.Failure{Code: trezor.Failure_Failure_UnexpectedMessage.Enum()}
+	})
+	trezorWallet, err := NewWallet(TrezorScheme, transport, WithTrafficLogger(log.NewLogger(handler)))
+	if err != nil {
+		t.Fatalf("failed to create trezor wallet: %v", err)
+	}
+	if err := trezorWallet.Open(""); err != nil {
+		t.Fatalf("failed to open trezor wallet: %v", err)
+	}
+	defer trezorWallet.Close()
+
+	if _, err := trezorWallet.Derive(accounts.DefaultBaseDerivationPath, false); err != nil {
+		t.Fatalf("failed to derive trezor account: %v", err)
+	}
+	if handler.find("Trezor message sent", "type", "EthereumGetAddress") == nil {
+		t.Errorf("trezor request not logged")
+	}
+	if handler.find("Trezor message received", "type", "EthereumAddress") == nil {
+		t.Errorf("trezor reply not logged")
+	}
+}
+
+// signTestMetrics records the signing operations reported to the metrics hooks.
+type signTestMetrics struct {
+	started []SignOp
+	ended   []string // Operation and outcome, joined by a colon
+}
+
+func (m *signTestMetrics) OnSignStart(op SignOp) {
+	m.started = append(m.started, op)
+}
+
+func (m *signTestMetrics) OnSignEnd(op SignOp, duration time.Duration, err error) {
+	m.ended = append(m.ended, string(op)+":"+SignOutcome(err))
+}
+
+// Tests that the metrics hooks are invoked around signing operations, both on
+// success and on the various error paths.
+func TestWalletSignMetrics(t *testing.T) {
+	device := newLedgerTestDevice([3]byte{1, 10, 4})
+	metrics := new(signTestMetrics)
+
+	wallet, err := NewWallet(LedgerScheme, device.MockTransport, WithSignMetrics(metrics))
+	if err != nil {
+		t.Fatalf("failed to create wallet: %v", err)
+	}
+	if err := wallet.Open(""); err != nil {
+		t.Fatalf("failed to open wallet: %v", err)
+	}
+	defer wallet.Close()
+
+	account, err := wallet.Derive(accounts.DefaultBaseDerivationPath, true)
+	if err != nil {
+		t.Fatalf("failed to derive account: %v", err)
+	}
+	if _, err := wallet.SignText(account, []byte("hello")); err != nil {
+		t.Fatalf("failed to sign text: %v", err)
+	}
+	device.reject = true
+	if _, err := wallet.SignText(account, []byte("hello")); !errors.Is(err, ErrUserRejected) {
+		t.Fatalf("rejection error mismatch: have %v, want %v", err, ErrUserRejected)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := wallet.SignTxContext(ctx, account, types.NewTx(&types.LegacyTx{}), big.NewInt(1)); err == nil {
+		t.Fatalf("cancelled transaction signed")
+	}
+	if _, err := wallet.SignText(accounts.Account{}, []byte("hello")); !errors.Is(err, accounts.ErrUnknownAccount) {
+		t.Fatalf("unknown account error mismatch: have %v, want %v", err, accounts.ErrUnknownAccount)
+	}
+	device.reject = false
+	if _, err := wallet.SignOwnershipProof(accounts.DefaultBaseDerivationPath, []byte("challenge")); err != nil {
+		t.Fatalf("failed to sign ownership proof: %v", err)
+	}
+	wantStarted := []SignOp{SignOpText, SignOpText, SignOpTx, SignOpText, SignOpOwnership}
+	if !reflect.DeepEqual(metrics.started, wantStarted) {
+		t.Errorf("started operations mismatch: have %v, want %v", metrics.started, wantStarted)
+	}
+	wantEnded := []string{"text:ok", "text:rejected", "tx:cancelled", "text:error", "ownership:ok"}
+	if !reflect.DeepEqual(metrics.ended, wantEnded) {
+		t.Errorf("ended operations mismatch: have %v, want %v", metrics.ended, wantEnded)
+	}
+}
+
+// Tests that raw transaction signatures carry the bare recovery id for legacy,
+// replay protected and typed transactions alike.
+func TestWalletSignTxRaw(t *testing.T) {
+	device := newLedgerTestDevice([3]byte{1, 10, 4})
+
+	wallet, err := NewWallet(LedgerScheme, device.MockTransport)
+	if err != nil {
+		t.Fatalf("failed to create wallet: %v", err)
+	}
+	if err := wallet.Open(""); err != nil {
+		t.Fatalf("failed to open wallet: %v", err)
+	}
+	defer wallet.Close()
+
+	account, err := wallet.Derive(accounts.DefaultBaseDerivationPath, true)
+	if err != nil {
+		t.Fatalf("failed to derive account: %v", err)
+	}
+	to := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	tests := []struct {
+		tx      *types.Transaction
+		chainID *big.Int
+	}{
+		{types.NewTx(&types.LegacyTx{Nonce: 1, To: &to, Gas: 21000, GasPrice: big.NewInt(1)}), nil},
+		{types.NewTx(&types.LegacyTx{Nonce: 2, To: &to, Gas: 21000, GasPrice: big.NewInt(1)}), big.NewInt(8453)},
+		{types.NewTx(&types.DynamicFeeTx{ChainID: big.NewInt(8453), Nonce: 3, To: &to, Gas: 21000, GasFeeCap: big.NewInt(2), GasTipCap: big.NewInt(1)}), big.NewInt(8453)},
+	}
+	for i, tt := range tests {
+		r, s, recid, err := wallet.SignTxRaw(account, tt.tx, tt.chainID)
+		if err != nil {
+			t.Fatalf("test %d: failed to sign transaction: %v", i, err)
+		}
+		if recid > 1 {
+			t.Fatalf("test %d: invalid recovery id %d", i, recid)
+		}
+		signer := types.LatestSignerForChainID(tt.chainID)
+		if tt.chainID == nil {
+			signer = types.HomesteadSigner{}
+		}
+		pubkey, err := crypto.SigToPub(signer.Hash(tt.tx).Bytes(), append(append(r[:], s[:]...), recid))
+		if err != nil {
+			t.Fatalf("test %d: failed to recover signer: %v", i, err)
+		}
+		if sender := crypto.PubkeyToAddress(*pubkey); sender != account.Address {
+			t.Errorf("test %d: signer mismatch: have %x, want %x", i, sender, account.Address)
+		}
+	}
+}
+
+// Tests that legacy transactions are signed without EIP-155 replay protection if
+// requested or if the chain ID is zero, and with it otherwise.
+func TestWalletLegacyNoEIP155(t *testing.T) {
+	to := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	legacy := types.NewTx(&types.LegacyTx{To: &to, Gas: 21000, GasPrice: big.NewInt(1)})
+	dynamic := types.NewTx(&types.DynamicFeeTx{ChainID: big.NewInt(1337), To: &to, Gas: 21000, GasFeeCap: big.NewInt(1)})
+
+	tests := []struct {
+		noEIP155  bool
+		tx        *types.Transaction
+		chainID   *big.Int
+		protected bool   // Whether the signature should be replay protected
+		vBase     uint64 // V value for a zero recovery id
+	}{
+		{false, legacy, big.NewInt(1337), true, 2*1337 + 35},
+		{false, legacy, big.NewInt(0), false, 27},
+		{true, legacy, big.NewInt(1337), false, 27},
+		{true, dynamic, big.NewInt(1337), true, 0},
+	}
+	for i, tt := range tests {
+		var opts []Option
+		if tt.noEIP155 {
+			opts = append(opts, LegacyNoEIP155())
+		}
+		wallet, err := NewWallet(LedgerScheme, newLedgerTestDevice([3]byte{1, 10, 4}).MockTransport, opts...)
+		if err != nil {
+			t.Fatalf("test %d: failed to create wallet: %v", i, err)
+		}
+		if err := wallet.Open(""); err != nil {
+			t.Fatalf("test %d: failed to open wallet: %v", i, err)
+		}
+		account, err := wallet.Derive(accounts.DefaultBaseDerivationPath, true)
+		if err != nil {
+			t.Fatalf("test %d: failed to derive account: %v", i, err)
+		}
+		signed, err := wallet.SignTx(account, tt.tx, tt.chainID)
+		if err != nil {
+			t.Fatalf("test %d: failed to sign transaction: %v", i, err)
+		}
+		if signed.Protected() != tt.protected {
+			t.Errorf("test %d: replay protection mismatch: have %v, want %v", i, signed.Protected(), tt.protected)
+		}
+		if v, _, _ := signed.RawSignatureValues(); v.Uint64() != tt.vBase && v.Uint64() != tt.vBase+1 {
+			t.Errorf("test %d: V value mismatch: have %v, want %d or %d", i, v, tt.vBase, tt.vBase+1)
+		}
+		var signer types.Signer = types.HomesteadSigner{}
+		if tt.protected {
+			signer = types.LatestSignerForChainID(signed.ChainId())
+		}
+		if sender, err := types.Sender(signer, signed); err != nil || sender != account.Address {
+			t.Errorf("test %d: sender mismatch: have %x (%v), want %x", i, sender, err, account.Address)
+		}
+		wallet.Close()
+	}
+}
+
+// Tests that typed data bound to another chain than the expected one, or to none,
+// is rejected before reaching the device, while matching domains are signed.
+func TestWalletExpectChainID(t *testing.T) {
+	tests := []struct {
+		expect   *big.Int // Chain ID configured on the wallet, nil if unchecked
+		domain   *big.Int // Chain ID of the typed data domain, nil if unbound
+		declared bool     // Whether an unbound domain still declares the chain ID
+		err      error
+	}{
+		{nil, big.NewInt(1), false, nil},
+		{nil, nil, false, nil},
+		{nil, nil, true, nil},
+		{big.NewInt(1), big.NewInt(1), false, nil},
+		{big.NewInt(1), nil, false, ErrChainIDMismatch},
+		{big.NewInt(1), nil, true, ErrChainIDMismatch},
+		{big.NewInt(1), big.NewInt(5), false, ErrChainIDMismatch},
+		{big.NewInt(10), big.NewInt(1), false, ErrChainIDMismatch},
+	}
+	for i, tt := range tests {
+		data := newTestTypedData([]apitypes.Type{{Name: "value", Type: "uint256"}}, apitypes.TypedDataMessage{"value": "1"})
+		if tt.domain == nil {
+			if !tt.declared {
+				data.Types["EIP712Domain"] = data.Types["EIP712Domain"][:1]
+			}
+			data.Domain.ChainId = nil
+		} else {
+			data.Domain.ChainId = (*math.HexOrDecimal256)(tt.domain)
+		}
+		device := newLedgerTestDevice([3]byte{1, 10, 4})
+		usbWallet, err := NewWallet(LedgerScheme, device, ExpectChainID(tt.expect))
+		if err != nil {
+			t.Fatalf("test %d: failed to create wallet: %v", i, err)
+		}
+		if err := usbWallet.Open(""); err != nil {
+			t.Fatalf("test %d: failed to open wallet: %v", i, err)
+		}
+		account, err := usbWallet.Derive(accounts.DefaultBaseDerivationPath, true)
+		if err != nil {
+			t.Fatalf("test %d: failed to derive account: %v", i, err)
+		}
+		domainHash, messageHash, err := typedDataHashes(data)
+		if err != nil {
+			t.Fatalf("test %d: failed to hash typed data: %v", i, err)
+		}
+		device.typedHash = crypto.Keccak256([]byte{0x19, 0x01}, domainHash, messageHash)
+		raw, err := json.Marshal(data)
+		if err != nil {
+			t.Fatalf("test %d: failed to encode typed data: %v", i, err)
+		}
+
+		for _, sign := range []func() ([]byte, error){
+			func() ([]byte, error) { return usbWallet.SignTypedData(account, data) },
+			func() ([]byte, error) { return usbWallet.SignTypedDataFiltered(account, data, nil) },
+			func() ([]byte, error) { return usbWallet.SignTypedDataJSON(account, raw) },
+		} {
+			device.eip712 = nil
+			_, err := sign()
+			if !errors.Is(err, tt.err) {
+				t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+			}
+			if tt.err != nil && len(device.eip712) != 0 {
+				t.Errorf("test %d: %d typed data commands sent despite the mismatch", i, len(device.eip712))
+			}
+		}
+		// Pre-hashed typed data can't be checked, so it's rejected if a chain is expected
+		var want error
+		if tt.expect != nil {
+			want = ErrChainIDMismatch
+		}
+		hashed := append([]byte{0x19, 0x01}, append(domainHash, messageHash...)...)
+		if _, err := usbWallet.SignData(account, accounts.MimetypeTypedData, hashed); !errors.Is(err, want) {
+			t.Errorf("test %d: hashed typed data error mismatch: have %v, want %v", i, err, want)
+		}
+		usbWallet.Close()
+	}
+}
+
+// Tests that signatures are checked against the address derived for the account's
+// path when requested, catching devices signing with another key.
+func TestWalletVerifySigner(t *testing.T) {
+	// Signatures produced by the right key must pass the verification
+	device := newLedgerTestDevice([3]byte{1, 10, 4})
+	usbWallet, err := NewWallet(LedgerScheme, device, VerifySigner())
+	if err != nil {
+		t.Fatalf("failed to create wallet: %v", err)
+	}
+	if err := usbWallet.Open(""); err != nil {
+		t.Fatalf("failed to open wallet: %v", err)
+	}
+	account, err := usbWallet.Derive(accounts.DefaultBaseDerivationPath, true)
+	if err != nil {
+		t.Fatalf("failed to derive account: %v", err)
+	}
+	data := newTestTypedData([]apitypes.Type{{Name: "value", Type: "uint256"}}, apitypes.TypedDataMessage{"value": "1"})
+	if device.typedHash, _, err = apitypes.TypedDataAndHash(data); err != nil {
+		t.Fatalf("failed to hash typed data: %v", err)
+	}
+	if _, err := usbWallet.SignTx(account, types.NewTransaction(0, common.Address{}, common.Big1, 21000, common.Big1, nil), big.NewInt(1)); err != nil {
+		t.Errorf("failed to sign verified transaction: %v", err)
+	}
+	if _, err := usbWallet.SignText(account, []byte("hello")); err != nil {
+		t.Errorf("failed to sign verified text: %v", err)
+	}
+	if _, err := usbWallet.SignTypedData(account, data); err != nil {
+		t.Errorf("failed to sign verified typed data: %v", err)
+	}
+	domainHash, messageHash, err := typedDataHashes(data)
+	if err != nil {
+		t.Fatalf("failed to hash typed data: %v", err)
+	}
+	hashed := append([]byte{0x19, 0x01}, append(domainHash, messageHash...)...)
+	if _, err := usbWallet.SignData(account, accounts.MimetypeTypedData, hashed); err != nil {
+		t.Errorf("failed to sign verified hashed typed data: %v", err)
+	}
+	usbWallet.Close()
+
+	// Signatures produced by another key than the derived one must be rejected
+	key, _ := crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	other, _ := crypto.GenerateKey()
+
+	for _, verify := range []bool{false, true} {
+		var opts []Option
+		if verify {
+			opts = append(opts, VerifySigner())
+		}
+		transport := NewMockTrezor(func(request proto.Message) proto.Message {
+			switch request := request.(type) {
+			case *trezor.EndSession, *trezor.Ping:
+				return new(trezor.Success)
+			case *trezor.Initialize, *trezor.GetFeatures:
+				return &trezor.Features{MajorVersion: proto.Uint32(2), MinorVersion: proto.Uint32(9), PatchVersion: proto.Uint32(1)}
+			case *trezor.EthereumGetAddress:
+				return &trezor.EthereumAddress{Address: proto.String(crypto.PubkeyToAddress(key.PublicKey).Hex())}
+			case *trezor.EthereumSignMessage:
+				signature, _ := crypto.Sign(accounts.TextHash(request.Message), other)
+				return &trezor.EthereumMessageSignature{Signature: signature, Address: proto.String(crypto.PubkeyToAddress(key.PublicKey).Hex())}
+			case *trezor.EthereumSignTypedData, *trezor.EthereumSignTypedHash:
+				signature, _ := crypto.Sign(device.typedHash, other)
+				return &trezor.EthereumTypedDataSignature{Signature: signature, Address: proto.String(crypto.PubkeyToAddress(key.PublicKey).Hex())}
+			}
+			return &trezor.Failure{Code: trezor.Failure_Failure_UnexpectedMessage.Enum()}
+		})
+		usbWallet, err := NewWallet(TrezorScheme, transport, opts...)
+		if err != nil {
+			t.Fatalf("verify %v: failed to create wallet: %v", verify, err)
+		}
+		if err := usbWallet.Open(""); err != nil {
+			t.Fatalf("verify %v: failed to open wallet: %v", verify, err)
+		}
+		account, err := usbWallet.Derive(accounts.DefaultBaseDerivationPath, true)
+		if err != nil {
+			t.Fatalf("verify %v: failed to derive account: %v", verify, err)
+		}
+		var want error
+		if verify {
+			want = ErrSignerMismatch
+		}
+		if _, err := usbWallet.SignText(account, []byte("hello")); !errors.Is(err, want) {
+			t.Errorf("verify %v: text signature error mismatch: have %v, want %v", verify, err, want)
+		}
+		if _, err := usbWallet.SignTypedData(account, data); !errors.Is(err, want) {
+			t.Errorf("verify %v: typed data signature error mismatch: have %v, want %v", verify, err, want)
+		}
+		if _, err := usbWallet.SignData(account, accounts.MimetypeTypedData, hashed); !errors.Is(err, want) {
+			t.Errorf("verify %v: hashed typed data signature error mismatch: have %v, want %v", verify, err, want)
+		}
+		usbWallet.Close()
+	}
+}
+
+// Tests that wallets without a serial number are identified by the fingerprint of
+// their seed once opened.
+func TestWalletStableIDSeed(t *testing.T) {
+	usbWallet, err := NewWallet(LedgerScheme, newLedgerTestDevice([3]byte{1, 10, 4}))
+	if err != nil {
+		t.Fatalf("failed to create wallet: %v", err)
+	}
+	if _, err := usbWallet.StableID(); !errors.Is(err, accounts.ErrWalletClosed) {
+		t.Fatalf("closed wallet error mismatch: have %v, want %v", err, accounts.ErrWalletClosed)
+	}
+	if err := usbWallet.Open(""); err != nil {
+		t.Fatalf("failed to open wallet: %v", err)
+	}
+	defer usbWallet.Close()
+
+	id, err := usbWallet.StableID()
+	if err != nil {
+		t.Fatalf("failed to derive stable id: %v", err)
+	}
+	if want := fmt.Sprintf("seed:%x", btcutil.Hash160(crypto.CompressPubkey(&ledgerTestKey(stableIDPath).PublicKey))[:4]); id != want {
+		t.Errorf("stable id mismatch: have %s, want %s", id, want)
+	}
+}
@@ -0,0 +1,36 @@
+package usbwallet
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ownershipProofPrefix starts every ownership proof message, separating proofs
+// from any other personal message (and, being signed as an EIP-191 personal
+// message, from transactions and typed data).
+const ownershipProofPrefix = "Ethereum account ownership proof\n"
+
+// OwnershipProofMessage returns the text signed as a personal message to prove
+// control of the address, binding it to the challenge of the verifier.
+func OwnershipProofMessage(address common.Address, challenge []byte) []byte {
+	return fmt.Appendf(nil, "%sAddress: %s\nChallenge: %#x", ownershipProofPrefix, address.Hex(), challenge)
+}
+
+// VerifyOwnershipProof checks that the signature is a proof of the ownership of
+// the address created by SignOwnershipProof for the challenge.
+func VerifyOwnershipProof(address common.Address, challenge []byte, signature []byte) error {
+	if len(challenge) == 0 {
+		return errors.New("empty ownership challenge")
+	}
+	signer, err := recoverSigner(accounts.TextHash(OwnershipProofMessage(address, challenge)), signature)
+	if err != nil {
+		return err
+	}
+	if signer != address {
+		return fmt.Errorf("%w: signer %s, want %s", ErrSignerMismatch, signer.Hex(), address.Hex())
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package usbwallet
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Tests that ownership proofs verify only against the address and challenge they
+// were signed for.
+func TestWalletSignOwnershipProof(t *testing.T) {
+	w, err := NewWallet(LedgerScheme, newLedgerTestDevice([3]byte{1, 10, 4}).MockTransport)
+	if err != nil {
+		t.Fatalf("failed to create wallet: %v", err)
+	}
+	if err := w.Open(""); err != nil {
+		t.Fatalf("failed to open wallet: %v", err)
+	}
+	path := accounts.DefaultBaseDerivationPath
+	account, err := w.Derive(path, true)
+	if err != nil {
+		t.Fatalf("failed to derive account: %v", err)
+	}
+	if _, err := w.SignOwnershipProof(path, nil); err == nil {
+		t.Errorf("empty challenge signed")
+	}
+	challenge := []byte("audit 2026-10-17")
+	signature, err := w.SignOwnershipProof(path, challenge)
+	if err != nil {
+		t.Fatalf("failed to sign ownership proof: %v", err)
+	}
+	if err := VerifyOwnershipProof(account.Address, challenge, signature); err != nil {
+		t.Errorf("valid proof rejected: %v", err)
+	}
+	if err := VerifyOwnershipProof(account.Address, []byte("audit 2026-10-18"), signature); !errors.Is(err, ErrSignerMismatch) {
+		t.Errorf("proof of other challenge: have %v, want %v", err, ErrSignerMismatch)
+	}
+	if err := VerifyOwnershipProof(common.Address{1}, challenge, signature); !errors.Is(err, ErrSignerMismatch) {
+		t.Errorf("proof of other address: have %v, want %v", err, ErrSignerMismatch)
+	}
+	// Ensure the proof can't be passed off as a plain signature of the challenge
+	plain, err := w.SignText(account, challenge)
+	if err != nil {
+		t.Fatalf("failed to sign challenge: %v", err)
+	}
+	if err := VerifyOwnershipProof(account.Address, challenge, plain); err == nil {
+		t.Errorf("plain personal message accepted as proof")
+	}
+	w.Close()
+	if _, err := w.SignOwnershipProof(path, challenge); err != accounts.ErrWalletClosed {
+		t.Errorf("closed wallet: have %v, want %v", err, accounts.ErrWalletClosed)
+	}
+}
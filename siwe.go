@@ -0,0 +1,94 @@
+package usbwallet
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SIWEMessage is an EIP-4361 Sign-In with Ethereum message. Timestamps are kept
+// as the RFC 3339 strings presented to the user, so the message is serialized
+// byte for byte as the relying party generated it. Optional fields are omitted
+// if empty.
+type SIWEMessage struct {
+	Scheme         string         // URI scheme of the origin of the request (optional)
+	Domain         string         // RFC 3986 authority requesting the signing
+	Address        common.Address // Ethereum address performing the signing
+	Statement      string         // Human-readable assertion the user signs (optional, single line)
+	URI            string         // RFC 3986 URI referring to the subject of the signing
+	Version        string         // Version of the message, must be "1"
+	ChainID        uint64         // EIP-155 chain ID the session is bound to
+	Nonce          string         // Randomized token of at least 8 alphanumeric characters
+	IssuedAt       string         // RFC 3339 time when the message was generated
+	ExpirationTime string         // RFC 3339 time when the message expires (optional)
+	NotBefore      string         // RFC 3339 time when the message becomes valid (optional)
+	RequestID      string         // System-specific identifier of the request (optional)
+	Resources      []string       // RFC 3986 URIs the user wishes to have resolved (optional)
+}
+
+// Validate checks that the mandatory fields of the message are set and that no
+// field would break the line based format of the message.
+func (m *SIWEMessage) Validate() error {
+	switch {
+	case m.Domain == "":
+		return errors.New("siwe: missing domain")
+	case m.URI == "":
+		return errors.New("siwe: missing uri")
+	case m.Version != "1":
+		return fmt.Errorf("siwe: unsupported version %q", m.Version)
+	case m.IssuedAt == "":
+		return errors.New("siwe: missing issued at time")
+	}
+	if len(m.Nonce) < 8 {
+		return fmt.Errorf("siwe: nonce %q shorter than 8 characters", m.Nonce)
+	}
+	for _, c := range m.Nonce {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return fmt.Errorf("siwe: nonce %q not alphanumeric", m.Nonce)
+		}
+	}
+	fields := append([]string{m.Scheme, m.Domain, m.Statement, m.URI, m.IssuedAt, m.ExpirationTime, m.NotBefore, m.RequestID}, m.Resources...)
+	for _, field := range fields {
+		if strings.ContainsAny(field, "\r\n") {
+			return fmt.Errorf("siwe: field %q contains a line break", field)
+		}
+	}
+	return nil
+}
+
+// String serializes the message into its EIP-191 signing form, as defined by the
+// EIP-4361 ABNF. The address is checksummed and the message has no trailing
+// newline.
+func (m *SIWEMessage) String() string {
+	var b strings.Builder
+
+	if m.Scheme != "" {
+		b.WriteString(m.Scheme + "://")
+	}
+	b.WriteString(m.Domain + " wants you to sign in with your Ethereum account:\n")
+	b.WriteString(m.Address.Hex() + "\n\n")
+	if m.Statement != "" {
+		b.WriteString(m.Statement + "\n")
+	}
+	b.WriteString("\n")
+
+	fmt.Fprintf(&b, "URI: %s\nVersion: %s\nChain ID: %d\nNonce: %s\nIssued At: %s", m.URI, m.Version, m.ChainID, m.Nonce, m.IssuedAt)
+	if m.ExpirationTime != "" {
+		b.WriteString("\nExpiration Time: " + m.ExpirationTime)
+	}
+	if m.NotBefore != "" {
+		b.WriteString("\nNot Before: " + m.NotBefore)
+	}
+	if m.RequestID != "" {
+		b.WriteString("\nRequest ID: " + m.RequestID)
+	}
+	if len(m.Resources) > 0 {
+		b.WriteString("\nResources:")
+		for _, resource := range m.Resources {
+			b.WriteString("\n- " + resource)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,155 @@
+package usbwallet
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// siweTestMessage is the example message of the EIP-4361 specification.
+var siweTestMessage = SIWEMessage{
+	Domain:    "example.com",
+	Address:   common.HexToAddress("0xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2"),
+	Statement: "I accept the ExampleOrg Terms of Service: https://example.com/tos",
+	URI:       "https://example.com/login",
+	Version:   "1",
+	ChainID:   1,
+	Nonce:     "32891756",
+	IssuedAt:  "2021-09-30T16:25:24Z",
+	Resources: []string{
+		"ipfs://bafybeiemxf5abjwjbikoz4mc3a3dla6ual3jsgpdr4cjr3oz3evfyavhwq/",
+		"https://example.com/my-web2-claim.json",
+	},
+}
+
+// Tests that SIWE messages are serialized byte for byte as in the EIP-4361
+// specification examples.
+func TestSIWEMessageString(t *testing.T) {
+	withScheme := siweTestMessage
+	withScheme.Scheme = "https"
+
+	minimal := siweTestMessage
+	minimal.Statement, minimal.Resources = "", nil
+
+	optional := minimal
+	optional.ExpirationTime, optional.NotBefore, optional.RequestID = "2021-10-30T16:25:24Z", "2021-09-30T16:25:24Z", "req-1"
+
+	tests := []struct {
+		message SIWEMessage
+		want    string
+	}{
+		{siweTestMessage, "example.com wants you to sign in with your Ethereum account:\n" +
+			"0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2\n\n" +
+			"I accept the ExampleOrg Terms of Service: https://example.com/tos\n\n" +
+			"URI: https://example.com/login\n" +
+			"Version: 1\n" +
+			"Chain ID: 1\n" +
+			"Nonce: 32891756\n" +
+			"Issued At: 2021-09-30T16:25:24Z\n" +
+			"Resources:\n" +
+			"- ipfs://bafybeiemxf5abjwjbikoz4mc3a3dla6ual3jsgpdr4cjr3oz3evfyavhwq/\n" +
+			"- https://example.com/my-web2-claim.json",
+		},
+		{withScheme, "https://example.com wants you to sign in with your Ethereum account:\n" +
+			"0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2\n\n" +
+			"I accept the ExampleOrg Terms of Service: https://example.com/tos\n\n" +
+			"URI: https://example.com/login\n" +
+			"Version: 1\n" +
+			"Chain ID: 1\n" +
+			"Nonce: 32891756\n" +
+			"Issued At: 2021-09-30T16:25:24Z\n" +
+			"Resources:\n" +
+			"- ipfs://bafybeiemxf5abjwjbikoz4mc3a3dla6ual3jsgpdr4cjr3oz3evfyavhwq/\n" +
+			"- https://example.com/my-web2-claim.json",
+		},
+		{minimal, "example.com wants you to sign in with your Ethereum account:\n" +
+			"0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2\n\n\n" +
+			"URI: https://example.com/login\n" +
+			"Version: 1\n" +
+			"Chain ID: 1\n" +
+			"Nonce: 32891756\n" +
+			"Issued At: 2021-09-30T16:25:24Z",
+		},
+		{optional, "example.com wants you to sign in with your Ethereum account:\n" +
+			"0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2\n\n\n" +
+			"URI: https://example.com/login\n" +
+			"Version: 1\n" +
+			"Chain ID: 1\n" +
+			"Nonce: 32891756\n" +
+			"Issued At: 2021-09-30T16:25:24Z\n" +
+			"Expiration Time: 2021-10-30T16:25:24Z\n" +
+			"Not Before: 2021-09-30T16:25:24Z\n" +
+			"Request ID: req-1",
+		},
+	}
+	for i, tt := range tests {
+		if err := tt.message.Validate(); err != nil {
+			t.Errorf("test %d: valid message rejected: %v", i, err)
+		}
+		if have := tt.message.String(); have != tt.want {
+			t.Errorf("test %d: message mismatch:\nhave %q\nwant %q", i, have, tt.want)
+		}
+	}
+}
+
+// Tests that malformed SIWE messages are rejected.
+func TestSIWEMessageValidate(t *testing.T) {
+	tests := []func(m *SIWEMessage){
+		func(m *SIWEMessage) { m.Domain = "" },
+		func(m *SIWEMessage) { m.URI = "" },
+		func(m *SIWEMessage) { m.Version = "2" },
+		func(m *SIWEMessage) { m.IssuedAt = "" },
+		func(m *SIWEMessage) { m.Nonce = "1234567" },
+		func(m *SIWEMessage) { m.Nonce = "1234-5678" },
+		func(m *SIWEMessage) { m.Statement = "line\nbreak" },
+		func(m *SIWEMessage) { m.Resources = []string{"https://example.com\r\n"} },
+	}
+	for i, mutate := range tests {
+		message := siweTestMessage
+		mutate(&message)
+		if err := message.Validate(); err == nil {
+			t.Errorf("test %d: invalid message accepted", i)
+		}
+	}
+}
+
+// Tests that SIWE messages are signed as personal messages by the account they
+// were issued for, recovering to it.
+func TestWalletSignSIWE(t *testing.T) {
+	wallet, err := NewWallet(LedgerScheme, newLedgerTestDevice([3]byte{1, 10, 4}).MockTransport)
+	if err != nil {
+		t.Fatalf("failed to create wallet: %v", err)
+	}
+	if err := wallet.Open(""); err != nil {
+		t.Fatalf("failed to open wallet: %v", err)
+	}
+	defer wallet.Close()
+
+	account, err := wallet.Derive(accounts.DefaultBaseDerivationPath, true)
+	if err != nil {
+		t.Fatalf("failed to derive account: %v", err)
+	}
+	// Ensure messages issued for other accounts are rejected
+	if _, err := wallet.SignSIWE(account, siweTestMessage); err == nil {
+		t.Fatalf("message of other account signed")
+	}
+	message := siweTestMessage
+	message.Address = account.Address
+
+	signature, err := wallet.SignSIWE(account, message)
+	if err != nil {
+		t.Fatalf("failed to sign message: %v", err)
+	}
+	if signature[64] >= 27 {
+		signature[64] -= 27
+	}
+	pubkey, err := crypto.SigToPub(accounts.TextHash([]byte(message.String())), signature)
+	if err != nil {
+		t.Fatalf("failed to recover signer: %v", err)
+	}
+	if signer := crypto.PubkeyToAddress(*pubkey); signer != account.Address {
+		t.Fatalf("signer mismatch: have %x, want %x", signer, account.Address)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package usbwallet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/base/usbwallet/usb"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// transportError wraps a failure of the USB transport itself, as opposed to an
+// error reported by the device. It records whether part of the request already
+// reached the device, in which case the exchange must not be repeated.
+type transportError struct {
+	err  error
+	sent bool // Whether any chunk of the request was sent (the device may act on it)
+}
+
+func (e *transportError) Error() string { return e.err.Error() }
+func (e *transportError) Unwrap() error { return e.err }
+
+// reopener is implemented by device connections that can be reestablished after
+// a transport failure.
+type reopener interface {
+	Reopen() error
+}
+
+// deviceGone reports whether a transport error means that the USB device itself
+// disappeared (e.g. it was unplugged, or re-enumerated at a new path after the
+// host slept), as opposed to a transient failure of a present device.
+func deviceGone(err error) bool {
+	return errors.Is(err, usb.ErrDeviceGone) || errors.Is(err, syscall.ENODEV)
+}
+
+// reopenableDevice is a USB device connection which can be closed and opened anew
+// to recover from a broken transport (e.g. a stalled libusb pipe).
+//
+// If the device disappears, the connection is marked gone and the next exchange
+// reopens it first, looking the device up by its serial number if it reappeared
+// at a different path. If that fails, accounts.ErrWalletClosed is returned.
+type reopenableDevice struct {
+	info   usb.DeviceInfo // USB device infos to reopen the device with
+	device usb.Device     // Currently open device handle
+	gone   bool           // Whether the device disappeared since it was opened
+	lock   sync.Mutex     // Protects the device handle from being swapped mid-use
+}
+
+// current returns the currently open device handle, reopening the device first
+// if it disappeared since the last exchange.
+func (d *reopenableDevice) current() (usb.Device, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.gone {
+		if err := d.reopen(); err != nil {
+			return nil, fmt.Errorf("%w: %v", accounts.ErrWalletClosed, err)
+		}
+		d.gone = false
+	}
+	return d.device, nil
+}
+
+// check marks the device gone if an exchange failed because it disappeared.
+func (d *reopenableDevice) check(err error) {
+	if err != nil && deviceGone(err) {
+		d.lock.Lock()
+		d.gone = true
+		d.lock.Unlock()
+	}
+}
+
+// Read implements io.Reader, reading from the currently open device handle.
+func (d *reopenableDevice) Read(b []byte) (int, error) {
+	device, err := d.current()
+	if err != nil {
+		return 0, err
+	}
+	n, err := device.Read(b)
+	d.check(err)
+	return n, err
+}
+
+// Write implements io.Writer, writing to the currently open device handle.
+func (d *reopenableDevice) Write(b []byte) (int, error) {
+	device, err := d.current()
+	if err != nil {
+		return 0, err
+	}
+	n, err := device.Write(b)
+	d.check(err)
+	return n, err
+}
+
+// Close implements usb.Device, closing the currently open device handle.
+func (d *reopenableDevice) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.device.Close()
+}
+
+// Reopen closes the current device handle and opens a new one in its place.
+func (d *reopenableDevice) Reopen() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if err := d.reopen(); err != nil {
+		return err
+	}
+	d.gone = false
+	return nil
+}
+
+// reopen closes the current device handle and opens a new one in its place. If
+// the device can't be opened at its known path, it is looked up by its serial
+// number, as it may have re-enumerated at a new one. A serial shared by several
+// attached devices is ambiguous and not followed.
+//
+// The method assumes that the lock is held!
+func (d *reopenableDevice) reopen() error {
+	d.device.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), openTimeout)
+	defer cancel()
+
+	device, err := usbOpen(d.info, ctx)
+	if err != nil && d.info.Serial != "" {
+		infos, ferr := usbEnumerate(ctx, d.info.VendorID, d.info.ProductID)
+		if ferr != nil {
+			return err
+		}
+		// Only follow the device if a single one matches, as vendor-constant serials
+		// (e.g. all Ledgers report 0001) don't tell devices apart
+		infos = slices.DeleteFunc(infos, func(info usb.DeviceInfo) bool {
+			return info.Path == d.info.Path || info.Serial != d.info.Serial || info.Interface != d.info.Interface || info.UsagePage != d.info.UsagePage
+		})
+		if len(infos) == 1 {
+			if device, err = usbOpen(infos[0], ctx); err == nil {
+				log.Debug("Reopened USB device at new path", "serial", infos[0].Serial, "old", d.info.Path, "new", infos[0].Path)
+				d.info = infos[0]
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	d.device = device
+	return nil
+}
+
+// retryExchange runs a data exchange with the device, retrying it according to
+// the retry policy if it fails with a transport error before any part of the
+// request was sent. Failures while reading the reply are never retried, as the
+// device already received the request and may have acted on it (e.g. prompting
+// the user). The device is reopened before each retry if supported by the
+// connection.
+func retryExchange(policy RetryPolicy, device io.ReadWriter, logger log.Logger, exchange func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := exchange()
+
+		var terr *transportError
+		if err == nil || !errors.As(err, &terr) || terr.sent || attempt >= policy.Attempts {
+			return err
+		}
+		logger.Debug("Retrying failed USB exchange", "attempt", attempt, "err", err)
+		time.Sleep(policy.delay(attempt))
+
+		if dev, ok := device.(reopener); ok {
+			if err := dev.Reopen(); err != nil {
+				return err
+			}
+		}
+	}
+}
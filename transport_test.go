@@ -0,0 +1,254 @@
+package usbwallet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/base/usbwallet/trezor"
+	"github.com/base/usbwallet/usb"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/log"
+	"google.golang.org/protobuf/proto"
+)
+
+// errFlakyWrite is the transport error injected by flakyTestDevice.
+var errFlakyWrite = errors.New("libusb: pipe error")
+
+// flakyTestDevice wraps a device connection, failing selected writes and reads,
+// and counting the times the connection was reopened.
+type flakyTestDevice struct {
+	io.ReadWriter
+
+	fails     map[int]bool // Writes (1 based) to fail with a transport error
+	readFails map[int]bool // Reads (1 based) to fail, leaving the data unread
+	writes    int          // Number of writes attempted
+	reads     int          // Number of reads attempted
+	reopens   int          // Number of times the connection was reopened
+}
+
+// Write implements io.Writer, failing the write if requested.
+func (d *flakyTestDevice) Write(b []byte) (int, error) {
+	if d.writes++; d.fails[d.writes] {
+		return 0, errFlakyWrite
+	}
+	return d.ReadWriter.Write(b)
+}
+
+// Read implements io.Reader, failing the read if requested.
+func (d *flakyTestDevice) Read(b []byte) (int, error) {
+	if d.reads++; d.readFails[d.reads] {
+		return 0, errFlakyWrite
+	}
+	return d.ReadWriter.Read(b)
+}
+
+// Reopen implements reopener, counting the reopens.
+func (d *flakyTestDevice) Reopen() error {
+	d.reopens++
+	return nil
+}
+
+// Tests that Ledger exchanges are retried on transport errors according to the
+// retry policy, but never if the request was partially sent or if the device
+// reported an error status.
+func TestLedgerExchangeRetry(t *testing.T) {
+	tests := []struct {
+		attempts int   // Total attempts allowed by the retry policy
+		fails    []int // Writes to fail with a transport error
+		reads    []int // Reads to fail with a transport error
+		long     bool  // Whether to sign a message spanning multiple chunks
+		wrongApp bool  // Whether the device answers with an error status
+		err      error // Expected error, nil if the exchange should succeed
+		reopens  int   // Expected number of device reopens
+		writes   int   // Expected number of writes
+	}{
+		// Transient errors before anything was sent are retried
+		{attempts: 3, fails: []int{1}, reopens: 1, writes: 2},
+		{attempts: 3, fails: []int{1, 2}, reopens: 2, writes: 3},
+		{attempts: 3, fails: []int{1, 2, 3}, err: errFlakyWrite, reopens: 2, writes: 3},
+
+		// Retries can be disabled
+		{attempts: 1, fails: []int{1}, err: errFlakyWrite, writes: 1},
+		{attempts: 0, fails: []int{1}, err: errFlakyWrite, writes: 1},
+
+		// Partially sent requests are never retried
+		{attempts: 3, fails: []int{2}, long: true, err: errFlakyWrite, writes: 2},
+
+		// Requests whose reply failed to arrive are never retried
+		{attempts: 3, reads: []int{1}, err: errFlakyWrite, writes: 1},
+		{attempts: 3, reads: []int{1}, long: true, err: errFlakyWrite, writes: 4},
+
+		// Errors reported by the device are never retried
+		{attempts: 3, wrongApp: true, err: &ledgerError{status: 0x6e00}, writes: 1},
+	}
+	for i, tt := range tests {
+		device := newLedgerTestDevice([3]byte{1, 10, 4})
+		flaky := &flakyTestDevice{ReadWriter: device}
+
+		driver := newLedgerDriver(log.Root(), &config{retry: RetryPolicy{Attempts: tt.attempts, Backoff: time.Millisecond}}).(*ledgerDriver)
+		if err := driver.Open(flaky, ""); err != nil {
+			t.Fatalf("test %d: failed to open ledger: %v", i, err)
+		}
+		flaky.writes, flaky.fails = 0, make(map[int]bool)
+		for _, n := range tt.fails {
+			flaky.fails[n] = true
+		}
+		flaky.reads, flaky.readFails = 0, make(map[int]bool)
+		for _, n := range tt.reads {
+			flaky.readFails[n] = true
+		}
+		if tt.wrongApp {
+			device.app = "Bitcoin"
+		}
+		var err error
+		if tt.long {
+			_, err = driver.SignText(accounts.DefaultBaseDerivationPath, make([]byte, 200))
+		} else {
+			_, err = driver.Derive(accounts.DefaultBaseDerivationPath)
+		}
+		switch {
+		case tt.err == nil && err != nil:
+			t.Errorf("test %d: exchange failed: %v", i, err)
+		case tt.err != nil && (err == nil || err.Error() != tt.err.Error()):
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		if flaky.reopens != tt.reopens {
+			t.Errorf("test %d: reopen count mismatch: have %d, want %d", i, flaky.reopens, tt.reopens)
+		}
+		if flaky.writes != tt.writes {
+			t.Errorf("test %d: write count mismatch: have %d, want %d", i, flaky.writes, tt.writes)
+		}
+	}
+}
+
+// Tests that Trezor exchanges are retried if the request failed to be sent, but
+// never once it was delivered and only the reply failed to arrive.
+func TestTrezorExchangeRetry(t *testing.T) {
+	tests := []struct {
+		fails  []int // Writes to fail with a transport error
+		reads  []int // Reads to fail with a transport error
+		err    error // Expected error, nil if the exchange should succeed
+		writes int   // Expected number of writes
+	}{
+		{fails: []int{1}, writes: 2},
+		{reads: []int{1}, err: errFlakyWrite, writes: 1},
+	}
+	for i, tt := range tests {
+		flaky := &flakyTestDevice{
+			ReadWriter: NewMockTrezor(func(request proto.Message) proto.Message {
+				return &trezor.EthereumAddress{Address: proto.String("0x0000000000000000000000000000000000000001")}
+			}),
+			fails:     make(map[int]bool),
+			readFails: make(map[int]bool),
+		}
+		for _, n := range tt.fails {
+			flaky.fails[n] = true
+		}
+		for _, n := range tt.reads {
+			flaky.readFails[n] = true
+		}
+		driver := newTrezorDriver(log.Root(), &config{retry: RetryPolicy{Attempts: 3, Backoff: time.Millisecond}}).(*trezorDriver)
+		driver.device = flaky
+
+		_, err := driver.Derive(accounts.DefaultBaseDerivationPath)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		if flaky.writes != tt.writes {
+			t.Errorf("test %d: write count mismatch: have %d, want %d", i, flaky.writes, tt.writes)
+		}
+	}
+}
+
+// goneTestDevice is a device handle which fails all exchanges with ENODEV once
+// the device is marked gone, emulating it disappearing from the bus.
+type goneTestDevice struct {
+	*MockTransport
+	gone bool
+}
+
+// Read implements io.Reader, failing the read if the device is gone.
+func (d *goneTestDevice) Read(b []byte) (int, error) {
+	if d.gone {
+		return 0, syscall.ENODEV
+	}
+	return d.MockTransport.Read(b)
+}
+
+// Write implements io.Writer, failing the write if the device is gone.
+func (d *goneTestDevice) Write(b []byte) (int, error) {
+	if d.gone {
+		return 0, syscall.ENODEV
+	}
+	return d.MockTransport.Write(b)
+}
+
+// Tests that a device which disappeared is reopened on the next exchange, looked
+// up by its serial number at a new path, and that the wallet is reported closed
+// if it can't be found.
+func TestReopenDeviceGone(t *testing.T) {
+	open, enumerate := usbOpen, usbEnumerate
+	t.Cleanup(func() { usbOpen, usbEnumerate = open, enumerate })
+
+	var (
+		ledger  = newLedgerTestDevice([3]byte{1, 10, 4})
+		handles = make(map[string]*goneTestDevice) // Openable device handles by path
+		present []usb.DeviceInfo                   // Devices reported by enumeration
+	)
+	usbOpen = func(info usb.DeviceInfo, ctx context.Context) (usb.Device, error) {
+		if handle, ok := handles[info.Path]; ok && !handle.gone {
+			return handle, nil
+		}
+		return nil, syscall.ENODEV
+	}
+	usbEnumerate = func(ctx context.Context, vendorID uint16, productID uint16) ([]usb.DeviceInfo, error) {
+		return present, nil
+	}
+	info := usb.DeviceInfo{Path: "old", VendorID: 0x2c97, ProductID: 0x4011, Serial: "0001"}
+	handles["old"] = &goneTestDevice{MockTransport: NewMockLedger(ledger.handle)}
+
+	device := &reopenableDevice{info: info, device: handles["old"]}
+	driver := newLedgerDriver(log.Root(), new(config)).(*ledgerDriver)
+	if err := driver.Open(device, ""); err != nil {
+		t.Fatalf("failed to open ledger: %v", err)
+	}
+	// Disconnect the device and ensure the failure is detected
+	handles["old"].gone = true
+	if _, err := driver.Derive(accounts.DefaultBaseDerivationPath); !deviceGone(err) {
+		t.Fatalf("gone device error mismatch: have %v, want %v", err, syscall.ENODEV)
+	}
+	// Re-enumerate the device at a new path (next to another one) and ensure the
+	// next exchange transparently reopens it
+	handles["other"] = &goneTestDevice{MockTransport: NewMockLedger(ledger.handle)}
+	handles["new"] = &goneTestDevice{MockTransport: NewMockLedger(ledger.handle)}
+	present = []usb.DeviceInfo{
+		{Path: "other", VendorID: info.VendorID, ProductID: info.ProductID, Serial: "0002"},
+		{Path: "new", VendorID: info.VendorID, ProductID: info.ProductID, Serial: info.Serial},
+	}
+	if _, err := driver.Derive(accounts.DefaultBaseDerivationPath); err != nil {
+		t.Fatalf("failed to derive after re-enumeration: %v", err)
+	}
+	if device.info.Path != "new" {
+		t.Fatalf("reopened device path mismatch: have %q, want %q", device.info.Path, "new")
+	}
+	// Disconnect the device and re-enumerate two with its serial, ensuring neither
+	// is picked as the serial is ambiguous and the wallet is reported closed
+	handles["new"].gone = true
+	handles["new-1"] = &goneTestDevice{MockTransport: NewMockLedger(ledger.handle)}
+	handles["new-2"] = &goneTestDevice{MockTransport: NewMockLedger(ledger.handle)}
+	present = []usb.DeviceInfo{
+		{Path: "new-1", VendorID: info.VendorID, ProductID: info.ProductID, Serial: info.Serial},
+		{Path: "new-2", VendorID: info.VendorID, ProductID: info.ProductID, Serial: info.Serial},
+	}
+
+	if _, err := driver.Derive(accounts.DefaultBaseDerivationPath); !deviceGone(err) {
+		t.Fatalf("gone device error mismatch: have %v, want %v", err, syscall.ENODEV)
+	}
+	if _, err := driver.Derive(accounts.DefaultBaseDerivationPath); !errors.Is(err, accounts.ErrWalletClosed) {
+		t.Fatalf("missing device error mismatch: have %v, want %v", err, accounts.ErrWalletClosed)
+	}
+}
@@ -21,28 +21,73 @@
 package usbwallet
 
 import (
+	"context"
+	"crypto/ecdsa"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 	"math/big"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/base/usbwallet/trezor"
+	"github.com/base/usbwallet/usb"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
 	pin "github.com/reserve-protocol/trezor"
 	"google.golang.org/protobuf/proto"
 )
 
+// trezorMaxPathLength is the maximum number of derivation path components the
+// Trezor firmware accepts in a request.
+const trezorMaxPathLength = 8
+
 // errTrezorReplyInvalidHeader is the error message returned by a Trezor data exchange
 // if the device replies with a mismatching header. This usually means the device
 // is in browser mode.
 var errTrezorReplyInvalidHeader = errors.New("trezor: invalid reply header")
 
+// ErrPassphraseRequired is returned if the Trezor requests a passphrase, but
+// neither a passphrase prompt was configured, nor one supplied when opening.
+var ErrPassphraseRequired = errors.New("trezor: passphrase required")
+
+// ErrPassphraseOnDevice can be returned by a PassphraseFunc to request that the
+// passphrase is entered on the Trezor itself instead of on the host.
+var ErrPassphraseOnDevice = errors.New("trezor: passphrase entry on device")
+
+// ErrDeviceInBootloader is returned when opening a Trezor in bootloader mode, which
+// only accepts firmware updates. The user needs to reconnect the device without
+// touching the screen (or holding the buttons) to start the firmware.
+var ErrDeviceInBootloader = errors.New("trezor: device in bootloader mode")
+
+// ErrDeviceNotInitialized is returned when opening a Trezor without a seed, as when
+// new, wiped or in the middle of a recovery. The user needs to complete the device
+// setup first.
+var ErrDeviceNotInitialized = errors.New("trezor: device not initialized")
+
+// PassphraseFunc is invoked when a Trezor requests the passphrase protecting its
+// wallet. It should return the passphrase entered by the user on the host, or
+// ErrPassphraseOnDevice to let the user type it on the device instead.
+type PassphraseFunc func() (string, error)
+
+// WithPassphraseFunc configures the prompt used to request the passphrase when
+// a passphrase protected Trezor needs it.
+func WithPassphraseFunc(fn PassphraseFunc) Option {
+	return func(c *config) {
+		c.passphrase = fn
+	}
+}
+
 type TrezorFailure struct {
 	*trezor.Failure
 }
@@ -53,26 +98,100 @@ func (f *TrezorFailure) Error() string {
 	return fmt.Sprintf("trezor: %s", f.GetMessage())
 }
 
+// Unwrap returns ErrUserRejected if the failure was caused by the user cancelling
+// the action on the device, allowing errors.Is to match it.
+func (f *TrezorFailure) Unwrap() error {
+	if f.GetCode() == trezor.Failure_Failure_ActionCancelled {
+		return ErrUserRejected
+	}
+	return nil
+}
+
+// PinFunc is invoked when a Trezor requests a PIN to be entered via its scrambled
+// matrix. It should return the positions (digits 1-9, numbered like a keypad from
+// the bottom left) of the matrix cells picked by the user, or an empty string if
+// the user aborted the entry.
+type PinFunc func(kind trezor.PinMatrixRequest_PinMatrixRequestType) (string, error)
+
+// WithPinFunc configures the prompt used to request the PIN matrix positions when
+// a Trezor needs to be unlocked or its PIN changed. Without it, the user is asked
+// on the terminal.
+func WithPinFunc(fn PinFunc) Option {
+	return func(c *config) {
+		c.pin = fn
+	}
+}
+
+// ButtonFunc is invoked when a Trezor waits for the user to confirm an action on
+// the device (e.g. to let the UI show "confirm on your Trezor"). The request is
+// acknowledged automatically after the callback returns, so it must not block.
+type ButtonFunc func(code trezor.ButtonRequest_ButtonRequestType)
+
+// WithButtonFunc configures the callback notified whenever a Trezor requests a
+// confirmation on the device. An operation may request several confirmations.
+func WithButtonFunc(fn ButtonFunc) Option {
+	return func(c *config) {
+		c.button = fn
+	}
+}
+
+// HideTrezorMessageHash stops asking Trezors to show the EIP-712 message hash for
+// confirmation before the typed data fields, so the user reviews the decoded fields
+// straight away. Without it, the hash is shown on firmwares supporting it (v2.9.1
+// and newer); older ones never show it.
+func HideTrezorMessageHash() Option {
+	return func(c *config) {
+		c.hideHash = true
+	}
+}
+
 // trezorDriver implements the communication with a Trezor hardware wallet.
 type trezorDriver struct {
 	device     io.ReadWriter // USB device connection to communicate through
 	version    [3]uint32     // Current version of the Trezor firmware
 	label      string        // Current textual label of the Trezor device
+	model      string        // Model of the Trezor device
 	passphrase string
-	failure    error      // Any failure that would make the device unusable
-	log        log.Logger // Contextual logger to tag the trezor with its id
+	prompt     PassphraseFunc // Host side passphrase prompt, nil if not configured
+	pin        PinFunc        // Host side PIN matrix prompt, nil for the terminal
+	button     ButtonFunc     // Device confirmation notification, nil if not configured
+	hideHash   bool           // Whether typed data is signed without showing the message hash
+	chunkify   bool           // Whether addresses are displayed in chunks of 4 characters
+	failure    error          // Any failure that would make the device unusable
+	infoLock   sync.RWMutex   // Protects the version, model and failure refreshed by health checks
+	retry      RetryPolicy    // Policy for retrying transient USB transport failures
+	timeouts   Timeouts       // Limits on the duration of interactive and background exchanges
+	traffic    log.Logger     // Logger for the protobuf traffic, nil if disabled
+	log        log.Logger     // Contextual logger to tag the trezor with its id
+
+	sequence  uint64     // Sequence number of the last exchange started
+	waiting   uint64     // Sequence number of the exchange waiting for a reply, 0 if none
+	cancels   int        // Number of Cancel messages sent while waiting for the reply
+	expired   uint64     // Sequence number of the last exchange cancelled by its timeout
+	waitLock  sync.Mutex // Protects the exchange sequence numbers and cancel counter
+	writeLock sync.Mutex // Prevents a Cancel from interleaving with the chunks of a request
 }
 
 // newTrezorDriver creates a new instance of a Trezor USB protocol driver.
-func newTrezorDriver(logger log.Logger) driver {
+func newTrezorDriver(logger log.Logger, config *config) driver {
 	return &trezorDriver{
-		log: logger,
+		prompt:   config.passphrase,
+		pin:      config.pin,
+		button:   config.button,
+		hideHash: config.hideHash,
+		retry:    config.retry,
+		timeouts: config.timeouts,
+		traffic:  config.traffic,
+		log:      logger,
 	}
 }
 
 // Status implements accounts.Wallet, always whether the Trezor is opened, closed
 // or whether the Ethereum app was not started on it.
 func (w *trezorDriver) Status() (string, error) {
+	w.infoLock.RLock() // Read without the comms lock, racing with health checks
+	defer w.infoLock.RUnlock()
+
 	if w.failure != nil {
 		return fmt.Sprintf("Failed: %v", w.failure), w.failure
 	}
@@ -87,41 +206,192 @@ func (w *trezorDriver) Status() (string, error) {
 func (w *trezorDriver) Open(device io.ReadWriter, passphrase string) error {
 	w.device, w.passphrase, w.failure = device, passphrase, nil
 
+	// Terminate any previous session, tolerating devices which don't know about
+	// sessions (older firmwares and Trezor clones such as the KeepKey)
 	if _, err := w.trezorExchange(&trezor.EndSession{}, new(trezor.Success)); err != nil {
-		return err
+		var failure *TrezorFailure
+		if !errors.As(err, &failure) || failure.GetCode() != trezor.Failure_Failure_UnexpectedMessage {
+			return err
+		}
 	}
 
 	features := new(trezor.Features)
 	if _, err := w.trezorExchange(&trezor.Initialize{}, features); err != nil {
 		return err
 	}
+	// Devices which can't derive keys would fail the first wallet request obscurely,
+	// report their state instead. Clones not reporting it are assumed initialized.
+	if features.GetBootloaderMode() {
+		return ErrDeviceInBootloader
+	}
+	if features.Initialized != nil && !features.GetInitialized() {
+		return ErrDeviceNotInitialized
+	}
 	w.version = [3]uint32{features.GetMajorVersion(), features.GetMinorVersion(), features.GetPatchVersion()}
-	w.label = features.GetLabel()
+	w.label, w.model = features.GetLabel(), trezorModel(features)
 
-	return w.Heartbeat()
+	return nil
+}
+
+// SelectInterface implements usbwallet.driver, picking the interface with the
+// lowest number. Trezor devices speak the wallet protocol on their first interface,
+// any further one is a debug link.
+func (w *trezorDriver) SelectInterface(infos []usb.DeviceInfo) usb.DeviceInfo {
+	return slices.MinFunc(infos, func(a, b usb.DeviceInfo) int { return a.Interface - b.Interface })
 }
 
 // Close implements usbwallet.driver, cleaning up and metadata maintained within
 // the Trezor driver.
 func (w *trezorDriver) Close() error {
-	w.version, w.label = [3]uint32{}, ""
+	w.version, w.label, w.model = [3]uint32{}, "", ""
 	return nil
 }
 
 // Heartbeat implements usbwallet.driver, performing a sanity check against the
-// Trezor to see if it's still online.
+// Trezor to see if it's still online, refreshing the firmware version. Unlike
+// Initialize, GetFeatures leaves the current session intact.
 func (w *trezorDriver) Heartbeat() error {
-	if _, err := w.trezorExchange(&trezor.Ping{}, new(trezor.Success)); err != nil {
+	features := new(trezor.Features)
+	if _, err := w.trezorExchange(&trezor.GetFeatures{}, features); err != nil {
+		w.infoLock.Lock()
 		w.failure = err
+		w.infoLock.Unlock()
 		return err
 	}
+	w.infoLock.Lock()
+	w.version = [3]uint32{features.GetMajorVersion(), features.GetMinorVersion(), features.GetPatchVersion()}
+	w.model = trezorModel(features)
+	w.infoLock.Unlock()
 	return nil
 }
 
+// Attestation implements usbwallet.driver, gathering the firmware details of the
+// Trezor and requesting it to sign the challenge with its certified key. Devices
+// without a secure element don't know the request, their attestation only holds
+// the firmware details.
+func (w *trezorDriver) Attestation(challenge []byte) (*Attestation, error) {
+	if w.device == nil {
+		return nil, accounts.ErrWalletClosed
+	}
+	features := new(trezor.Features)
+	if _, err := w.trezorExchange(&trezor.GetFeatures{}, features); err != nil {
+		return nil, err
+	}
+	attestation := &Attestation{
+		Challenge:        challenge,
+		Vendor:           features.GetVendor(),
+		Model:            features.GetInternalModel(),
+		Revision:         features.GetRevision(),
+		BootloaderHash:   features.GetBootloaderHash(),
+		BootloaderLocked: features.GetBootloaderLocked(),
+	}
+	proof := new(trezor.AuthenticityProof)
+	if _, err := w.trezorExchange(&trezor.AuthenticateDevice{Challenge: challenge}, proof); err != nil {
+		var failure *TrezorFailure
+		if !errors.As(err, &failure) || failure.GetCode() != trezor.Failure_Failure_UnexpectedMessage {
+			return nil, err
+		}
+		return attestation, nil
+	}
+	attestation.Certificates, attestation.Signature = proof.GetCertificates(), proof.GetSignature()
+	return attestation, nil
+}
+
+// DeviceInfo implements usbwallet.driver, returning the model and firmware
+// version reported by the Trezor.
+func (w *trezorDriver) DeviceInfo() DeviceInfo {
+	w.infoLock.RLock()
+	defer w.infoLock.RUnlock()
+
+	if w.device == nil {
+		return DeviceInfo{}
+	}
+	return DeviceInfo{
+		Model:    w.model,
+		Firmware: fmt.Sprintf("%d.%d.%d", w.version[0], w.version[1], w.version[2]),
+	}
+}
+
+// Capabilities implements usbwallet.driver, deriving the supported features from
+// the firmware version. Trezor One style firmwares (1.x) only sign typed data
+// hashes, and dynamic fee transactions are the only typed ones signed.
+func (w *trezorDriver) Capabilities() Capabilities {
+	w.infoLock.RLock()
+	defer w.infoLock.RUnlock()
+
+	if w.device == nil {
+		return Capabilities{}
+	}
+	native := w.trezorTypedData()
+	return Capabilities{
+		TypedDataNative: native,
+		NestedArrays:    native,
+		DynamicFeeTx:    w.trezorEIP1559(),
+	}
+}
+
+// trezorModel names the device model reported in the features, recognizing the
+// Trezor internal model codes and prefixing other (fork) models by their vendor.
+func trezorModel(features *trezor.Features) string {
+	switch model := features.GetModel(); {
+	case model == "1":
+		return "Trezor Model One"
+	case model == "T":
+		return "Trezor Model T"
+	case features.GetInternalModel() == "T2B1" || features.GetInternalModel() == "T3B1":
+		return "Trezor Safe 3"
+	case features.GetInternalModel() == "T3T1":
+		return "Trezor Safe 5"
+	default:
+		return strings.TrimSpace(features.GetVendor() + " " + model)
+	}
+}
+
 // Derive implements usbwallet.driver, sending a derivation request to the Trezor
 // and returning the Ethereum address located on that derivation path.
 func (w *trezorDriver) Derive(path accounts.DerivationPath) (common.Address, error) {
-	return w.trezorDerive(path)
+	return w.trezorDerive(path, false)
+}
+
+// ExtendedPublicKey implements usbwallet.driver, retrieving the extended public
+// key located on the derivation path from the Trezor.
+func (w *trezorDriver) ExtendedPublicKey(path accounts.DerivationPath) (*hdkeychain.ExtendedKey, error) {
+	if w.device == nil {
+		return nil, accounts.ErrWalletClosed
+	}
+	if err := validatePath(path, trezorMaxPathLength); err != nil {
+		return nil, err
+	}
+	pubkey := new(trezor.EthereumPublicKey)
+	if _, err := w.trezorExchange(&trezor.EthereumGetPublicKey{AddressN: path}, pubkey); err != nil {
+		return nil, err
+	}
+	node := pubkey.GetNode()
+
+	parentFP := binary.BigEndian.AppendUint32(nil, node.GetFingerprint())
+	return hdkeychain.NewExtendedKey(chaincfg.MainNetParams.HDPublicKeyID[:], node.GetPublicKey(), node.GetChainCode(),
+		parentFP, uint8(node.GetDepth()), node.GetChildNum(), false), nil
+}
+
+// ConfirmAddress implements usbwallet.driver, displaying the Ethereum address
+// located on the derivation path on the Trezor and waiting for the user to
+// confirm or reject it.
+func (w *trezorDriver) ConfirmAddress(path accounts.DerivationPath) (common.Address, error) {
+	if w.device == nil {
+		return common.Address{}, accounts.ErrWalletClosed
+	}
+	address, _, err := w.trezorPublicKey(path, true)
+	return address, err
+}
+
+// PublicKey implements usbwallet.driver, retrieving the public key located on the
+// derivation path from the Trezor.
+func (w *trezorDriver) PublicKey(path accounts.DerivationPath) (*ecdsa.PublicKey, error) {
+	if w.device == nil {
+		return nil, accounts.ErrWalletClosed
+	}
+	_, key, err := w.trezorPublicKey(path, false)
+	return key, err
 }
 
 // SignTx implements usbwallet.driver, sending the transaction to the Trezor and
@@ -133,10 +403,81 @@ func (w *trezorDriver) SignTx(path accounts.DerivationPath, tx *types.Transactio
 	return w.trezorSign(path, tx, chainID)
 }
 
+// SignAuthorization implements usbwallet.driver. The Trezor firmware doesn't
+// support standalone EIP-7702 authorizations, so this method always errors.
+func (w *trezorDriver) SignAuthorization(path accounts.DerivationPath, auth types.SetCodeAuthorization) ([]byte, error) {
+	return nil, accounts.ErrNotSupported
+}
+
+// Cancel implements usbwallet.driver, sending a Cancel message to the Trezor while
+// an exchange is in flight (e.g. a signature waiting to be confirmed). The device
+// dismisses the prompt and fails the pending request with Failure_ActionCancelled,
+// leaving it ready for the next request.
+func (w *trezorDriver) Cancel() error {
+	if w.device == nil {
+		return accounts.ErrWalletClosed
+	}
+	_, err := w.trezorCancel(0)
+	return err
+}
+
+// trezorCancel sends a Cancel message to the Trezor if the exchange with the given
+// sequence number (any if zero) is waiting for its reply, reporting whether it did.
+// Nothing is sent otherwise, as an idle device would answer the Cancel itself with
+// a stray failure. Cancels with a sequence number mark the exchange expired.
+func (w *trezorDriver) trezorCancel(id uint64) (bool, error) {
+	w.waitLock.Lock()
+	defer w.waitLock.Unlock()
+
+	if w.waiting == 0 || (id != 0 && w.waiting != id) {
+		return false, nil
+	}
+	req := new(trezor.Cancel)
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+	if err := w.trezorWrite(req, data); err != nil {
+		return false, err
+	}
+	w.cancels++
+	if id != 0 {
+		w.expired = id
+	}
+	return true, nil
+}
+
+// trezorNextExchange returns the sequence number of a new exchange.
+func (w *trezorDriver) trezorNextExchange() uint64 {
+	w.waitLock.Lock()
+	defer w.waitLock.Unlock()
+
+	w.sequence++
+	return w.sequence
+}
+
+// trezorExpired reports whether the exchange with the given sequence number was
+// cancelled by its timeout.
+func (w *trezorDriver) trezorExpired(id uint64) bool {
+	w.waitLock.Lock()
+	defer w.waitLock.Unlock()
+
+	return w.expired == id
+}
+
+// LedgerAppConfig implements usbwallet.driver. Trezor devices don't run a Ledger
+// app, so the request is always rejected.
+func (w *trezorDriver) LedgerAppConfig() ([3]byte, byte, error) {
+	return [3]byte{}, 0, accounts.ErrNotSupported
+}
+
 func (w *trezorDriver) SignTypedHash(path accounts.DerivationPath, domainHash []byte, messageHash []byte) ([]byte, error) {
 	if w.device == nil {
 		return nil, accounts.ErrWalletClosed
 	}
+	if err := validatePath(path, trezorMaxPathLength); err != nil {
+		return nil, err
+	}
 	response := new(trezor.EthereumTypedDataSignature)
 	_, err := w.trezorExchange(&trezor.EthereumSignTypedHash{
 		AddressN:            path,
@@ -150,10 +491,14 @@ func (w *trezorDriver) SignTypedHash(path accounts.DerivationPath, domainHash []
 }
 
 // trezorDerive sends a derivation request to the Trezor device and returns the
-// Ethereum address located on that path.
-func (w *trezorDriver) trezorDerive(derivationPath []uint32) (common.Address, error) {
+// Ethereum address located on that path. If display is set, the device shows the
+// address and waits for the user to confirm it before returning.
+func (w *trezorDriver) trezorDerive(derivationPath []uint32, display bool) (common.Address, error) {
+	if err := validatePath(derivationPath, trezorMaxPathLength); err != nil {
+		return common.Address{}, err
+	}
 	address := new(trezor.EthereumAddress)
-	if _, err := w.trezorExchange(&trezor.EthereumGetAddress{AddressN: derivationPath}, address); err != nil {
+	if _, err := w.trezorExchange(&trezor.EthereumGetAddress{AddressN: derivationPath, ShowDisplay: &display, Chunkify: w.chunkifyFlag()}, address); err != nil {
 		return common.Address{}, err
 	}
 	if addr := address.GetAddress(); len(addr) > 0 {
@@ -162,9 +507,92 @@ func (w *trezorDriver) trezorDerive(derivationPath []uint32) (common.Address, er
 	return common.Address{}, errors.New("missing derived address")
 }
 
+// trezorPublicKey derives the Ethereum address and retrieves the public key located
+// on the derivation path from the Trezor, making sure the two belong together. If
+// display is set, the device shows the address and waits for the user to confirm
+// it before returning.
+func (w *trezorDriver) trezorPublicKey(derivationPath []uint32, display bool) (common.Address, *ecdsa.PublicKey, error) {
+	address, err := w.trezorDerive(derivationPath, display)
+	if err != nil {
+		return common.Address{}, nil, err
+	}
+	pubkey := new(trezor.EthereumPublicKey)
+	if _, err := w.trezorExchange(&trezor.EthereumGetPublicKey{AddressN: derivationPath}, pubkey); err != nil {
+		return common.Address{}, nil, err
+	}
+	key, err := crypto.DecompressPubkey(pubkey.GetNode().GetPublicKey())
+	if err != nil {
+		return common.Address{}, nil, fmt.Errorf("trezor: invalid public key: %w", err)
+	}
+	if derived := crypto.PubkeyToAddress(*key); derived != address {
+		return common.Address{}, nil, fmt.Errorf("trezor: address mismatch: displayed %s, derived %s", address.Hex(), derived.Hex())
+	}
+	return address, key, nil
+}
+
+// trezorChunkifyVersion is the first Trezor T family firmware able to display
+// addresses in chunks. Trezor One firmwares don't support it.
+var trezorChunkifyVersion = [3]uint32{2, 6, 4}
+
+// SetDisplayMode implements displayDriver, displaying the addresses of later
+// requests in chunks of 4 characters in the detailed mode.
+func (w *trezorDriver) SetDisplayMode(mode DisplayMode) error {
+	switch mode {
+	case DisplayConcise:
+		w.chunkify = false
+	case DisplayDetailed:
+		if w.version[0] < 2 || !w.atLeast(trezorChunkifyVersion) {
+			return fmt.Errorf("trezor: detailed display on firmware v%d.%d.%d: %w", w.version[0], w.version[1], w.version[2], ErrUnsupported)
+		}
+		w.chunkify = true
+	default:
+		return fmt.Errorf("trezor: display mode %d: %w", mode, ErrUnsupported)
+	}
+	return nil
+}
+
+// chunkifyFlag returns the Chunkify field of the requests displaying addresses,
+// left unset in the concise mode so older firmwares don't see it.
+func (w *trezorDriver) chunkifyFlag() *bool {
+	if !w.chunkify {
+		return nil
+	}
+	chunkify := true
+	return &chunkify
+}
+
+// trezorEIP1559Versions are the first Trezor One and Trezor T family firmwares
+// able to sign EIP-1559 dynamic fee transactions, indexed by major version.
+var trezorEIP1559Versions = map[uint32][3]uint32{
+	1: {1, 10, 4},
+	2: {2, 4, 2},
+}
+
+// trezorEIP1559 reports whether the firmware can sign dynamic fee transactions.
+func (w *trezorDriver) trezorEIP1559() bool {
+	if version, ok := trezorEIP1559Versions[w.version[0]]; ok {
+		return w.atLeast(version)
+	}
+	return w.version[0] > 2
+}
+
 // trezorSign sends the transaction to the Trezor wallet, and waits for the user
 // to confirm or deny the transaction.
 func (w *trezorDriver) trezorSign(derivationPath []uint32, tx *types.Transaction, chainID *big.Int) (common.Address, *types.Transaction, error) {
+	if err := validatePath(derivationPath, trezorMaxPathLength); err != nil {
+		return common.Address{}, nil, err
+	}
+	switch tx.Type() {
+	case types.LegacyTxType:
+	case types.DynamicFeeTxType:
+		return w.trezorSignEIP1559(derivationPath, tx, chainID)
+	case types.AccessListTxType:
+		// The firmware only accepts access lists as part of EIP-1559 transactions,
+		// EthereumSignTx has no access list and its tx_type is Wanchain specific.
+		return common.Address{}, nil, fmt.Errorf("trezor: EIP-2930 access list transactions: %w, use a dynamic fee transaction", accounts.ErrNotSupported)
+	default:
+		return common.Address{}, nil, fmt.Errorf("trezor: transaction type %d: %w", tx.Type(), accounts.ErrNotSupported)
+	}
 	// Create the transaction initiation message
 	data := tx.Data()
 	length := uint32(len(data))
@@ -176,34 +604,23 @@ func (w *trezorDriver) trezorSign(derivationPath []uint32, tx *types.Transaction
 		GasLimit:   new(big.Int).SetUint64(tx.Gas()).Bytes(),
 		Value:      tx.Value().Bytes(),
 		DataLength: &length,
+		Chunkify:   w.chunkifyFlag(),
 	}
 	if to := tx.To(); to != nil {
 		// Non contract deploy, set recipient explicitly
 		hex := to.Hex()
 		request.To = &hex
 	}
-	if length > 1024 { // Send the data chunked if that was requested
-		request.DataInitialChunk, data = data[:1024], data[1024:]
-	} else {
-		request.DataInitialChunk, data = data, nil
-	}
+	request.DataInitialChunk, data = trezorDataChunk(data)
 	if chainID != nil { // EIP-155 transaction, set chain ID explicitly (only 32 bit is supported!?)
 		id := chainID.Uint64()
 		request.ChainId = &id
 	}
 	// Send the initiation message and stream content until a signature is returned
-	response := new(trezor.EthereumTxRequest)
-	if _, err := w.trezorExchange(request, response); err != nil {
+	response, err := w.trezorStreamTx(request, data)
+	if err != nil {
 		return common.Address{}, nil, err
 	}
-	for response.DataLength != nil && int(*response.DataLength) <= len(data) {
-		chunk := data[:*response.DataLength]
-		data = data[*response.DataLength:]
-
-		if _, err := w.trezorExchange(&trezor.EthereumTxAck{DataChunk: chunk}, response); err != nil {
-			return common.Address{}, nil, err
-		}
-	}
 	// Extract the Ethereum signature and do a sanity validation
 	if len(response.GetSignatureR()) == 0 || len(response.GetSignatureS()) == 0 || response.GetSignatureV() == 0 {
 		return common.Address{}, nil, errors.New("reply lacks signature")
@@ -214,8 +631,10 @@ func (w *trezorDriver) trezorSign(derivationPath []uint32, tx *types.Transaction
 	var signer types.Signer
 	if chainID == nil {
 		signer = new(types.HomesteadSigner)
+		// The firmware returns the 27 offset V, the signer expects the bare parity
+		signature[64] -= 27
 	} else {
-		// Trezor backend does not support typed transactions yet.
+		// Legacy transaction, typed ones are handled by trezorSignEIP1559
 		signer = types.NewEIP155Signer(chainID)
 		// if chainId is above (MaxUint32 - 36) / 2 then the final v values is returned
 		// directly. Otherwise, the returned value is 35 + chainid * 2.
@@ -236,56 +655,346 @@ func (w *trezorDriver) trezorSign(derivationPath []uint32, tx *types.Transaction
 	return sender, signed, nil
 }
 
+// trezorSignEIP1559 sends a dynamic fee transaction to the Trezor wallet, and
+// waits for the user to confirm or deny the transaction.
+func (w *trezorDriver) trezorSignEIP1559(derivationPath []uint32, tx *types.Transaction, chainID *big.Int) (common.Address, *types.Transaction, error) {
+	if !w.trezorEIP1559() {
+		return common.Address{}, nil, fmt.Errorf("trezor: firmware v%d.%d.%d doesn't support EIP-1559 transactions", w.version[0], w.version[1], w.version[2])
+	}
+	if chainID == nil {
+		chainID = tx.ChainId()
+	}
+	if !chainID.IsUint64() {
+		return common.Address{}, nil, fmt.Errorf("trezor: chain id %v too large", chainID)
+	}
+	// Create the transaction initiation message
+	data := tx.Data()
+	length := uint32(len(data))
+	id := chainID.Uint64()
+
+	request := &trezor.EthereumSignTxEIP1559{
+		AddressN:       derivationPath,
+		Nonce:          new(big.Int).SetUint64(tx.Nonce()).Bytes(),
+		MaxGasFee:      tx.GasFeeCap().Bytes(),
+		MaxPriorityFee: tx.GasTipCap().Bytes(),
+		GasLimit:       new(big.Int).SetUint64(tx.Gas()).Bytes(),
+		Value:          tx.Value().Bytes(),
+		DataLength:     &length,
+		ChainId:        &id,
+		Chunkify:       w.chunkifyFlag(),
+	}
+	if to := tx.To(); to != nil {
+		// Non contract deploy, set recipient explicitly
+		hex := to.Hex()
+		request.To = &hex
+	}
+	for _, tuple := range tx.AccessList() {
+		address := tuple.Address.Hex()
+		entry := &trezor.EthereumSignTxEIP1559_EthereumAccessList{Address: &address}
+		for _, key := range tuple.StorageKeys {
+			entry.StorageKeys = append(entry.StorageKeys, key.Bytes())
+		}
+		request.AccessList = append(request.AccessList, entry)
+	}
+	request.DataInitialChunk, data = trezorDataChunk(data)
+
+	// Send the initiation message and stream content until a signature is returned
+	response, err := w.trezorStreamTx(request, data)
+	if err != nil {
+		return common.Address{}, nil, err
+	}
+	// Extract the Ethereum signature, V being the bare parity for typed transactions
+	if len(response.GetSignatureR()) == 0 || len(response.GetSignatureS()) == 0 || response.SignatureV == nil {
+		return common.Address{}, nil, errors.New("reply lacks signature")
+	}
+	if response.GetSignatureV() > 1 {
+		return common.Address{}, nil, fmt.Errorf("trezor: invalid signature V %d", response.GetSignatureV())
+	}
+	signature := make([]byte, crypto.SignatureLength)
+	copy(signature[32-len(response.GetSignatureR()):32], response.GetSignatureR())
+	copy(signature[64-len(response.GetSignatureS()):64], response.GetSignatureS())
+	signature[64] = byte(response.GetSignatureV())
+
+	// Inject the final signature into the transaction and sanity check the sender
+	signer := types.LatestSignerForChainID(chainID)
+	signed, err := tx.WithSignature(signer, signature)
+	if err != nil {
+		return common.Address{}, nil, err
+	}
+	sender, err := types.Sender(signer, signed)
+	if err != nil {
+		return common.Address{}, nil, err
+	}
+	return sender, signed, nil
+}
+
+// trezorDataChunk splits the transaction payload into the initial chunk sent with
+// the signing request and the remainder streamed on request.
+func trezorDataChunk(data []byte) ([]byte, []byte) {
+	if len(data) > 1024 {
+		return data[:1024], data[1024:]
+	}
+	return data, nil
+}
+
+// trezorStreamTx sends a transaction signing request and streams the remaining
+// payload chunks requested by the device, until it returns the signature. If the
+// stream is interrupted, the signing workflow is cancelled on the device.
+func (w *trezorDriver) trezorStreamTx(request proto.Message, data []byte) (_ *trezor.EthereumTxRequest, err error) {
+	defer func() {
+		if err != nil {
+			w.trezorAbort(err)
+		}
+	}()
+	response := new(trezor.EthereumTxRequest)
+	if _, err := w.trezorExchange(request, response); err != nil {
+		return nil, err
+	}
+	for response.DataLength != nil && int(*response.DataLength) <= len(data) {
+		chunk := data[:*response.DataLength]
+		data = data[*response.DataLength:]
+
+		if _, err := w.trezorExchange(&trezor.EthereumTxAck{DataChunk: chunk}, response); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// trezorAbort cancels the workflow of an interrupted multi-message exchange, so
+// the next request doesn't land in a device still waiting for the rest of the
+// stream. Failures reported by the device already ended its workflow.
+//
+// Invariant: once a multi-message exchange fails, the device is back to its idle
+// state, ready to accept a new request on the same connection.
+func (w *trezorDriver) trezorAbort(err error) {
+	var failure *TrezorFailure
+	if errors.As(err, &failure) {
+		return
+	}
+	req := new(trezor.Cancel)
+	data, _ := proto.Marshal(req)
+	if _, _, err := w._trezorExchange(req, data, w.trezorNextExchange()); err != nil {
+		w.log.Debug("Failed to cancel interrupted Trezor workflow", "err", err)
+	}
+}
+
+// trezorPin assembles the reply to a PIN matrix request, asking the configured
+// prompt (or the terminal if none) for the matrix positions picked by the user.
+func (w *trezorDriver) trezorPin(kind trezor.PinMatrixRequest_PinMatrixRequestType) (*trezor.PinMatrixAck, error) {
+	prompt := w.pin
+	if prompt == nil {
+		prompt = func(kind trezor.PinMatrixRequest_PinMatrixRequestType) (string, error) {
+			switch kind {
+			case trezor.PinMatrixRequest_PinMatrixRequestType_NewFirst:
+				return pin.GetPIN("Please enter your new Trezor PIN")
+			case trezor.PinMatrixRequest_PinMatrixRequestType_NewSecond:
+				return pin.GetPIN("Please re-enter your new Trezor PIN")
+			default:
+				return pin.GetPIN("Please enter your Trezor PIN")
+			}
+		}
+	}
+	p, err := prompt(kind)
+	if err != nil {
+		return nil, err
+	}
+	if p == "" {
+		return nil, ErrUserRejected
+	}
+	for _, c := range p {
+		if c < '1' || c > '9' {
+			return nil, fmt.Errorf("trezor: invalid PIN matrix position %q", c)
+		}
+	}
+	return &trezor.PinMatrixAck{Pin: &p}, nil
+}
+
+// trezorPassphrase assembles the reply to a passphrase request, preferring the
+// configured prompt over the passphrase supplied when opening the wallet.
+func (w *trezorDriver) trezorPassphrase() (*trezor.PassphraseAck, error) {
+	if w.prompt == nil {
+		if w.passphrase == "" {
+			return nil, ErrPassphraseRequired
+		}
+		return &trezor.PassphraseAck{Passphrase: &w.passphrase}, nil
+	}
+	passphrase, err := w.prompt()
+	if errors.Is(err, ErrPassphraseOnDevice) {
+		onDevice := true
+		return &trezor.PassphraseAck{OnDevice: &onDevice}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &trezor.PassphraseAck{Passphrase: &passphrase}, nil
+}
+
 // trezorExchange performs a data exchange with the Trezor wallet, sending it a
 // message and retrieving the response. If multiple responses are possible, the
 // method will also return the index of the destination object used.
 func (w *trezorDriver) trezorExchange(req proto.Message, results ...proto.Message) (int, error) {
+	return w.trezorExchangeStep(req, false, results...)
+}
+
+// trezorExchangeStep is identical to trezorExchange, but limits the wait for the
+// reply by the interactive timeout if the user was already prompted during the
+// request (i.e. it acknowledges a button, PIN or passphrase request), or by the
+// background one otherwise. Expired requests are cancelled on the device.
+func (w *trezorDriver) trezorExchangeStep(req proto.Message, interactive bool, results ...proto.Message) (int, error) {
 	// Construct the original message payload to chunk up
 	data, err := proto.Marshal(req)
 	if err != nil {
 		return 0, err
 	}
-	payload := make([]byte, 8+len(data))
-	copy(payload, []byte{0x23, 0x23})
-	binary.BigEndian.PutUint16(payload[2:], trezor.Type(req))
-	binary.BigEndian.PutUint32(payload[4:], uint32(len(data)))
-	copy(payload[8:], data)
-
-	// Stream all the chunks to the device
-	chunk := make([]byte, 64)
-	chunk[0] = 0x3f // Report ID magic number
+	var (
+		kind  uint16
+		reply []byte
+		timer *time.Timer
 
-	for len(payload) > 0 {
-		// Construct the new message to stream, padding with zeroes if needed
-		if len(payload) > 63 {
-			copy(chunk[1:], payload[:63])
-			payload = payload[63:]
-		} else {
-			copy(chunk[1:], payload)
-			copy(chunk[1+len(payload):], make([]byte, 63-len(payload)))
-			payload = nil
+		id = w.trezorNextExchange()
+	)
+	if timeout := w.timeouts.timeout(interactive); timeout > 0 {
+		// Only cancel this exchange, the timer may fire after it's done
+		timer = time.AfterFunc(timeout, func() { w.trezorCancel(id) })
+	}
+	err = retryExchange(w.retry, w.device, w.log, func() (err error) {
+		kind, reply, err = w._trezorExchange(req, data, id)
+		return err
+	})
+	if timer != nil {
+		timer.Stop()
+	}
+	if w.trezorExpired(id) && (err != nil || kind == uint16(trezor.MessageType_MessageType_Failure)) {
+		return 0, fmt.Errorf("trezor: %s timed out: %w", trezor.Name(trezor.Type(req)), context.DeadlineExceeded)
+	}
+	if err != nil {
+		return 0, err
+	}
+	// Try to parse the reply into the requested reply message
+	if kind == uint16(trezor.MessageType_MessageType_Failure) {
+		// Trezor returned a failure, extract and return the message
+		failure := new(trezor.Failure)
+		if err := proto.Unmarshal(reply, failure); err != nil {
+			return 0, err
 		}
-		// Send over to the device
-		w.log.Trace("Data chunk sent to the Trezor", "chunk", hexutil.Bytes(chunk))
-		if _, err := w.device.Write(chunk); err != nil {
+		return 0, &TrezorFailure{Failure: failure}
+	}
+	if kind == uint16(trezor.MessageType_MessageType_ButtonRequest) {
+		// Trezor is waiting for user confirmation, ack and wait for the next message
+		if w.button != nil {
+			request := new(trezor.ButtonRequest)
+			if err := proto.Unmarshal(reply, request); err != nil {
+				return 0, err
+			}
+			w.button(request.GetCode())
+		}
+		return w.trezorExchangeStep(&trezor.ButtonAck{}, true, results...)
+	}
+	if kind == uint16(trezor.MessageType_MessageType_PinMatrixRequest) {
+		request := new(trezor.PinMatrixRequest)
+		if err := proto.Unmarshal(reply, request); err != nil {
+			return 0, err
+		}
+		ack, err := w.trezorPin(request.GetType())
+		if err != nil {
+			return 0, err
+		}
+		return w.trezorExchangeStep(ack, true, results...)
+	}
+	if kind == uint16(trezor.MessageType_MessageType_PassphraseRequest) {
+		ack, err := w.trezorPassphrase()
+		if err != nil {
 			return 0, err
 		}
+		return w.trezorExchangeStep(ack, true, results...)
+	}
+	for i, res := range results {
+		if trezor.Type(res) == kind {
+			return i, proto.Unmarshal(reply, res)
+		}
+	}
+	expected := make([]string, len(results))
+	for i, res := range results {
+		expected[i] = trezor.Name(trezor.Type(res))
+	}
+	return 0, fmt.Errorf("trezor: expected reply types %s, got %s", expected, trezor.Name(kind))
+}
+
+// _trezorExchange sends an already marshalled message to the Trezor wallet and
+// retrieves the type and raw payload of the reply, the exchange being identified
+// by the given sequence number towards Cancel.
+//
+// Cancel messages sent while waiting are answered with a failure by the device if
+// it already replied (or replied with an intermediate request, whose workflow is
+// cancelled instead). These replies are drained, so they don't answer the next
+// request.
+func (w *trezorDriver) _trezorExchange(req proto.Message, data []byte, id uint64) (uint16, []byte, error) {
+	// Only allow cancelling once the request was sent, so the Cancel follows it
+	if err := w.trezorWrite(req, data); err != nil {
+		return 0, nil, err
 	}
-	// Stream the reply back from the wallet in 64 byte chunks
+	w.waitLock.Lock()
+	w.waiting = id
+	w.waitLock.Unlock()
+
+	kind, reply, err := w.trezorRead()
+
+	w.waitLock.Lock()
+	cancels := w.cancels
+	w.waiting, w.cancels = 0, 0
+	w.waitLock.Unlock()
+
+	if err != nil {
+		return 0, nil, err
+	}
+	if cancels > 0 && trezorCancelled(kind, reply) {
+		cancels-- // The Cancel failed the request itself
+	}
+	for ; cancels > 0; cancels-- {
+		failure, freply, err := w.trezorRead()
+		if err != nil {
+			return 0, nil, err
+		}
+		// Intermediate requests of the device were cancelled along with the workflow
+		switch kind {
+		case uint16(trezor.MessageType_MessageType_ButtonRequest), uint16(trezor.MessageType_MessageType_PinMatrixRequest), uint16(trezor.MessageType_MessageType_PassphraseRequest):
+			kind, reply = failure, freply
+		}
+	}
+	return kind, reply, nil
+}
+
+// trezorCancelled reports whether a reply is the failure of a cancelled workflow.
+func trezorCancelled(kind uint16, reply []byte) bool {
+	if kind != uint16(trezor.MessageType_MessageType_Failure) {
+		return false
+	}
+	failure := new(trezor.Failure)
+	if err := proto.Unmarshal(reply, failure); err != nil {
+		return false
+	}
+	return failure.GetCode() == trezor.Failure_Failure_ActionCancelled
+}
+
+// trezorRead streams a reply back from the Trezor wallet in 64 byte chunks and
+// returns its type and raw payload.
+func (w *trezorDriver) trezorRead() (uint16, []byte, error) {
 	var (
 		kind  uint16
 		reply []byte
+		chunk = make([]byte, 64)
 	)
 	for {
 		// Read the next chunk from the Trezor wallet
 		if _, err := io.ReadFull(w.device, chunk); err != nil {
-			return 0, err
+			return 0, nil, &transportError{err: err, sent: true} // Request delivered, never retry
 		}
 		w.log.Trace("Data chunk received from the Trezor", "chunk", hexutil.Bytes(chunk))
 
 		// Make sure the transport header matches
 		if chunk[0] != 0x3f || (len(reply) == 0 && (chunk[1] != 0x23 || chunk[2] != 0x23)) {
-			return 0, errTrezorReplyInvalidHeader
+			return 0, nil, errTrezorReplyInvalidHeader
 		}
 		// If it's the first chunk, retrieve the reply message type and total message length
 		var payload []byte
@@ -305,37 +1014,46 @@ func (w *trezorDriver) trezorExchange(req proto.Message, results ...proto.Messag
 			break
 		}
 	}
-	// Try to parse the reply into the requested reply message
-	if kind == uint16(trezor.MessageType_MessageType_Failure) {
-		// Trezor returned a failure, extract and return the message
-		failure := new(trezor.Failure)
-		if err := proto.Unmarshal(reply, failure); err != nil {
-			return 0, err
-		}
-		return 0, &TrezorFailure{Failure: failure}
+	if w.traffic != nil {
+		w.traffic.Debug("Trezor message received", "type", trezor.Name(kind), "len", len(reply))
 	}
-	if kind == uint16(trezor.MessageType_MessageType_ButtonRequest) {
-		// Trezor is waiting for user confirmation, ack and wait for the next message
-		return w.trezorExchange(&trezor.ButtonAck{}, results...)
+	return kind, reply, nil
+}
+
+// trezorWrite frames an already marshalled message and streams it to the Trezor
+// wallet in 64 byte chunks, without waiting for a reply.
+func (w *trezorDriver) trezorWrite(req proto.Message, data []byte) error {
+	payload := make([]byte, 8+len(data))
+	copy(payload, []byte{0x23, 0x23})
+	binary.BigEndian.PutUint16(payload[2:], trezor.Type(req))
+	binary.BigEndian.PutUint32(payload[4:], uint32(len(data)))
+	copy(payload[8:], data)
+
+	w.writeLock.Lock()
+	defer w.writeLock.Unlock()
+
+	if w.traffic != nil {
+		w.traffic.Debug("Trezor message sent", "type", trezor.Name(trezor.Type(req)), "len", len(data))
 	}
-	if kind == uint16(trezor.MessageType_MessageType_PinMatrixRequest) {
-		p, err := pin.GetPIN("Please enter your Trezor PIN")
-		if err != nil {
-			return 0, err
+	// Stream all the chunks to the device
+	chunk := make([]byte, 64)
+	chunk[0] = 0x3f // Report ID magic number
+
+	for i := 0; len(payload) > 0; i++ {
+		// Construct the new message to stream, padding with zeroes if needed
+		if len(payload) > 63 {
+			copy(chunk[1:], payload[:63])
+			payload = payload[63:]
+		} else {
+			copy(chunk[1:], payload)
+			copy(chunk[1+len(payload):], make([]byte, 63-len(payload)))
+			payload = nil
 		}
-		return w.trezorExchange(&trezor.PinMatrixAck{Pin: &p}, results...)
-	}
-	if kind == uint16(trezor.MessageType_MessageType_PassphraseRequest) {
-		return w.trezorExchange(&trezor.PassphraseAck{Passphrase: &w.passphrase}, results...)
-	}
-	for i, res := range results {
-		if trezor.Type(res) == kind {
-			return i, proto.Unmarshal(reply, res)
+		// Send over to the device
+		w.log.Trace("Data chunk sent to the Trezor", "chunk", hexutil.Bytes(chunk))
+		if _, err := w.device.Write(chunk); err != nil {
+			return &transportError{err: err, sent: i > 0}
 		}
 	}
-	expected := make([]string, len(results))
-	for i, res := range results {
-		expected[i] = trezor.Name(trezor.Type(res))
-	}
-	return 0, fmt.Errorf("trezor: expected reply types %s, got %s", expected, trezor.Name(kind))
+	return nil
 }
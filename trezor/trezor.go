@@ -51,8 +51,19 @@ import (
 	"reflect"
 
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
 )
 
+// packages are the protocol buffer packages the Trezor messages are defined in.
+var packages = []protoreflect.FullName{
+	"hw.trezor.messages",
+	"hw.trezor.messages.common",
+	"hw.trezor.messages.management",
+	"hw.trezor.messages.ethereum",
+	"hw.trezor.messages.ethereum_eip712",
+}
+
 // Type returns the protocol buffer type number of a specific message. If the
 // message is nil, this method panics!
 func Type(msg proto.Message) uint16 {
@@ -68,3 +79,18 @@ func Name(kind uint16) string {
 	}
 	return name[12:]
 }
+
+// New creates an empty protocol buffer message of a specific type number. If the
+// type number is unknown, nil is returned.
+func New(kind uint16) proto.Message {
+	name := Name(kind)
+	if name == "" {
+		return nil
+	}
+	for _, pkg := range packages {
+		if mt, err := protoregistry.GlobalTypes.FindMessageByName(pkg.Append(protoreflect.Name(name))); err == nil {
+			return mt.New().Interface()
+		}
+	}
+	return nil
+}
@@ -4,12 +4,11 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	gomath "math"
 	"math/big"
-	"reflect"
 
 	"github.com/base/usbwallet/trezor"
 	"github.com/ethereum/go-ethereum/accounts"
-	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/signer/core/apitypes"
 	"google.golang.org/protobuf/proto"
 )
@@ -18,10 +17,14 @@ func (w *trezorDriver) SignText(path accounts.DerivationPath, text []byte) ([]by
 	if w.device == nil {
 		return nil, accounts.ErrWalletClosed
 	}
+	if err := validatePath(path, trezorMaxPathLength); err != nil {
+		return nil, err
+	}
 	response := new(trezor.EthereumMessageSignature)
 	_, err := w.trezorExchange(&trezor.EthereumSignMessage{
 		AddressN: path,
 		Message:  text,
+		Chunkify: w.chunkifyFlag(),
 	}, response)
 	if err != nil {
 		return nil, err
@@ -29,35 +32,104 @@ func (w *trezorDriver) SignText(path accounts.DerivationPath, text []byte) ([]by
 	return response.Signature, nil
 }
 
+// trezorTypedDataVersion is the first Trezor T family firmware (Model T, Safe 3,
+// Safe 5) able to sign EIP-712 typed data streamed to it.
+var trezorTypedDataVersion = [3]uint32{2, 4, 3}
+
+// trezorMessageHashVersion is the first firmware accepting the ShowMessageHash
+// field, letting the device display the message hash for confirmation.
+var trezorMessageHashVersion = [3]uint32{2, 9, 1}
+
+// atLeast reports whether the device firmware is at least the given version.
+func (w *trezorDriver) atLeast(version [3]uint32) bool {
+	for i := range version {
+		if w.version[i] != version[i] {
+			return w.version[i] > version[i]
+		}
+	}
+	return true
+}
+
+// trezorTypedData reports whether the firmware can sign typed data streamed to it.
+func (w *trezorDriver) trezorTypedData() bool {
+	return w.atLeast(trezorTypedDataVersion)
+}
+
 func (w *trezorDriver) SignedTypedData(path accounts.DerivationPath, data apitypes.TypedData) ([]byte, error) {
 	if w.device == nil {
 		return nil, accounts.ErrWalletClosed
 	}
+	if err := validatePath(path, trezorMaxPathLength); err != nil {
+		return nil, err
+	}
+
+	data, err := decodeTypedBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	domainHash, messageHash, err := typedDataHashes(data)
+	if err != nil {
+		return nil, fmt.Errorf("trezor: error hashing typed data: %w", err)
+	}
+	return w.trezorSignTypedData(path, data, newTypedDataValues(data), domainHash, messageHash)
+}
 
-	_, hashes, err := apitypes.TypedDataAndHash(data)
+// SignedTypedDataStream implements usbwallet.driver, answering the value requests
+// of the Trezor with values pulled from message. The message is hashed on the host
+// beforehand (for devices displaying or blind signing it), so values are pulled
+// twice.
+func (w *trezorDriver) SignedTypedDataStream(path accounts.DerivationPath, data apitypes.TypedData, message TypedDataValues) ([]byte, error) {
+	if w.device == nil {
+		return nil, accounts.ErrWalletClosed
+	}
+	if err := validatePath(path, trezorMaxPathLength); err != nil {
+		return nil, err
+	}
+	domainHash, err := data.HashStruct("EIP712Domain", typedDomainMap(data))
+	if err != nil {
+		return nil, fmt.Errorf("trezor: error hashing typed data domain: %w", err)
+	}
+	messageHash, err := hashTypedDataValues(data, message)
 	if err != nil {
 		return nil, fmt.Errorf("trezor: error hashing typed data: %w", err)
 	}
-	domainHash, messageHash := hashes[2:34], hashes[34:66]
+	return w.trezorSignTypedData(path, data, message, domainHash, messageHash)
+}
+
+// trezorSignTypedData streams the typed data, with the message values provided by
+// message, to the Trezor as it requests them, or blind signs the precomputed hashes
+// on devices not supporting typed data.
+func (w *trezorDriver) trezorSignTypedData(path accounts.DerivationPath, data apitypes.TypedData, message TypedDataValues, domainHash, messageHash []byte) (_ []byte, err error) {
 	if w.version[0] == 1 {
-		// legacy Trezor devices don't support typed data; fallback to hash signing:
-		return w.SignTypedHash(path, []byte(domainHash), []byte(messageHash))
+		// legacy Trezor devices (and forks reporting Trezor One style versions, such
+		// as the OneKey Classic/Mini) don't support typed data; fallback to hash signing:
+		return w.SignTypedHash(path, domainHash, messageHash)
 	}
 
-	if w.version[0] == 2 && (w.version[1] < 9 || (w.version[1] == 9 && w.version[2] == 0)) {
-		// ShowMessageHash was introduced in Trezor firmware v2.9.1
-		return nil, fmt.Errorf("trezor: typed data signing requires firmware v2.9.1 or newer")
+	if !w.trezorTypedData() {
+		return nil, fmt.Errorf("trezor: typed data signing requires firmware v2.4.3 or newer")
 	}
 
 	signature := new(trezor.EthereumTypedDataSignature)
 	structRequest := new(trezor.EthereumTypedDataStructRequest)
 	valueRequest := new(trezor.EthereumTypedDataValueRequest)
-	var req proto.Message = &trezor.EthereumSignTypedData{
-		AddressN:        path,
-		PrimaryType:     &data.PrimaryType,
-		ShowMessageHash: []byte(messageHash),
+	request := &trezor.EthereumSignTypedData{
+		AddressN:    path,
+		PrimaryType: &data.PrimaryType,
 	}
+	if w.atLeast(trezorMessageHashVersion) && !w.hideHash {
+		// Older firmwares reject the unknown field, only send it where supported
+		request.ShowMessageHash = messageHash
+	}
+	var req proto.Message = request
 	nestedArray := false
+
+	// Don't leave the device waiting for struct or value acks if streaming fails
+	defer func() {
+		if err != nil {
+			w.trezorAbort(err)
+		}
+	}()
 	for {
 		n, err := w.trezorExchange(req, signature, structRequest, valueRequest)
 		if err != nil {
@@ -106,10 +178,11 @@ func (w *trezorDriver) SignedTypedData(path accounts.DerivationPath, data apityp
 					dataType = trezor.EthereumTypedDataStructAck_STRUCT
 					members := uint32(len(data.Types[name]))
 					inner.Size = &members
-				case IntType:
+				case IntType, FixedPointType:
+					// Fixed point numbers are sent as their underlying scaled integers
 					dataType = trezor.EthereumTypedDataStructAck_INT
 					inner.Size = &ubyteLength
-				case UintType:
+				case UintType, UfixedPointType:
 					dataType = trezor.EthereumTypedDataStructAck_UINT
 					inner.Size = &ubyteLength
 				case AddressType:
@@ -132,100 +205,132 @@ func (w *trezorDriver) SignedTypedData(path accounts.DerivationPath, data apityp
 			}
 			req = ack
 		case 2:
-			structType := data.Types[data.PrimaryType]
-			structValue := data.Message
-			if valueRequest.MemberPath[0] == 0 {
-				// populate with domain info
-				structType = data.Types["EIP712Domain"]
-				structValue = data.Domain.Map()
-			}
-			var value []byte
-			for i := 1; i < len(valueRequest.MemberPath); i++ {
-				p := valueRequest.MemberPath[i]
-				if structType == nil {
-					return nil, fmt.Errorf("trezor: no struct type for path %v", path)
-				}
-				if int(p) >= len(structType) {
-					return nil, fmt.Errorf("trezor: invalid field index %d for struct %s", p, structRequest.GetName())
+			value, nested, err := trezorTypedValue(data, message, valueRequest.MemberPath)
+			if nestedArray = nested; err != nil {
+				return nil, err
+			}
+			req = &trezor.EthereumTypedDataValueAck{
+				Value: value,
+			}
+		default:
+			return nil, fmt.Errorf("trezor: unexpected reply index %d", n)
+		}
+	}
+}
+
+// trezorTypedValue encodes the EIP-712 value a Trezor requested by member path,
+// whose first index selects the domain (0) or the message (1) and the following
+// ones the struct fields and array items leading to it. For arrays, the length of
+// the requested dimension is returned. It also reports whether the path crosses a
+// nested array, which older firmwares fail to handle.
+func trezorTypedValue(data apitypes.TypedData, message TypedDataValues, memberPath []uint32) (value []byte, nested bool, err error) {
+	if len(memberPath) < 2 {
+		return nil, false, fmt.Errorf("trezor: invalid member path %v", memberPath)
+	}
+	structType, values := data.Types[data.PrimaryType], message
+	if memberPath[0] == 0 {
+		// populate with domain info
+		structType, values = data.Types["EIP712Domain"], newTypedDomainValues(data)
+	}
+	for i := 1; i < len(memberPath); i++ {
+		p := memberPath[i]
+		if int(p) >= len(structType) {
+			return nil, nested, fmt.Errorf("trezor: invalid field index %d at path %v", p, memberPath[:i+1])
+		}
+		dt, name, byteLength, arrays, err := parseType(data, structType[p])
+		if err != nil {
+			return nil, nested, err
+		}
+		if len(arrays) > 1 {
+			nested = true
+		}
+		// Descend through the array dimensions, outermost (last declared) first
+		depth := min(len(arrays), len(memberPath)-1-i)
+		i += depth
+
+		if depth < len(arrays) {
+			// Array value, return the length of the current dimension as uint16
+			items, err := values.Len(memberPath[1 : i+1])
+			if err != nil {
+				return nil, nested, fmt.Errorf("trezor: invalid array at path %v: %w", memberPath[:i+1], err)
+			}
+			if length := arrays[len(arrays)-1-depth]; length != nil && items != *length {
+				return nil, nested, fmt.Errorf("trezor: array length mismatch at path %v: have %d, want %d", memberPath[:i+1], items, *length)
+			}
+			if items > gomath.MaxUint16 {
+				return nil, nested, fmt.Errorf("trezor: array too long at path %v: %d items", memberPath[:i+1], items)
+			}
+			return binary.BigEndian.AppendUint16([]byte{}, uint16(items)), nested, nil
+		}
+		if i < len(memberPath)-1 {
+			if dt != CustomType {
+				return nil, nested, fmt.Errorf("trezor: path %v descends into %s", memberPath[:i+2], name)
+			}
+			structType = data.Types[name]
+			continue
+		}
+		next, err := values.Value(memberPath[1:])
+		if err != nil {
+			return nil, nested, fmt.Errorf("trezor: invalid value at path %v: %w", memberPath, err)
+		}
+		if next == nil {
+			return nil, nested, fmt.Errorf("trezor: missing value at path %v", memberPath)
+		}
+		// Last value, encode it as a primitive value
+		switch dt {
+		case CustomType:
+			return nil, nested, fmt.Errorf("trezor: cannot encode custom type %s at path %v", name, memberPath[:i+1])
+		case IntType, UintType, FixedPointType, UfixedPointType:
+			signed := dt == IntType || dt == FixedPointType
+			if value, err = encodeInteger(next, signed, byteLength); err != nil {
+				return nil, nested, fmt.Errorf("trezor: invalid integer at path %v: %w", memberPath[:i+1], err)
+			}
+		case AddressType:
+			address, err := parseAddress(next)
+			if err != nil {
+				return nil, nested, fmt.Errorf("trezor: invalid address at path %v: %w", memberPath[:i+1], err)
+			}
+			value = address.Bytes()
+		case FixedBytesType:
+			if f, ok := next.(float64); ok {
+				// Numeric values are left padded to the declared length
+				value = new(big.Int).SetInt64(int64(f)).Bytes()
+				if len(value) > byteLength {
+					return nil, nested, fmt.Errorf("trezor: value at path %v is too long (%d bytes, expected %d)", memberPath[:i+1], len(value), byteLength)
 				}
-				field := structType[p]
-				nextValue := structValue[field.Name]
-				dt, name, byteLength, arrays, err := parseType(data, field)
-				if err != nil {
-					return nil, err
+				for len(value) < byteLength {
+					value = append([]byte{0}, value...)
 				}
-				if len(arrays) > 1 {
-					nestedArray = true
+			} else {
+				if value, err = parseBytes(next); err != nil {
+					return nil, nested, fmt.Errorf("trezor: invalid bytes at path %v: %w", memberPath[:i+1], err)
 				}
-				for j := 0; j < len(arrays) && i < len(valueRequest.MemberPath)-1; i, j = i+1, j+1 {
-					k := reflect.TypeOf(nextValue).Kind()
-					if !(k == reflect.Array || k == reflect.Slice) {
-						return nil, fmt.Errorf("trezor: expected array at path %v, got %T", valueRequest.MemberPath[:i+1], nextValue)
-					}
-					a := reflect.ValueOf(nextValue)
-					p = valueRequest.MemberPath[i+1]
-					if int(p) >= a.Len() {
-						return nil, fmt.Errorf("trezor: invalid array index %d for path %v", p, valueRequest.MemberPath[:i+1])
-					}
-					nextValue = a.Index(int(p)).Interface()
+				if len(value) != byteLength {
+					return nil, nested, fmt.Errorf("trezor: invalid length at path %v: have %d bytes, want %d", memberPath[:i+1], len(value), byteLength)
 				}
-				k := reflect.TypeOf(nextValue).Kind()
-				if i < len(valueRequest.MemberPath)-1 {
-					if reflect.TypeOf(nextValue).Kind() != reflect.Map {
-						return nil, fmt.Errorf("trezor: expected map at path %v, got %T", valueRequest.MemberPath[:i+1], nextValue)
-					}
-					structType = data.Types[name]
-					structValue = nextValue.(apitypes.TypedDataMessage)
-				} else if k == reflect.Array || k == reflect.Slice {
-					// Array value, return length as uint16
-					value = binary.BigEndian.AppendUint16([]byte{}, uint16(reflect.ValueOf(nextValue).Len()))
+			}
+		case BoolType:
+			if b, ok := next.(bool); ok {
+				if b {
+					value = []byte{1}
 				} else {
-					// Last value, encode it as a primitive value
-					switch dt {
-					case CustomType:
-						return nil, fmt.Errorf("trezor: cannot encode custom type %s at path %v", name, valueRequest.MemberPath[:i+1])
-					case IntType, UintType, AddressType, FixedBytesType:
-						if str, ok := nextValue.(string); ok {
-							value = common.FromHex(str)
-						} else if f, ok := nextValue.(float64); ok {
-							value = new(big.Int).SetInt64(int64(f)).Bytes()
-						}
-						if len(value) > byteLength {
-							return nil, fmt.Errorf("trezor: value at path %v is too long (%d bytes, expected %d)", valueRequest.MemberPath[:i+1], len(value), byteLength)
-						}
-						for len(value) < byteLength {
-							value = append([]byte{0}, value...)
-						}
-					case BoolType:
-						if b, ok := nextValue.(bool); ok {
-							if b {
-								value = []byte{1}
-							} else {
-								value = []byte{0}
-							}
-						} else {
-							return nil, fmt.Errorf("trezor: expected bool at path %v, got %T", valueRequest.MemberPath[:i+1], nextValue)
-						}
-					case StringType:
-						if str, ok := nextValue.(string); ok {
-							value = []byte(str)
-						} else {
-							return nil, fmt.Errorf("trezor: expected string at path %v, got %T", valueRequest.MemberPath[:i+1], nextValue)
-						}
-					case BytesType:
-						if str, ok := nextValue.(string); ok {
-							value = common.FromHex(str)
-						} else {
-							return nil, fmt.Errorf("trezor: expected bytes at path %v, got %T", valueRequest.MemberPath[:i+1], nextValue)
-						}
-					}
+					value = []byte{0}
 				}
+			} else {
+				return nil, nested, fmt.Errorf("trezor: expected bool at path %v, got %T", memberPath[:i+1], next)
 			}
-			req = &trezor.EthereumTypedDataValueAck{
-				Value: value,
+		case StringType:
+			if str, ok := next.(string); ok {
+				value = []byte(str)
+			} else {
+				return nil, nested, fmt.Errorf("trezor: expected string at path %v, got %T", memberPath[:i+1], next)
+			}
+		case BytesType:
+			if value, err = parseBytes(next); err != nil {
+				return nil, nested, fmt.Errorf("trezor: invalid bytes at path %v: %w", memberPath[:i+1], err)
 			}
-		default:
-			return nil, fmt.Errorf("trezor: unexpected reply index %d", n)
 		}
+		return value, nested, nil
 	}
+	return nil, nested, fmt.Errorf("trezor: invalid member path %v", memberPath)
 }
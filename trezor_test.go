@@ -0,0 +1,1238 @@
+package usbwallet
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/base/usbwallet/trezor"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTrezorFailureUserRejected(t *testing.T) {
+	tests := []struct {
+		code     trezor.Failure_FailureType
+		rejected bool
+	}{
+		{trezor.Failure_Failure_ActionCancelled, true},
+		{trezor.Failure_Failure_DataError, false},
+		{trezor.Failure_Failure_FirmwareError, false},
+	}
+	for _, tt := range tests {
+		code := tt.code
+		err := error(&TrezorFailure{Failure: &trezor.Failure{Code: &code}})
+		if errors.Is(err, ErrUserRejected) != tt.rejected {
+			t.Errorf("%v: rejection mismatch: have %v, want %v", code, !tt.rejected, tt.rejected)
+		}
+	}
+}
+
+// newTestTrezor creates a Trezor driver connected to an emulated device which
+// answers requests with the given handler.
+func newTestTrezor(config *config, handle func(request proto.Message) proto.Message) *trezorDriver {
+	driver := newTrezorDriver(log.Root(), config).(*trezorDriver)
+	driver.device = NewMockTrezor(handle)
+	return driver
+}
+
+// testTrezorValueWalk records the typed data signing flow of an emulated Trezor.
+type testTrezorValueWalk struct {
+	values [][]byte // Message values sent by the host, in order of the requests
+	hash   []byte   // Message hash the host asked the device to display
+}
+
+// newTestTrezorValueWalk creates a Trezor driver able to sign typed data, whose
+// emulated device requests the values at the given member paths in order before
+// returning a fixed signature. The values sent are recorded in the returned walk.
+func newTestTrezorValueWalk(requests [][]uint32) (*trezorDriver, *testTrezorValueWalk) {
+	walk := new(testTrezorValueWalk)
+	driver := newTestTrezor(new(config), func(request proto.Message) proto.Message {
+		switch request := request.(type) {
+		case *trezor.EthereumSignTypedData:
+			walk.hash = request.ShowMessageHash
+		case *trezor.EthereumTypedDataValueAck:
+			walk.values = append(walk.values, request.Value)
+		case *trezor.Cancel:
+			return &trezor.Failure{Code: trezor.Failure_Failure_ActionCancelled.Enum()}
+		}
+		if len(walk.values) < len(requests) {
+			return &trezor.EthereumTypedDataValueRequest{MemberPath: requests[len(walk.values)]}
+		}
+		return &trezor.EthereumTypedDataSignature{Signature: make([]byte, 65), Address: proto.String("0x0000000000000000000000000000000000000001")}
+	})
+	driver.version = [3]uint32{2, 9, 1}
+	return driver, walk
+}
+
+// Tests that opening a Trezor in bootloader mode or without a seed fails with an
+// error telling the state of the device.
+func TestTrezorOpenDeviceState(t *testing.T) {
+	tests := []struct {
+		features *trezor.Features
+		err      error
+	}{
+		{&trezor.Features{MajorVersion: proto.Uint32(2), MinorVersion: proto.Uint32(9), PatchVersion: proto.Uint32(1), Initialized: proto.Bool(true)}, nil},
+		{&trezor.Features{MajorVersion: proto.Uint32(2), MinorVersion: proto.Uint32(9), PatchVersion: proto.Uint32(1)}, nil},
+		{&trezor.Features{MajorVersion: proto.Uint32(2), MinorVersion: proto.Uint32(9), PatchVersion: proto.Uint32(1), BootloaderMode: proto.Bool(true)}, ErrDeviceInBootloader},
+		{&trezor.Features{MajorVersion: proto.Uint32(2), MinorVersion: proto.Uint32(9), PatchVersion: proto.Uint32(1), Initialized: proto.Bool(false)}, ErrDeviceNotInitialized},
+		{&trezor.Features{MajorVersion: proto.Uint32(2), MinorVersion: proto.Uint32(9), PatchVersion: proto.Uint32(1), Initialized: proto.Bool(false), BootloaderMode: proto.Bool(true)}, ErrDeviceInBootloader},
+	}
+	for i, tt := range tests {
+		driver := newTrezorDriver(log.Root(), new(config)).(*trezorDriver)
+		device := NewMockTrezor(func(request proto.Message) proto.Message {
+			switch request.(type) {
+			case *trezor.EndSession:
+				return new(trezor.Success)
+			case *trezor.Initialize:
+				return tt.features
+			}
+			return &trezor.Failure{Code: trezor.Failure_Failure_UnexpectedMessage.Enum()}
+		})
+		if err := driver.Open(device, ""); !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
+
+// Tests that passphrase requests are answered through the configured prompt, the
+// passphrase supplied on open, or entry on the device.
+func TestTrezorPassphrase(t *testing.T) {
+	tests := []struct {
+		prompt     PassphraseFunc
+		passphrase string
+		want       *trezor.PassphraseAck
+		err        error
+	}{
+		{nil, "", nil, ErrPassphraseRequired},
+		{nil, "open", &trezor.PassphraseAck{Passphrase: proto.String("open")}, nil},
+		{func() (string, error) { return "prompt", nil }, "open", &trezor.PassphraseAck{Passphrase: proto.String("prompt")}, nil},
+		{func() (string, error) { return "", ErrPassphraseOnDevice }, "", &trezor.PassphraseAck{OnDevice: proto.Bool(true)}, nil},
+		{func() (string, error) { return "", ErrUserRejected }, "", nil, ErrUserRejected},
+	}
+	for i, tt := range tests {
+		var ack *trezor.PassphraseAck
+
+		driver := newTestTrezor(&config{passphrase: tt.prompt}, func(request proto.Message) proto.Message {
+			switch request := request.(type) {
+			case *trezor.EthereumGetAddress:
+				return new(trezor.PassphraseRequest)
+			case *trezor.PassphraseAck:
+				ack = request
+				return &trezor.EthereumAddress{Address: proto.String("0x0000000000000000000000000000000000000001")}
+			}
+			t.Fatalf("test %d: unexpected request %T", i, request)
+			return nil
+		})
+		driver.passphrase = tt.passphrase
+
+		addr, err := driver.Derive(accounts.DefaultBaseDerivationPath)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+			continue
+		}
+		if tt.err != nil {
+			continue
+		}
+		if addr != common.HexToAddress("0x01") {
+			t.Errorf("test %d: address mismatch: have %x", i, addr)
+		}
+		if !proto.Equal(ack, tt.want) {
+			t.Errorf("test %d: ack mismatch: have %v, want %v", i, ack, tt.want)
+		}
+	}
+}
+
+// Tests that PIN matrix requests are answered through the configured prompt with
+// the kind of PIN being requested.
+func TestTrezorPin(t *testing.T) {
+	tests := []struct {
+		kind trezor.PinMatrixRequest_PinMatrixRequestType
+		pin  string
+		err  error
+	}{
+		{trezor.PinMatrixRequest_PinMatrixRequestType_Current, "1397", nil},
+		{trezor.PinMatrixRequest_PinMatrixRequestType_NewFirst, "2468", nil},
+		{trezor.PinMatrixRequest_PinMatrixRequestType_NewSecond, "2468", nil},
+		{trezor.PinMatrixRequest_PinMatrixRequestType_Current, "", ErrUserRejected},
+		{trezor.PinMatrixRequest_PinMatrixRequestType_Current, "1230", errors.New("trezor: invalid PIN matrix position '0'")},
+	}
+	for i, tt := range tests {
+		var (
+			kind trezor.PinMatrixRequest_PinMatrixRequestType
+			ack  *trezor.PinMatrixAck
+		)
+		prompt := func(k trezor.PinMatrixRequest_PinMatrixRequestType) (string, error) {
+			kind = k
+			return tt.pin, nil
+		}
+		driver := newTestTrezor(&config{pin: prompt}, func(request proto.Message) proto.Message {
+			switch request := request.(type) {
+			case *trezor.EthereumGetAddress:
+				return &trezor.PinMatrixRequest{Type: tt.kind.Enum()}
+			case *trezor.PinMatrixAck:
+				ack = request
+				return &trezor.EthereumAddress{Address: proto.String("0x0000000000000000000000000000000000000001")}
+			}
+			t.Fatalf("test %d: unexpected request %T", i, request)
+			return nil
+		})
+		_, err := driver.Derive(accounts.DefaultBaseDerivationPath)
+		if kind != tt.kind {
+			t.Errorf("test %d: prompt kind mismatch: have %v, want %v", i, kind, tt.kind)
+		}
+		if tt.err != nil {
+			if err == nil || (!errors.Is(err, tt.err) && err.Error() != tt.err.Error()) {
+				t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: failed to derive: %v", i, err)
+			continue
+		}
+		if ack.GetPin() != tt.pin {
+			t.Errorf("test %d: PIN mismatch: have %q, want %q", i, ack.GetPin(), tt.pin)
+		}
+	}
+}
+
+// Tests that confirmation requests are acknowledged automatically, notifying the
+// button callback (if any) of each, even if an operation requests several.
+func TestTrezorButtonRequest(t *testing.T) {
+	codes := []trezor.ButtonRequest_ButtonRequestType{
+		trezor.ButtonRequest_ButtonRequest_ConfirmOutput,
+		trezor.ButtonRequest_ButtonRequest_SignTx,
+		trezor.ButtonRequest_ButtonRequest_Other,
+	}
+	for _, notify := range []bool{false, true} {
+		var (
+			acks     int
+			notified []trezor.ButtonRequest_ButtonRequestType
+		)
+		cfg := new(config)
+		if notify {
+			cfg.button = func(code trezor.ButtonRequest_ButtonRequestType) { notified = append(notified, code) }
+		}
+		driver := newTestTrezor(cfg, func(request proto.Message) proto.Message {
+			switch request.(type) {
+			case *trezor.EthereumSignMessage:
+				return &trezor.ButtonRequest{Code: codes[0].Enum()}
+			case *trezor.ButtonAck:
+				if acks++; acks < len(codes) {
+					return &trezor.ButtonRequest{Code: codes[acks].Enum()}
+				}
+				return &trezor.EthereumMessageSignature{Signature: make([]byte, 65), Address: proto.String("0x0000000000000000000000000000000000000001")}
+			}
+			t.Fatalf("notify %v: unexpected request %T", notify, request)
+			return nil
+		})
+		if _, err := driver.SignText(accounts.DefaultBaseDerivationPath, []byte("hello")); err != nil {
+			t.Fatalf("notify %v: failed to sign: %v", notify, err)
+		}
+		if acks != len(codes) {
+			t.Errorf("notify %v: acknowledgement count mismatch: have %d, want %d", notify, acks, len(codes))
+		}
+		var want []trezor.ButtonRequest_ButtonRequestType
+		if notify {
+			want = codes
+		}
+		if !reflect.DeepEqual(notified, want) {
+			t.Errorf("notify %v: notifications mismatch: have %v, want %v", notify, notified, want)
+		}
+	}
+}
+
+// Tests that typed data signing picks the hash signing fallback for devices with
+// Trezor One style firmware versions (including forks such as the OneKey), and
+// streams the typed data to newer ones, asking to show the message hash where
+// supported unless hidden.
+func TestTrezorSignedTypedDataVersions(t *testing.T) {
+	tests := []struct {
+		vendor  string
+		version [3]uint32
+		hide    bool // whether the HideTrezorMessageHash option is set
+		request proto.Message
+		hash    bool // whether ShowMessageHash is expected
+	}{
+		{"trezor.io", [3]uint32{1, 12, 1}, false, new(trezor.EthereumSignTypedHash), false},
+		{"onekey.so", [3]uint32{1, 9, 0}, false, new(trezor.EthereumSignTypedHash), false},
+		{"trezor.io", [3]uint32{2, 4, 3}, false, new(trezor.EthereumSignTypedData), false},
+		{"trezor.io", [3]uint32{2, 8, 7}, false, new(trezor.EthereumSignTypedData), false},
+		{"trezor.io", [3]uint32{2, 9, 1}, false, new(trezor.EthereumSignTypedData), true},
+		{"trezor.io", [3]uint32{2, 9, 1}, true, new(trezor.EthereumSignTypedData), false},
+		{"trezor.io", [3]uint32{2, 8, 7}, true, new(trezor.EthereumSignTypedData), false},
+	}
+	data := apitypes.TypedData{
+		Types: apitypes.Types{
+			"EIP712Domain": {{Name: "name", Type: "string"}},
+			"Mail":         {{Name: "contents", Type: "string"}},
+		},
+		PrimaryType: "Mail",
+		Domain:      apitypes.TypedDataDomain{Name: "test"},
+		Message:     apitypes.TypedDataMessage{"contents": "hello"},
+	}
+	for i, tt := range tests {
+		var (
+			signer uint16
+			hash   bool
+		)
+		driver := newTestTrezor(&config{hideHash: tt.hide}, func(request proto.Message) proto.Message {
+			switch request.(type) {
+			case *trezor.EndSession, *trezor.Ping:
+				return new(trezor.Success)
+			case *trezor.Initialize:
+				return &trezor.Features{
+					Vendor:       proto.String(tt.vendor),
+					MajorVersion: proto.Uint32(tt.version[0]),
+					MinorVersion: proto.Uint32(tt.version[1]),
+					PatchVersion: proto.Uint32(tt.version[2]),
+				}
+			}
+			signer = trezor.Type(request)
+			if typed, ok := request.(*trezor.EthereumSignTypedData); ok {
+				hash = typed.ShowMessageHash != nil
+			}
+			return &trezor.EthereumTypedDataSignature{Signature: make([]byte, 65), Address: proto.String("0x0000000000000000000000000000000000000001")}
+		})
+		if err := driver.Open(driver.device, ""); err != nil {
+			t.Fatalf("test %d: failed to open trezor: %v", i, err)
+		}
+		if _, err := driver.SignedTypedData(accounts.DefaultBaseDerivationPath, data); err != nil {
+			t.Fatalf("test %d: failed to sign typed data: %v", i, err)
+		}
+		if want := trezor.Type(tt.request); signer != want {
+			t.Errorf("test %d: signing request mismatch: have %s, want %s", i, trezor.Name(signer), trezor.Name(want))
+		}
+		if hash != tt.hash {
+			t.Errorf("test %d: message hash presence mismatch: have %v, want %v", i, hash, tt.hash)
+		}
+	}
+}
+
+// Tests that signed integers are sent to the Trezor as two's complement numbers
+// of the declared width.
+func TestTrezorSignedTypedDataNegativeInt(t *testing.T) {
+	data := apitypes.TypedData{
+		Types: apitypes.Types{
+			"EIP712Domain": {{Name: "name", Type: "string"}},
+			"Value":        {{Name: "value", Type: "int256"}},
+		},
+		PrimaryType: "Value",
+		Domain:      apitypes.TypedDataDomain{Name: "test"},
+		Message:     apitypes.TypedDataMessage{"value": float64(-1)},
+	}
+	var (
+		value     []byte
+		cancelled int
+	)
+	driver := newTestTrezor(new(config), func(request proto.Message) proto.Message {
+		switch request := request.(type) {
+		case *trezor.EthereumSignTypedData:
+			return &trezor.EthereumTypedDataValueRequest{MemberPath: []uint32{1, 0}}
+		case *trezor.EthereumTypedDataValueAck:
+			value = request.Value
+			return &trezor.EthereumTypedDataSignature{Signature: make([]byte, 65), Address: proto.String("0x0000000000000000000000000000000000000001")}
+		case *trezor.Cancel:
+			cancelled++
+			return &trezor.Failure{Code: trezor.Failure_Failure_ActionCancelled.Enum()}
+		}
+		t.Fatalf("unexpected request %T", request)
+		return nil
+	})
+	driver.version = [3]uint32{2, 9, 1}
+
+	if _, err := driver.SignedTypedData(accounts.DefaultBaseDerivationPath, data); err != nil {
+		t.Fatalf("failed to sign typed data: %v", err)
+	}
+	if want := bytes.Repeat([]byte{0xff}, 32); !bytes.Equal(value, want) {
+		t.Fatalf("value mismatch: have %x, want %x", value, want)
+	}
+	// Ensure values overflowing the declared width are rejected
+	data.Types["Value"][0].Type = "int8"
+	data.Message["value"] = float64(-129)
+	if _, err := driver.SignedTypedData(accounts.DefaultBaseDerivationPath, data); err == nil {
+		t.Fatalf("overflowing value accepted")
+	}
+	// The device was waiting for the value, so the workflow must be cancelled
+	if cancelled != 1 {
+		t.Fatalf("cancellation count mismatch: have %d, want 1", cancelled)
+	}
+}
+
+// Tests that typed data built in code with raw byte values is signed, and that
+// fixed size bytes of the wrong length are rejected.
+func TestTrezorSignedTypedDataRawBytes(t *testing.T) {
+	data := apitypes.TypedData{
+		Types: apitypes.Types{
+			"EIP712Domain": {{Name: "name", Type: "string"}},
+			"Call":         {{Name: "data", Type: "bytes"}, {Name: "salt", Type: "bytes32"}, {Name: "selector", Type: "bytes4"}},
+		},
+		PrimaryType: "Call",
+		Domain:      apitypes.TypedDataDomain{Name: "test"},
+		Message: apitypes.TypedDataMessage{
+			"data":     []byte{1, 2, 3},
+			"salt":     common.Hash{31: 7},
+			"selector": []byte{0xa9, 0x05, 0x9c, 0xbb},
+		},
+	}
+	requests := [][]uint32{{1, 0}, {1, 1}, {1, 2}}
+	driver, walk := newTestTrezorValueWalk(requests)
+
+	if _, err := driver.SignedTypedData(accounts.DefaultBaseDerivationPath, data); err != nil {
+		t.Fatalf("failed to sign typed data: %v", err)
+	}
+	want := [][]byte{{1, 2, 3}, common.Hash{31: 7}.Bytes(), {0xa9, 0x05, 0x9c, 0xbb}}
+	if !reflect.DeepEqual(walk.values, want) {
+		t.Fatalf("values mismatch: have %x, want %x", walk.values, want)
+	}
+	// Ensure fixed size bytes not matching the declared length are rejected
+	data.Message["selector"] = []byte{0xa9, 0x05, 0x9c}
+	if _, err := driver.SignedTypedData(accounts.DefaultBaseDerivationPath, data); err == nil {
+		t.Fatalf("short fixed size bytes accepted")
+	}
+}
+
+// Tests that typed data decoded with json.Decoder.UseNumber is encoded at full
+// precision.
+func TestTrezorSignedTypedDataJSONNumber(t *testing.T) {
+	const message = `{
+		"types": {
+			"EIP712Domain": [{"name": "name", "type": "string"}],
+			"Value": [{"name": "amount", "type": "uint256"}, {"name": "delta", "type": "int8"}]
+		},
+		"primaryType": "Value",
+		"domain": {"name": "test"},
+		"message": {"amount": 123456789012345678901234567890, "delta": -2}
+	}`
+	decoder := json.NewDecoder(strings.NewReader(message))
+	decoder.UseNumber()
+
+	var data apitypes.TypedData
+	if err := decoder.Decode(&data); err != nil {
+		t.Fatalf("failed to decode typed data: %v", err)
+	}
+	requests := [][]uint32{{1, 0}, {1, 1}}
+	driver, walk := newTestTrezorValueWalk(requests)
+
+	if _, err := driver.SignedTypedData(accounts.DefaultBaseDerivationPath, data); err != nil {
+		t.Fatalf("failed to sign typed data: %v", err)
+	}
+	amount, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	want := [][]byte{common.LeftPadBytes(amount.Bytes(), 32), {0xfe}}
+	for i := range want {
+		if !bytes.Equal(walk.values[i], want[i]) {
+			t.Errorf("value %v mismatch: have %x, want %x", requests[i], walk.values[i], want[i])
+		}
+	}
+}
+
+// Tests that the value requests of a Trezor are answered identically whether the
+// message values are pulled on demand or decoded into memory.
+func TestTrezorSignedTypedDataStream(t *testing.T) {
+	requests := [][]uint32{{0, 0}, {1, 0}, {1, 1}, {1, 1, 2, 1}, {1, 1, 3, 2}, {1, 1, 3, 2, 1}}
+	sign := func(sign func(driver *trezorDriver) error) ([][]byte, []byte) {
+		driver, walk := newTestTrezorValueWalk(requests)
+		if err := sign(driver); err != nil {
+			t.Fatalf("failed to sign typed data: %v", err)
+		}
+		return walk.values, walk.hash
+	}
+	stream := &testTypedDataStream{legs: 4}
+	data := newTestStreamTypedData()
+	data.Message = stream.message()
+
+	want, wantHash := sign(func(driver *trezorDriver) error {
+		_, err := driver.SignedTypedData(accounts.DefaultBaseDerivationPath, data)
+		return err
+	})
+	have, haveHash := sign(func(driver *trezorDriver) error {
+		_, err := driver.SignedTypedDataStream(accounts.DefaultBaseDerivationPath, newTestStreamTypedData(), stream)
+		return err
+	})
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("values mismatch: have %x, want %x", have, want)
+	}
+	if !bytes.Equal(haveHash, wantHash) {
+		t.Errorf("message hash mismatch: have %x, want %x", haveHash, wantHash)
+	}
+}
+
+// Tests that the values of struct array members are resolved whether the structs
+// are decoded from JSON or built programmatically as typed data messages.
+func TestTrezorSignedTypedDataStructArray(t *testing.T) {
+	alice := apitypes.TypedDataMessage{"name": "alice", "wallet": "0x0000000000000000000000000000000000000001"}
+	bob := map[string]interface{}{"name": "bob", "wallet": "0x0000000000000000000000000000000000000002"}
+
+	tests := []interface{}{
+		[]interface{}{map[string]interface{}(alice), bob},
+		[]apitypes.TypedDataMessage{alice, bob},
+	}
+	for i, members := range tests {
+		data := apitypes.TypedData{
+			Types: apitypes.Types{
+				"EIP712Domain": {{Name: "name", Type: "string"}},
+				"Group":        {{Name: "members", Type: "Person[2]"}},
+				"Person":       {{Name: "name", Type: "string"}, {Name: "wallet", Type: "address"}},
+			},
+			PrimaryType: "Group",
+			Domain:      apitypes.TypedDataDomain{Name: "test"},
+			Message:     apitypes.TypedDataMessage{"members": members},
+		}
+		requests := [][]uint32{{1, 0}, {1, 0, 0, 0}, {1, 0, 1, 0}, {1, 0, 1, 1}}
+		driver, walk := newTestTrezorValueWalk(requests)
+
+		if _, err := driver.SignedTypedData(accounts.DefaultBaseDerivationPath, data); err != nil {
+			t.Fatalf("test %d: failed to sign typed data: %v", i, err)
+		}
+		want := [][]byte{{0, 2}, []byte("alice"), []byte("bob"), common.HexToAddress("0x02").Bytes()}
+		if !reflect.DeepEqual(walk.values, want) {
+			t.Errorf("test %d: walk.values mismatch: have %x, want %x", i, walk.values, want)
+		}
+	}
+}
+
+// Tests that the values of multi-dimensional arrays are resolved by descending
+// through each dimension, outermost first.
+func TestTrezorSignedTypedDataNestedArrays(t *testing.T) {
+	matrix := []interface{}{
+		[]interface{}{float64(1), float64(2)},
+		[]interface{}{float64(3), float64(4)},
+		[]interface{}{float64(5), float64(6)},
+	}
+	data := apitypes.TypedData{
+		Types: apitypes.Types{
+			"EIP712Domain": {{Name: "name", Type: "string"}},
+			"Matrix":       {{Name: "values", Type: "uint256[2][3]"}},
+		},
+		PrimaryType: "Matrix",
+		Domain:      apitypes.TypedDataDomain{Name: "test"},
+		Message:     apitypes.TypedDataMessage{"values": matrix},
+	}
+	requests := [][]uint32{{1, 0}, {1, 0, 2}, {1, 0, 2, 1}}
+	driver, walk := newTestTrezorValueWalk(requests)
+
+	if _, err := driver.SignedTypedData(accounts.DefaultBaseDerivationPath, data); err != nil {
+		t.Fatalf("failed to sign typed data: %v", err)
+	}
+	want := [][]byte{{0, 3}, {0, 2}, append(make([]byte, 31), 6)}
+	for i := range want {
+		if !bytes.Equal(walk.values[i], want[i]) {
+			t.Errorf("value %v mismatch: have %x, want %x", requests[i], walk.values[i], want[i])
+		}
+	}
+	// Ensure fixed size dimensions not matching the declared length are rejected
+	data.Message["values"] = matrix[:2]
+	walk.values = nil
+	if _, err := driver.SignedTypedData(accounts.DefaultBaseDerivationPath, data); err == nil {
+		t.Fatalf("array with invalid length accepted")
+	}
+}
+
+// Tests that bytes values given as base64 or raw bytes are streamed to the Trezor
+// decoded, the same as their hex form.
+func TestTrezorSignedTypedDataBase64(t *testing.T) {
+	for i, message := range []apitypes.TypedDataMessage{
+		{"data": "0x0102030405", "selector": "0xa9059cbb"},
+		{"data": "AQIDBAU=", "selector": "qQWcuw=="},
+		{"data": []byte{1, 2, 3, 4, 5}, "selector": []byte{0xa9, 0x05, 0x9c, 0xbb}},
+	} {
+		data := apitypes.TypedData{
+			Types: apitypes.Types{
+				"EIP712Domain": {{Name: "name", Type: "string"}},
+				"Call":         {{Name: "data", Type: "bytes"}, {Name: "selector", Type: "bytes4"}},
+			},
+			PrimaryType: "Call",
+			Domain:      apitypes.TypedDataDomain{Name: "test"},
+			Message:     message,
+		}
+		requests := [][]uint32{{1, 0}, {1, 1}}
+		driver, walk := newTestTrezorValueWalk(requests)
+
+		if _, err := driver.SignedTypedData(accounts.DefaultBaseDerivationPath, data); err != nil {
+			t.Fatalf("test %d: failed to sign typed data: %v", i, err)
+		}
+		want := [][]byte{{1, 2, 3, 4, 5}, {0xa9, 0x05, 0x9c, 0xbb}}
+		if !reflect.DeepEqual(walk.values, want) {
+			t.Errorf("test %d: walk.values mismatch: have %x, want %x", i, walk.values, want)
+		}
+	}
+}
+
+// Tests that the device info reports the model and firmware version from the
+// features, refreshed by the heartbeat.
+func TestTrezorDeviceInfo(t *testing.T) {
+	features := &trezor.Features{
+		Model:         proto.String("Safe 5"),
+		InternalModel: proto.String("T3T1"),
+		MajorVersion:  proto.Uint32(2),
+		MinorVersion:  proto.Uint32(8),
+		PatchVersion:  proto.Uint32(7),
+	}
+	driver := newTestTrezor(new(config), func(request proto.Message) proto.Message {
+		switch request.(type) {
+		case *trezor.EndSession:
+			return new(trezor.Success)
+		case *trezor.Initialize, *trezor.GetFeatures:
+			return features
+		}
+		t.Fatalf("unexpected request %T", request)
+		return nil
+	})
+	if err := driver.Open(driver.device, ""); err != nil {
+		t.Fatalf("failed to open trezor: %v", err)
+	}
+	if info, want := driver.DeviceInfo(), (DeviceInfo{Model: "Trezor Safe 5", Firmware: "2.8.7"}); info != want {
+		t.Fatalf("device info mismatch: have %+v, want %+v", info, want)
+	}
+	features.PatchVersion = proto.Uint32(8)
+	if err := driver.Heartbeat(); err != nil {
+		t.Fatalf("failed to check trezor health: %v", err)
+	}
+	if info := driver.DeviceInfo(); info.Firmware != "2.8.8" {
+		t.Fatalf("firmware version not refreshed: have %s, want 2.8.8", info.Firmware)
+	}
+}
+
+// Tests that the supported features are derived from the firmware version, Trezor
+// One style firmwares only signing typed data hashes.
+func TestTrezorCapabilities(t *testing.T) {
+	tests := []struct {
+		version [3]uint32
+		native  bool
+		eip1559 bool
+	}{
+		{[3]uint32{1, 10, 3}, false, false},
+		{[3]uint32{1, 12, 1}, false, true},
+		{[3]uint32{2, 4, 1}, false, false},
+		{[3]uint32{2, 4, 2}, false, true},
+		{[3]uint32{2, 4, 3}, true, true},
+		{[3]uint32{2, 9, 0}, true, true},
+		{[3]uint32{2, 9, 1}, true, true},
+		{[3]uint32{2, 10, 0}, true, true},
+		{[3]uint32{3, 0, 0}, true, true},
+	}
+	for i, tt := range tests {
+		driver := newTestTrezor(new(config), func(request proto.Message) proto.Message {
+			switch request.(type) {
+			case *trezor.EndSession:
+				return new(trezor.Success)
+			case *trezor.Initialize:
+				return &trezor.Features{MajorVersion: proto.Uint32(tt.version[0]), MinorVersion: proto.Uint32(tt.version[1]), PatchVersion: proto.Uint32(tt.version[2])}
+			}
+			t.Fatalf("test %d: unexpected request %T", i, request)
+			return nil
+		})
+		if err := driver.Open(driver.device, ""); err != nil {
+			t.Fatalf("test %d: failed to open trezor: %v", i, err)
+		}
+		want := Capabilities{TypedDataNative: tt.native, NestedArrays: tt.native, DynamicFeeTx: tt.eip1559}
+		if caps := driver.Capabilities(); caps != want {
+			t.Errorf("test %d: capabilities mismatch: have %+v, want %+v", i, caps, want)
+		}
+	}
+}
+
+// Tests that derivation paths the Trezor can't derive are rejected before any
+// request is sent to the device.
+func TestTrezorPathValidation(t *testing.T) {
+	var requests int
+	driver := newTestTrezor(new(config), func(request proto.Message) proto.Message {
+		requests++
+		return new(trezor.Success)
+	})
+	for _, length := range []int{0, 9} {
+		path := make(accounts.DerivationPath, length)
+
+		if _, err := driver.Derive(path); !errors.Is(err, ErrInvalidDerivationPath) {
+			t.Errorf("length %d: derive error mismatch: have %v, want %v", length, err, ErrInvalidDerivationPath)
+		}
+		if _, err := driver.SignText(path, []byte("hello")); !errors.Is(err, ErrInvalidDerivationPath) {
+			t.Errorf("length %d: sign error mismatch: have %v, want %v", length, err, ErrInvalidDerivationPath)
+		}
+	}
+	if requests != 0 {
+		t.Errorf("%d requests sent for invalid paths", requests)
+	}
+}
+
+// Tests that attestations carry the firmware details of the Trezor, along with the
+// proof of authenticity of devices supporting it, and that the proof's failures
+// other than the request being unknown are reported.
+func TestTrezorAttestation(t *testing.T) {
+	challenge := []byte("attestation challenge")
+	proof := &trezor.AuthenticityProof{
+		Certificates: [][]byte{{0x30, 0x01}, {0x30, 0x02}},
+		Signature:    []byte{0x30, 0x03},
+	}
+	tests := []struct {
+		reply proto.Message // Reply to the authentication request
+		proof bool          // Whether the proof is expected in the attestation
+		fail  bool          // Whether the attestation is expected to fail
+	}{
+		{proof, true, false},
+		{&trezor.Failure{Code: trezor.Failure_Failure_UnexpectedMessage.Enum()}, false, false},
+		{&trezor.Failure{Code: trezor.Failure_Failure_ProcessError.Enum()}, false, true},
+	}
+	for i, tt := range tests {
+		driver := newTestTrezor(new(config), func(request proto.Message) proto.Message {
+			switch request := request.(type) {
+			case *trezor.GetFeatures:
+				return &trezor.Features{
+					Vendor:           proto.String("trezor.io"),
+					MajorVersion:     proto.Uint32(2),
+					MinorVersion:     proto.Uint32(8),
+					PatchVersion:     proto.Uint32(1),
+					InternalModel:    proto.String("T3T1"),
+					Revision:         []byte{0xab, 0xcd},
+					BootloaderHash:   []byte{0x12, 0x34},
+					BootloaderLocked: proto.Bool(true),
+				}
+			case *trezor.AuthenticateDevice:
+				if !bytes.Equal(request.Challenge, challenge) {
+					t.Errorf("test %d: challenge mismatch: have %q, want %q", i, request.Challenge, challenge)
+				}
+				return tt.reply
+			}
+			t.Fatalf("test %d: unexpected request %T", i, request)
+			return nil
+		})
+		attestation, err := driver.Attestation(challenge)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("test %d: expected failure, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: failed to attest: %v", i, err)
+			continue
+		}
+		want := &Attestation{
+			Challenge:        challenge,
+			Vendor:           "trezor.io",
+			Model:            "T3T1",
+			Revision:         []byte{0xab, 0xcd},
+			BootloaderHash:   []byte{0x12, 0x34},
+			BootloaderLocked: true,
+		}
+		if tt.proof {
+			want.Certificates, want.Signature = proof.Certificates, proof.Signature
+		}
+		if !reflect.DeepEqual(attestation, want) {
+			t.Errorf("test %d: attestation mismatch: have %+v, want %+v", i, attestation, want)
+		}
+	}
+}
+
+// Tests that the public key on a derivation path is retrieved from the device and
+// rejected if it doesn't belong to the address derived on the same path.
+func TestTrezorPublicKey(t *testing.T) {
+	key, _ := crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	other, _ := crypto.GenerateKey()
+
+	tests := []struct {
+		address common.Address // Address reported by the device
+		valid   bool           // Whether the public key should be accepted
+	}{
+		{crypto.PubkeyToAddress(key.PublicKey), true},
+		{crypto.PubkeyToAddress(other.PublicKey), false},
+	}
+	for i, tt := range tests {
+		var display bool
+		driver := newTestTrezor(new(config), func(request proto.Message) proto.Message {
+			switch request := request.(type) {
+			case *trezor.EthereumGetAddress:
+				display = request.GetShowDisplay()
+				return &trezor.EthereumAddress{Address: proto.String(tt.address.Hex())}
+			case *trezor.EthereumGetPublicKey:
+				return &trezor.EthereumPublicKey{Xpub: proto.String(""), Node: &trezor.HDNodeType{
+					Depth:       proto.Uint32(5),
+					Fingerprint: proto.Uint32(0),
+					ChildNum:    proto.Uint32(0),
+					ChainCode:   make([]byte, 32),
+					PublicKey:   crypto.CompressPubkey(&key.PublicKey),
+				}}
+			}
+			return &trezor.Failure{Code: trezor.Failure_Failure_UnexpectedMessage.Enum()}
+		})
+		pubkey, err := driver.PublicKey(accounts.DefaultBaseDerivationPath)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("test %d: mismatching public key accepted", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: failed to retrieve public key: %v", i, err)
+			continue
+		}
+		if !pubkey.Equal(&key.PublicKey) {
+			t.Errorf("test %d: public key mismatch: have %x, want %x", i, crypto.FromECDSAPub(pubkey), crypto.FromECDSAPub(&key.PublicKey))
+		}
+		if display {
+			t.Errorf("test %d: address displayed on the device", i)
+		}
+	}
+}
+
+// cancelTestDevice wraps an emulated Trezor, holding back the reply to a button
+// acknowledgement until a Cancel message arrives, as the device does while its
+// user looks at the prompt. Cancel messages are swallowed, the real device only
+// failing the pending request in response.
+type cancelTestDevice struct {
+	*MockTransport
+
+	acked     chan struct{} // Closed when the button request is acknowledged
+	cancelled chan struct{} // Closed when a Cancel message arrives
+	cancels   int           // Number of Cancel messages received
+	lock      sync.Mutex    // Protects the cancel counter
+}
+
+// Write implements io.Writer, intercepting the Cancel messages.
+func (d *cancelTestDevice) Write(chunk []byte) (int, error) {
+	if chunk[1] == 0x23 && chunk[2] == 0x23 {
+		switch binary.BigEndian.Uint16(chunk[3:5]) {
+		case uint16(trezor.MessageType_MessageType_Cancel):
+			d.lock.Lock()
+			if d.cancels++; d.cancels == 1 {
+				close(d.cancelled)
+			}
+			d.lock.Unlock()
+			return len(chunk), nil
+
+		case uint16(trezor.MessageType_MessageType_ButtonAck):
+			defer close(d.acked)
+		}
+	}
+	return d.MockTransport.Write(chunk)
+}
+
+// Read implements io.Reader, blocking after a button acknowledgement until the
+// request is cancelled.
+func (d *cancelTestDevice) Read(buf []byte) (int, error) {
+	select {
+	case <-d.acked:
+		<-d.cancelled
+	default:
+	}
+	return d.MockTransport.Read(buf)
+}
+
+// Tests that a signature waiting for confirmation on a Trezor can be cancelled,
+// and that cancelling an idle device sends nothing.
+func TestTrezorCancel(t *testing.T) {
+	device := &cancelTestDevice{
+		MockTransport: NewMockTrezor(func(request proto.Message) proto.Message {
+			switch request.(type) {
+			case *trezor.EthereumSignMessage:
+				return &trezor.ButtonRequest{}
+			case *trezor.ButtonAck:
+				return &trezor.Failure{Code: trezor.Failure_Failure_ActionCancelled.Enum()}
+			}
+			return &trezor.Failure{Code: trezor.Failure_Failure_UnexpectedMessage.Enum()}
+		}),
+		acked:     make(chan struct{}),
+		cancelled: make(chan struct{}),
+	}
+	driver := newTrezorDriver(log.Root(), new(config)).(*trezorDriver)
+	driver.device = device
+
+	if err := driver.Cancel(); err != nil {
+		t.Fatalf("failed to cancel idle device: %v", err)
+	}
+	if device.cancels != 0 {
+		t.Fatalf("cancel sent to idle device")
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := driver.SignText(accounts.DefaultBaseDerivationPath, []byte("hello"))
+		errc <- err
+	}()
+	<-device.acked
+	if err := driver.Cancel(); err != nil {
+		t.Fatalf("failed to cancel signature: %v", err)
+	}
+	if err := <-errc; !errors.Is(err, ErrUserRejected) {
+		t.Fatalf("cancelled signature error mismatch: have %v, want %v", err, ErrUserRejected)
+	}
+	if device.cancels != 1 {
+		t.Fatalf("cancel count mismatch: have %d, want 1", device.cancels)
+	}
+}
+
+// racedTestDevice wraps an emulated Trezor, holding back its reply to a request
+// until a Cancel message arrives, as if the reply was already on its way when the
+// request was cancelled. The device answers the Cancel on its own, as it's idle.
+type racedTestDevice struct {
+	*MockTransport
+
+	cancelled chan struct{} // Closed when the first Cancel message arrives
+	once      sync.Once     // Guards closing the cancel channel
+}
+
+// Write implements io.Writer, intercepting the Cancel messages.
+func (d *racedTestDevice) Write(chunk []byte) (int, error) {
+	n, err := d.MockTransport.Write(chunk)
+	if chunk[1] == 0x23 && chunk[2] == 0x23 && binary.BigEndian.Uint16(chunk[3:5]) == uint16(trezor.MessageType_MessageType_Cancel) {
+		d.once.Do(func() { close(d.cancelled) })
+	}
+	return n, err
+}
+
+// Read implements io.Reader, blocking until the request is cancelled.
+func (d *racedTestDevice) Read(buf []byte) (int, error) {
+	<-d.cancelled
+	return d.MockTransport.Read(buf)
+}
+
+// Tests that cancelling a request whose reply was already on its way returns the
+// reply, and that the failure the device answers the Cancel with is drained
+// instead of being taken as the reply to the next request.
+func TestTrezorCancelRaced(t *testing.T) {
+	signature := &trezor.EthereumMessageSignature{Signature: make([]byte, 65), Address: proto.String(common.Address{}.Hex())}
+	device := &racedTestDevice{
+		MockTransport: NewMockTrezor(func(request proto.Message) proto.Message {
+			switch request.(type) {
+			case *trezor.EthereumSignMessage:
+				return signature
+			case *trezor.Cancel:
+				return &trezor.Failure{Code: trezor.Failure_Failure_ActionCancelled.Enum()}
+			}
+			return &trezor.Failure{Code: trezor.Failure_Failure_UnexpectedMessage.Enum()}
+		}),
+		cancelled: make(chan struct{}),
+	}
+	driver := newTrezorDriver(log.Root(), new(config)).(*trezorDriver)
+	driver.device = device
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := driver.SignText(accounts.DefaultBaseDerivationPath, []byte("hello"))
+		errc <- err
+	}()
+	for sent := false; !sent; time.Sleep(time.Millisecond) {
+		var err error
+		if sent, err = driver.trezorCancel(0); err != nil {
+			t.Fatalf("failed to cancel signature: %v", err)
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("raced signature failed: %v", err)
+	}
+	if _, err := driver.SignText(accounts.DefaultBaseDerivationPath, []byte("hello")); err != nil {
+		t.Fatalf("failed to sign after raced cancellation: %v", err)
+	}
+}
+
+// Tests that a signature left unconfirmed on a Trezor beyond the interactive
+// timeout is cancelled on the device.
+func TestTrezorTimeouts(t *testing.T) {
+	device := &cancelTestDevice{
+		MockTransport: NewMockTrezor(func(request proto.Message) proto.Message {
+			switch request.(type) {
+			case *trezor.EthereumSignMessage:
+				return &trezor.ButtonRequest{}
+			case *trezor.ButtonAck:
+				return &trezor.Failure{Code: trezor.Failure_Failure_ActionCancelled.Enum()}
+			}
+			return &trezor.Failure{Code: trezor.Failure_Failure_UnexpectedMessage.Enum()}
+		}),
+		acked:     make(chan struct{}),
+		cancelled: make(chan struct{}),
+	}
+	driver := newTrezorDriver(log.Root(), &config{timeouts: Timeouts{Interactive: 50 * time.Millisecond}}).(*trezorDriver)
+	driver.device = device
+
+	if _, err := driver.SignText(accounts.DefaultBaseDerivationPath, []byte("hello")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expired signature error mismatch: have %v, want %v", err, context.DeadlineExceeded)
+	}
+	if device.cancels != 1 {
+		t.Fatalf("cancel count mismatch: have %d, want 1", device.cancels)
+	}
+}
+
+// Tests that dynamic fee transactions are signed through the EIP-1559 request,
+// streaming the payload beyond the initial chunk, and that firmwares predating
+// it reject them.
+func TestTrezorSignDynamicFeeTx(t *testing.T) {
+	key, _ := crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	to := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	tx := types.NewTx(&types.DynamicFeeTx{
+		ChainID:   big.NewInt(8453),
+		Nonce:     7,
+		GasTipCap: big.NewInt(1),
+		GasFeeCap: big.NewInt(2),
+		Gas:       100000,
+		To:        &to,
+		Value:     big.NewInt(3),
+		Data:      bytes.Repeat([]byte{0xaa}, 1500),
+		AccessList: types.AccessList{{
+			Address:     to,
+			StorageKeys: []common.Hash{{0x01}},
+		}},
+	})
+	signer := types.LatestSignerForChainID(big.NewInt(8453))
+
+	tests := []struct {
+		version [3]uint32
+		ok      bool // Whether the firmware signs EIP-1559 transactions
+	}{
+		{[3]uint32{2, 4, 1}, false},
+		{[3]uint32{2, 8, 7}, true},
+	}
+	for i, tt := range tests {
+		var (
+			request *trezor.EthereumSignTxEIP1559
+			chunks  [][]byte
+		)
+		driver := newTestTrezor(new(config), func(msg proto.Message) proto.Message {
+			switch msg := msg.(type) {
+			case *trezor.EndSession:
+				return new(trezor.Success)
+			case *trezor.Initialize:
+				return &trezor.Features{MajorVersion: proto.Uint32(tt.version[0]), MinorVersion: proto.Uint32(tt.version[1]), PatchVersion: proto.Uint32(tt.version[2])}
+			case *trezor.EthereumSignTxEIP1559:
+				request = msg
+				return &trezor.EthereumTxRequest{DataLength: proto.Uint32(uint32(msg.GetDataLength()) - uint32(len(msg.DataInitialChunk)))}
+			case *trezor.EthereumTxAck:
+				chunks = append(chunks, msg.DataChunk)
+
+				sig, err := crypto.Sign(signer.Hash(tx).Bytes(), key)
+				if err != nil {
+					t.Fatalf("test %d: failed to sign: %v", i, err)
+				}
+				return &trezor.EthereumTxRequest{SignatureV: proto.Uint32(uint32(sig[64])), SignatureR: sig[:32], SignatureS: sig[32:64]}
+			}
+			t.Fatalf("test %d: unexpected request %T", i, msg)
+			return nil
+		})
+		if err := driver.Open(driver.device, ""); err != nil {
+			t.Fatalf("test %d: failed to open trezor: %v", i, err)
+		}
+		sender, signed, err := driver.SignTx(accounts.DefaultBaseDerivationPath, tx, big.NewInt(8453))
+		if !tt.ok {
+			if err == nil || request != nil {
+				t.Fatalf("test %d: EIP-1559 transaction signed by old firmware", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test %d: failed to sign transaction: %v", i, err)
+		}
+		if want := crypto.PubkeyToAddress(key.PublicKey); sender != want {
+			t.Errorf("test %d: sender mismatch: have %x, want %x", i, sender, want)
+		}
+		if signed.Type() != types.DynamicFeeTxType || signed.Hash() == tx.Hash() {
+			t.Errorf("test %d: transaction not signed as dynamic fee", i)
+		}
+		if new(big.Int).SetBytes(request.MaxGasFee).Int64() != 2 || new(big.Int).SetBytes(request.MaxPriorityFee).Int64() != 1 || request.GetChainId() != 8453 {
+			t.Errorf("test %d: fee fields mismatch: %v", i, request)
+		}
+		if len(request.AccessList) != 1 || request.AccessList[0].GetAddress() != to.Hex() || !bytes.Equal(request.AccessList[0].StorageKeys[0], common.Hash{0x01}.Bytes()) {
+			t.Errorf("test %d: access list mismatch: %v", i, request.AccessList)
+		}
+		if data := append(append([]byte{}, request.DataInitialChunk...), bytes.Join(chunks, nil)...); !bytes.Equal(data, tx.Data()) {
+			t.Errorf("test %d: streamed payload mismatch", i)
+		}
+	}
+}
+
+// Tests that access lists of any size round trip through the EIP-1559 request,
+// and that EIP-2930 transactions, which the firmware can't sign, are rejected
+// before anything is sent to the device.
+func TestTrezorSignAccessLists(t *testing.T) {
+	key, _ := crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	to := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	chainID := big.NewInt(8453)
+	signer := types.LatestSignerForChainID(chainID)
+
+	large := make(types.AccessList, 64)
+	for i := range large {
+		large[i].Address = common.BigToAddress(big.NewInt(int64(i)))
+		for j := 0; j < 4; j++ {
+			large[i].StorageKeys = append(large[i].StorageKeys, common.BigToHash(big.NewInt(int64(i*4+j))))
+		}
+	}
+	for i, list := range []types.AccessList{nil, large} {
+		tx := types.NewTx(&types.DynamicFeeTx{ChainID: chainID, Gas: 100000, GasFeeCap: big.NewInt(2), GasTipCap: big.NewInt(1), To: &to, Data: bytes.Repeat([]byte{0xbb}, 2500), AccessList: list})
+
+		var (
+			request *trezor.EthereumSignTxEIP1559
+			data    []byte
+		)
+		driver := newTestTrezor(new(config), func(msg proto.Message) proto.Message {
+			switch msg := msg.(type) {
+			case *trezor.EndSession:
+				return new(trezor.Success)
+			case *trezor.Initialize:
+				return &trezor.Features{MajorVersion: proto.Uint32(2), MinorVersion: proto.Uint32(8), PatchVersion: proto.Uint32(7)}
+			case *trezor.EthereumSignTxEIP1559:
+				request, data = msg, msg.DataInitialChunk
+			case *trezor.EthereumTxAck:
+				data = append(data, msg.DataChunk...)
+			default:
+				t.Fatalf("test %d: unexpected request %T", i, msg)
+			}
+			// Request the payload in chunks of at most 1024 bytes, then sign
+			if remaining := int(request.GetDataLength()) - len(data); remaining > 0 {
+				return &trezor.EthereumTxRequest{DataLength: proto.Uint32(uint32(min(remaining, 1024)))}
+			}
+			sig, err := crypto.Sign(signer.Hash(tx).Bytes(), key)
+			if err != nil {
+				t.Fatalf("test %d: failed to sign: %v", i, err)
+			}
+			return &trezor.EthereumTxRequest{SignatureV: proto.Uint32(uint32(sig[64])), SignatureR: sig[:32], SignatureS: sig[32:64]}
+		})
+		if err := driver.Open(driver.device, ""); err != nil {
+			t.Fatalf("test %d: failed to open trezor: %v", i, err)
+		}
+		_, signed, err := driver.SignTx(accounts.DefaultBaseDerivationPath, tx, chainID)
+		if err != nil {
+			t.Fatalf("test %d: failed to sign transaction: %v", i, err)
+		}
+		if sender, err := types.Sender(signer, signed); err != nil || sender != crypto.PubkeyToAddress(key.PublicKey) {
+			t.Errorf("test %d: recovered signer mismatch: have %x (%v), want %x", i, sender, err, crypto.PubkeyToAddress(key.PublicKey))
+		}
+		if len(request.AccessList) != len(list) {
+			t.Fatalf("test %d: access list length mismatch: have %d, want %d", i, len(request.AccessList), len(list))
+		}
+		for j, tuple := range list {
+			entry := request.AccessList[j]
+			if entry.GetAddress() != tuple.Address.Hex() || len(entry.StorageKeys) != len(tuple.StorageKeys) {
+				t.Fatalf("test %d: access list entry %d mismatch: have %v, want %v", i, j, entry, tuple)
+			}
+			for k, slot := range tuple.StorageKeys {
+				if !bytes.Equal(entry.StorageKeys[k], slot.Bytes()) {
+					t.Errorf("test %d: entry %d storage key %d mismatch: have %x, want %x", i, j, k, entry.StorageKeys[k], slot)
+				}
+			}
+		}
+		if !bytes.Equal(data, tx.Data()) {
+			t.Errorf("test %d: streamed payload mismatch", i)
+		}
+	}
+	// EIP-2930 transactions have no signing request on the device
+	requests := 0
+	driver := newTestTrezor(new(config), func(msg proto.Message) proto.Message {
+		requests++
+		return new(trezor.Success)
+	})
+	tx := types.NewTx(&types.AccessListTx{ChainID: chainID, Gas: 21000, GasPrice: big.NewInt(1), To: &to, AccessList: large})
+	if _, _, err := driver.SignTx(accounts.DefaultBaseDerivationPath, tx, chainID); !errors.Is(err, accounts.ErrNotSupported) {
+		t.Errorf("access list transaction error mismatch: have %v, want %v", err, accounts.ErrNotSupported)
+	}
+	if requests != 0 {
+		t.Errorf("%d requests sent for an unsupported transaction", requests)
+	}
+}
+
+// Tests that a transaction sign interrupted while streaming its payload cancels
+// the workflow on the device, so the next sign on the same connection succeeds.
+func TestTrezorSignInterrupted(t *testing.T) {
+	key, _ := crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	to := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	tx := types.NewTx(&types.LegacyTx{Gas: 21000, GasPrice: big.NewInt(1), To: &to, Data: make([]byte, 1500)})
+	signer := types.NewEIP155Signer(big.NewInt(1))
+
+	var (
+		flaky     *flakyTestDevice
+		interrupt bool // Whether to fail the first payload chunk of the next sign
+		streaming bool // Whether the emulated device is waiting for payload chunks
+		cancels   int
+	)
+	driver := newTestTrezor(new(config), func(msg proto.Message) proto.Message {
+		switch msg.(type) {
+		case *trezor.EthereumSignTx:
+			if streaming {
+				return &trezor.Failure{Code: trezor.Failure_Failure_UnexpectedMessage.Enum()}
+			}
+			if streaming = true; interrupt {
+				flaky.fails[flaky.writes+1] = true
+			}
+			return &trezor.EthereumTxRequest{DataLength: proto.Uint32(476)}
+		case *trezor.EthereumTxAck:
+			streaming = false
+			sig, err := crypto.Sign(signer.Hash(tx).Bytes(), key)
+			if err != nil {
+				t.Fatalf("failed to sign: %v", err)
+			}
+			return &trezor.EthereumTxRequest{SignatureV: proto.Uint32(uint32(sig[64]) + 37), SignatureR: sig[:32], SignatureS: sig[32:64]}
+		case *trezor.Cancel:
+			streaming = false
+			cancels++
+			return &trezor.Failure{Code: trezor.Failure_Failure_ActionCancelled.Enum()}
+		}
+		t.Fatalf("unexpected request %T", msg)
+		return nil
+	})
+	flaky = &flakyTestDevice{ReadWriter: driver.device, fails: make(map[int]bool)}
+	driver.device = flaky
+
+	interrupt = true
+	if _, _, err := driver.SignTx(accounts.DefaultBaseDerivationPath, tx, big.NewInt(1)); !errors.Is(err, errFlakyWrite) {
+		t.Fatalf("interrupted sign error mismatch: have %v, want %v", err, errFlakyWrite)
+	}
+	if cancels != 1 {
+		t.Fatalf("cancellation count mismatch: have %d, want 1", cancels)
+	}
+	interrupt = false
+	sender, _, err := driver.SignTx(accounts.DefaultBaseDerivationPath, tx, big.NewInt(1))
+	if err != nil {
+		t.Fatalf("failed to sign after interruption: %v", err)
+	}
+	if want := crypto.PubkeyToAddress(key.PublicKey); sender != want {
+		t.Fatalf("sender mismatch: have %x, want %x", sender, want)
+	}
+}
+
+// Tests that the detailed display mode chunks the addresses displayed by Trezor
+// firmwares supporting it, and is rejected by older ones.
+func TestTrezorDisplayMode(t *testing.T) {
+	tests := []struct {
+		version [3]uint32
+		mode    DisplayMode
+		err     error
+		chunked bool
+	}{
+		{[3]uint32{2, 6, 4}, DisplayDetailed, nil, true},
+		{[3]uint32{2, 6, 4}, DisplayConcise, nil, false},
+		{[3]uint32{2, 6, 3}, DisplayDetailed, ErrUnsupported, false},
+		{[3]uint32{1, 12, 1}, DisplayDetailed, ErrUnsupported, false},
+		{[3]uint32{2, 6, 4}, DisplayMode(2), ErrUnsupported, false},
+	}
+	for i, tt := range tests {
+		var chunkify *bool
+		driver := newTestTrezor(new(config), func(request proto.Message) proto.Message {
+			if req, ok := request.(*trezor.EthereumSignMessage); ok {
+				chunkify = req.Chunkify
+				return &trezor.EthereumMessageSignature{Address: proto.String(common.Address{}.Hex()), Signature: make([]byte, 65)}
+			}
+			return &trezor.Failure{Code: trezor.Failure_Failure_UnexpectedMessage.Enum()}
+		})
+		driver.version = tt.version
+
+		if err := driver.SetDisplayMode(tt.mode); !errors.Is(err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		if _, err := driver.SignText(accounts.DefaultBaseDerivationPath, []byte("hello")); err != nil {
+			t.Fatalf("test %d: failed to sign text: %v", i, err)
+		}
+		if chunked := chunkify != nil && *chunkify; chunked != tt.chunked {
+			t.Errorf("test %d: chunkify mismatch: have %v, want %v", i, chunked, tt.chunked)
+		}
+	}
+}
@@ -25,8 +25,10 @@ import "C"
 
 import (
 	"errors"
+	"fmt"
 	"runtime"
 	"sync"
+	"syscall"
 	"unsafe"
 )
 
@@ -129,7 +131,8 @@ func (dev *hidDevice) Write(b []byte) (int, error) {
 		report = b
 	}
 	// Execute the write operation
-	written := int(C.hid_write(device, (*C.uchar)(&report[0]), C.size_t(len(report))))
+	res, errno := C.hid_write(device, (*C.uchar)(&report[0]), C.size_t(len(report)))
+	written := int(res)
 	if written == -1 {
 		// If the write failed, verify if closed or other error
 		dev.lock.Lock()
@@ -145,7 +148,7 @@ func (dev *hidDevice) Write(b []byte) (int, error) {
 			return 0, errors.New("hidapi: unknown failure")
 		}
 		failure, _ := wcharTToString(message)
-		return 0, errors.New("hidapi: " + failure)
+		return 0, hidError(failure, errno)
 	}
 	return written, nil
 }
@@ -165,7 +168,8 @@ func (dev *hidDevice) Read(b []byte) (int, error) {
 		return 0, ErrDeviceClosed
 	}
 	// Execute the read operation
-	read := int(C.hid_read(device, (*C.uchar)(&b[0]), C.size_t(len(b))))
+	res, errno := C.hid_read(device, (*C.uchar)(&b[0]), C.size_t(len(b)))
+	read := int(res)
 	if read == -1 {
 		// If the read failed, verify if closed or other error
 		dev.lock.Lock()
@@ -181,7 +185,25 @@ func (dev *hidDevice) Read(b []byte) (int, error) {
 			return 0, errors.New("hidapi: unknown failure")
 		}
 		failure, _ := wcharTToString(message)
-		return 0, errors.New("hidapi: " + failure)
+		return 0, hidError(failure, errno)
 	}
 	return read, nil
 }
+
+// hidGoneFailures are the failures the hidapi backends report for a disconnected
+// device without setting errno (the device fd hung up on Linux, the IOKit removal
+// callback fired on macOS).
+var hidGoneFailures = map[string]bool{
+	"hid_read_timeout: unexpected poll error (device disconnected)": true,
+	"hid_read_timeout: device disconnected":                         true,
+	"Device is disconnected":                                        true,
+}
+
+// hidError converts a failure reported by hidapi into an error, mapping the errno
+// of a removed device or the backend's own disconnect failure to ErrDeviceGone.
+func hidError(failure string, errno error) error {
+	if errors.Is(errno, syscall.ENODEV) || errors.Is(errno, syscall.ENXIO) || hidGoneFailures[failure] {
+		return fmt.Errorf("hidapi: %s: %w", failure, ErrDeviceGone)
+	}
+	return errors.New("hidapi: " + failure)
+}
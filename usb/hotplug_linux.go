@@ -0,0 +1,82 @@
+// usb - Self contained USB and HID library for Go
+// Copyright 2017 The library Authors
+//
+// This library is free software: you can redistribute it and/or modify it under
+// the terms of the GNU Lesser General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// The library is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License along
+// with the library. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package usb
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+)
+
+// Hotplug subscribes to USB device attach and detach notifications. The returned
+// channel is signalled (coalescing bursts) whenever a USB or HID device appears
+// or disappears; the stop function terminates the subscription.
+//
+// On Linux, the notifications are the kernel uevents broadcast over netlink, the
+// same source libusb relies on for its hotplug callbacks.
+func Hotplug() (<-chan struct{}, func(), error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 1}); err != nil {
+		syscall.Close(fd)
+		return nil, nil, err
+	}
+	// Switch to non-blocking mode so closing the socket interrupts pending reads
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, nil, err
+	}
+	socket := os.NewFile(uintptr(fd), "uevent")
+	events := make(chan struct{}, 1)
+
+	go func() {
+		buf := make([]byte, 8192)
+		for {
+			n, err := socket.Read(buf)
+			if err != nil {
+				return
+			}
+			if isUsbUevent(buf[:n]) {
+				select {
+				case events <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return events, func() { socket.Close() }, nil
+}
+
+// isUsbUevent returns whether a kernel uevent announces a USB or HID device being
+// added or removed. The uevent is a sequence of NUL separated KEY=VALUE fields,
+// following an ACTION@DEVPATH header.
+func isUsbUevent(uevent []byte) bool {
+	var action, subsystem bool
+	for _, field := range bytes.Split(uevent, []byte{0}) {
+		switch {
+		case bytes.Equal(field, []byte("ACTION=add")), bytes.Equal(field, []byte("ACTION=remove")):
+			action = true
+		case bytes.Equal(field, []byte("SUBSYSTEM=usb")), bytes.Equal(field, []byte("SUBSYSTEM=hidraw")):
+			subsystem = true
+		}
+	}
+	return action && subsystem
+}
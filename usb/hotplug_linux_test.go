@@ -0,0 +1,52 @@
+// usb - Self contained USB and HID library for Go
+// Copyright 2017 The library Authors
+//
+// This library is free software: you can redistribute it and/or modify it under
+// the terms of the GNU Lesser General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option) any
+// later version.
+//
+// The library is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License along
+// with the library. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package usb
+
+import (
+	"strings"
+	"testing"
+)
+
+// Tests that only USB and HID attach/detach uevents are reported.
+func TestIsUsbUevent(t *testing.T) {
+	tests := []struct {
+		fields []string
+		want   bool
+	}{
+		{[]string{"add@/devices/pci0000:00/usb1/1-1", "ACTION=add", "SUBSYSTEM=usb", "DEVTYPE=usb_device"}, true},
+		{[]string{"remove@/devices/pci0000:00/usb1/1-1", "ACTION=remove", "SUBSYSTEM=usb"}, true},
+		{[]string{"add@/devices/virtual/hidraw/hidraw0", "ACTION=add", "SUBSYSTEM=hidraw"}, true},
+		{[]string{"bind@/devices/pci0000:00/usb1/1-1", "ACTION=bind", "SUBSYSTEM=usb"}, false},
+		{[]string{"add@/devices/virtual/net/eth0", "ACTION=add", "SUBSYSTEM=net"}, false},
+	}
+	for i, tt := range tests {
+		if have := isUsbUevent([]byte(strings.Join(tt.fields, "\x00"))); have != tt.want {
+			t.Errorf("test %d: match mismatch: have %v, want %v", i, have, tt.want)
+		}
+	}
+}
+
+// Tests that a hotplug subscription can be started and stopped.
+func TestHotplugStop(t *testing.T) {
+	_, stop, err := Hotplug()
+	if err != nil {
+		t.Skipf("netlink uevents unavailable: %v", err)
+	}
+	stop()
+}
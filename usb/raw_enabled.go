@@ -33,6 +33,23 @@ import (
 	"unsafe"
 )
 
+// rawUsers is the number of users of the libusb context: the ones registered via
+// Retain and the raw devices currently open. It is protected by enumerateLock.
+var rawUsers int
+
+// releaseRaw drops a user of the libusb context, freeing it once none are left.
+//
+// The method assumes that enumerateLock is held!
+func releaseRaw() {
+	if rawUsers > 0 {
+		rawUsers--
+	}
+	if rawUsers == 0 && C.ctx != nil {
+		C.libusb_exit(C.ctx)
+		C.ctx = nil
+	}
+}
+
 // enumerateRaw returns a list of all the USB devices attached to the system which
 // match the vendor and product id:
 //   - If the vendor id is set to 0 then any vendor matches.
@@ -200,6 +217,8 @@ func openRaw(info DeviceInfo) (*rawDevice, error) {
 		C.libusb_close(handle)
 		return nil, fmt.Errorf("failed to claim interface: %v", err)
 	}
+	rawUsers++ // Keep the context alive until the device is closed
+
 	return &rawDevice{
 		DeviceInfo: info,
 		handle:     handle,
@@ -219,13 +238,20 @@ func (dev *rawDevice) Close() error {
 	dev.lock.Lock()
 	defer dev.lock.Unlock()
 
-	if dev.handle != nil {
+	open := dev.handle != nil
+	if open {
 		C.libusb_release_interface(dev.handle, (C.int)(dev.Interface))
 		C.libusb_close(dev.handle)
 		dev.handle = nil
 	}
 	C.libusb_unref_device(dev.rawDevice.(*C.libusb_device))
 
+	// Drop the device's hold on the libusb context, only after it's fully released
+	if open {
+		enumerateLock.Lock()
+		releaseRaw()
+		enumerateLock.Unlock()
+	}
 	return nil
 }
 
@@ -30,6 +30,12 @@ func (e rawError) Error() string {
 	return fmt.Sprintf("libusb: %s [code %d]", rawErrorString[e], e)
 }
 
+// Is reports whether the error matches the target, mapping a missing device to
+// ErrDeviceGone.
+func (e rawError) Is(target error) bool {
+	return target == ErrDeviceGone && e == errNoDevice
+}
+
 // fromRawErrno converts a raw libusb error into a Go type.
 func fromRawErrno(errno C.int) error {
 	err := rawError(errno)
@@ -16,12 +16,20 @@
 // Package usb provide interfaces for generic USB devices.
 package usb
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+)
 
 // ErrDeviceClosed is returned for operations where the device closed before or
 // during the execution.
 var ErrDeviceClosed = errors.New("usb: device closed")
 
+// ErrDeviceGone is returned for operations where the device disappeared from the
+// bus while open (e.g. it was unplugged, or re-enumerated after the host slept).
+var ErrDeviceGone = errors.New("usb: device gone")
+
 // ErrUnsupportedPlatform is returned for all operations where the underlying
 // operating system is not supported by the library.
 var ErrUnsupportedPlatform = errors.New("usb: unsupported platform")
@@ -52,6 +60,12 @@ type DeviceInfo struct {
 	rawWriter *uint8 // Pointer to differentiate between unset and endpoint 0
 }
 
+// Raw returns whether the device was discovered through low level libusb rather
+// than HID enumeration, and as such will be accessed via interrupt transfers.
+func (info DeviceInfo) Raw() bool {
+	return info.rawDevice != nil
+}
+
 // Device is a generic USB device interface. It may either be backed by a USB HID
 // device or a low level raw (libusb) device.
 type Device interface {
@@ -66,3 +80,70 @@ type Device interface {
 	// reports, for low level USB read uses interrupt transfers.
 	Read(b []byte) (int, error)
 }
+
+// enumerateSlot is held by the enumeration started by EnumerateContext until the
+// platform returns, even if the caller stopped waiting for it.
+var enumerateSlot = make(chan struct{}, 1)
+
+// EnumerateContext is identical to Enumerate, but stops waiting for the platform
+// to finish enumerating if the context is cancelled, returning an error wrapping
+// ctx.Err(). The underlying system calls cannot be interrupted, so they will keep
+// running in the background until they return. No other enumeration is started
+// until then: later calls wait for the stale one to finish, or for their context
+// to be cancelled.
+func EnumerateContext(ctx context.Context, vendorID uint16, productID uint16) ([]DeviceInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("usb: enumeration aborted: %w", err)
+	}
+	select {
+	case enumerateSlot <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("usb: enumeration aborted, previous one still running: %w", ctx.Err())
+	}
+	type result struct {
+		infos []DeviceInfo
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() { <-enumerateSlot }()
+
+		infos, err := Enumerate(vendorID, productID)
+		done <- result{infos, err}
+	}()
+	select {
+	case res := <-done:
+		return res.infos, res.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("usb: enumeration aborted: %w", ctx.Err())
+	}
+}
+
+// OpenContext is identical to Open, but stops waiting for the device to open if
+// the context is cancelled, returning an error wrapping ctx.Err(). If the device
+// eventually opens after the context was cancelled, it is closed again.
+func (info DeviceInfo) OpenContext(ctx context.Context) (Device, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("usb: open aborted: %w", err)
+	}
+	type result struct {
+		device Device
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		device, err := info.Open()
+		done <- result{device, err}
+	}()
+	select {
+	case res := <-done:
+		return res.device, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-done; res.err == nil {
+				res.device.Close()
+			}
+		}()
+		return nil, fmt.Errorf("usb: open aborted: %w", ctx.Err())
+	}
+}
@@ -49,3 +49,11 @@ func EnumerateHid(vendorID uint16, productID uint16) ([]DeviceInfo, error) {
 func (info DeviceInfo) Open() (Device, error) {
 	return nil, ErrUnsupportedPlatform
 }
+
+// Retain registers a user of the libusb context shared by all raw USB accesses of
+// the process. On platforms that this file implements the function is a noop.
+func Retain() {}
+
+// Release drops a user registered by Retain. On platforms that this file
+// implements the function is a noop.
+func Release() {}
@@ -96,3 +96,23 @@ func (info DeviceInfo) Open() (Device, error) {
 	}
 	return openRaw(info)
 }
+
+// Retain registers a user of the libusb context shared by all raw USB accesses of
+// the process, keeping it alive until a matching Release. The context itself is
+// created on demand by the first enumeration.
+func Retain() {
+	enumerateLock.Lock()
+	defer enumerateLock.Unlock()
+
+	rawUsers++
+}
+
+// Release drops a user registered by Retain. Once the last one is gone and no raw
+// device is open anymore, the shared libusb context is freed; the next enumeration
+// creates a new one.
+func Release() {
+	enumerateLock.Lock()
+	defer enumerateLock.Unlock()
+
+	releaseRaw()
+}
@@ -16,11 +16,14 @@
 package usb
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"runtime"
 	"sync"
 	"testing"
+	"time"
 )
 
 // Tests that HID enumeration can be called concurrently from multiple threads.
@@ -115,3 +118,34 @@ func TestThreadedEnumerate(t *testing.T) {
 		}
 	}
 }
+
+// Tests that enumeration and opening abort if the context is already done.
+func TestContextAborted(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+
+	if _, err := EnumerateContext(ctx, 0, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("enumeration error mismatch: have %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := (DeviceInfo{}).OpenContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("open error mismatch: have %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// Tests that no enumeration is started while an abandoned one is still running,
+// and that enumerating resumes once it returns.
+func TestEnumerateInFlight(t *testing.T) {
+	enumerateSlot <- struct{}{} // Simulate a stale enumeration
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := EnumerateContext(ctx, 0, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("enumeration error mismatch: have %v, want %v", err, context.DeadlineExceeded)
+	}
+	<-enumerateSlot
+
+	if _, err := EnumerateContext(context.Background(), 0, 0); err != nil && !errors.Is(err, ErrUnsupportedPlatform) {
+		t.Errorf("failed to enumerate after the stale one returned: %v", err)
+	}
+}
@@ -18,14 +18,23 @@
 package usbwallet
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/big"
 	"sync"
 	"time"
 
+	"github.com/base/usbwallet/trezor"
 	"github.com/base/usbwallet/usb"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/common"
@@ -38,15 +47,223 @@ import (
 // Maximum time between wallet health checks to detect USB unplugs.
 const heartbeatCycle = time.Second
 
+// Maximum time to wait for the USB device connection to be established.
+const openTimeout = 5 * time.Second
+
 // Minimum time to wait between self derivation attempts, even it the user is
 // requesting accounts like crazy.
 const selfDeriveThrottling = time.Second
 
+// ErrUserRejected is returned if the owner of the hardware wallet denied the
+// requested operation on the device.
+var ErrUserRejected = errors.New("user rejected the request on the device")
+
+// ErrBlindSigningDisabled is returned if a signature which the device can only
+// blind sign is requested with blind signing disabled in the device settings.
+var ErrBlindSigningDisabled = errors.New("blind signing not allowed")
+
+// ErrChainIDMismatch is returned if the domain of EIP-712 typed data is bound to a
+// different chain than the one configured via the ExpectChainID option, or to none.
+var ErrChainIDMismatch = errors.New("typed data chain ID mismatch")
+
+// ErrSignerMismatch is returned if a signature produced by the device recovers to
+// another address than the account signed with, or than the device derives for
+// the account's path if the VerifySigner option is set.
+var ErrSignerMismatch = errors.New("signer mismatch")
+
+// ErrInvalidDerivationPath is returned if a derivation path is empty or longer
+// than the device can derive, before any request is sent to it.
+var ErrInvalidDerivationPath = errors.New("invalid derivation path")
+
+// ErrUnsupported is returned if a feature is not supported by the device or its
+// firmware, instead of silently ignoring the request. It is an alias of
+// accounts.ErrNotSupported, so either may be matched with errors.Is.
+var ErrUnsupported = accounts.ErrNotSupported
+
+// DisplayMode is the level of detail of the data displayed on the device screen
+// for confirmation.
+type DisplayMode int
+
+const (
+	// DisplayConcise shows the data as the device does by default.
+	DisplayConcise DisplayMode = iota
+
+	// DisplayDetailed shows the data in its most readable form the device supports,
+	// e.g. splitting addresses into chunks of 4 characters on Trezor devices.
+	DisplayDetailed
+)
+
+// validatePath checks that a derivation path has at least one and at most limit
+// components, as the devices reject (or silently truncate the length prefix of)
+// anything else.
+func validatePath(path []uint32, limit int) error {
+	if len(path) == 0 || len(path) > limit {
+		return fmt.Errorf("%w: %d components, must be between 1 and %d", ErrInvalidDerivationPath, len(path), limit)
+	}
+	return nil
+}
+
 type Wallet interface {
 	accounts.Wallet
 
 	SignTypedData(account accounts.Account, data apitypes.TypedData) ([]byte, error)
 	SignTypedDataWithPassphrase(account accounts.Account, passphrase string, data apitypes.TypedData) ([]byte, error)
+	SignTypedDataFiltered(account accounts.Account, data apitypes.TypedData, filters *LedgerEIP712Filters) ([]byte, error)
+	SignTypedDataJSON(account accounts.Account, raw []byte) ([]byte, error)
+	SignTypedDataStream(account accounts.Account, data apitypes.TypedData, message TypedDataValues) ([]byte, error)
+	SignAuthorization(account accounts.Account, auth types.SetCodeAuthorization) ([]byte, error)
+	SignTextHash(account accounts.Account, text []byte) (signature []byte, hash []byte, err error)
+	SignSIWE(account accounts.Account, message SIWEMessage) ([]byte, error)
+	SignOwnershipProof(path accounts.DerivationPath, challenge []byte) ([]byte, error)
+	ConfirmAddress(path accounts.DerivationPath) (common.Address, error)
+	DeriveAndShow(path accounts.DerivationPath, pin bool) (accounts.Account, error)
+	ExtendedPublicKey(path accounts.DerivationPath) (*hdkeychain.ExtendedKey, error)
+	PublicKey(path accounts.DerivationPath) (*ecdsa.PublicKey, error)
+	DeriveBatch(paths []accounts.DerivationPath) ([]common.Address, error)
+	ScanAccounts(base accounts.DerivationPath, gapLimit int, used func(common.Address) bool) ([]accounts.Account, error)
+	LedgerAppConfig() (version [3]byte, flags byte, err error)
+	SetPlugin(descriptor []byte, external bool) error
+	SetDisplayMode(mode DisplayMode) error
+	Serial() string
+	StableID() (string, error)
+	DetailedStatus() (WalletStatus, error)
+	Ping() error
+	DeviceHealth() (DeviceHealth, error)
+	Cancel() error
+	DeviceInfo() DeviceInfo
+	Capabilities() Capabilities
+	Attestation(challenge []byte) (*Attestation, error)
+
+	SignTxContext(ctx context.Context, account accounts.Account, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error)
+	SignTxRaw(account accounts.Account, tx *types.Transaction, chainID *big.Int) (r, s [32]byte, recid byte, err error)
+	SignTextContext(ctx context.Context, account accounts.Account, text []byte) ([]byte, error)
+}
+
+// DeviceInfo describes a hardware wallet and the software running on it, as last
+// reported by the device (on open and on every heartbeat).
+type DeviceInfo struct {
+	Model      string // Device model (e.g. Ledger Nano X, Trezor Safe 5)
+	Firmware   string // Firmware version, empty if not reported (Ledger)
+	App        string // Name of the app running on the device (Ledger only)
+	AppVersion string // Version of the running app (Ledger only)
+	Flags      byte   // Configuration flags of the Ethereum app (LedgerFlagXYZ)
+}
+
+// WalletState is the state of a wallet as reported by DetailedStatus.
+type WalletState int
+
+const (
+	WalletClosed   WalletState = iota // The wallet is not open
+	WalletLocked                      // The device must be unlocked with its PIN
+	WalletWrongApp                    // The Ledger doesn't run the Ethereum app
+	WalletReady                       // The device is ready to sign
+	WalletBusy                        // An operation (e.g. awaiting confirmation) is in progress
+)
+
+// String implements fmt.Stringer.
+func (s WalletState) String() string {
+	switch s {
+	case WalletClosed:
+		return "Closed"
+	case WalletLocked:
+		return "Locked"
+	case WalletWrongApp:
+		return "WrongApp"
+	case WalletReady:
+		return "Ready"
+	case WalletBusy:
+		return "Busy"
+	default:
+		return fmt.Sprintf("WalletState(%d)", int(s))
+	}
+}
+
+// WalletStatus is the state of a wallet, along with a human readable detail (e.g.
+// the app version, or the reason the device is locked), empty if none.
+type WalletStatus struct {
+	State  WalletState
+	Detail string
+}
+
+// HealthUnknown is reported by DeviceHealth for the metrics a device doesn't expose.
+const HealthUnknown = -1
+
+// DeviceHealth is a snapshot of the state of a device and of its connection, for
+// monitoring purposes. Metrics the device doesn't report are HealthUnknown.
+//
+// Neither the Ledger Ethereum app nor the Trezor firmware expose the battery level
+// or the Bluetooth signal strength over USB (the Nano X only shows them on its own
+// screen), so these are currently always unknown.
+type DeviceHealth struct {
+	Connected bool          // Whether the device responded to a health check
+	Latency   time.Duration // Duration of the health check (incl. queueing), 0 if it failed
+	Battery   int           // Battery charge in percent, HealthUnknown if not reported
+	RSSI      int           // Wireless signal strength in dBm, HealthUnknown if not reported
+}
+
+// Attestation is the raw material to verify that a device is genuine against its
+// manufacturer's certificate authority. It is not verified by this package.
+type Attestation struct {
+	Challenge    []byte   // Random challenge the device was asked to sign
+	Certificates [][]byte // DER certificate chain from the device certificate up to one signed by the manufacturer's root CA
+	Signature    []byte   // DER signature over the challenge by the device certificate's key, in a vendor specific format
+
+	Vendor           string // Vendor of the firmware (Trezor only)
+	Model            string // Internal hardware model identifier (Trezor only)
+	Revision         []byte // Source revision the firmware was built from (Trezor only)
+	BootloaderHash   []byte // Hash of the bootloader (Trezor only)
+	BootloaderLocked bool   // Whether the bootloader refuses unofficial firmwares (Trezor only)
+}
+
+// Capabilities reports the signing features supported by a device, based on its
+// model and the version of its firmware (Trezor) or Ethereum app (Ledger), so that
+// unsupported operations can be hidden from the user instead of failing.
+type Capabilities struct {
+	TypedDataNative bool // EIP-712 messages are displayed on the device (not just their hashes)
+	NestedArrays    bool // EIP-712 messages may contain arrays of arrays
+	BlobTx          bool // EIP-4844 blob transactions can be signed
+	AccessListTx    bool // EIP-2930 access list (and later typed) transactions can be signed
+	DynamicFeeTx    bool // EIP-1559 dynamic fee transactions can be signed
+	ClearSigning    bool // EIP-712 clear signing filters are displayed (Ledger only)
+}
+
+// SignOp identifies the kind of a signing operation reported to SignMetrics.
+type SignOp string
+
+const (
+	SignOpTx            SignOp = "tx"            // Transaction signing
+	SignOpText          SignOp = "text"          // Personal message signing
+	SignOpTypedData     SignOp = "typedData"     // EIP-712 typed data signing
+	SignOpAuthorization SignOp = "authorization" // EIP-7702 authorization signing
+	SignOpOwnership     SignOp = "ownership"     // Account ownership proof signing
+)
+
+// SignMetrics is a set of hooks invoked around every signing operation of the
+// wallets, to be backed by the caller's metrics (e.g. counters and histograms).
+// The hooks are called synchronously, so they should not block.
+type SignMetrics interface {
+	// OnSignStart is called when a signing operation is requested.
+	OnSignStart(op SignOp)
+
+	// OnSignEnd is called when a signing operation finishes, successfully or not,
+	// with the time it took (including waiting for the user) and its error.
+	OnSignEnd(op SignOp, duration time.Duration, err error)
+}
+
+// SignOutcome classifies the error of a signing operation for metrics tagging:
+// "ok" on success, "rejected" if the user denied the request, "cancelled" if the
+// caller's context was cancelled and "error" otherwise.
+func SignOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, ErrUserRejected):
+		return "rejected"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "cancelled"
+	default:
+		return "error"
+	}
 }
 
 // driver defines the vendor specific functionality hardware wallets instances
@@ -61,6 +278,10 @@ type driver interface {
 	// or may not be used by the implementation of a particular wallet instance.
 	Open(device io.ReadWriter, passphrase string) error
 
+	// SelectInterface picks the USB interface to exchange messages over among all
+	// the matching interfaces a device exposes (in enumeration order).
+	SelectInterface(infos []usb.DeviceInfo) usb.DeviceInfo
+
 	// Close releases any resources held by an open wallet instance.
 	Close() error
 
@@ -72,6 +293,38 @@ type driver interface {
 	// address located on that path.
 	Derive(path accounts.DerivationPath) (common.Address, error)
 
+	// ConfirmAddress displays the Ethereum address located on the derivation path
+	// on the USB device and waits for the user to confirm or reject it.
+	ConfirmAddress(path accounts.DerivationPath) (common.Address, error)
+
+	// ExtendedPublicKey retrieves the extended public key (public key and chain
+	// code) located on the derivation path from the USB device.
+	ExtendedPublicKey(path accounts.DerivationPath) (*hdkeychain.ExtendedKey, error)
+
+	// PublicKey retrieves the uncompressed public key located on the derivation
+	// path from the USB device, checked against the address the device derives.
+	PublicKey(path accounts.DerivationPath) (*ecdsa.PublicKey, error)
+
+	// LedgerAppConfig retrieves the version and configuration flags of the Ledger
+	// Ethereum app running on the USB device.
+	LedgerAppConfig() ([3]byte, byte, error)
+
+	// Cancel aborts the request in flight (e.g. a signature waiting for the user
+	// to confirm it) from another goroutine. It is a no-op if nothing is pending.
+	Cancel() error
+
+	// DeviceInfo returns the model and software versions of the USB device cached
+	// on open and refreshed by the heartbeat.
+	DeviceInfo() DeviceInfo
+
+	// Capabilities returns the signing features supported by the USB device, based
+	// on the model and versions cached on open and refreshed by the heartbeat.
+	Capabilities() Capabilities
+
+	// Attestation requests the USB device to prove its authenticity by signing the
+	// challenge with a key certified by the manufacturer.
+	Attestation(challenge []byte) (*Attestation, error)
+
 	// SignTx sends the transaction to the USB device and waits for the user to confirm
 	// or deny the transaction.
 	SignTx(path accounts.DerivationPath, tx *types.Transaction, chainID *big.Int) (common.Address, *types.Transaction, error)
@@ -80,6 +333,10 @@ type driver interface {
 	// or deny the signature.
 	SignText(path accounts.DerivationPath, text []byte) ([]byte, error)
 
+	// SignAuthorization sends an EIP-7702 authorization to sign to the USB device
+	// and waits for the user to confirm or deny the signature.
+	SignAuthorization(path accounts.DerivationPath, auth types.SetCodeAuthorization) ([]byte, error)
+
 	// SignTypedHash sends a typed message to sign to the USB device and waits for the user to confirm
 	// or deny the signature.
 	SignTypedHash(path accounts.DerivationPath, messageHash []byte, domainHash []byte) ([]byte, error)
@@ -87,6 +344,88 @@ type driver interface {
 	// SignedTypedData sends a typed data struct to sign to the USB device and waits for the user to confirm
 	// or deny the signature.
 	SignedTypedData(path accounts.DerivationPath, data apitypes.TypedData) ([]byte, error)
+
+	// SignedTypedDataStream is identical to SignedTypedData, but pulls the message
+	// values from message as needed instead of reading them from data.
+	SignedTypedDataStream(path accounts.DerivationPath, data apitypes.TypedData, message TypedDataValues) ([]byte, error)
+}
+
+// contextDriver is implemented by drivers which can abort waiting for the user to
+// confirm or deny a signature when a context is cancelled.
+type contextDriver interface {
+	// SignTxContext is identical to driver.SignTx, but aborts if the context is cancelled.
+	SignTxContext(ctx context.Context, path accounts.DerivationPath, tx *types.Transaction, chainID *big.Int) (common.Address, *types.Transaction, error)
+
+	// SignTextContext is identical to driver.SignText, but aborts if the context is cancelled.
+	SignTextContext(ctx context.Context, path accounts.DerivationPath, text []byte) ([]byte, error)
+}
+
+// filterDriver is implemented by drivers which can display EIP-712 messages in a
+// human readable form using clear signing filters.
+type filterDriver interface {
+	// SignedTypedDataFiltered is identical to driver.SignedTypedData, but sends the
+	// clear signing filters along with the message.
+	SignedTypedDataFiltered(path accounts.DerivationPath, data apitypes.TypedData, filters *LedgerEIP712Filters) ([]byte, error)
+}
+
+// pluginDriver is implemented by drivers which can decode contract calls with
+// plugins selected by signed descriptors.
+type pluginDriver interface {
+	// SetPlugin selects the plugin (or external plugin, e.g. swap) decoding the
+	// contract call of the next transaction signed.
+	SetPlugin(descriptor []byte, external bool) error
+}
+
+// displayDriver is implemented by drivers which can change the level of detail
+// of the data displayed on the device screen.
+type displayDriver interface {
+	// SetDisplayMode sets the display mode of the requests sent after it,
+	// returning ErrUnsupported if the firmware doesn't support the mode.
+	SetDisplayMode(mode DisplayMode) error
+}
+
+// deriveAddress derives the Ethereum address of a non-hardened child of an
+// extended public key.
+func deriveAddress(xpub *hdkeychain.ExtendedKey, index uint32) (common.Address, error) {
+	child, err := xpub.Derive(index)
+	if err != nil {
+		return common.Address{}, err
+	}
+	pubkey, err := child.ECPubKey()
+	if err != nil {
+		return common.Address{}, err
+	}
+	key, err := crypto.UnmarshalPubkey(pubkey.SerializeUncompressed())
+	if err != nil {
+		return common.Address{}, err
+	}
+	return crypto.PubkeyToAddress(*key), nil
+}
+
+// newExtendedPublicKey assembles an extended public key from the public key and
+// chain code located on a derivation path, along with the public key of its parent
+// (nil for the master node). The public keys may be compressed or uncompressed.
+func newExtendedPublicKey(path accounts.DerivationPath, pubkey []byte, chainCode []byte, parent []byte) (*hdkeychain.ExtendedKey, error) {
+	key, err := btcec.ParsePubKey(pubkey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	if len(chainCode) != 32 {
+		return nil, fmt.Errorf("invalid chain code length: %d", len(chainCode))
+	}
+	var (
+		parentFP = []byte{0, 0, 0, 0}
+		childNum uint32
+	)
+	if len(path) > 0 {
+		parentKey, err := btcec.ParsePubKey(parent)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parent public key: %w", err)
+		}
+		parentFP = btcutil.Hash160(parentKey.SerializeCompressed())[:4]
+		childNum = path[len(path)-1]
+	}
+	return hdkeychain.NewExtendedKey(chaincfg.MainNetParams.HDPublicKeyID[:], key.SerializeCompressed(), chainCode, parentFP, uint8(len(path)), childNum, false), nil
 }
 
 // wallet represents the common functionality shared by all USB hardware
@@ -96,12 +435,19 @@ type wallet struct {
 	hub    *Hub          // USB hub scanning
 	driver driver        // Hardware implementation of the low level device operations
 	url    *accounts.URL // Textual URL uniquely identifying this wallet
+	serial string        // USB serial number telling the device apart from the others, empty if none
 
-	info   usb.DeviceInfo // Known USB device infos about the wallet
-	device usb.Device     // USB device advertising itself as a hardware wallet
+	lastErr  error      // Outcome of the last signing operation or ping, reported by DetailedStatus
+	lastLock sync.Mutex // Protects the last error, updated under the state read lock
+
+	info       usb.DeviceInfo   // Known USB device infos about the wallet
+	interfaces []usb.DeviceInfo // All matching USB interfaces of the device, the driver picks one on open
+	device     usb.Device       // USB device advertising itself as a hardware wallet
+	transport  usb.Device       // Connected transport to use instead of opening the USB device
 
 	accounts []accounts.Account                         // List of derive accounts pinned on the hardware wallet
 	paths    map[common.Address]accounts.DerivationPath // Known derivation paths for signing operations
+	derived  map[string]common.Address                  // Addresses derived on the device, keyed by path
 
 	deriveNextPaths []accounts.DerivationPath // Next derivation paths for account auto-discovery (multiple bases supported)
 	deriveNextAddrs []common.Address          // Next derived account addresses for auto-discovery (multiple bases supported)
@@ -141,6 +487,86 @@ func (w *wallet) URL() accounts.URL {
 	return *w.url // Immutable, no need for a lock
 }
 
+// Serial returns the USB serial number of the hardware device, which (unlike the
+// URL) is the same across operating systems. If the device or the OS's USB stack
+// doesn't report one, the serial number is empty.
+func (w *wallet) Serial() string {
+	return w.info.Serial // Immutable, no need for a lock
+}
+
+// stableIDPath is the derivation path of the node whose public key fingerprints the
+// seed of devices without a serial number. The Ethereum apps refuse to derive the
+// master key, the first BIP-44 account is the shallowest node all devices derive.
+var stableIDPath = accounts.DerivationPath{0x80000000 + 44, 0x80000000 + 60, 0x80000000 + 0}
+
+// StableID returns an identifier of the device that survives reconnects, unlike
+// the USB path: "serial:" followed by its USB serial number, as used in the URL by
+// the WithStableURLs option. Devices not reporting a unique serial number (e.g.
+// Ledgers, which all report the same), or sharing it with another attached device,
+// are identified by the fingerprint of their seed
+// instead: "seed:" followed by the hex encoded first 4 bytes of the Hash160 of the
+// public key of m/44'/60'/0'. Deriving it requires the wallet to be open, and a
+// different passphrase yields a different seed, hence a different identifier.
+func (w *wallet) StableID() (string, error) {
+	if w.serial != "" {
+		return "serial:" + w.serial, nil // Immutable, no need for a lock
+	}
+	key, err := w.PublicKey(stableIDPath)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("seed:%x", btcutil.Hash160(crypto.CompressPubkey(key))[:4]), nil
+}
+
+// DeviceInfo returns the model and software versions of the device, as reported
+// on open and refreshed by the health checks. The Ledger model is derived from
+// the USB product identifier, unknown for wallets not backed by a USB device.
+func (w *wallet) DeviceInfo() DeviceInfo {
+	w.stateLock.RLock() // No device communication, drivers guard the infos health checks refresh
+	defer w.stateLock.RUnlock()
+
+	info := w.driver.DeviceInfo()
+	if info.Model == "" && w.hub.scheme == LedgerScheme && w.transport == nil {
+		info.Model = ledgerModel(w.info.ProductID)
+	}
+	return info
+}
+
+// Attestation requests the device to prove its authenticity by signing the given
+// random challenge with a key certified by the manufacturer, returning the raw
+// material for the caller to verify against the manufacturer's CA.
+//
+// Trezor devices with a secure element (Safe family) return the certificate chain
+// and the signature; older models only the firmware and bootloader details. The
+// Ledger genuine check runs between the device dashboard and Ledger's servers over
+// a secure channel the Ethereum app doesn't expose, so Ledgers return
+// accounts.ErrNotSupported.
+func (w *wallet) Attestation(challenge []byte) (*Attestation, error) {
+	w.stateLock.RLock() // Avoid device disappearing during the attestation
+	defer w.stateLock.RUnlock()
+
+	if w.device == nil {
+		return nil, accounts.ErrWalletClosed
+	}
+	if len(challenge) == 0 {
+		return nil, errors.New("empty attestation challenge")
+	}
+	<-w.commsLock // Avoid concurrent hardware access
+	defer func() { w.commsLock <- struct{}{} }()
+
+	return w.driver.Attestation(challenge)
+}
+
+// Capabilities returns the signing features supported by the device, as derived
+// from the model and versions reported on open and refreshed by the health checks.
+// A closed wallet supports nothing.
+func (w *wallet) Capabilities() Capabilities {
+	w.stateLock.RLock() // No device communication, drivers guard the infos health checks refresh
+	defer w.stateLock.RUnlock()
+
+	return w.driver.Capabilities()
+}
+
 // Status implements accounts.Wallet, returning a custom status message from the
 // underlying vendor-specific hardware wallet implementation.
 func (w *wallet) Status() (string, error) {
@@ -154,6 +580,75 @@ func (w *wallet) Status() (string, error) {
 	return status, failure
 }
 
+// opened reports whether the wallet holds a connection to its device.
+func (w *wallet) opened() bool {
+	w.stateLock.RLock()
+	defer w.stateLock.RUnlock()
+
+	return w.device != nil
+}
+
+// DetailedStatus is identical to Status, but reports the state of the wallet as
+// a WalletState to branch on instead of a textual description. The state is
+// derived from the cached app and version info, and from the outcome of the last
+// signing operation or ping, without communicating with the device. Wallets that
+// failed are reported in the state they were in, along with the failure.
+func (w *wallet) DetailedStatus() (WalletStatus, error) {
+	w.stateLock.RLock() // No device communication, drivers guard the infos health checks refresh
+	defer w.stateLock.RUnlock()
+
+	detail, failure := w.driver.Status()
+	if w.device == nil {
+		return WalletStatus{State: WalletClosed}, failure
+	}
+	// An operation holding the device takes precedence over its last outcome
+	select {
+	case <-w.commsLock:
+		w.commsLock <- struct{}{}
+	default:
+		return WalletStatus{State: WalletBusy, Detail: detail}, failure
+	}
+	w.lastLock.Lock()
+	last := w.lastErr
+	w.lastLock.Unlock()
+
+	if isLockedError(last) {
+		return WalletStatus{State: WalletLocked, Detail: last.Error()}, failure
+	}
+	if w.hub.scheme == LedgerScheme {
+		info := w.driver.DeviceInfo()
+		if info.AppVersion == "" || errors.Is(last, ErrWrongApp) {
+			if info.App != "" && info.App != ledgerEthereumApp {
+				detail = fmt.Sprintf("%s app running", info.App)
+			}
+			return WalletStatus{State: WalletWrongApp, Detail: detail}, failure
+		}
+	}
+	return WalletStatus{State: WalletReady, Detail: detail}, failure
+}
+
+// isLockedError reports whether an error was caused by the device being locked.
+func isLockedError(err error) bool {
+	if errors.Is(err, ErrLedgerLocked) {
+		return true
+	}
+	var failure *TrezorFailure
+	if errors.As(err, &failure) {
+		switch failure.GetCode() {
+		case trezor.Failure_Failure_PinExpected, trezor.Failure_Failure_PinCancelled, trezor.Failure_Failure_PinInvalid:
+			return true
+		}
+	}
+	return false
+}
+
+// recordResult stores the outcome of an operation for DetailedStatus.
+func (w *wallet) recordResult(err error) {
+	w.lastLock.Lock()
+	w.lastErr = err
+	w.lastLock.Unlock()
+}
+
 // Open implements accounts.Wallet, attempting to open a USB connection to the
 // hardware wallet.
 func (w *wallet) Open(passphrase string) error {
@@ -166,9 +661,20 @@ func (w *wallet) Open(passphrase string) error {
 	}
 	// Make sure the actual device connection is done only once
 	if w.device == nil {
-		device, err := w.info.Open()
-		if err != nil {
-			return err
+		device := w.transport
+		if device == nil {
+			info := w.info
+			if len(w.interfaces) > 1 {
+				info = w.driver.SelectInterface(w.interfaces)
+				w.log.Debug("Selected USB interface", "path", info.Path, "interface", info.Interface, "candidates", len(w.interfaces))
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), openTimeout)
+			dev, err := usbOpen(info, ctx)
+			cancel()
+			if err != nil {
+				return err
+			}
+			device = &reopenableDevice{info: info, device: dev}
 		}
 		w.device = device
 		w.commsLock = make(chan struct{}, 1)
@@ -180,6 +686,8 @@ func (w *wallet) Open(passphrase string) error {
 	}
 	// Connection successful, start life-cycle management
 	w.paths = make(map[common.Address]accounts.DerivationPath)
+	w.derived = make(map[string]common.Address)
+	w.recordResult(nil)
 
 	w.deriveReq = make(chan chan struct{})
 	w.deriveQuit = make(chan chan error)
@@ -224,8 +732,15 @@ func (w *wallet) heartbeat() {
 		<-w.commsLock // Don't lock state while resolving version
 		err = w.driver.Heartbeat()
 		w.commsLock <- struct{}{}
+		_, reopenable := w.device.(reopener)
 		w.stateLock.RUnlock()
 
+		// If the device disappeared (e.g. re-enumerated after the host slept), keep
+		// the wallet open, the next exchange reopens it or reports it closed
+		if err != nil && reopenable && deviceGone(err) {
+			w.log.Debug("USB wallet device gone, reopening on next use", "err", err)
+			err = nil
+		}
 		if err != nil {
 			w.stateLock.Lock() // Lock state to tear the wallet down
 			w.close()
@@ -293,7 +808,7 @@ func (w *wallet) close() error {
 	w.device.Close()
 	w.device = nil
 
-	w.accounts, w.paths = nil, nil
+	w.accounts, w.paths, w.derived = nil, nil, nil
 	return w.driver.Close()
 }
 
@@ -472,6 +987,11 @@ func (w *wallet) Contains(account accounts.Account) bool {
 // Derive implements accounts.Wallet, deriving a new account at the specific
 // derivation path. If pin is set to true, the account will be added to the list
 // of tracked accounts.
+//
+// Addresses derived since the wallet was opened are cached by path, so repeated
+// derivations don't hit the device, unless pin is set, which always queries it.
+// The cache is dropped when the wallet is closed, so reopening it (e.g. with a
+// different Trezor passphrase, hence seed) never returns stale addresses.
 func (w *wallet) Derive(path accounts.DerivationPath, pin bool) (accounts.Account, error) {
 	// Try to derive the actual account and update its URL if successful
 	w.stateLock.RLock() // Avoid device disappearing during derivation
@@ -480,16 +1000,22 @@ func (w *wallet) Derive(path accounts.DerivationPath, pin bool) (accounts.Accoun
 		w.stateLock.RUnlock()
 		return accounts.Account{}, accounts.ErrWalletClosed
 	}
-	<-w.commsLock // Avoid concurrent hardware access
-	address, err := w.driver.Derive(path)
+	<-w.commsLock // Avoid concurrent hardware access (and cache updates)
+	address, ok := w.derived[path.String()]
+	if !ok || pin {
+		var err error
+		if address, err = w.driver.Derive(path); err != nil {
+			w.commsLock <- struct{}{}
+			w.stateLock.RUnlock()
+			return accounts.Account{}, err
+		}
+		w.derived[path.String()] = address
+	}
 	w.commsLock <- struct{}{}
 
 	w.stateLock.RUnlock()
 
-	// If an error occurred or no pinning was requested, return
-	if err != nil {
-		return accounts.Account{}, err
-	}
+	// If no pinning was requested, return
 	account := accounts.Account{
 		Address: address,
 		URL:     accounts.URL{Scheme: w.url.Scheme, Path: fmt.Sprintf("%s/%s", w.url.Path, path)},
@@ -497,22 +1023,368 @@ func (w *wallet) Derive(path accounts.DerivationPath, pin bool) (accounts.Accoun
 	if !pin {
 		return account, nil
 	}
+	if err := w.pin(account, path); err != nil {
+		return accounts.Account{}, err
+	}
+	return account, nil
+}
+
+// pin adds an account derived on the given path to the list of tracked accounts,
+// unless it's already tracked.
+func (w *wallet) pin(account accounts.Account, path accounts.DerivationPath) error {
 	// Pinning needs to modify the state
 	w.stateLock.Lock()
 	defer w.stateLock.Unlock()
 
 	if w.device == nil {
-		return accounts.Account{}, accounts.ErrWalletClosed
+		return accounts.ErrWalletClosed
 	}
 
-	if _, ok := w.paths[address]; !ok {
+	if _, ok := w.paths[account.Address]; !ok {
 		w.accounts = append(w.accounts, account)
-		w.paths[address] = make(accounts.DerivationPath, len(path))
-		copy(w.paths[address], path)
+		w.paths[account.Address] = make(accounts.DerivationPath, len(path))
+		copy(w.paths[account.Address], path)
+	}
+	return nil
+}
+
+// DeriveBatch derives the addresses located on multiple derivation paths. Paths
+// ending in a non-hardened component are derived locally from the extended public
+// key of their parent, fetched once per parent, others (or all if the device can't
+// export extended keys) one by one from the device. If the device fails mid-batch,
+// the addresses derived so far are returned along with the error.
+func (w *wallet) DeriveBatch(paths []accounts.DerivationPath) ([]common.Address, error) {
+	w.stateLock.RLock() // Avoid device disappearing during derivation
+	defer w.stateLock.RUnlock()
+
+	if w.device == nil {
+		return nil, accounts.ErrWalletClosed
+	}
+	<-w.commsLock // Avoid concurrent hardware access (and cache updates)
+	defer func() { w.commsLock <- struct{}{} }()
+
+	var (
+		addresses = make([]common.Address, 0, len(paths))
+		parents   = make(map[string]*hdkeychain.ExtendedKey)
+	)
+	for _, path := range paths {
+		address, ok := w.derived[path.String()]
+		if !ok {
+			var err error
+			if address, err = w.deriveBatched(path, parents); err != nil {
+				return addresses, err
+			}
+			w.derived[path.String()] = address
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+// maxGapLimit caps the gap limit of account scans, as each index in the gap costs
+// an address derivation (BIP-44 recommends a gap limit of 20).
+const maxGapLimit = 1000
+
+// ScanAccounts discovers the used accounts of the wallet, deriving the addresses
+// on the base path and the paths following it (incrementing its last component)
+// until gapLimit consecutive ones are reported unused by the used predicate, which
+// the caller backs with chain state. If the base path is empty, the accounts are
+// enumerated according to the derivation scheme of the hub instead (BIP44Scheme
+// unless configured by WithDerivationScheme). The used accounts found are pinned
+// and returned. Addresses are derived locally from the extended public key of each
+// path's parent where possible, avoiding a device round trip per index.
+//
+// The device is locked for the whole scan, so the predicate should be reasonably
+// fast. If the scan fails, the accounts found so far are pinned and returned
+// along with the error. Scans running out of indices without leaving the hardened
+// or non-hardened range of the base path (or of the scheme's index) fail with
+// ErrInvalidDerivationPath.
+func (w *wallet) ScanAccounts(base accounts.DerivationPath, gapLimit int, used func(common.Address) bool) ([]accounts.Account, error) {
+	if gapLimit < 1 || gapLimit > maxGapLimit {
+		return nil, fmt.Errorf("invalid gap limit %d, must be 1-%d", gapLimit, maxGapLimit)
+	}
+	var (
+		scheme = w.hub.config.scheme
+		limit  = uint32(hdkeychain.HardenedKeyStart) // Number of indices to scan at most
+	)
+	if len(base) > 0 {
+		if last := base[len(base)-1]; last < hdkeychain.HardenedKeyStart {
+			limit = hdkeychain.HardenedKeyStart - last
+		} else {
+			limit = math.MaxUint32 - last + 1
+		}
+		base = append(accounts.DerivationPath{}, base...)
+		scheme = func(index uint32) accounts.DerivationPath {
+			path := append(accounts.DerivationPath{}, base...)
+			path[len(path)-1] += index
+			return path
+		}
+	} else if scheme == nil {
+		scheme = BIP44Scheme
+	}
+	w.stateLock.RLock() // Avoid device disappearing during derivation
+
+	if w.device == nil {
+		w.stateLock.RUnlock()
+		return nil, accounts.ErrWalletClosed
+	}
+	<-w.commsLock // Avoid concurrent hardware access (and cache updates)
+
+	var (
+		found   []accounts.Account
+		paths   []accounts.DerivationPath
+		parents = make(map[string]*hdkeychain.ExtendedKey)
+		err     error
+	)
+	for index, misses := uint32(0), 0; misses < gapLimit; index++ {
+		if index == limit {
+			err = fmt.Errorf("%w: scan ran out of indices after %d", ErrInvalidDerivationPath, limit)
+			break
+		}
+		path := scheme(index)
+
+		address, ok := w.derived[path.String()]
+		if !ok {
+			if address, err = w.deriveBatched(path, parents); err != nil {
+				break
+			}
+			w.derived[path.String()] = address
+		}
+		if !used(address) {
+			misses++
+			continue
+		}
+		misses = 0
+		found = append(found, accounts.Account{
+			Address: address,
+			URL:     accounts.URL{Scheme: w.url.Scheme, Path: fmt.Sprintf("%s/%s", w.url.Path, path)},
+		})
+		paths = append(paths, path)
+	}
+	w.commsLock <- struct{}{}
+	w.stateLock.RUnlock()
+
+	for i, account := range found {
+		if err := w.pin(account, paths[i]); err != nil {
+			return found[:i], err
+		}
+	}
+	return found, err
+}
+
+// deriveBatched derives the address on a derivation path, locally from the
+// extended public key of its parent if possible, tracking the parent keys fetched
+// from the device (nil if the device couldn't export one) across calls.
+//
+// The method assumes that the communication lock is held!
+func (w *wallet) deriveBatched(path accounts.DerivationPath, parents map[string]*hdkeychain.ExtendedKey) (common.Address, error) {
+	if n := len(path); n > 0 && path[n-1] < hdkeychain.HardenedKeyStart {
+		parent := path[:n-1].String()
+		xpub, ok := parents[parent]
+		if !ok {
+			if key, err := w.driver.ExtendedPublicKey(path[:n-1]); err == nil {
+				xpub = key
+			} else {
+				w.log.Debug("Falling back to device derivation", "parent", parent, "err", err)
+			}
+			parents[parent] = xpub
+		}
+		if xpub != nil {
+			return deriveAddress(xpub, path[n-1])
+		}
+	}
+	return w.driver.Derive(path)
+}
+
+// ExtendedPublicKey retrieves the extended public key at the specific derivation
+// path, allowing non-hardened child addresses to be derived locally without any
+// further device round-trips.
+func (w *wallet) ExtendedPublicKey(path accounts.DerivationPath) (*hdkeychain.ExtendedKey, error) {
+	w.stateLock.RLock() // Avoid device disappearing during derivation
+	defer w.stateLock.RUnlock()
+
+	if w.device == nil {
+		return nil, accounts.ErrWalletClosed
+	}
+	<-w.commsLock // Avoid concurrent hardware access
+	defer func() { w.commsLock <- struct{}{} }()
+
+	return w.driver.ExtendedPublicKey(path)
+}
+
+// PublicKey retrieves the public key at the specific derivation path, verifying
+// that it hashes to the address the device derives on the same path. The address
+// is cached, so a following Derive of the path doesn't hit the device.
+func (w *wallet) PublicKey(path accounts.DerivationPath) (*ecdsa.PublicKey, error) {
+	w.stateLock.RLock() // Avoid device disappearing during derivation
+	defer w.stateLock.RUnlock()
+
+	if w.device == nil {
+		return nil, accounts.ErrWalletClosed
+	}
+	<-w.commsLock // Avoid concurrent hardware access (and cache updates)
+	defer func() { w.commsLock <- struct{}{} }()
+
+	key, err := w.driver.PublicKey(path)
+	if err != nil {
+		return nil, err
+	}
+	w.derived[path.String()] = crypto.PubkeyToAddress(*key)
+	return key, nil
+}
+
+// Ping checks that the device is still responsive with a cheap request (refreshing
+// the cached firmware or app version as a side effect). The request is serialized
+// with any other device communication, so it waits for a pending signature to be
+// confirmed or denied instead of interfering with it. If the check fails, the
+// error is returned, but the wallet is only torn down by the health checker.
+func (w *wallet) Ping() error {
+	w.stateLock.RLock() // Avoid device disappearing during the check
+	defer w.stateLock.RUnlock()
+
+	if w.device == nil {
+		return accounts.ErrWalletClosed
+	}
+	<-w.commsLock // Avoid concurrent hardware access
+	defer func() { w.commsLock <- struct{}{} }()
+
+	err := w.driver.Heartbeat()
+	w.recordResult(err)
+	return err
+}
+
+// DeviceHealth checks that the device is still responsive like Ping, and reports
+// the outcome along with the device metrics available. Metrics a model doesn't
+// expose are reported as HealthUnknown instead of failing the check. If the device
+// is unresponsive, the snapshot (marked disconnected) is returned with the error.
+func (w *wallet) DeviceHealth() (DeviceHealth, error) {
+	health := DeviceHealth{Battery: HealthUnknown, RSSI: HealthUnknown}
+
+	start := time.Now()
+	if err := w.Ping(); err != nil {
+		return health, err
+	}
+	health.Connected, health.Latency = true, time.Since(start)
+	return health, nil
+}
+
+// LedgerAppConfig retrieves the version and configuration flags (LedgerFlagXYZ)
+// of the Ethereum app running on a Ledger, allowing callers to check whether
+// blind signing is enabled before requesting a signature relying on it.
+func (w *wallet) LedgerAppConfig() (version [3]byte, flags byte, err error) {
+	w.stateLock.RLock() // Avoid device disappearing during the query
+	defer w.stateLock.RUnlock()
+
+	if w.device == nil {
+		return [3]byte{}, 0, accounts.ErrWalletClosed
+	}
+	<-w.commsLock // Avoid concurrent hardware access
+	defer func() { w.commsLock <- struct{}{} }()
+
+	return w.driver.LedgerAppConfig()
+}
+
+// SetPlugin sends a signed plugin descriptor (see LedgerPluginInfo) to a Ledger,
+// selecting the Ethereum app plugin decoding the contract call of the next
+// transaction signed. External plugins (e.g. swap) are selected by a descriptor
+// of their own, sent with external set. Descriptors configured with
+// WithLedgerPlugins are sent by SignTx automatically. Other devices return
+// accounts.ErrNotSupported.
+func (w *wallet) SetPlugin(descriptor []byte, external bool) error {
+	driver, ok := w.driver.(pluginDriver)
+	if !ok {
+		return fmt.Errorf("plugin descriptors: %w", accounts.ErrNotSupported)
+	}
+	done, err := w.lockDevice()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return driver.SetPlugin(descriptor, external)
+}
+
+// SetDisplayMode requests the device to display the data of subsequent requests
+// concisely or in detail. The mode is applied by the host to every request it
+// sends (the devices have no persistent setting to switch), and is kept until
+// changed. Devices or firmwares without such a display option return
+// ErrUnsupported, currently all but Trezor T family devices since v2.6.4.
+func (w *wallet) SetDisplayMode(mode DisplayMode) error {
+	w.stateLock.RLock() // Avoid device disappearing during the request
+	defer w.stateLock.RUnlock()
+
+	if w.device == nil {
+		return accounts.ErrWalletClosed
+	}
+	driver, ok := w.driver.(displayDriver)
+	if !ok {
+		return fmt.Errorf("display mode: %w", ErrUnsupported)
+	}
+	<-w.commsLock // Avoid concurrent hardware access
+	defer func() { w.commsLock <- struct{}{} }()
+
+	return driver.SetDisplayMode(mode)
+}
+
+// ConfirmAddress displays the address at the specific derivation path on the
+// device screen, blocking until the user confirms it. If the user rejects the
+// address, ErrUserRejected is returned.
+func (w *wallet) ConfirmAddress(path accounts.DerivationPath) (common.Address, error) {
+	done, err := w.lockDevice()
+	if err != nil {
+		return common.Address{}, err
+	}
+	defer done()
+
+	address, err := w.driver.ConfirmAddress(path)
+	if err != nil {
+		return common.Address{}, err
+	}
+	w.derived[path.String()] = address
+	return address, nil
+}
+
+// DeriveAndShow is identical to Derive, but displays the address on the device
+// screen and blocks until the user confirms it. The address cache is bypassed, so
+// the device is always queried, but updated with the confirmed address. If the
+// user rejects the address, ErrUserRejected is returned and nothing is pinned.
+func (w *wallet) DeriveAndShow(path accounts.DerivationPath, pin bool) (accounts.Account, error) {
+	address, err := w.ConfirmAddress(path)
+	if err != nil {
+		return accounts.Account{}, err
+	}
+	account := accounts.Account{
+		Address: address,
+		URL:     accounts.URL{Scheme: w.url.Scheme, Path: fmt.Sprintf("%s/%s", w.url.Path, path)},
+	}
+	if !pin {
+		return account, nil
+	}
+	if err := w.pin(account, path); err != nil {
+		return accounts.Account{}, err
 	}
 	return account, nil
 }
 
+// Cancel aborts the request the device is waiting for the user to confirm (e.g.
+// when the user navigates away from the signing screen), failing the pending call.
+// Unlike every other method, it doesn't wait for exclusive access to the device.
+//
+// Trezor devices dismiss the prompt and the pending call fails with a
+// TrezorFailure matching ErrUserRejected. The Ledger app can't be told to abort,
+// so the pending call fails with context.Canceled, but the prompt stays on the
+// device until the user dismisses it physically, any further request waiting
+// until then.
+func (w *wallet) Cancel() error {
+	w.stateLock.RLock() // Avoid device disappearing during the cancellation
+	defer w.stateLock.RUnlock()
+
+	if w.device == nil {
+		return accounts.ErrWalletClosed
+	}
+	return w.driver.Cancel()
+}
+
 // SelfDerive sets a base account derivation path from which the wallet attempts
 // to discover non zero accounts and automatically add them to list of tracked
 // accounts.
@@ -547,14 +1419,20 @@ func (w *wallet) signHash(account accounts.Account, hash []byte) ([]byte, error)
 }
 
 // SignData signs keccak256(data). The mimetype parameter describes the type of data being signed
-func (w *wallet) SignData(account accounts.Account, mimeType string, data []byte) ([]byte, error) {
+func (w *wallet) SignData(account accounts.Account, mimeType string, data []byte) (signature []byte, err error) {
 	// Unless we are doing 712 signing, simply dispatch to signHash
 	if !(mimeType == accounts.MimetypeTypedData && len(data) == 66 && data[0] == 0x19 && data[1] == 0x01) {
 		return w.signHash(account, crypto.Keccak256(data))
 	}
 
 	// dispatch to 712 signing if the mimetype is TypedData and the format matches
+	defer w.measureSign(SignOpTypedData)(&err)
 
+	// The domain is only known by its hash, so the chain it's bound to cannot be
+	// checked: refuse pre-hashed typed data altogether if a chain is expected
+	if expect := w.hub.config.chainID; expect != nil {
+		return nil, fmt.Errorf("%w: chain ID of hashed typed data unverifiable, expected %v", ErrChainIDMismatch, expect)
+	}
 	path, done, err := w.lockAndDerivePath(account)
 	if err != nil {
 		return nil, err
@@ -562,7 +1440,20 @@ func (w *wallet) SignData(account accounts.Account, mimeType string, data []byte
 	defer done()
 
 	// Sign the transaction
-	return w.driver.SignTypedHash(path, data[2:34], data[34:66])
+	signature, err = w.driver.SignTypedHash(path, data[2:34], data[34:66])
+	if err != nil {
+		return nil, err
+	}
+	if w.hub.config.verifySigner {
+		signer, err := recoverSigner(crypto.Keccak256(data), signature)
+		if err != nil {
+			return nil, err
+		}
+		if err := w.verifySigner(path, signer); err != nil {
+			return nil, err
+		}
+	}
+	return signature, nil
 }
 
 // SignDataWithPassphrase implements accounts.Wallet, attempting to sign the given
@@ -572,15 +1463,118 @@ func (w *wallet) SignDataWithPassphrase(account accounts.Account, passphrase, mi
 	return w.SignData(account, mimeType, data)
 }
 
-// SignTypedData signs the EIP-712 typed data struct.
-func (w *wallet) SignTypedData(account accounts.Account, data apitypes.TypedData) ([]byte, error) {
+// SignTypedData signs the EIP-712 typed data struct. Values of bytes and bytesN
+// fields may be given as 0x prefixed hex strings, standard (padded) base64 strings,
+// raw []byte values or byte arrays (e.g. common.Hash); strings lacking the 0x
+// prefix are decoded as base64. Values of bytesN fields must be exactly N bytes.
+func (w *wallet) SignTypedData(account accounts.Account, data apitypes.TypedData) (signature []byte, err error) {
+	defer w.measureSign(SignOpTypedData)(&err)
+
+	if err := w.checkTypedDataChainID(data); err != nil {
+		return nil, err
+	}
+	path, done, err := w.lockAndDerivePath(account)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	signature, err = w.driver.SignedTypedData(path, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.verifyTypedDataSigner(path, data, newTypedDataValues(data), signature); err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
+
+// SignTypedDataJSON signs an EIP-712 typed data payload given as raw JSON (e.g. the
+// parameter of an eth_signTypedData_v4 request). The payload is checked before
+// anything is sent to the device. Malformed payloads fail with an error wrapping
+// ErrInvalidTypedData that names the offending JSON field. Domain fields declared
+// but missing are hashed as zero values, as by SignTypedData.
+func (w *wallet) SignTypedDataJSON(account accounts.Account, raw []byte) ([]byte, error) {
+	data, err := parseTypedDataJSON(raw)
+	if err != nil {
+		return nil, err
+	}
+	return w.SignTypedData(account, data)
+}
+
+// SignTypedDataStream signs an EIP-712 message whose values are provided lazily by
+// message, for messages too large to be decoded into memory. The types, primary
+// type and domain are taken from data, its message is ignored. Values are pulled
+// by member path as the device consumes them, after hashing the message once on
+// the host.
+func (w *wallet) SignTypedDataStream(account accounts.Account, data apitypes.TypedData, message TypedDataValues) (signature []byte, err error) {
+	defer w.measureSign(SignOpTypedData)(&err)
+
+	if err := w.checkTypedDataChainID(data); err != nil {
+		return nil, err
+	}
 	path, done, err := w.lockAndDerivePath(account)
 	if err != nil {
 		return nil, err
 	}
 	defer done()
 
-	return w.driver.SignedTypedData(path, data)
+	signature, err = w.driver.SignedTypedDataStream(path, data, message)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.verifyTypedDataSigner(path, data, message, signature); err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
+
+// SignTypedDataFiltered signs the EIP-712 typed data struct, sending the Ledger
+// clear signing filters along with it. Devices not supporting filters (Trezor or
+// old Ledger apps) sign the message as SignTypedData does.
+func (w *wallet) SignTypedDataFiltered(account accounts.Account, data apitypes.TypedData, filters *LedgerEIP712Filters) (signature []byte, err error) {
+	defer w.measureSign(SignOpTypedData)(&err)
+
+	if err := w.checkTypedDataChainID(data); err != nil {
+		return nil, err
+	}
+	path, done, err := w.lockAndDerivePath(account)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if driver, ok := w.driver.(filterDriver); ok {
+		signature, err = driver.SignedTypedDataFiltered(path, data, filters)
+	} else {
+		signature, err = w.driver.SignedTypedData(path, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := w.verifyTypedDataSigner(path, data, newTypedDataValues(data), signature); err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
+
+// checkTypedDataChainID ensures the domain of the typed data is bound to the chain
+// configured via the ExpectChainID option, guarding against a dapp requesting a
+// signature replayable on another chain than the one it advertises. Domains not
+// specifying a chain ID are rejected too, as they are replayable on any chain (or
+// hashed with a zero chain ID if declared, see typedDomainMap).
+func (w *wallet) checkTypedDataChainID(data apitypes.TypedData) error {
+	expect := w.hub.config.chainID
+	if expect == nil {
+		return nil
+	}
+	if data.Domain.ChainId == nil {
+		return fmt.Errorf("%w: domain without chain ID, expected %v", ErrChainIDMismatch, expect)
+	}
+	if have := (*big.Int)(data.Domain.ChainId); have.Cmp(expect) != 0 {
+		return fmt.Errorf("%w: domain chain ID %v, expected %v", ErrChainIDMismatch, have, expect)
+	}
+	return nil
 }
 
 // SignTypedDataWithPassphrase implements accounts.Wallet, attempting to sign the given
@@ -591,6 +1585,81 @@ func (w *wallet) SignTypedDataWithPassphrase(account accounts.Account, passphras
 }
 
 func (w *wallet) SignText(account accounts.Account, text []byte) ([]byte, error) {
+	return w.SignTextContext(context.Background(), account, text)
+}
+
+// SignTextHash is identical to SignText, but also returns the EIP-191 digest that
+// was signed (accounts.TextHash of the text), e.g. for audit logs. Neither Ledger
+// nor Trezor devices return the digest: both prefix and hash the text themselves,
+// so it is computed on the host and checked against the signature instead. If the
+// signer recovered from the signature over the digest isn't the account, the
+// device signed something else and an error is returned.
+func (w *wallet) SignTextHash(account accounts.Account, text []byte) ([]byte, []byte, error) {
+	signature, err := w.SignText(account, text)
+	if err != nil {
+		return nil, nil, err
+	}
+	hash := accounts.TextHash(text)
+	signer, err := recoverSigner(hash, signature)
+	if err != nil {
+		return nil, nil, err
+	}
+	if signer != account.Address {
+		return nil, nil, fmt.Errorf("signed digest mismatch: signer %s, want %s", signer.Hex(), account.Address.Hex())
+	}
+	return signature, hash, nil
+}
+
+// SignSIWE signs an EIP-4361 Sign-In with Ethereum message with the given account,
+// serializing it into its canonical form and signing that as a personal message.
+// The message must be valid and issued for the signing account.
+func (w *wallet) SignSIWE(account accounts.Account, message SIWEMessage) ([]byte, error) {
+	if err := message.Validate(); err != nil {
+		return nil, err
+	}
+	if message.Address != account.Address {
+		return nil, fmt.Errorf("siwe: message address %s doesn't match account %s", message.Address.Hex(), account.Address.Hex())
+	}
+	return w.SignText(account, []byte(message.String()))
+}
+
+// SignOwnershipProof proves control of the account at the derivation path without
+// exposing its key, signing the challenge of a verifier along with the derived
+// address as a personal message (see OwnershipProofMessage). The account needn't
+// be derived beforehand. Proofs are checked with VerifyOwnershipProof.
+func (w *wallet) SignOwnershipProof(path accounts.DerivationPath, challenge []byte) (signature []byte, err error) {
+	defer w.measureSign(SignOpOwnership)(&err)
+
+	if len(challenge) == 0 {
+		return nil, errors.New("empty ownership challenge")
+	}
+	done, err := w.lockDevice()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	address, err := w.driver.Derive(path)
+	if err != nil {
+		return nil, err
+	}
+	signature, err = w.driver.SignText(path, OwnershipProofMessage(address, challenge))
+	if err != nil {
+		return nil, err
+	}
+	// Never hand out a proof not verifying against the address it claims
+	if err := VerifyOwnershipProof(address, challenge, signature); err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
+
+// SignTextContext is identical to SignText, but stops waiting for the user to
+// confirm the signature if the context is cancelled. Drivers unable to abort an
+// in-flight request ignore the context.
+func (w *wallet) SignTextContext(ctx context.Context, account accounts.Account, text []byte) (signature []byte, err error) {
+	defer w.measureSign(SignOpText)(&err)
+
 	path, done, err := w.lockAndDerivePath(account)
 	if err != nil {
 		return nil, err
@@ -598,13 +1667,40 @@ func (w *wallet) SignText(account accounts.Account, text []byte) ([]byte, error)
 	defer done()
 
 	// Sign the transaction
-	signature, err := w.driver.SignText(path, text)
+	if driver, ok := w.driver.(contextDriver); ok {
+		signature, err = driver.SignTextContext(ctx, path, text)
+	} else {
+		signature, err = w.driver.SignText(path, text)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if w.hub.config.verifySigner {
+		signer, err := recoverSigner(accounts.TextHash(text), signature)
+		if err != nil {
+			return nil, err
+		}
+		if err := w.verifySigner(path, signer); err != nil {
+			return nil, err
+		}
+	}
 	return signature, nil
 }
 
+// SignAuthorization signs a standalone EIP-7702 authorization, returning the 65
+// byte signature with V being the bare y-parity of the signature.
+func (w *wallet) SignAuthorization(account accounts.Account, auth types.SetCodeAuthorization) (signature []byte, err error) {
+	defer w.measureSign(SignOpAuthorization)(&err)
+
+	path, done, err := w.lockAndDerivePath(account)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	return w.driver.SignAuthorization(path, auth)
+}
+
 // SignTx implements accounts.Wallet. It sends the transaction over to the Ledger
 // wallet to request a confirmation from the user. It returns either the signed
 // transaction or a failure if the user denied the transaction.
@@ -613,23 +1709,128 @@ func (w *wallet) SignText(account accounts.Account, text []byte) ([]byte, error)
 // too old to sign EIP-155 transactions, but such is requested nonetheless, an error
 // will be returned opposed to silently signing in Homestead mode.
 func (w *wallet) SignTx(account accounts.Account, tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	return w.SignTxContext(context.Background(), account, tx, chainID)
+}
+
+// SignTxContext is identical to SignTx, but stops waiting for the user to confirm
+// the transaction if the context is cancelled. Drivers unable to abort an in-flight
+// request ignore the context.
+func (w *wallet) SignTxContext(ctx context.Context, account accounts.Account, tx *types.Transaction, chainID *big.Int) (_ *types.Transaction, err error) {
+	defer w.measureSign(SignOpTx)(&err)
+
 	path, done, err := w.lockAndDerivePath(account)
 	if err != nil {
 		return nil, err
 	}
 	defer done()
 
+	// Legacy transactions without a chain ID (or if requested) are signed without
+	// replay protection
+	if tx.Type() == types.LegacyTxType && (w.hub.config.noEIP155 || (chainID != nil && chainID.Sign() == 0)) {
+		chainID = nil
+	}
 	// Sign the transaction and verify the sender to avoid hardware fault surprises
-	sender, signed, err := w.driver.SignTx(path, tx, chainID)
+	var (
+		sender common.Address
+		signed *types.Transaction
+	)
+	if driver, ok := w.driver.(contextDriver); ok {
+		sender, signed, err = driver.SignTxContext(ctx, path, tx, chainID)
+	} else {
+		sender, signed, err = w.driver.SignTx(path, tx, chainID)
+	}
 	if err != nil {
 		return nil, err
 	}
 	if sender != account.Address {
-		return nil, fmt.Errorf("signer mismatch: expected %s, got %s", account.Address.Hex(), sender.Hex())
+		return nil, fmt.Errorf("%w: expected %s, got %s", ErrSignerMismatch, account.Address.Hex(), sender.Hex())
+	}
+	if w.hub.config.verifySigner {
+		if err := w.verifySigner(path, sender); err != nil {
+			return nil, err
+		}
 	}
 	return signed, nil
 }
 
+// verifySigner derives the address of the path on the device again and ensures it
+// is the signer recovered from a signature, catching devices signing with another
+// key than the one they report for the path. It must be called with the comms
+// lock held.
+func (w *wallet) verifySigner(path accounts.DerivationPath, signer common.Address) error {
+	derived, err := w.driver.Derive(path)
+	if err != nil {
+		return fmt.Errorf("failed to verify signer: %w", err)
+	}
+	if signer != derived {
+		return fmt.Errorf("%w: derived %s, signed by %s", ErrSignerMismatch, derived.Hex(), signer.Hex())
+	}
+	return nil
+}
+
+// verifyTypedDataSigner recovers the signer of an EIP-712 signature over the typed
+// data with its message values provided by message, verifying it against the path
+// if the VerifySigner option is set.
+func (w *wallet) verifyTypedDataSigner(path accounts.DerivationPath, data apitypes.TypedData, message TypedDataValues, signature []byte) error {
+	if !w.hub.config.verifySigner {
+		return nil
+	}
+	hash, err := typedDataDigest(data, message)
+	if err != nil {
+		return err
+	}
+	signer, err := recoverSigner(hash, signature)
+	if err != nil {
+		return err
+	}
+	return w.verifySigner(path, signer)
+}
+
+// recoverSigner returns the address of the signer of a 65 byte [R || S || V]
+// signature over the hash, with V being either the recovery id or 27 offset.
+func recoverSigner(hash, signature []byte) (common.Address, error) {
+	if len(signature) != crypto.SignatureLength {
+		return common.Address{}, fmt.Errorf("invalid signature length: %d", len(signature))
+	}
+	sig := bytes.Clone(signature)
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+	pubkey, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("failed to recover signer: %w", err)
+	}
+	return crypto.PubkeyToAddress(*pubkey), nil
+}
+
+// SignTxRaw is identical to SignTx, but returns the raw signature values with the
+// recovery id (0 or 1) instead of the V value encoded for the transaction type,
+// letting the caller assemble the signature with whatever V convention it needs.
+func (w *wallet) SignTxRaw(account accounts.Account, tx *types.Transaction, chainID *big.Int) (r, s [32]byte, recid byte, err error) {
+	signed, err := w.SignTx(account, tx, chainID)
+	if err != nil {
+		return r, s, 0, err
+	}
+	v, R, S := signed.RawSignatureValues()
+
+	// Strip the 27 offset of legacy and the EIP-155 chain id of replay protected
+	// transactions, typed transactions carry the recovery id as is
+	id := new(big.Int).Set(v)
+	if signed.Type() == types.LegacyTxType {
+		if signed.Protected() {
+			id.Sub(id, new(big.Int).Add(new(big.Int).Lsh(signed.ChainId(), 1), big.NewInt(35)))
+		} else {
+			id.Sub(id, big.NewInt(27))
+		}
+	}
+	if !id.IsUint64() || id.Uint64() > 1 {
+		return r, s, 0, fmt.Errorf("invalid signature V value %v", v)
+	}
+	R.FillBytes(r[:])
+	S.FillBytes(s[:])
+	return r, s, byte(id.Uint64()), nil
+}
+
 // SignTextWithPassphrase implements accounts.Wallet, however signing arbitrary
 // data is not supported for Ledger wallets, so this method will always return
 // an error.
@@ -644,22 +1845,50 @@ func (w *wallet) SignTxWithPassphrase(account accounts.Account, passphrase strin
 	return w.SignTx(account, tx, chainID)
 }
 
-func (w *wallet) lockAndDerivePath(account accounts.Account) (accounts.DerivationPath, func(), error) {
-	w.stateLock.RLock() // Comms have own mutex, this is for the state fields
+// measureSign reports the start of a signing operation to the metrics hooks of the
+// hub, returning a function to report its end with the final error of the call,
+// which is also recorded for DetailedStatus.
+func (w *wallet) measureSign(op SignOp) func(err *error) {
+	metrics := w.hub.config.metrics
+	if metrics == nil {
+		return func(err *error) { w.recordResult(*err) }
+	}
+	metrics.OnSignStart(op)
 
-	// If the wallet is closed, abort
-	if w.device == nil {
-		w.stateLock.RUnlock()
-		return nil, nil, accounts.ErrWalletClosed
+	start := time.Now()
+	return func(err *error) {
+		w.recordResult(*err)
+		metrics.OnSignEnd(op, time.Since(start), *err)
+	}
+}
+
+func (w *wallet) lockAndDerivePath(account accounts.Account) (accounts.DerivationPath, func(), error) {
+	done, err := w.lockDevice()
+	if err != nil {
+		return nil, nil, err
 	}
 	// Make sure the requested account is contained within
 	path, ok := w.paths[account.Address]
 	if !ok {
-		w.stateLock.RUnlock()
+		done()
 		return nil, nil, accounts.ErrUnknownAccount
 	}
-	// All infos gathered and metadata checks out, request signing
-	<-w.commsLock
+	return path, done, nil
+}
+
+// lockDevice acquires the wallet for a request that may wait for the user on the
+// device, returning the function releasing it. The state lock keeps the device
+// from disappearing, the comms lock serializes hardware access and the hub holds
+// off enumeration until the request is done.
+func (w *wallet) lockDevice() (func(), error) {
+	w.stateLock.RLock() // Comms have own mutex, this is for the state fields
+
+	// If the wallet is closed, abort
+	if w.device == nil {
+		w.stateLock.RUnlock()
+		return nil, accounts.ErrWalletClosed
+	}
+	<-w.commsLock // Avoid concurrent hardware access
 
 	// Ensure the device isn't screwed with while user confirmation is pending
 	// TODO(karalabe): remove if hotplug lands on Windows
@@ -675,6 +1904,5 @@ func (w *wallet) lockAndDerivePath(account accounts.Account) (accounts.Derivatio
 		w.hub.commsPend--
 		w.hub.commsLock.Unlock()
 	}
-
-	return path, done, nil
+	return done, nil
 }